@@ -0,0 +1,356 @@
+package abcmiddleware
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/friendsofgo/errors"
+	"github.com/volatiletech/abcweb/v5/abcrender"
+	"github.com/volatiletech/abcweb/v5/abcsessions"
+)
+
+// csrfSecretLen is the length of the random CSRF secret in bytes
+const csrfSecretLen = 32
+
+// ErrCSRF is returned through the ErrorManager when an unsafe request has a
+// missing or invalid CSRF token. The CSRF middleware adds a 403 error for it
+// to the ErrorManager unless one has been added already.
+var ErrCSRF = errors.New("csrf token is missing or invalid")
+
+// CSRFOptions configures the CSRF middleware
+type CSRFOptions struct {
+	// FieldName is the form field the token is read from,
+	// defaults to "csrf_token"
+	FieldName string
+	// HeaderName is the header the token is read from when it is set,
+	// for requests made with javascript. Defaults to "X-CSRF-Token".
+	HeaderName string
+	// SessionKey is the session key the secret is stored under with the
+	// abcsessions key-value helpers, defaults to "csrf_secret"
+	SessionKey string
+
+	// DoubleSubmit stores the secret in its own cookie instead of the
+	// session, so apps using the CookieOverseer do not rewrite the session
+	// cookie of every visitor. The token in the form field or header must
+	// match the cookie.
+	DoubleSubmit bool
+	// Cookie is the cookie the secret is stored in when DoubleSubmit is
+	// set. Its Name defaults to "csrf" and MaxAge is ignored, the cookie
+	// lasts until the browser is closed.
+	Cookie abcsessions.CookieOptions
+	// Key signs the double submit cookie together with the session id, so
+	// a cookie planted by another site or subdomain is not accepted, and
+	// the cookie stops working when the session id changes. It must be set
+	// when DoubleSubmit is, use 32 random bytes that are the same for every
+	// instance of the app.
+	Key []byte
+}
+
+// NewCSRFOptions gives healthy defaults for the CSRF middleware
+func NewCSRFOptions() CSRFOptions {
+	cookie := abcsessions.NewCookieOptions()
+	cookie.Name = "csrf"
+
+	return CSRFOptions{
+		FieldName:  abcrender.DefaultCSRFFieldName,
+		HeaderName: "X-CSRF-Token",
+		SessionKey: "csrf_secret",
+		Cookie:     cookie,
+	}
+}
+
+// Validate returns an error if the options are missing a field
+func (c CSRFOptions) Validate() error {
+	if len(c.FieldName) == 0 {
+		return errors.New("csrf field name must be provided")
+	}
+	if len(c.HeaderName) == 0 {
+		return errors.New("csrf header name must be provided")
+	}
+	if c.DoubleSubmit {
+		if len(c.Key) == 0 {
+			return errors.New("csrf key must be provided for double submit")
+		}
+		return errors.Wrap(c.Cookie.Validate(), "invalid csrf cookie options")
+	}
+	if len(c.SessionKey) == 0 {
+		return errors.New("csrf session key must be provided")
+	}
+
+	return nil
+}
+
+// CSRF returns a middleware that protects against cross-site request
+// forgery. Each client gets a random per-session secret, stored in the
+// session with the overseer (or in its own cookie in double submit mode),
+// and a token derived from it is put in the request context. Requests with
+// unsafe methods (anything but GET, HEAD, OPTIONS and TRACE) must send the
+// token back in the form field or header, or ErrCSRF is passed to the
+// error manager.
+//
+// The secret is only created when the token of a request is first asked
+// for, so visitors of pages without forms do not get a session.
+//
+// The token is masked with a new random value on every request, so it does
+// not leak the secret through compression (BREACH). Use CSRFToken or the
+// csrfField and csrfToken abcrender helpers to add it to your pages.
+//
+// The middleware must come after the abcsessions middleware, and after the
+// request id logger the error manager logs with. In double submit mode the
+// overseer is only used to read the session id the cookie is bound to.
+func CSRF(opts CSRFOptions, overseer abcsessions.Overseer, errMgr *ErrorManager) MW {
+	if err := opts.Validate(); err != nil {
+		panic(err)
+	}
+	if overseer == nil {
+		panic("csrf overseer must be provided")
+	}
+
+	if _, found := errMgr.find(ErrCSRF); !found {
+		errMgr.Add(NewError(ErrCSRF, http.StatusForbidden, errMgr.errLayout, "errors/403", nil))
+	}
+
+	return csrfMiddleware{
+		opts:     opts,
+		overseer: overseer,
+		errMgr:   errMgr,
+	}
+}
+
+// CSRFToken returns the CSRF token of the request, or an empty string if
+// the CSRF middleware did not run. The secret of the client is created the
+// first time it is called, which fails if the session can not be written.
+func CSRFToken(r *http.Request) (string, error) {
+	token, _, err := abcrender.CSRFToken(r.Context())
+	return token, err
+}
+
+type csrfMiddleware struct {
+	opts     CSRFOptions
+	overseer abcsessions.Overseer
+	errMgr   *ErrorManager
+}
+
+func (c csrfMiddleware) Wrap(next http.Handler) http.Handler {
+	return csrfHandler{
+		csrfMiddleware: c,
+		next:           next,
+	}
+}
+
+type csrfHandler struct {
+	csrfMiddleware
+	next http.Handler
+}
+
+func (c csrfHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	secret, err := c.secret(w, r)
+	if err == nil && !csrfSafeMethod(r.Method) {
+		err = c.verify(r, secret)
+	}
+	if err != nil {
+		c.errMgr.Errors(func(w http.ResponseWriter, r *http.Request) error {
+			return err
+		})(w, r)
+		return
+	}
+
+	token := &csrfToken{csrfHandler: c, w: w, r: r, secret: secret}
+	ctx := abcrender.WithCSRFToken(r.Context(), token.get, c.opts.FieldName)
+	c.next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// csrfToken makes the token of a request the first time it is asked for,
+// creating the secret of the client if it does not have one yet
+type csrfToken struct {
+	csrfHandler
+	w      http.ResponseWriter
+	r      *http.Request
+	secret []byte
+
+	once  sync.Once
+	token string
+	err   error
+}
+
+func (t *csrfToken) get() (string, error) {
+	t.once.Do(func() {
+		if t.secret == nil {
+			t.secret, t.err = t.newSecret(t.w, t.r)
+			if t.err != nil {
+				return
+			}
+		}
+
+		t.token, t.err = maskCSRFSecret(t.secret)
+	})
+
+	return t.token, t.err
+}
+
+// secret returns the CSRF secret of the client, or nil if it does not have
+// a valid one
+func (c csrfHandler) secret(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	var encoded string
+	if c.opts.DoubleSubmit {
+		cookie, err := r.Cookie(c.opts.Cookie.Name)
+		if err != nil {
+			return nil, nil
+		}
+
+		sessID, err := c.sessionID(w, r)
+		if err != nil {
+			return nil, err
+		}
+
+		var ok bool
+		if encoded, ok = c.openCookie(cookie.Value, sessID); !ok {
+			return nil, nil
+		}
+	} else {
+		var err error
+		encoded, err = abcsessions.Get(c.overseer, w, r, c.opts.SessionKey)
+		if err != nil && !abcsessions.IsNoSessionError(err) && !abcsessions.IsNoMapKeyError(err) {
+			return nil, errors.Wrap(err, "unable to get csrf secret from session")
+		}
+	}
+
+	if secret, err := base64.RawURLEncoding.DecodeString(encoded); err == nil && len(secret) == csrfSecretLen {
+		return secret, nil
+	}
+
+	return nil, nil
+}
+
+// newSecret creates a CSRF secret for the client and stores it
+func (c csrfHandler) newSecret(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	secret := make([]byte, csrfSecretLen)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, errors.Wrap(err, "unable to create csrf secret")
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+
+	if c.opts.DoubleSubmit {
+		sessID, err := c.sessionID(w, r)
+		if err != nil {
+			return nil, err
+		}
+
+		cookie := c.opts.Cookie
+		cookie.MaxAge = 0
+		abcsessions.WriteCookie(w, cookie, encoded+"."+c.sign(encoded, sessID))
+		return secret, nil
+	}
+
+	if err := abcsessions.Set(c.overseer, w, r, c.opts.SessionKey, encoded); err != nil {
+		return nil, errors.Wrap(err, "unable to set csrf secret in session")
+	}
+
+	return secret, nil
+}
+
+// sessionID returns the session id the double submit cookie is bound to,
+// which is empty for clients without a session
+func (c csrfHandler) sessionID(w http.ResponseWriter, r *http.Request) (string, error) {
+	sessID, err := c.overseer.SessionID(w, r)
+	if err != nil && !abcsessions.IsNoSessionError(err) {
+		return "", errors.Wrap(err, "unable to get session id for csrf cookie")
+	}
+
+	return sessID, nil
+}
+
+// sign returns the signature of the encoded secret for the session id
+func (c csrfHandler) sign(encoded, sessID string) string {
+	mac := hmac.New(sha256.New, c.opts.Key)
+	_, _ = mac.Write([]byte(sessID))
+	_, _ = mac.Write([]byte{0})
+	_, _ = mac.Write([]byte(encoded))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// openCookie returns the encoded secret of a double submit cookie if it is
+// signed for the session id
+func (c csrfHandler) openCookie(value, sessID string) (string, bool) {
+	i := strings.IndexByte(value, '.')
+	if i < 0 {
+		return "", false
+	}
+
+	encoded, sig := value[:i], value[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(c.sign(encoded, sessID))) {
+		return "", false
+	}
+
+	return encoded, true
+}
+
+// verify returns ErrCSRF unless the request sent a token for the secret
+// in the header or form field
+func (c csrfHandler) verify(r *http.Request, secret []byte) error {
+	if secret == nil {
+		return errors.Wrap(ErrCSRF, "no csrf secret for client")
+	}
+
+	token := r.Header.Get(c.opts.HeaderName)
+	if len(token) == 0 {
+		token = r.PostFormValue(c.opts.FieldName)
+	}
+	if len(token) == 0 {
+		return errors.Wrap(ErrCSRF, "no csrf token in request")
+	}
+
+	sent, ok := unmaskCSRFToken(token)
+	if !ok || subtle.ConstantTimeCompare(sent, secret) != 1 {
+		return errors.Wrap(ErrCSRF, "csrf token does not match")
+	}
+
+	return nil
+}
+
+// csrfSafeMethod returns true for the methods that must not change state,
+// as defined in RFC 7231 section 4.2.1
+func csrfSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+
+	return false
+}
+
+// maskCSRFSecret returns a token of a random one-time pad followed by the
+// secret xored with the pad
+func maskCSRFSecret(secret []byte) (string, error) {
+	token := make([]byte, 2*len(secret))
+	if _, err := rand.Read(token[:len(secret)]); err != nil {
+		return "", errors.Wrap(err, "unable to create csrf token")
+	}
+	for i, b := range secret {
+		token[len(secret)+i] = b ^ token[i]
+	}
+
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// unmaskCSRFToken returns the secret of a token made with maskCSRFSecret
+func unmaskCSRFToken(token string) ([]byte, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(raw) != 2*csrfSecretLen {
+		return nil, false
+	}
+
+	secret := make([]byte, csrfSecretLen)
+	for i := range secret {
+		secret[i] = raw[csrfSecretLen+i] ^ raw[i]
+	}
+
+	return secret, true
+}
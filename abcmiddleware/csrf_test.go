@@ -0,0 +1,257 @@
+package abcmiddleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/volatiletech/abcweb/v5/abcrender"
+	"github.com/volatiletech/abcweb/v5/abcsessions"
+	"go.uber.org/zap"
+)
+
+// csrfTestServer returns a handler protected by the CSRF middleware that
+// responds with the CSRF token of the request, unless the path is /plain,
+// and records the code of the errors passed to the error manager.
+func csrfTestServer(t *testing.T, opts CSRFOptions, overseer abcsessions.Overseer, code *int) http.Handler {
+	t.Helper()
+
+	m := NewErrorManager(&mockRender{}, "")
+	m.Add(NewError(ErrCSRF, http.StatusForbidden, "", "errors/403", func(w http.ResponseWriter, r *http.Request, e ErrorContainer, render abcrender.Renderer) error {
+		*code = e.Code
+		w.WriteHeader(e.Code)
+		return nil
+	}))
+
+	handler := CSRF(opts, overseer, m).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/plain" {
+			return
+		}
+
+		token, err := CSRFToken(r)
+		if err != nil {
+			t.Error(err)
+		}
+		_, _ = w.Write([]byte(token))
+	}))
+
+	return abcsessions.Middleware(handler)
+}
+
+func csrfRequest(method, target string, form url.Values, cookies []*http.Cookie) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), CTXKeyLogger, zap.NewNop()))
+}
+
+func TestCSRF(t *testing.T) {
+	t.Parallel()
+
+	for _, doubleSubmit := range []bool{false, true} {
+		mem, err := abcsessions.NewDefaultMemoryStorer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		overseer := abcsessions.NewStorageOverseer(abcsessions.NewCookieOptions(), mem)
+
+		opts := NewCSRFOptions()
+		opts.DoubleSubmit = doubleSubmit
+		opts.Key = []byte(strings.Repeat("k", 32))
+
+		var code int
+		h := csrfTestServer(t, opts, overseer, &code)
+
+		// Pages that do not use the token do not get a secret
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, csrfRequest("GET", "/plain", nil, nil))
+		if w.Code != http.StatusOK || len(w.Result().Cookies()) != 0 {
+			t.Errorf("double submit %t: expected no cookies, got %v", doubleSubmit, w.Result().Cookies())
+		}
+
+		// Unsafe requests without a secret are rejected
+		code = 0
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, csrfRequest("POST", "/plain", url.Values{"csrf_token": {"nope"}}, nil))
+		if code != http.StatusForbidden || len(w.Result().Cookies()) != 0 {
+			t.Errorf("double submit %t: expected a 403 without cookies, got %d and %v", doubleSubmit, code, w.Result().Cookies())
+		}
+
+		// A safe request that uses the token gets a token and a secret
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, csrfRequest("GET", "/", nil, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("double submit %t: expected 200, got %d", doubleSubmit, w.Code)
+		}
+		token := w.Body.String()
+		cookies := w.Result().Cookies()
+		if len(token) == 0 || len(cookies) != 1 {
+			t.Fatalf("double submit %t: expected a token and a cookie, got %q and %v", doubleSubmit, token, cookies)
+		}
+
+		// Tokens are masked differently on every request
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, csrfRequest("GET", "/", nil, cookies))
+		if w.Body.String() == token {
+			t.Errorf("double submit %t: expected a new mask for every request", doubleSubmit)
+		}
+
+		// The token is accepted from the form field and the header
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, csrfRequest("POST", "/", url.Values{"csrf_token": {token}}, cookies))
+		if w.Code != http.StatusOK {
+			t.Errorf("double submit %t: expected the form token to be accepted, got %d", doubleSubmit, w.Code)
+		}
+
+		r := csrfRequest("DELETE", "/", nil, cookies)
+		r.Header.Set("X-CSRF-Token", token)
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("double submit %t: expected the header token to be accepted, got %d", doubleSubmit, w.Code)
+		}
+
+		// Missing, invalid and foreign tokens are rejected
+		bad := []*http.Request{
+			csrfRequest("POST", "/", nil, cookies),
+			csrfRequest("POST", "/", url.Values{"csrf_token": {"nope"}}, cookies),
+			csrfRequest("POST", "/", url.Values{"csrf_token": {token}}, nil),
+		}
+		for i, r := range bad {
+			code = 0
+			w = httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if code != http.StatusForbidden || w.Code != http.StatusForbidden {
+				t.Errorf("double submit %t: %d) expected 403 from the error manager, got %d", doubleSubmit, i, w.Code)
+			}
+		}
+	}
+}
+
+func TestCSRFAddsError(t *testing.T) {
+	t.Parallel()
+
+	m := NewErrorManager(&mockRender{}, "layouts/errors")
+	overseer := abcsessions.NewCookieOverseer(abcsessions.NewCookieOptions(), []byte(strings.Repeat("k", 32)))
+
+	CSRF(NewCSRFOptions(), overseer, m)
+	CSRF(NewCSRFOptions(), overseer, m)
+
+	if len(m.errors) != 1 {
+		t.Fatalf("expected a single error to be added, got %d", len(m.errors))
+	}
+	if e := m.errors[0]; e.Code != http.StatusForbidden || e.Template != "errors/403" || e.ErrLayout != "layouts/errors" {
+		t.Errorf("expected a 403 error, got %#v", e)
+	}
+}
+
+func TestCSRFOptionsValidate(t *testing.T) {
+	t.Parallel()
+
+	if err := NewCSRFOptions().Validate(); err != nil {
+		t.Error(err)
+	}
+
+	opts := NewCSRFOptions()
+	opts.SessionKey = ""
+	if err := opts.Validate(); err == nil {
+		t.Error("expected an error for a missing session key")
+	}
+
+	opts.DoubleSubmit = true
+	if err := opts.Validate(); err == nil {
+		t.Error("expected an error for a missing key")
+	}
+
+	opts.Key = []byte(strings.Repeat("k", 32))
+	opts.Cookie.Name = ""
+	if err := opts.Validate(); err == nil {
+		t.Error("expected an error for a missing cookie name")
+	}
+}
+
+func TestCSRFDoubleSubmitCookie(t *testing.T) {
+	t.Parallel()
+
+	mem, err := abcsessions.NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessOpts := abcsessions.NewCookieOptions()
+	overseer := abcsessions.NewStorageOverseer(sessOpts, mem)
+
+	opts := NewCSRFOptions()
+	opts.DoubleSubmit = true
+	opts.Key = []byte(strings.Repeat("k", 32))
+	opts.Cookie.SameSite = http.SameSiteNoneMode
+	opts.Cookie.Partitioned = true
+
+	var code int
+	h := csrfTestServer(t, opts, overseer, &code)
+
+	// The cookie has the attributes of the options and is bound to the
+	// session of the client
+	session := &http.Cookie{Name: sessOpts.Name, Value: "session-a"}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, csrfRequest("GET", "/", nil, []*http.Cookie{session}))
+	token := w.Body.String()
+
+	header := w.Header().Get("Set-Cookie")
+	if !strings.Contains(header, "SameSite=None") || !strings.HasSuffix(header, "; Partitioned") {
+		t.Errorf("expected the SameSite and Partitioned attributes, got %q", header)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "csrf" {
+		t.Fatalf("expected a csrf cookie, got %v", cookies)
+	}
+
+	form := url.Values{"csrf_token": {token}}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, csrfRequest("POST", "/", form, []*http.Cookie{session, cookies[0]}))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected the token to be accepted, got %d", w.Code)
+	}
+
+	// A cookie made for another session, or with a changed secret, is
+	// rejected even when the token matches it
+	other := &http.Cookie{Name: sessOpts.Name, Value: "session-b"}
+	forged := &http.Cookie{Name: "csrf", Value: strings.Replace(cookies[0].Value, ".", "x.", 1)}
+	bad := [][]*http.Cookie{
+		{other, cookies[0]},
+		{cookies[0]},
+		{session, forged},
+	}
+	for i, c := range bad {
+		code = 0
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, csrfRequest("POST", "/", form, c))
+		if code != http.StatusForbidden {
+			t.Errorf("%d) expected 403, got %d", i, w.Code)
+		}
+	}
+}
+
+func TestCSRFMask(t *testing.T) {
+	t.Parallel()
+
+	secret := []byte(strings.Repeat("s", csrfSecretLen))
+	token, err := maskCSRFSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok := unmaskCSRFToken(token)
+	if !ok || string(got) != string(secret) {
+		t.Errorf("expected the secret back, got %q", got)
+	}
+
+	if _, ok := unmaskCSRFToken(token[:10]); ok {
+		t.Error("expected a short token to be rejected")
+	}
+}
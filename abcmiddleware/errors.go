@@ -1,9 +1,16 @@
 package abcmiddleware
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"html/template"
+	"mime"
 	"net/http"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 
 	chimiddleware "github.com/go-chi/chi/middleware"
 	"github.com/volatiletech/abcweb/v5/abcrender"
@@ -18,10 +25,37 @@ var (
 	ErrForbidden    = errors.New("access is forbidden")
 )
 
-// ErrorContainer holds all of the relevant variables for a users custom error
+// HTTPError is implemented by errors that know the HTTP status code they
+// should be responded to with. The Errors middleware honours them without an
+// ErrorContainer being added for them, rendering "errors/<status code>"
+// with the error layout of the ErrorManager, or "errors/500" if the Renderer
+// does not have that template. Status codes outside of 100-599 are
+// responded to with a 500.
+type HTTPError interface {
+	error
+	// StatusCode is the HTTP status code to respond with
+	StatusCode() int
+	// PublicMessage is a message that is safe to show to the client. It
+	// is the detail of problem+json responses and the binding of the
+	// error template.
+	PublicMessage() string
+}
+
+// ErrorContainer holds all of the relevant variables for a users custom error.
+//
+// The Errors middleware picks the ErrorContainer for an error in this order:
+//  1. the first container added whose Err matches with errors.Is
+//  2. the first container added whose As type matches with errors.As
+//  3. an HTTPError anywhere in the error chain
+//  4. the default 500 error
 type ErrorContainer struct {
 	// The error that will be returned by the controller
 	Err error
+	// As matches the container to every error of a type with errors.As,
+	// instead of a single error value. It is a value of the error type,
+	// such as (*ValidationError)(nil), or a nil pointer to an interface
+	// type, such as (*interface{ Timeout() bool })(nil). See NewErrorAs.
+	As interface{}
 	// Optional override layout string
 	ErrLayout string
 	// The template file top render (e.g "errors/500")
@@ -30,13 +64,37 @@ type ErrorContainer struct {
 	Code int
 	// A custom handler to perform additional operations on this error
 	Handler ErrorHandler
+
+	// Optional title of the problem+json response, defaults to the
+	// status text of Code
+	Title string
+	// Optional type URI of the problem+json response identifying the
+	// kind of error, defaults to "about:blank"
+	Type string
 }
 
-// ErrorManager helps manage errors at the application level
+// Problem is the RFC 7807 problem details body ErrorManager responds with
+// to requests that accept JSON
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	// Detail is the error text, it is left out of 5xx responses so
+	// internal errors are not leaked to clients
+	Detail    string `json:"detail,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// ErrorManager helps manage errors at the application level. Its methods
+// are safe to call concurrently, so errors can be added and removed while it
+// handles requests.
 type ErrorManager struct {
 	render    abcrender.Renderer
-	errors    []ErrorContainer
 	errLayout string
+
+	mut      sync.RWMutex
+	errors   []ErrorContainer
+	notifier *ErrorNotifier
 }
 
 // NewErrorManager creates an error manager that can be used to
@@ -72,20 +130,162 @@ func NewError(err error, code int, errorLayout, template string, handler ErrorHa
 	}
 }
 
-// Remove a ErrorContainer from the error manager
+// NewErrorAs creates a new ErrorContainer that matches every error of the
+// type of target with errors.As, such as any *ValidationError:
+//
+//	NewErrorAs((*ValidationError)(nil), http.StatusUnprocessableEntity, "", "errors/422", nil)
+//
+// To match errors that implement an interface, pass a nil pointer to the
+// interface type. Containers added with NewError are matched first.
+func NewErrorAs(target interface{}, code int, errorLayout, template string, handler ErrorHandler) ErrorContainer {
+	if errorTargetType(target) == nil {
+		panic(fmt.Sprintf("cannot match errors of type %T", target))
+	}
+
+	// template and code must be set if handler is nil
+	if handler == nil && (len(template) == 0 || code == 0) {
+		panic("template and code must be set if handler is nil")
+	}
+
+	return ErrorContainer{
+		As:        target,
+		Code:      code,
+		ErrLayout: errorLayout,
+		Template:  template,
+		Handler:   handler,
+	}
+}
+
+// errorTargetType returns the type errors.As must find to match the As
+// value of a container, or nil if it can not match any errors
+func errorTargetType(target interface{}) reflect.Type {
+	typ := reflect.TypeOf(target)
+	if typ == nil {
+		return nil
+	}
+
+	if typ.Kind() == reflect.Ptr && typ.Elem().Kind() == reflect.Interface {
+		return typ.Elem()
+	}
+	if !typ.Implements(reflect.TypeOf((*error)(nil)).Elem()) {
+		return nil
+	}
+
+	return typ
+}
+
+// Remove the ErrorContainers from the error manager that match the same Err,
+// or the same As type, as e
 func (m *ErrorManager) Remove(e ErrorContainer) {
-	for i, v := range m.errors {
-		if reflect.DeepEqual(v, e) {
-			m.errors = append(m.errors[:i], m.errors[i+1:]...)
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	typ := errorTargetType(e.As)
+
+	kept := make([]ErrorContainer, 0, len(m.errors))
+	for _, v := range m.errors {
+		if (e.Err != nil && sameError(v.Err, e.Err)) || (typ != nil && errorTargetType(v.As) == typ) {
+			continue
 		}
+		kept = append(kept, v)
 	}
+
+	m.errors = kept
+}
+
+// sameError returns true if a and b are the same error value. Errors of a
+// type that is not comparable are never the same.
+func sameError(a, b error) bool {
+	typ := reflect.TypeOf(a)
+	return typ != nil && typ == reflect.TypeOf(b) && typ.Comparable() && a == b
 }
 
 // Add a new ErrorContainer to the error manager
 func (m *ErrorManager) Add(e ErrorContainer) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
 	m.errors = append(m.errors, e)
 }
 
+// SetNotifier sets the ErrorNotifier that is notified of the errors the
+// Errors middleware responds to with a 5xx status, nil stops notifications
+func (m *ErrorManager) SetNotifier(n *ErrorNotifier) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	m.notifier = n
+}
+
+// notify notifies the ErrorNotifier of a 5xx error if one is set
+func (m *ErrorManager) notify(r *http.Request, err error, code int) {
+	if code < http.StatusInternalServerError {
+		return
+	}
+
+	m.mut.RLock()
+	notifier := m.notifier
+	m.mut.RUnlock()
+
+	if notifier != nil {
+		notifier.notifyError(r, err, code)
+	}
+}
+
+// find returns the ErrorContainer for err, in the order documented on
+// ErrorContainer, without the default 500 error
+func (m *ErrorManager) find(err error) (ErrorContainer, bool) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+
+	for _, e := range m.errors {
+		if e.Err != nil && errors.Is(err, e.Err) {
+			return e, true
+		}
+	}
+
+	for _, e := range m.errors {
+		if typ := errorTargetType(e.As); typ != nil && errors.As(err, reflect.New(typ).Interface()) {
+			return e, true
+		}
+	}
+
+	var httpErr HTTPError
+	if errors.As(err, &httpErr) {
+		code := httpErr.StatusCode()
+		// WriteHeader panics on codes that are not 3 digits
+		if code < 100 || code > 599 {
+			code = http.StatusInternalServerError
+		}
+
+		tmpl := fmt.Sprintf("errors/%d", code)
+		if !m.hasTemplate(tmpl) {
+			tmpl = "errors/500"
+		}
+
+		return ErrorContainer{
+			Code:      code,
+			ErrLayout: m.errLayout,
+			Template:  tmpl,
+		}, true
+	}
+
+	return ErrorContainer{}, false
+}
+
+// templateLookuper is implemented by Renderers that can look up their
+// templates, such as abcrender.Render
+type templateLookuper interface {
+	TemplateLookup(name string) *template.Template
+}
+
+// hasTemplate returns true if the Renderer has the template, or if it can
+// not tell
+func (m *ErrorManager) hasTemplate(name string) bool {
+	lookuper, ok := m.render.(templateLookuper)
+	return !ok || lookuper.TemplateLookup(name) != nil
+}
+
 // AppHandler is the function signature for controllers that return errors.
 type AppHandler func(w http.ResponseWriter, r *http.Request) error
 
@@ -97,32 +297,41 @@ type ErrorHandler func(w http.ResponseWriter, r *http.Request, e ErrorContainer,
 // errors directly in your controller is that it's all centralized to one
 // location which simplifies adding notifiers (like slack and email).
 // It also reduces a lot of controller boilerplate.
+//
+// Requests that prefer JSON over HTML in their Accept header get an RFC 7807
+// application/problem+json body instead of the error page.
 func (m *ErrorManager) Errors(ctrl AppHandler) http.HandlerFunc {
+	return m.handle(ctrl, false)
+}
+
+// APIErrors is the Errors middleware for JSON API routes, it always responds
+// with an RFC 7807 application/problem+json body whatever the request
+// accepts.
+func (m *ErrorManager) APIErrors(ctrl AppHandler) http.HandlerFunc {
+	return m.handle(ctrl, true)
+}
+
+// handle returns the Errors middleware, responding with problem+json to
+// every request if api is true
+func (m *ErrorManager) handle(ctrl AppHandler, api bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		err := ctrl(w, r)
 		if err == nil {
 			return
 		}
 
-		var container ErrorContainer
 		var layout string
 		var template string
 		var code int
 
-		found := false
-		for _, e := range m.errors {
-			if errors.Is(err, e.Err) {
-				container = e
-				found = true
-				break
-			}
-		}
-
+		container, found := m.find(err)
 		if !found { // no error containers/handlers found, default path
 			code = http.StatusInternalServerError
 			layout = m.errLayout
 			template = "errors/500"
 		} else if container.Handler != nil { // container and handler are set
+			m.notify(r, err, container.Code)
+
 			err := container.Handler(w, r, container, m.render)
 			if err != nil {
 				panic(err)
@@ -149,22 +358,97 @@ func (m *ErrorManager) Errors(ctrl AppHandler) http.HandlerFunc {
 			zap.Error(err),
 		}
 
-		// log with the request_id scoped logger
-		switch code {
-		case http.StatusInternalServerError:
+		// log with the request_id scoped logger, warn does not log
+		// stacktrace in prod, but error and above does
+		if code >= http.StatusInternalServerError {
 			log.Error("request error", fields...)
-			requestID := chimiddleware.GetReqID(r.Context())
+		} else {
+			log.Warn("request failed", fields...)
+		}
 
-			err = m.render.HTMLWithLayout(w, code, template, requestID, layout)
-			if err != nil {
-				panic(err)
+		m.notify(r, err, code)
+
+		if api || acceptsJSON(r) {
+			writeProblem(w, r, container, code, err)
+			return
+		}
+
+		var binding interface{}
+		var httpErr HTTPError
+		// errors/500 also renders the HTTPErrors that have no template
+		if code == http.StatusInternalServerError || template == "errors/500" {
+			binding = chimiddleware.GetReqID(r.Context())
+		} else if errors.As(err, &httpErr) {
+			binding = httpErr.PublicMessage()
+		}
+
+		err = m.render.HTMLWithLayout(w, code, template, binding, layout)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// writeProblem writes the RFC 7807 problem details of the error. The detail
+// is the public message of an HTTPError in the error chain, otherwise the
+// error text is only included for 4xx errors.
+func writeProblem(w http.ResponseWriter, r *http.Request, container ErrorContainer, code int, err error) {
+	problem := Problem{
+		Type:      container.Type,
+		Title:     container.Title,
+		Status:    code,
+		RequestID: chimiddleware.GetReqID(r.Context()),
+	}
+	if len(problem.Type) == 0 {
+		problem.Type = "about:blank"
+	}
+	if len(problem.Title) == 0 {
+		problem.Title = http.StatusText(code)
+	}
+	var httpErr HTTPError
+	if errors.As(err, &httpErr) {
+		problem.Detail = httpErr.PublicMessage()
+	} else if code < http.StatusInternalServerError {
+		problem.Detail = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(problem); err != nil {
+		panic(err)
+	}
+}
+
+// acceptsJSON returns true if the Accept header of the request prefers a
+// JSON media type (application/json, application/problem+json or any
+// other +json type) over text/html. Requests without an Accept header, or
+// that accept anything, get HTML.
+func acceptsJSON(r *http.Request) bool {
+	var jsonQ, htmlQ float64
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
 			}
-		default: // warn does not log stacktrace in prod, but error and above does
-			log.Warn("request failed", fields...)
-			err = m.render.HTMLWithLayout(w, code, template, nil, layout)
-			if err != nil {
-				panic(err)
+		}
+
+		switch {
+		case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+			if q > jsonQ {
+				jsonQ = q
+			}
+		case mediaType == "text/html" || mediaType == "text/*" || mediaType == "*/*":
+			if q > htmlQ {
+				htmlQ = q
 			}
 		}
 	}
+
+	return jsonQ > htmlQ
 }
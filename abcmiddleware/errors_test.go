@@ -2,13 +2,17 @@ package abcmiddleware
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"html/template"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"testing"
 
+	chimiddleware "github.com/go-chi/chi/middleware"
 	"go.uber.org/zap"
 
 	"github.com/volatiletech/abcweb/v5/abcrender"
@@ -65,6 +69,35 @@ func TestRemoveAndAdd(t *testing.T) {
 	}
 }
 
+func TestRemoveHandlers(t *testing.T) {
+	t.Parallel()
+
+	handler := func(w http.ResponseWriter, r *http.Request, e ErrorContainer, render abcrender.Renderer) error {
+		return nil
+	}
+
+	ea := errors.New("error1")
+	eb := errors.New("error2")
+
+	m := NewErrorManager(&mockRender{}, "")
+	m.Add(NewError(ea, 404, "", "", handler))
+	m.Add(NewError(ea, 404, "", "errors/404", nil))
+	m.Add(NewErrorAs((*validationError)(nil), 422, "", "", handler))
+	m.Add(NewError(eb, 404, "", "", handler))
+
+	// Containers with a handler are matched by their error, so both
+	// containers of error1 are removed
+	m.Remove(NewError(ea, 404, "", "", handler))
+	if len(m.errors) != 2 {
+		t.Fatalf("expected len 2, got %d", len(m.errors))
+	}
+
+	m.Remove(NewErrorAs((*validationError)(nil), 422, "", "", handler))
+	if len(m.errors) != 1 || m.errors[0].Err != eb {
+		t.Errorf("expected only the container of error2, got %#v", m.errors)
+	}
+}
+
 func TestCustomErrorHandler(t *testing.T) {
 	t.Parallel()
 
@@ -129,9 +162,305 @@ func TestCustomErrorHandler(t *testing.T) {
 	}
 }
 
+func TestErrorsProblemJSON(t *testing.T) {
+	t.Parallel()
+
+	e1 := errors.New("post not found")
+	rndr := &mockRender{}
+	m := NewErrorManager(rndr, "")
+	notFound := NewError(e1, http.StatusNotFound, "", "errors/404", nil)
+	notFound.Title = "Post not found"
+	notFound.Type = "https://example.com/problems/not-found"
+	m.Add(notFound)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		accept  string
+		status  int
+		problem Problem
+	}{
+		{
+			name:    "4xx",
+			handler: m.Errors(func(w http.ResponseWriter, r *http.Request) error { return e1 }),
+			accept:  "application/json",
+			status:  http.StatusNotFound,
+			problem: Problem{Type: notFound.Type, Title: "Post not found", Status: 404, Detail: "post not found", RequestID: "req-1"},
+		},
+		{
+			name:    "500",
+			handler: m.Errors(func(w http.ResponseWriter, r *http.Request) error { return errors.New("secret database error") }),
+			accept:  "text/html;q=0.8, application/problem+json",
+			status:  http.StatusInternalServerError,
+			problem: Problem{Type: "about:blank", Title: "Internal Server Error", Status: 500, RequestID: "req-1"},
+		},
+		{
+			name:    "api",
+			handler: m.APIErrors(func(w http.ResponseWriter, r *http.Request) error { return e1 }),
+			accept:  "text/html",
+			status:  http.StatusNotFound,
+			problem: Problem{Type: notFound.Type, Title: "Post not found", Status: 404, Detail: "post not found", RequestID: "req-1"},
+		},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept", test.accept)
+		ctx := context.WithValue(context.Background(), CTXKeyLogger, zap.NewNop())
+		ctx = context.WithValue(ctx, chimiddleware.RequestIDKey, "req-1")
+		test.handler.ServeHTTP(w, r.WithContext(ctx))
+
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+			t.Errorf("%s: expected problem+json, got %q", test.name, ct)
+		}
+
+		var problem Problem
+		if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+			t.Fatal(err)
+		}
+		if problem != test.problem {
+			t.Errorf("%s: expected:\n%#v\ngot:\n%#v", test.name, test.problem, problem)
+		}
+	}
+
+	if rndr.status != 0 {
+		t.Error("expected no html to be rendered")
+	}
+}
+
+type validationError struct {
+	field string
+}
+
+func (v *validationError) Error() string { return v.field + " is invalid" }
+
+type statusError struct {
+	code    int
+	message string
+	err     error
+}
+
+func (s statusError) Error() string         { return "status error: " + s.message }
+func (s statusError) StatusCode() int       { return s.code }
+func (s statusError) PublicMessage() string { return s.message }
+func (s statusError) Unwrap() error         { return s.err }
+
+type temporary interface {
+	Temporary() bool
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "try again" }
+func (temporaryError) Temporary() bool { return true }
+
+func TestErrorsMatchPrecedence(t *testing.T) {
+	t.Parallel()
+
+	sentinel := errors.New("sentinel")
+	wrappedValidation := fmt.Errorf("saving user: %w", &validationError{field: "email"})
+
+	rndr := &mockRender{}
+	m := NewErrorManager(rndr, "layouts/errors")
+	m.Add(NewErrorAs((*validationError)(nil), http.StatusUnprocessableEntity, "", "errors/422", nil))
+	m.Add(NewErrorAs((*temporary)(nil), http.StatusServiceUnavailable, "", "errors/503", nil))
+	m.Add(NewError(sentinel, http.StatusConflict, "", "errors/409", nil))
+
+	tests := []struct {
+		name     string
+		err      error
+		status   int
+		template string
+		layout   string
+		binding  interface{}
+	}{
+		{
+			name:     "is before as",
+			err:      fmt.Errorf("%w: %v", sentinel, &validationError{field: "email"}),
+			status:   http.StatusConflict,
+			template: "errors/409",
+		},
+		{
+			name:     "as type",
+			err:      wrappedValidation,
+			status:   http.StatusUnprocessableEntity,
+			template: "errors/422",
+		},
+		{
+			name:     "as interface",
+			err:      fmt.Errorf("fetching: %w", temporaryError{}),
+			status:   http.StatusServiceUnavailable,
+			template: "errors/503",
+		},
+		{
+			name:     "as before http error",
+			err:      statusError{code: http.StatusBadRequest, message: "check your email", err: wrappedValidation},
+			status:   http.StatusUnprocessableEntity,
+			template: "errors/422",
+			binding:  "check your email",
+		},
+		{
+			name:     "http error",
+			err:      fmt.Errorf("loading: %w", statusError{code: http.StatusGone, message: "post was deleted"}),
+			status:   http.StatusGone,
+			template: "errors/410",
+			layout:   "layouts/errors",
+			binding:  "post was deleted",
+		},
+		{
+			name:     "default",
+			err:      errors.New("boom"),
+			status:   http.StatusInternalServerError,
+			template: "errors/500",
+			layout:   "layouts/errors",
+			binding:  "req-1",
+		},
+	}
+
+	for _, test := range tests {
+		err := test.err
+		*rndr = mockRender{}
+
+		r := httptest.NewRequest("GET", "/", nil)
+		ctx := context.WithValue(context.Background(), CTXKeyLogger, zap.NewNop())
+		ctx = context.WithValue(ctx, chimiddleware.RequestIDKey, "req-1")
+		m.Errors(func(w http.ResponseWriter, r *http.Request) error { return err }).ServeHTTP(httptest.NewRecorder(), r.WithContext(ctx))
+
+		if rndr.status != test.status || rndr.name != test.template || rndr.layout != test.layout || rndr.binding != test.binding {
+			t.Errorf("%s: expected %d %q %q %v, got %d %q %q %v", test.name,
+				test.status, test.template, test.layout, test.binding,
+				rndr.status, rndr.name, rndr.layout, rndr.binding)
+		}
+	}
+}
+
+func TestErrorsHTTPErrorProblem(t *testing.T) {
+	t.Parallel()
+
+	m := NewErrorManager(&mockRender{}, "")
+	h := m.APIErrors(func(w http.ResponseWriter, r *http.Request) error {
+		return fmt.Errorf("charging card: %w", statusError{code: http.StatusBadGateway, message: "the payment provider is down"})
+	})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", nil)
+	h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), CTXKeyLogger, zap.NewNop())))
+
+	var problem Problem
+	if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+		t.Fatal(err)
+	}
+	expected := Problem{Type: "about:blank", Title: "Bad Gateway", Status: 502, Detail: "the payment provider is down"}
+	if w.Code != http.StatusBadGateway || problem != expected {
+		t.Errorf("expected 502 and:\n%#v\ngot %d and:\n%#v", expected, w.Code, problem)
+	}
+}
+
+// lookupRender is a mockRender that only has some templates
+type lookupRender struct {
+	mockRender
+	templates map[string]bool
+}
+
+func (l *lookupRender) TemplateLookup(name string) *template.Template {
+	if !l.templates[name] {
+		return nil
+	}
+
+	return template.New(name)
+}
+
+func TestErrorsHTTPErrorTemplate(t *testing.T) {
+	t.Parallel()
+
+	rndr := &lookupRender{templates: map[string]bool{"errors/404": true, "errors/500": true}}
+	m := NewErrorManager(rndr, "layouts/errors")
+
+	tests := []struct {
+		code     int
+		status   int
+		template string
+		binding  interface{}
+	}{
+		{code: http.StatusNotFound, status: http.StatusNotFound, template: "errors/404", binding: "message"},
+		{code: http.StatusTeapot, status: http.StatusTeapot, template: "errors/500", binding: "req-1"},
+		{code: 1000, status: http.StatusInternalServerError, template: "errors/500", binding: "req-1"},
+		{code: 0, status: http.StatusInternalServerError, template: "errors/500", binding: "req-1"},
+	}
+
+	for _, test := range tests {
+		err := statusError{code: test.code, message: "message"}
+		rndr.mockRender = mockRender{}
+
+		r := httptest.NewRequest("GET", "/", nil)
+		ctx := context.WithValue(context.Background(), CTXKeyLogger, zap.NewNop())
+		ctx = context.WithValue(ctx, chimiddleware.RequestIDKey, "req-1")
+		m.Errors(func(w http.ResponseWriter, r *http.Request) error { return err }).ServeHTTP(httptest.NewRecorder(), r.WithContext(ctx))
+
+		if rndr.status != test.status || rndr.name != test.template || rndr.binding != test.binding {
+			t.Errorf("%d: expected %d %q %v, got %d %q %v", test.code,
+				test.status, test.template, test.binding,
+				rndr.status, rndr.name, rndr.binding)
+		}
+
+		// Problem details are written with a valid status code too
+		w := httptest.NewRecorder()
+		m.APIErrors(func(w http.ResponseWriter, r *http.Request) error { return err }).ServeHTTP(w, r.WithContext(ctx))
+		if w.Code != test.status {
+			t.Errorf("%d: expected status %d, got %d", test.code, test.status, w.Code)
+		}
+	}
+}
+
+func TestNewErrorAsPanics(t *testing.T) {
+	t.Parallel()
+
+	targets := []interface{}{nil, "string", (*string)(nil), validationError{}}
+	for _, target := range targets {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%T: expected a panic", target)
+				}
+			}()
+			NewErrorAs(target, http.StatusBadRequest, "", "errors/400", nil)
+		}()
+	}
+}
+
+func TestAcceptsJSON(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]bool{
+		"":    false,
+		"*/*": false,
+		"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8": false,
+		"application/json":                  true,
+		"application/problem+json":          true,
+		"application/json, */*;q=0.1":       true,
+		"text/html;q=0.5, application/json": true,
+		"application/json;q=0.5, text/html": false,
+		"application/vnd.api+json":          true,
+	}
+
+	for accept, expected := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept", accept)
+		if got := acceptsJSON(r); got != expected {
+			t.Errorf("%q: expected %t, got %t", accept, expected, got)
+		}
+	}
+}
+
 type mockRender struct {
-	status int
-	name   string
+	status  int
+	name    string
+	binding interface{}
+	layout  string
 }
 
 func (mockRender) Data(w io.Writer, status int, v []byte) error      { return nil }
@@ -142,6 +471,10 @@ func (m *mockRender) HTML(w io.Writer, status int, name string, binding interfac
 	m.name = name
 	return nil
 }
-func (mockRender) HTMLWithLayout(w io.Writer, status int, name string, binding interface{}, layout string) error {
+func (m *mockRender) HTMLWithLayout(w io.Writer, status int, name string, binding interface{}, layout string) error {
+	m.status = status
+	m.name = name
+	m.binding = binding
+	m.layout = layout
 	return nil
 }
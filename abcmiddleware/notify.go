@@ -0,0 +1,433 @@
+package abcmiddleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/friendsofgo/errors"
+	"github.com/go-chi/chi"
+	chimiddleware "github.com/go-chi/chi/middleware"
+	"go.uber.org/zap"
+)
+
+// Notification describes a server error or panic that a Notifier is
+// notified of
+type Notification struct {
+	// Fingerprint identifies notifications of the same error, it is made
+	// from the route pattern and the innermost error or the panic value
+	Fingerprint string `json:"fingerprint"`
+	// Panic is true if the notification is for a panic recovered by
+	// ZapRecover
+	Panic bool `json:"panic"`
+	// Error is the error text or the panic value
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+
+	RequestID string `json:"request_id,omitempty"`
+	Method    string `json:"method"`
+	URI       string `json:"uri"`
+	Host      string `json:"host"`
+	// Route is the chi route pattern of the request, such as
+	// "/posts/{id}", if the request was routed by chi
+	Route string `json:"route,omitempty"`
+	// Stack is the stack trace of the error if it has one (errors made
+	// with github.com/friendsofgo/errors), or the stack of the goroutine
+	// where the error was handled or the panic recovered
+	Stack string    `json:"stack"`
+	Time  time.Time `json:"time"`
+
+	// Suppressed is the number of notifications with the same fingerprint
+	// that were not sent since the last one was
+	Suppressed int `json:"suppressed"`
+}
+
+// Notifier is notified of server errors and panics by an ErrorNotifier
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// NotifierFunc is an adapter to use a function as a Notifier
+type NotifierFunc func(ctx context.Context, n Notification) error
+
+// Notify calls f(ctx, n)
+func (f NotifierFunc) Notify(ctx context.Context, n Notification) error {
+	return f(ctx, n)
+}
+
+// NotifyOptions configures an ErrorNotifier
+type NotifyOptions struct {
+	// Interval is the time after a notification during which notifications
+	// with the same fingerprint are suppressed, defaults to 1 minute
+	Interval time.Duration
+	// QueueSize is the number of notifications waiting to be sent after
+	// which new ones are dropped, defaults to 64
+	QueueSize int
+	// Timeout is how long each notifier gets to send a notification,
+	// defaults to 10 seconds
+	Timeout time.Duration
+}
+
+// NewNotifyOptions gives healthy defaults for an ErrorNotifier
+func NewNotifyOptions() NotifyOptions {
+	return NotifyOptions{
+		Interval:  time.Minute,
+		QueueSize: 64,
+		Timeout:   10 * time.Second,
+	}
+}
+
+// maxFingerprints is the number of fingerprints an ErrorNotifier remembers
+// before it forgets the ones outside of the interval
+const maxFingerprints = 1000
+
+// ErrorNotifier sends notifications of server errors and panics to its
+// notifiers in the background. Notifications with the same fingerprint are
+// sent at most once per interval, the ones in between are counted in the
+// Suppressed field of the next one that is sent.
+//
+// Set it on the ErrorManager with SetNotifier to be notified of 5xx errors,
+// and pass it to ZapRecoverNotify to be notified of panics.
+type ErrorNotifier struct {
+	log       *zap.Logger
+	opts      NotifyOptions
+	notifiers []Notifier
+
+	mut          sync.Mutex
+	closed       bool
+	fingerprints map[string]*fingerprint
+	queue        chan Notification
+	done         chan struct{}
+
+	now func() time.Time
+}
+
+type fingerprint struct {
+	sent       time.Time
+	suppressed int
+}
+
+// NewErrorNotifier creates an ErrorNotifier and starts sending its
+// notifications in the background until it is closed. Errors from the
+// notifiers are logged with log.
+func NewErrorNotifier(log *zap.Logger, opts NotifyOptions, notifiers ...Notifier) *ErrorNotifier {
+	if opts.Interval <= 0 || opts.QueueSize <= 0 || opts.Timeout <= 0 {
+		panic("notify interval, queue size and timeout must be set")
+	}
+
+	n := &ErrorNotifier{
+		log:          log,
+		opts:         opts,
+		notifiers:    notifiers,
+		fingerprints: make(map[string]*fingerprint),
+		queue:        make(chan Notification, opts.QueueSize),
+		done:         make(chan struct{}),
+		now:          time.Now,
+	}
+
+	go n.send()
+
+	return n
+}
+
+// Notify queues the notification to be sent to the notifiers, unless one
+// with the same fingerprint was sent during the interval. Its Time is set if
+// it is zero. It does not block, if the queue is full the notification is
+// dropped.
+func (e *ErrorNotifier) Notify(n Notification) {
+	e.notify(n, nil)
+}
+
+// notify is Notify, setting the Stack of the notification with stack if it
+// is not nil and the notification is not suppressed, so no stack trace is
+// made for the notifications that are suppressed
+func (e *ErrorNotifier) notify(n Notification, stack func() string) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+
+	if e.closed {
+		return
+	}
+
+	now := e.now()
+	if n.Time.IsZero() {
+		n.Time = now
+	}
+
+	fp, ok := e.fingerprints[n.Fingerprint]
+	if ok && now.Sub(fp.sent) < e.opts.Interval {
+		fp.suppressed++
+		return
+	}
+	if !ok {
+		e.forget(now)
+		fp = &fingerprint{}
+		e.fingerprints[n.Fingerprint] = fp
+	}
+
+	n.Suppressed = fp.suppressed
+	fp.sent = now
+	fp.suppressed = 0
+
+	if stack != nil {
+		n.Stack = stack()
+	}
+
+	select {
+	case e.queue <- n:
+	default:
+		e.log.Warn("error notification queue is full, dropping notification",
+			zap.String("fingerprint", n.Fingerprint),
+			zap.String("error", n.Error),
+		)
+	}
+}
+
+// Close stops accepting notifications and waits for the queued ones to be
+// sent
+func (e *ErrorNotifier) Close() {
+	e.mut.Lock()
+	if e.closed {
+		e.mut.Unlock()
+		<-e.done
+		return
+	}
+	e.closed = true
+	close(e.queue)
+	e.mut.Unlock()
+
+	<-e.done
+}
+
+// forget deletes the fingerprints outside of the interval once there are
+// too many to remember
+func (e *ErrorNotifier) forget(now time.Time) {
+	if len(e.fingerprints) < maxFingerprints {
+		return
+	}
+
+	for key, fp := range e.fingerprints {
+		if now.Sub(fp.sent) >= e.opts.Interval {
+			delete(e.fingerprints, key)
+		}
+	}
+}
+
+// send sends the queued notifications to every notifier until the queue is
+// closed
+func (e *ErrorNotifier) send() {
+	defer close(e.done)
+
+	for n := range e.queue {
+		for _, notifier := range e.notifiers {
+			ctx, cancel := context.WithTimeout(context.Background(), e.opts.Timeout)
+			err := notifier.Notify(ctx, n)
+			cancel()
+			if err != nil {
+				e.log.Error("unable to send error notification",
+					zap.String("fingerprint", n.Fingerprint),
+					zap.Error(err),
+				)
+			}
+		}
+	}
+}
+
+// notifyError queues a notification for an error the ErrorManager responded
+// to with a 5xx status
+func (e *ErrorNotifier) notifyError(r *http.Request, err error, status int) {
+	// fingerprint the innermost error, so the same error wrapped with
+	// different messages is still deduplicated
+	inner := err
+	for {
+		u, ok := inner.(interface{ Unwrap() error })
+		if !ok || u.Unwrap() == nil {
+			break
+		}
+		inner = u.Unwrap()
+	}
+
+	n := newNotification(r, status, "")
+	n.Error = err.Error()
+	n.Fingerprint = notificationFingerprint("error", n.Route, fmt.Sprintf("%T", inner), inner.Error())
+	e.notify(n, func() string {
+		var st stackTracer
+		if errors.As(err, &st) {
+			return strings.TrimPrefix(fmt.Sprintf("%+v", st.StackTrace()), "\n")
+		}
+
+		return string(debug.Stack())
+	})
+}
+
+// notifyPanic queues a notification for a panic recovered by ZapRecover
+func (e *ErrorNotifier) notifyPanic(r *http.Request, v interface{}, stack []byte) {
+	n := newNotification(r, http.StatusInternalServerError, string(stack))
+	n.Panic = true
+	n.Error = fmt.Sprintf("%+v", v)
+	n.Fingerprint = notificationFingerprint("panic", n.Route, fmt.Sprintf("%T", v), fmt.Sprint(v))
+	e.Notify(n)
+}
+
+type stackTracer interface {
+	StackTrace() errors.StackTrace
+}
+
+func newNotification(r *http.Request, status int, stack string) Notification {
+	n := Notification{
+		Status:    status,
+		RequestID: chimiddleware.GetReqID(r.Context()),
+		Method:    r.Method,
+		URI:       r.RequestURI,
+		Host:      r.Host,
+		Stack:     stack,
+	}
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		n.Route = strings.Join(rctx.RoutePatterns, "")
+	}
+
+	return n
+}
+
+// notificationFingerprint hashes the parts that identify an error
+func notificationFingerprint(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// NewWebhookNotifier returns a Notifier that posts notifications as JSON to
+// the url. A nil client uses http.DefaultClient.
+func NewWebhookNotifier(url string, client *http.Client) Notifier {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return NotifierFunc(func(ctx context.Context, n Notification) error {
+		body, err := json.Marshal(n)
+		if err != nil {
+			return errors.Wrap(err, "unable to marshal notification")
+		}
+
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return errors.Wrap(err, "unable to create webhook request")
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return errors.Wrap(err, "unable to post webhook")
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return errors.Errorf("webhook responded with status %d", resp.StatusCode)
+		}
+
+		return nil
+	})
+}
+
+// SMTPNotifier emails notifications through an SMTP server, such as a local
+// mail relay or development stand-in like MailHog
+type SMTPNotifier struct {
+	// Addr is the host:port of the SMTP server
+	Addr string
+	// Auth is optional, most servers only allow it over TLS
+	Auth smtp.Auth
+	From string
+	To   []string
+}
+
+// Notify sends the notification in a plain text email
+func (s SMTPNotifier) Notify(ctx context.Context, n Notification) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return errors.Wrap(err, "unable to connect to smtp server")
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return errors.Wrap(err, "unable to set smtp deadline")
+		}
+	}
+
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return errors.Wrap(err, "invalid smtp address")
+	}
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return errors.Wrap(err, "unable to start smtp session")
+	}
+	defer client.Close()
+
+	if s.Auth != nil {
+		if err := client.Auth(s.Auth); err != nil {
+			return errors.Wrap(err, "unable to authenticate with smtp server")
+		}
+	}
+	if err := client.Mail(s.From); err != nil {
+		return errors.Wrap(err, "smtp server refused sender")
+	}
+	for _, to := range s.To {
+		if err := client.Rcpt(to); err != nil {
+			return errors.Wrapf(err, "smtp server refused recipient %s", to)
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return errors.Wrap(err, "unable to start smtp data")
+	}
+	if _, err := w.Write(s.message(n)); err != nil {
+		return errors.Wrap(err, "unable to write email")
+	}
+	if err := w.Close(); err != nil {
+		return errors.Wrap(err, "unable to send email")
+	}
+
+	return errors.Wrap(client.Quit(), "unable to end smtp session")
+}
+
+// message formats the notification as an email
+func (s SMTPNotifier) message(n Notification) []byte {
+	kind := "Error"
+	if n.Panic {
+		kind = "Panic"
+	}
+	subject := fmt.Sprintf("[%s] %d %s %s", kind, n.Status, n.Method, n.Route)
+	if len(n.Route) == 0 {
+		subject = fmt.Sprintf("[%s] %d %s %s", kind, n.Status, n.Method, n.URI)
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From: %s\r\n", s.From)
+	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(s.To, ", "))
+	fmt.Fprintf(buf, "Subject: %s\r\n", strings.NewReplacer("\r", "", "\n", "").Replace(subject))
+	fmt.Fprintf(buf, "Date: %s\r\n", n.Time.Format(time.RFC1123Z))
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+
+	fmt.Fprintf(buf, "%s\r\n\r\n", n.Error)
+	fmt.Fprintf(buf, "Request ID:  %s\r\n", n.RequestID)
+	fmt.Fprintf(buf, "Request:     %s %s%s\r\n", n.Method, n.Host, n.URI)
+	fmt.Fprintf(buf, "Route:       %s\r\n", n.Route)
+	fmt.Fprintf(buf, "Fingerprint: %s\r\n", n.Fingerprint)
+	fmt.Fprintf(buf, "Suppressed:  %d\r\n\r\n", n.Suppressed)
+	buf.WriteString(strings.Replace(n.Stack, "\n", "\r\n", -1))
+
+	return buf.Bytes()
+}
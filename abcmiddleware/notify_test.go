@@ -0,0 +1,374 @@
+package abcmiddleware
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/friendsofgo/errors"
+	"github.com/go-chi/chi"
+	chimiddleware "github.com/go-chi/chi/middleware"
+	"go.uber.org/zap"
+)
+
+// notificationRecorder is a Notifier that records its notifications
+type notificationRecorder struct {
+	mut           sync.Mutex
+	notifications []Notification
+}
+
+func (n *notificationRecorder) Notify(ctx context.Context, notification Notification) error {
+	n.mut.Lock()
+	defer n.mut.Unlock()
+
+	n.notifications = append(n.notifications, notification)
+	return nil
+}
+
+func (n *notificationRecorder) get() []Notification {
+	n.mut.Lock()
+	defer n.mut.Unlock()
+
+	return append([]Notification(nil), n.notifications...)
+}
+
+func TestErrorNotifierDedup(t *testing.T) {
+	t.Parallel()
+
+	rec := &notificationRecorder{}
+	failing := NotifierFunc(func(ctx context.Context, n Notification) error {
+		return errors.New("failed")
+	})
+	e := NewErrorNotifier(zap.NewNop(), NewNotifyOptions(), failing, rec)
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	e.now = func() time.Time { return now }
+
+	e.Notify(Notification{Fingerprint: "a", Error: "1"})
+	e.Notify(Notification{Fingerprint: "a", Error: "2"})
+	e.Notify(Notification{Fingerprint: "b", Error: "3"})
+	now = now.Add(30 * time.Second)
+	e.Notify(Notification{Fingerprint: "a", Error: "4"})
+	now = now.Add(31 * time.Second)
+	e.Notify(Notification{Fingerprint: "a", Error: "5"})
+	e.Close()
+	e.Notify(Notification{Fingerprint: "c", Error: "6"})
+
+	got := rec.get()
+	if len(got) != 3 {
+		t.Fatalf("expected 3 notifications, got %#v", got)
+	}
+	expected := []struct {
+		err        string
+		suppressed int
+	}{{"1", 0}, {"3", 0}, {"5", 2}}
+	for i, n := range got {
+		if n.Error != expected[i].err || n.Suppressed != expected[i].suppressed {
+			t.Errorf("%d) expected %q with %d suppressed, got %q with %d", i,
+				expected[i].err, expected[i].suppressed, n.Error, n.Suppressed)
+		}
+		if n.Time.IsZero() {
+			t.Errorf("%d) expected the time to be set", i)
+		}
+	}
+}
+
+func TestErrorNotifierStackAfterDedup(t *testing.T) {
+	t.Parallel()
+
+	rec := &notificationRecorder{}
+	e := NewErrorNotifier(zap.NewNop(), NewNotifyOptions(), rec)
+
+	stacks := 0
+	stack := func() string {
+		stacks++
+		return "stack"
+	}
+
+	for i := 0; i < 3; i++ {
+		e.notify(Notification{Fingerprint: "a"}, stack)
+	}
+	e.Close()
+
+	if stacks != 1 {
+		t.Errorf("expected only the sent notification to get a stack, made %d", stacks)
+	}
+	if got := rec.get(); len(got) != 1 || got[0].Stack != "stack" {
+		t.Errorf("expected 1 notification with the stack, got %#v", got)
+	}
+}
+
+func TestErrorNotifierQueueFull(t *testing.T) {
+	t.Parallel()
+
+	sending := make(chan struct{}, 1)
+	release := make(chan struct{})
+	rec := &notificationRecorder{}
+	blocking := NotifierFunc(func(ctx context.Context, n Notification) error {
+		sending <- struct{}{}
+		<-release
+		return rec.Notify(ctx, n)
+	})
+
+	opts := NewNotifyOptions()
+	opts.QueueSize = 1
+	e := NewErrorNotifier(zap.NewNop(), opts, blocking)
+
+	// The first is being sent, the second queued, the rest dropped
+	e.Notify(Notification{Fingerprint: "0"})
+	<-sending
+	for i := 1; i < 5; i++ {
+		e.Notify(Notification{Fingerprint: fmt.Sprint(i)})
+	}
+	go func() {
+		for range sending {
+		}
+	}()
+	close(release)
+	e.Close()
+	close(sending)
+
+	if got := rec.get(); len(got) != 2 {
+		t.Errorf("expected 2 notifications, got %d", len(got))
+	}
+}
+
+func TestErrorManagerNotify(t *testing.T) {
+	t.Parallel()
+
+	rec := &notificationRecorder{}
+	notifier := NewErrorNotifier(zap.NewNop(), NewNotifyOptions(), rec)
+
+	m := NewErrorManager(&mockRender{}, "")
+	m.Add(NewError(ErrForbidden, http.StatusForbidden, "", "errors/403", nil))
+	m.SetNotifier(notifier)
+
+	router := chi.NewRouter()
+	router.Use(chimiddleware.RequestID)
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), CTXKeyLogger, zap.NewNop())))
+		})
+	})
+	router.Get("/posts/{id}", m.Errors(func(w http.ResponseWriter, r *http.Request) error {
+		if chi.URLParam(r, "id") == "1" {
+			return ErrForbidden
+		}
+		return errors.Wrapf(errors.New("connection refused"), "loading post %s", chi.URLParam(r, "id"))
+	}))
+
+	for _, id := range []string{"1", "2", "3"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/posts/"+id, nil))
+	}
+	notifier.Close()
+
+	got := rec.get()
+	if len(got) != 1 {
+		t.Fatalf("expected a single notification for the 500s, got %#v", got)
+	}
+	n := got[0]
+	if n.Panic || n.Status != 500 || n.Error != "loading post 2: connection refused" ||
+		n.Route != "/posts/{id}" || n.Method != "GET" || n.URI != "/posts/2" || len(n.RequestID) == 0 {
+		t.Errorf("unexpected notification: %#v", n)
+	}
+	if !strings.Contains(n.Stack, "TestErrorManagerNotify") {
+		t.Errorf("expected the stack of the error, got:\n%s", n.Stack)
+	}
+}
+
+func TestZapRecoverNotify(t *testing.T) {
+	t.Parallel()
+
+	rec := &notificationRecorder{}
+	notifier := NewErrorNotifier(zap.NewNop(), NewNotifyOptions(), rec)
+
+	recoverer := ZapRecoverNotify(zap.NewNop(), func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}, notifier)
+	h := recoverer.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("nil map")
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/posts", nil))
+	notifier.Close()
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", w.Code)
+	}
+	got := rec.get()
+	if len(got) != 1 {
+		t.Fatalf("expected a notification, got %#v", got)
+	}
+	if n := got[0]; !n.Panic || n.Error != "nil map" || !strings.Contains(n.Stack, "TestZapRecoverNotify") {
+		t.Errorf("unexpected notification: %#v", n)
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	t.Parallel()
+
+	received := make(chan Notification, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("expected json, got %q", ct)
+		}
+		var n Notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Error(err)
+		}
+		received <- n
+		if n.Status == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	notifier := NewWebhookNotifier(server.URL, nil)
+	if err := notifier.Notify(context.Background(), Notification{Fingerprint: "abc", Status: 500}); err != nil {
+		t.Fatal(err)
+	}
+	if n := <-received; n.Fingerprint != "abc" {
+		t.Errorf("expected the notification to be posted, got %#v", n)
+	}
+
+	if err := notifier.Notify(context.Background(), Notification{}); err == nil {
+		t.Error("expected an error for a 400 response")
+	}
+	<-received
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// A stand-in SMTP server that accepts a single email
+	type email struct {
+		from, to, data string
+	}
+	received := make(chan email, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		tp := textproto.NewConn(conn)
+		var e email
+		_ = tp.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+			case "EHLO", "HELO":
+				_ = tp.PrintfLine("250 localhost")
+			case "MAIL":
+				e.from = line
+				_ = tp.PrintfLine("250 OK")
+			case "RCPT":
+				e.to = line
+				_ = tp.PrintfLine("250 OK")
+			case "DATA":
+				_ = tp.PrintfLine("354 go ahead")
+				data, err := tp.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				e.data = string(data)
+				_ = tp.PrintfLine("250 OK")
+			case "QUIT":
+				_ = tp.PrintfLine("221 bye")
+				received <- e
+				return
+			default:
+				_ = tp.PrintfLine("502 %s not implemented", cmd)
+			}
+		}
+	}()
+
+	notifier := SMTPNotifier{
+		Addr: ln.Addr().String(),
+		From: "app@example.com",
+		To:   []string{"ops@example.com"},
+	}
+	n := Notification{
+		Panic:       true,
+		Error:       "nil map",
+		Status:      500,
+		Method:      "POST",
+		Route:       "/posts",
+		RequestID:   "host/abc-000001",
+		Fingerprint: "abc",
+		Stack:       "goroutine 1 [running]:\nmain.main()",
+		Time:        time.Now(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := notifier.Notify(ctx, n); err != nil {
+		t.Fatal(err)
+	}
+
+	e := <-received
+	if e.from != "MAIL FROM:<app@example.com>" || e.to != "RCPT TO:<ops@example.com>" {
+		t.Errorf("unexpected envelope: %q %q", e.from, e.to)
+	}
+
+	msg, err := textproto.NewReader(bufio.NewReader(strings.NewReader(e.data))).ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject := msg.Get("Subject"); subject != "[Panic] 500 POST /posts" {
+		t.Errorf("unexpected subject %q", subject)
+	}
+	for _, s := range []string{"nil map", "host/abc-000001", "main.main()"} {
+		if !strings.Contains(e.data, s) {
+			t.Errorf("expected the email to contain %q:\n%s", s, e.data)
+		}
+	}
+}
+
+func TestErrorManagerConcurrent(t *testing.T) {
+	t.Parallel()
+
+	m := NewErrorManager(&mockRender{}, "")
+	h := m.APIErrors(func(w http.ResponseWriter, r *http.Request) error { return ErrUnauthorized })
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			e := NewError(ErrUnauthorized, http.StatusUnauthorized, "", "errors/401", nil)
+			m.Add(e)
+			m.Remove(e)
+		}()
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", "/", nil)
+			h.ServeHTTP(httptest.NewRecorder(), r.WithContext(context.WithValue(r.Context(), CTXKeyLogger, zap.NewNop())))
+		}()
+	}
+	wg.Wait()
+
+	if len(m.errors) != 0 {
+		t.Errorf("expected every error to be removed, got %d", len(m.errors))
+	}
+}
@@ -0,0 +1,339 @@
+package abcmiddleware
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/friendsofgo/errors"
+	"github.com/volatiletech/abcweb/v5/abcsessions"
+	"go.uber.org/zap"
+)
+
+// ErrRateLimited is returned through the ErrorManager when a client made
+// more requests than the rate limit allows. The RateLimit middleware adds a
+// 429 error for it to the ErrorManager unless one has been added already.
+var ErrRateLimited = errors.New("too many requests")
+
+// RateLimitKeyFunc returns the key the requests of a client are counted
+// under
+type RateLimitKeyFunc func(w http.ResponseWriter, r *http.Request) (string, error)
+
+// RateLimitByIP counts requests by the IP address of the client. Behind a
+// proxy use the chi RealIP middleware first, so the address of the client
+// is used instead of the address of the proxy.
+func RateLimitByIP(w http.ResponseWriter, r *http.Request) (string, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return "ip:" + host, nil
+}
+
+// RateLimitBySession counts requests by session id, and by IP address for
+// clients without a session. Only sessions that exist in the overseer are
+// used, so clients can not escape the limit by making up session ids.
+func RateLimitBySession(overseer abcsessions.Overseer) RateLimitKeyFunc {
+	return func(w http.ResponseWriter, r *http.Request) (string, error) {
+		_, err := overseer.Get(w, r)
+		if abcsessions.IsNoSessionError(err) {
+			return RateLimitByIP(w, r)
+		} else if err != nil {
+			return "", errors.Wrap(err, "unable to get session")
+		}
+
+		id, err := overseer.SessionID(w, r)
+		if err != nil {
+			return "", errors.Wrap(err, "unable to get session id")
+		}
+
+		return "session:" + id, nil
+	}
+}
+
+// RateLimitByUser counts requests by the id of the authenticated user
+// returned by userID, and by IP address when it returns an empty string
+func RateLimitByUser(userID func(r *http.Request) string) RateLimitKeyFunc {
+	return func(w http.ResponseWriter, r *http.Request) (string, error) {
+		if id := userID(r); len(id) != 0 {
+			return "user:" + id, nil
+		}
+
+		return RateLimitByIP(w, r)
+	}
+}
+
+// RateLimitResult is the result of counting a request against a limit
+type RateLimitResult struct {
+	// Allowed is true if the request is within the limit
+	Allowed bool
+	// Limit is the number of requests allowed per window
+	Limit int
+	// Remaining is the number of requests still allowed
+	Remaining int
+	// Reset is the time until the current window ends
+	Reset time.Duration
+	// RetryAfter is the time until a request is allowed again, it is only
+	// set when the request was not allowed
+	RetryAfter time.Duration
+}
+
+// RateLimitStore counts requests with a sliding window. The requests of
+// each key are counted in fixed windows, and the count of the previous
+// window is weighed by how much of it still overlaps the sliding window.
+type RateLimitStore interface {
+	// Take counts a request for key if it is within limit requests per
+	// window, and returns the result
+	Take(ctx context.Context, key string, limit int, window time.Duration) (RateLimitResult, error)
+}
+
+// slidingWindow returns the result of a request given the counts of the
+// previous and current fixed windows and the time elapsed in the current one
+func slidingWindow(limit int, window, elapsed time.Duration, prev, curr int) RateLimitResult {
+	weight := 1 - float64(elapsed)/float64(window)
+	count := int(float64(prev)*weight) + curr
+
+	res := RateLimitResult{
+		Limit: limit,
+		Reset: window - elapsed,
+	}
+	if count < limit {
+		res.Allowed = true
+		res.Remaining = limit - count - 1
+		return res
+	}
+
+	if curr < limit {
+		// wait until the previous window overlaps the sliding window
+		// little enough
+		res.RetryAfter = time.Duration(float64(window)*(1-float64(limit-curr)/float64(prev))) - elapsed
+	} else {
+		// wait until the current window has become the previous one and
+		// overlaps the sliding window little enough
+		res.RetryAfter = window - elapsed + time.Duration(float64(window)*(1-float64(limit)/float64(curr)))
+	}
+
+	return res
+}
+
+// fixedWindow returns the index of the fixed window now is in and the time
+// elapsed in it
+func fixedWindow(now time.Time, window time.Duration) (int64, time.Duration) {
+	nanos := now.UnixNano()
+	return nanos / int64(window), time.Duration(nanos % int64(window))
+}
+
+// MemoryRateLimitStore counts requests in memory, so every instance of the
+// app has its own counts
+type MemoryRateLimitStore struct {
+	mut       sync.Mutex
+	counts    map[string]*rateLimitCount
+	lastPrune time.Time
+
+	now func() time.Time
+}
+
+type rateLimitCount struct {
+	// window is the duration of the windows the requests are counted in,
+	// and idx the index of the current one
+	window time.Duration
+	idx    int64
+	prev   int
+	curr   int
+}
+
+// NewMemoryRateLimitStore creates a MemoryRateLimitStore
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		counts: make(map[string]*rateLimitCount),
+		now:    time.Now,
+	}
+}
+
+// Take counts a request for key if it is within limit requests per window
+func (m *MemoryRateLimitStore) Take(ctx context.Context, key string, limit int, window time.Duration) (RateLimitResult, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	now := m.now()
+	idx, elapsed := fixedWindow(now, window)
+	m.prune(now, window)
+
+	c, ok := m.counts[key]
+	if !ok || c.window != window {
+		c = &rateLimitCount{window: window, idx: idx}
+		m.counts[key] = c
+	}
+	switch c.idx {
+	case idx:
+	case idx - 1:
+		c.idx, c.prev, c.curr = idx, c.curr, 0
+	default:
+		c.idx, c.prev, c.curr = idx, 0, 0
+	}
+
+	res := slidingWindow(limit, window, elapsed, c.prev, c.curr)
+	if res.Allowed {
+		c.curr++
+	}
+
+	return res, nil
+}
+
+// prune deletes the counts that no longer overlap their sliding window, at
+// most once per window of the request that prunes. Each count is checked
+// against its own window, as keys with different prefixes can be counted
+// in windows of different durations.
+func (m *MemoryRateLimitStore) prune(now time.Time, window time.Duration) {
+	if now.Sub(m.lastPrune) < window {
+		return
+	}
+	m.lastPrune = now
+
+	for key, c := range m.counts {
+		if idx, _ := fixedWindow(now, c.window); c.idx < idx-1 {
+			delete(m.counts, key)
+		}
+	}
+}
+
+// RateLimitOptions configures the RateLimit middleware
+type RateLimitOptions struct {
+	// Limit is the number of requests a client may make per Window,
+	// defaults to 60
+	Limit int
+	// Window defaults to a minute
+	Window time.Duration
+	// Key returns the key requests are counted under, defaults to
+	// RateLimitByIP
+	Key RateLimitKeyFunc
+	// Store counts the requests, defaults to a MemoryRateLimitStore
+	Store RateLimitStore
+	// Prefix is put in front of every key, so rate limiters with different
+	// limits can share a store, such as "login:"
+	Prefix string
+}
+
+// NewRateLimitOptions gives healthy defaults for the RateLimit middleware
+func NewRateLimitOptions() RateLimitOptions {
+	return RateLimitOptions{
+		Limit:  60,
+		Window: time.Minute,
+		Key:    RateLimitByIP,
+		Store:  NewMemoryRateLimitStore(),
+	}
+}
+
+// Validate returns an error if the options are missing a field
+func (o RateLimitOptions) Validate() error {
+	if o.Limit <= 0 {
+		return errors.New("rate limit must be greater than zero")
+	}
+	if o.Window <= 0 {
+		return errors.New("rate limit window must be greater than zero")
+	}
+	if o.Key == nil {
+		return errors.New("rate limit key func must be provided")
+	}
+	if o.Store == nil {
+		return errors.New("rate limit store must be provided")
+	}
+
+	return nil
+}
+
+// RateLimit returns a middleware that allows each client Limit requests per
+// Window, counted with a sliding window. Every response gets the
+// RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers, and
+// requests over the limit get a Retry-After header and ErrRateLimited is
+// passed to the error manager.
+//
+// If the store fails the error is logged and the request is let through,
+// so a Redis outage does not take the app down with it.
+//
+// The middleware must come after the request id logger the error manager
+// logs with, and after the abcsessions middleware when counting by session.
+// Use it on the routes to protect, such as a login form:
+//
+//	opts := abcmiddleware.NewRateLimitOptions()
+//	opts.Limit = 5
+//	router.With(abcmiddleware.RateLimit(opts, errMgr).Wrap).Post("/login", login)
+func RateLimit(opts RateLimitOptions, errMgr *ErrorManager) MW {
+	if err := opts.Validate(); err != nil {
+		panic(err)
+	}
+
+	if _, found := errMgr.find(ErrRateLimited); !found {
+		errMgr.Add(NewError(ErrRateLimited, http.StatusTooManyRequests, errMgr.errLayout, "errors/429", nil))
+	}
+
+	return rateLimitMiddleware{
+		opts:   opts,
+		errMgr: errMgr,
+	}
+}
+
+type rateLimitMiddleware struct {
+	opts   RateLimitOptions
+	errMgr *ErrorManager
+}
+
+func (l rateLimitMiddleware) Wrap(next http.Handler) http.Handler {
+	return rateLimiter{
+		rateLimitMiddleware: l,
+		next:                next,
+	}
+}
+
+type rateLimiter struct {
+	rateLimitMiddleware
+	next http.Handler
+}
+
+func (l rateLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key, err := l.opts.Key(w, r)
+	if err != nil {
+		l.errMgr.Errors(func(w http.ResponseWriter, r *http.Request) error {
+			return errors.Wrap(err, "unable to get rate limit key")
+		})(w, r)
+		return
+	}
+
+	res, err := l.opts.Store.Take(r.Context(), l.opts.Prefix+key, l.opts.Limit, l.opts.Window)
+	if err != nil {
+		Logger(r).Error("unable to rate limit request", zap.String("key", key), zap.Error(err))
+		l.next.ServeHTTP(w, r)
+		return
+	}
+
+	header := w.Header()
+	header.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+
+	if !res.Allowed {
+		header.Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+		l.errMgr.Errors(func(w http.ResponseWriter, r *http.Request) error {
+			return ErrRateLimited
+		})(w, r)
+		return
+	}
+
+	l.next.ServeHTTP(w, r)
+}
+
+// ceilSeconds rounds d up to whole seconds, and to at least one second so
+// clients do not retry right away
+func ceilSeconds(d time.Duration) int {
+	seconds := int(math.Ceil(d.Seconds()))
+	if seconds < 1 {
+		return 1
+	}
+
+	return seconds
+}
@@ -0,0 +1,78 @@
+package abcmiddleware
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/friendsofgo/errors"
+	redis "gopkg.in/redis.v5"
+)
+
+// redisRateLimitScript reads the counts of the current and previous windows
+// and counts the request if the sliding window count is within the limit,
+// in one step so concurrent requests of a client are counted correctly.
+// It returns the counts before the request.
+var redisRateLimitScript = redis.NewScript(`
+local curr = tonumber(redis.call('GET', KEYS[1]) or '0')
+local prev = tonumber(redis.call('GET', KEYS[2]) or '0')
+if math.floor(prev * tonumber(ARGV[1])) + curr < tonumber(ARGV[2]) then
+	redis.call('INCR', KEYS[1])
+	redis.call('PEXPIRE', KEYS[1], ARGV[3])
+end
+return {prev, curr}
+`)
+
+// RedisRateLimitStore counts requests in Redis, so the instances of the app
+// share the counts
+type RedisRateLimitStore struct {
+	// prefix is put in front of every key written to Redis
+	prefix string
+	client *redis.Client
+
+	now func() time.Time
+}
+
+// NewRedisRateLimitStore creates a RedisRateLimitStore. The prefix is put in
+// front of every key it writes, such as "ratelimit:", so the counts can
+// share a database with other data.
+func NewRedisRateLimitStore(opts redis.Options, prefix string) *RedisRateLimitStore {
+	return &RedisRateLimitStore{
+		prefix: prefix,
+		client: redis.NewClient(&opts),
+		now:    time.Now,
+	}
+}
+
+// Take counts a request for key if it is within limit requests per window.
+// The redis client does not support contexts, use the timeouts of the
+// redis options instead.
+func (s *RedisRateLimitStore) Take(ctx context.Context, key string, limit int, window time.Duration) (RateLimitResult, error) {
+	if err := ctx.Err(); err != nil {
+		return RateLimitResult{}, err
+	}
+
+	idx, elapsed := fixedWindow(s.now(), window)
+	keys := []string{
+		s.prefix + key + ":" + strconv.FormatInt(idx, 10),
+		s.prefix + key + ":" + strconv.FormatInt(idx-1, 10),
+	}
+	weight := 1 - float64(elapsed)/float64(window)
+	// the count of the current window is kept until it stops overlapping
+	// the sliding window as the previous one
+	expiry := int64(2 * window / time.Millisecond)
+
+	res, err := redisRateLimitScript.Run(s.client, keys, weight, limit, expiry).Result()
+	if err != nil {
+		return RateLimitResult{}, errors.Wrap(err, "unable to run rate limit script")
+	}
+
+	counts, ok := res.([]interface{})
+	if !ok || len(counts) != 2 {
+		return RateLimitResult{}, errors.Errorf("unexpected rate limit script result %v", res)
+	}
+	prev, _ := counts[0].(int64)
+	curr, _ := counts[1].(int64)
+
+	return slidingWindow(limit, window, elapsed, int(prev), int(curr)), nil
+}
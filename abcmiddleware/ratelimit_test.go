@@ -0,0 +1,284 @@
+package abcmiddleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/friendsofgo/errors"
+	"github.com/volatiletech/abcweb/v5/abcsessions"
+	"go.uber.org/zap"
+	redis "gopkg.in/redis.v5"
+)
+
+func TestSlidingWindow(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		elapsed    time.Duration
+		prev, curr int
+		allowed    bool
+		remaining  int
+		retryAfter time.Duration
+	}{
+		{elapsed: 0, prev: 0, curr: 0, allowed: true, remaining: 9},
+		{elapsed: 15 * time.Second, prev: 0, curr: 9, allowed: true, remaining: 0},
+		{elapsed: 15 * time.Second, prev: 0, curr: 10, retryAfter: 45 * time.Second},
+		// 10 * 0.5 + 4 = 9
+		{elapsed: 30 * time.Second, prev: 10, curr: 4, allowed: true, remaining: 0},
+		// 10 * 0.5 + 6 = 11, wait until 10 * 0.4 + 6 < 10
+		{elapsed: 30 * time.Second, prev: 10, curr: 6, retryAfter: 6 * time.Second},
+		// 20 * 0.5 + 1 = 11, wait until 20 * 0.45 + 1 < 10
+		{elapsed: 30 * time.Second, prev: 20, curr: 1, retryAfter: 3 * time.Second},
+		// over the limit in the current window, wait for the next window
+		// and until 20 * 0.5 < 10
+		{elapsed: 50 * time.Second, prev: 0, curr: 20, retryAfter: 40 * time.Second},
+	}
+
+	for i, test := range tests {
+		res := slidingWindow(10, time.Minute, test.elapsed, test.prev, test.curr)
+		if res.Allowed != test.allowed || res.Remaining != test.remaining || res.RetryAfter.Round(time.Millisecond) != test.retryAfter {
+			t.Errorf("%d) expected allowed %t, remaining %d, retry after %s, got %#v", i,
+				test.allowed, test.remaining, test.retryAfter, res)
+		}
+		if res.Limit != 10 || res.Reset != time.Minute-test.elapsed {
+			t.Errorf("%d) expected limit 10 and reset %s, got %#v", i, time.Minute-test.elapsed, res)
+		}
+	}
+}
+
+// testRateLimitStore takes requests at the times of a limit of 2 per minute
+// and checks which are allowed
+func testRateLimitStore(t *testing.T, store RateLimitStore, now *time.Time) {
+	t.Helper()
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	takes := []struct {
+		key     string
+		at      time.Duration
+		allowed bool
+	}{
+		{"a", 0, true},
+		{"a", 10 * time.Second, true},
+		{"a", 20 * time.Second, false},
+		{"b", 20 * time.Second, true},
+		// 2 * 0.5 + 0
+		{"a", 90 * time.Second, true},
+		// 2 * 0.5 + 1
+		{"a", 90 * time.Second, false},
+		// the previous window no longer overlaps
+		{"a", 180 * time.Second, true},
+		{"a", 180 * time.Second, true},
+		{"a", 180 * time.Second, false},
+	}
+
+	for i, take := range takes {
+		*now = start.Add(take.at)
+		res, err := store.Take(context.Background(), take.key, 2, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Allowed != take.allowed {
+			t.Errorf("%d) expected allowed to be %t, got %#v", i, take.allowed, res)
+		}
+	}
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	t.Parallel()
+
+	var now time.Time
+	store := NewMemoryRateLimitStore()
+	store.now = func() time.Time { return now }
+
+	testRateLimitStore(t, store, &now)
+
+	if len(store.counts) != 1 {
+		t.Errorf("expected the count of b to be pruned, got %d counts", len(store.counts))
+	}
+}
+
+func TestMemoryRateLimitStorePruneWindows(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewMemoryRateLimitStore()
+	store.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	if _, err := store.Take(ctx, "login:a", 5, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Take(ctx, "api:a", 5, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second windows of api:a are over, the hour of login:a is not
+	now = now.Add(3 * time.Second)
+	if _, err := store.Take(ctx, "api:b", 5, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := store.counts["api:a"]; ok {
+		t.Error("expected the count of api:a to be pruned")
+	}
+	if c, ok := store.counts["login:a"]; !ok || c.curr != 1 {
+		t.Errorf("expected the count of login:a to be kept, got %#v", c)
+	}
+}
+
+func TestRedisRateLimitStore(t *testing.T) {
+	t.Parallel()
+
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	var now time.Time
+	store := NewRedisRateLimitStore(redis.Options{Addr: mr.Addr()}, "ratelimit:")
+	store.now = func() time.Time { return now }
+
+	testRateLimitStore(t, store, &now)
+
+	if ttl := mr.TTL("ratelimit:a:" + "26297280"); ttl != 2*time.Minute {
+		t.Errorf("expected the count to expire after two windows, got %s", ttl)
+	}
+}
+
+type failingRateLimitStore struct{}
+
+func (failingRateLimitStore) Take(ctx context.Context, key string, limit int, window time.Duration) (RateLimitResult, error) {
+	return RateLimitResult{}, errors.New("connection refused")
+}
+
+func TestRateLimit(t *testing.T) {
+	t.Parallel()
+
+	rndr := &mockRender{}
+	m := NewErrorManager(rndr, "layouts/errors")
+
+	opts := NewRateLimitOptions()
+	opts.Limit = 1
+	h := RateLimit(opts, m).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/login", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), CTXKeyLogger, zap.NewNop())))
+		return w
+	}
+
+	w := request("10.0.0.1:1234")
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected the first request to be allowed, got %d", w.Code)
+	}
+	if w.Header().Get("RateLimit-Limit") != "1" || w.Header().Get("RateLimit-Remaining") != "0" || len(w.Header().Get("RateLimit-Reset")) == 0 {
+		t.Errorf("expected rate limit headers, got %v", w.Header())
+	}
+
+	w = request("10.0.0.1:5678")
+	if rndr.status != http.StatusTooManyRequests || rndr.name != "errors/429" || rndr.layout != "layouts/errors" {
+		t.Errorf("expected the 429 error to be rendered, got %d %q %q", rndr.status, rndr.name, rndr.layout)
+	}
+	if len(w.Header().Get("Retry-After")) == 0 {
+		t.Error("expected a Retry-After header")
+	}
+
+	if w = request("10.0.0.2:1234"); w.Code != http.StatusNoContent {
+		t.Errorf("expected another client to be allowed, got %d", w.Code)
+	}
+
+	// Requests are let through when the store fails
+	opts.Store = failingRateLimitStore{}
+	h = RateLimit(opts, m).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	if w = request("10.0.0.1:1234"); w.Code != http.StatusNoContent {
+		t.Errorf("expected the request to be let through, got %d", w.Code)
+	}
+
+	if len(m.errors) != 1 {
+		t.Errorf("expected a single error to be added, got %d", len(m.errors))
+	}
+}
+
+func TestRateLimitKeys(t *testing.T) {
+	t.Parallel()
+
+	mem, err := abcsessions.NewDefaultMemoryStorer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	overseer := abcsessions.NewStorageOverseer(abcsessions.NewCookieOptions(), mem)
+	if err := mem.Set("sessid", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	bySession := RateLimitBySession(overseer)
+	byUser := RateLimitByUser(func(r *http.Request) string { return r.Header.Get("X-User") })
+
+	tests := []struct {
+		name    string
+		keyFunc RateLimitKeyFunc
+		cookie  string
+		user    string
+		key     string
+	}{
+		{name: "ip", keyFunc: RateLimitByIP, key: "ip:192.0.2.1"},
+		{name: "session", keyFunc: bySession, cookie: "sessid", key: "session:sessid"},
+		{name: "no session", keyFunc: bySession, key: "ip:192.0.2.1"},
+		{name: "unknown session", keyFunc: bySession, cookie: "madeup", key: "ip:192.0.2.1"},
+		{name: "user", keyFunc: byUser, user: "bob", key: "user:bob"},
+		{name: "no user", keyFunc: byUser, key: "ip:192.0.2.1"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if len(test.cookie) != 0 {
+			r.AddCookie(&http.Cookie{Name: abcsessions.NewCookieOptions().Name, Value: test.cookie})
+		}
+		if len(test.user) != 0 {
+			r.Header.Set("X-User", test.user)
+		}
+
+		var key string
+		var err error
+		abcsessions.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, err = test.keyFunc(w, r)
+		})).ServeHTTP(httptest.NewRecorder(), r)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if key != test.key {
+			t.Errorf("%s: expected key %q, got %q", test.name, test.key, key)
+		}
+	}
+}
+
+func TestRateLimitOptionsValidate(t *testing.T) {
+	t.Parallel()
+
+	if err := NewRateLimitOptions().Validate(); err != nil {
+		t.Error(err)
+	}
+
+	opts := NewRateLimitOptions()
+	opts.Limit = 0
+	if err := opts.Validate(); err == nil {
+		t.Error("expected an error for a zero limit")
+	}
+
+	opts = NewRateLimitOptions()
+	opts.Store = nil
+	if err := opts.Validate(); err == nil {
+		t.Error("expected an error for a missing store")
+	}
+}
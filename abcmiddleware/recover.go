@@ -3,6 +3,7 @@ package abcmiddleware
 import (
 	"fmt"
 	"net/http"
+	"runtime/debug"
 
 	"go.uber.org/zap"
 )
@@ -16,15 +17,23 @@ import (
 // The zap logger that's used here should be careful to enable stacktrace
 // logging for any levels that they require it for.
 func ZapRecover(fallback *zap.Logger, errorHandler http.HandlerFunc) MW {
+	return ZapRecoverNotify(fallback, errorHandler, nil)
+}
+
+// ZapRecoverNotify is ZapRecover that also notifies the ErrorNotifier of
+// the panics it recovers, with the stack of the panicking goroutine.
+func ZapRecoverNotify(fallback *zap.Logger, errorHandler http.HandlerFunc, notifier *ErrorNotifier) MW {
 	return zapRecoverMiddleware{
 		fallback: fallback,
 		eh:       errorHandler,
+		notifier: notifier,
 	}
 }
 
 type zapRecoverMiddleware struct {
 	fallback *zap.Logger
 	eh       http.HandlerFunc
+	notifier *ErrorNotifier
 }
 
 func (z zapRecoverMiddleware) Wrap(next http.Handler) http.Handler {
@@ -51,6 +60,10 @@ func (z zapRecoverer) recoverNicely(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if z.zr.notifier != nil {
+		z.zr.notifier.notifyPanic(r, err, debug.Stack())
+	}
+
 	var protocol string
 	if r.TLS == nil {
 		protocol = "http"
@@ -0,0 +1,171 @@
+package abcmiddleware
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/volatiletech/abcweb/v5/abcrender"
+)
+
+// CSPNoncePlaceholder is replaced with the nonce of the request in the
+// Content-Security-Policy of SecurityHeadersOptions
+const CSPNoncePlaceholder = "{nonce}"
+
+// cspNonceLen is the length of the random CSP nonce in bytes
+const cspNonceLen = 16
+
+// SecurityHeadersOptions configures the SecurityHeaders middleware. Headers
+// with an empty value are not set.
+type SecurityHeadersOptions struct {
+	// HSTSMaxAge is how long browsers must only use https for the site
+	// after they visited it over TLS, 0 leaves out the
+	// Strict-Transport-Security header. Defaults to a year.
+	HSTSMaxAge time.Duration
+	// HSTSIncludeSubdomains applies HSTS to every subdomain
+	HSTSIncludeSubdomains bool
+	// HSTSPreload allows the site to be put in the HSTS preload lists of
+	// browsers, see https://hstspreload.org before setting it
+	HSTSPreload bool
+
+	// ContentTypeNosniff sets X-Content-Type-Options to "nosniff",
+	// defaults to true
+	ContentTypeNosniff bool
+	// FrameOptions is the X-Frame-Options header, defaults to "DENY"
+	FrameOptions string
+	// ReferrerPolicy is the Referrer-Policy header, defaults to
+	// "strict-origin-when-cross-origin"
+	ReferrerPolicy string
+
+	// ContentSecurityPolicy is the Content-Security-Policy header. Every
+	// CSPNoncePlaceholder in it is replaced with a random nonce made for
+	// each request, which inline scripts and styles must have to run.
+	ContentSecurityPolicy string
+	// CSPReportOnly sends the policy in the
+	// Content-Security-Policy-Report-Only header instead, so browsers
+	// report violations but do not block anything. Use it to try out a
+	// policy before enforcing it.
+	CSPReportOnly bool
+	// CSPReportURI is added to the policy as the report-uri directive
+	// browsers send violation reports to
+	CSPReportURI string
+}
+
+// NewSecurityHeadersOptions gives healthy defaults for the SecurityHeaders
+// middleware. The Content-Security-Policy only allows resources from the
+// site itself, and inline scripts with the nonce of the request.
+func NewSecurityHeadersOptions() SecurityHeadersOptions {
+	return SecurityHeadersOptions{
+		HSTSMaxAge:         365 * 24 * time.Hour,
+		ContentTypeNosniff: true,
+		FrameOptions:       "DENY",
+		ReferrerPolicy:     "strict-origin-when-cross-origin",
+		ContentSecurityPolicy: "default-src 'self'; " +
+			"script-src 'self' 'nonce-" + CSPNoncePlaceholder + "'; " +
+			"style-src 'self' 'unsafe-inline'; " +
+			"img-src 'self' data:; " +
+			"object-src 'none'; " +
+			"base-uri 'self'; " +
+			"frame-ancestors 'none'",
+	}
+}
+
+// SecurityHeaders returns a middleware that sets the HSTS,
+// X-Content-Type-Options, X-Frame-Options, Referrer-Policy and
+// Content-Security-Policy headers of every response.
+//
+// Strict-Transport-Security is only sent on requests made over TLS, as
+// browsers ignore it over plain http.
+//
+// The Content-Security-Policy nonce of the request is put in the request
+// context, use the cspNonce abcrender helper to add it to your inline
+// scripts, or CSPNonce in controllers.
+func SecurityHeaders(opts SecurityHeadersOptions) MW {
+	return securityHeadersMiddleware{
+		opts: opts,
+		hsts: opts.hsts(),
+	}
+}
+
+// CSPNonce returns the Content-Security-Policy nonce of the request, or an
+// empty string if the SecurityHeaders middleware did not make one
+func CSPNonce(r *http.Request) string {
+	return abcrender.CSPNonce(r.Context())
+}
+
+// hsts returns the Strict-Transport-Security header value
+func (o SecurityHeadersOptions) hsts() string {
+	if o.HSTSMaxAge <= 0 {
+		return ""
+	}
+
+	hsts := "max-age=" + strconv.FormatInt(int64(o.HSTSMaxAge/time.Second), 10)
+	if o.HSTSIncludeSubdomains {
+		hsts += "; includeSubDomains"
+	}
+	if o.HSTSPreload {
+		hsts += "; preload"
+	}
+
+	return hsts
+}
+
+type securityHeadersMiddleware struct {
+	opts SecurityHeadersOptions
+	hsts string
+}
+
+func (s securityHeadersMiddleware) Wrap(next http.Handler) http.Handler {
+	return securityHeadersHandler{
+		securityHeadersMiddleware: s,
+		next:                      next,
+	}
+}
+
+type securityHeadersHandler struct {
+	securityHeadersMiddleware
+	next http.Handler
+}
+
+func (s securityHeadersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	header := w.Header()
+
+	if len(s.hsts) != 0 && r.TLS != nil {
+		header.Set("Strict-Transport-Security", s.hsts)
+	}
+	if s.opts.ContentTypeNosniff {
+		header.Set("X-Content-Type-Options", "nosniff")
+	}
+	if len(s.opts.FrameOptions) != 0 {
+		header.Set("X-Frame-Options", s.opts.FrameOptions)
+	}
+	if len(s.opts.ReferrerPolicy) != 0 {
+		header.Set("Referrer-Policy", s.opts.ReferrerPolicy)
+	}
+
+	if len(s.opts.ContentSecurityPolicy) != 0 {
+		nonce := make([]byte, cspNonceLen)
+		if _, err := rand.Read(nonce); err != nil {
+			panic(err)
+		}
+		encoded := base64.StdEncoding.EncodeToString(nonce)
+
+		policy := strings.Replace(s.opts.ContentSecurityPolicy, CSPNoncePlaceholder, encoded, -1)
+		if len(s.opts.CSPReportURI) != 0 {
+			policy += "; report-uri " + s.opts.CSPReportURI
+		}
+
+		if s.opts.CSPReportOnly {
+			header.Set("Content-Security-Policy-Report-Only", policy)
+		} else {
+			header.Set("Content-Security-Policy", policy)
+		}
+
+		r = r.WithContext(abcrender.WithCSPNonce(r.Context(), encoded))
+	}
+
+	s.next.ServeHTTP(w, r)
+}
@@ -0,0 +1,107 @@
+package abcmiddleware
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	t.Parallel()
+
+	var nonce string
+	h := SecurityHeaders(NewSecurityHeadersOptions()).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce = CSPNonce(r)
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	expected := map[string]string{
+		"Strict-Transport-Security": "",
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "DENY",
+		"Referrer-Policy":           "strict-origin-when-cross-origin",
+	}
+	for name, value := range expected {
+		if got := w.Header().Get(name); got != value {
+			t.Errorf("expected %s to be %q, got %q", name, value, got)
+		}
+	}
+
+	if len(nonce) == 0 {
+		t.Fatal("expected a nonce in the request context")
+	}
+	csp := w.Header().Get("Content-Security-Policy")
+	if !strings.Contains(csp, "script-src 'self' 'nonce-"+nonce+"'") {
+		t.Errorf("expected the nonce in the policy, got %q", csp)
+	}
+
+	first := nonce
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if nonce == first {
+		t.Error("expected a new nonce for every request")
+	}
+}
+
+func TestSecurityHeadersHSTS(t *testing.T) {
+	t.Parallel()
+
+	opts := NewSecurityHeadersOptions()
+	opts.HSTSMaxAge = 2 * time.Hour
+	opts.HSTSIncludeSubdomains = true
+	opts.HSTSPreload = true
+	h := SecurityHeaders(opts).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	r := httptest.NewRequest("GET", "https://example.com/", nil)
+	r.TLS = &tls.ConnectionState{}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if got := w.Header().Get("Strict-Transport-Security"); got != "max-age=7200; includeSubDomains; preload" {
+		t.Errorf("unexpected HSTS header %q", got)
+	}
+
+	opts.HSTSMaxAge = 0
+	h = SecurityHeaders(opts).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if got := w.Header().Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("expected no HSTS header, got %q", got)
+	}
+}
+
+func TestSecurityHeadersReportOnly(t *testing.T) {
+	t.Parallel()
+
+	opts := SecurityHeadersOptions{
+		ContentSecurityPolicy: "script-src 'nonce-{nonce}'",
+		CSPReportOnly:         true,
+		CSPReportURI:          "/csp-reports",
+	}
+
+	var nonce string
+	h := SecurityHeaders(opts).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce = CSPNonce(r)
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if got := w.Header().Get("Content-Security-Policy"); got != "" {
+		t.Errorf("expected no enforced policy, got %q", got)
+	}
+	expected := "script-src 'nonce-" + nonce + "'; report-uri /csp-reports"
+	if got := w.Header().Get("Content-Security-Policy-Report-Only"); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	for _, name := range []string{"X-Content-Type-Options", "X-Frame-Options", "Referrer-Policy"} {
+		if got := w.Header().Get(name); got != "" {
+			t.Errorf("expected no %s header, got %q", name, got)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package abcrender
+
+import (
+	"context"
+	"net/http"
+)
+
+type cspNonceCtxKey struct{}
+
+// WithCSPNonce returns a copy of ctx holding the Content-Security-Policy
+// nonce of the request, for the cspNonce template helper. It is called by
+// the abcmiddleware SecurityHeaders middleware.
+func WithCSPNonce(ctx context.Context, nonce string) context.Context {
+	return context.WithValue(ctx, cspNonceCtxKey{}, nonce)
+}
+
+// CSPNonce returns the Content-Security-Policy nonce of the request context,
+// or an empty string if the SecurityHeaders middleware did not run.
+func CSPNonce(ctx context.Context) string {
+	nonce, _ := ctx.Value(cspNonceCtxKey{}).(string)
+	return nonce
+}
+
+// cspNonceHelper returns the Content-Security-Policy nonce of the request,
+// to allow inline scripts and styles:
+//
+//	<script nonce="{{ cspNonce .Request }}">...</script>
+func cspNonceHelper(r *http.Request) (string, error) {
+	if r == nil {
+		return "", errNoRequest
+	}
+
+	return CSPNonce(r.Context()), nil
+}
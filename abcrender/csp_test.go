@@ -0,0 +1,24 @@
+package abcrender
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCSPNonceHelper(t *testing.T) {
+	t.Parallel()
+
+	if _, err := cspNonceHelper(nil); err != errNoRequest {
+		t.Errorf("expected an error without a request, got %v", err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	if got, err := cspNonceHelper(r); err != nil || got != "" {
+		t.Errorf("expected no nonce, got %q (%v)", got, err)
+	}
+
+	r = r.WithContext(WithCSPNonce(r.Context(), "abc"))
+	if got, err := cspNonceHelper(r); err != nil || got != "abc" {
+		t.Errorf("expected %q, got %q (%v)", "abc", got, err)
+	}
+}
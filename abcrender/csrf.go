@@ -0,0 +1,82 @@
+package abcrender
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+
+	"github.com/friendsofgo/errors"
+)
+
+// DefaultCSRFFieldName is the form field the CSRF token is sent in when
+// the CSRF middleware does not set another one
+const DefaultCSRFFieldName = "csrf_token"
+
+type csrfCtxKey struct{}
+
+// errNoRequest is returned by the CSRF and CSP template helpers when the
+// template was not rendered with the request, instead of panicking on a nil
+// request
+var errNoRequest = errors.New("template helper needs the request, put it in the template data")
+
+// csrfToken is the CSRF token of a request and the form field it is sent in
+type csrfToken struct {
+	token     func() (string, error)
+	fieldName string
+}
+
+// WithCSRFToken returns a copy of ctx holding the function returning the
+// CSRF token of the request and the form field it must be sent in, for the
+// csrfField and csrfToken template helpers. The token is only made when it
+// is first asked for, so pages without forms do not start a session. It is
+// called by the abcmiddleware CSRF middleware.
+func WithCSRFToken(ctx context.Context, token func() (string, error), fieldName string) context.Context {
+	return context.WithValue(ctx, csrfCtxKey{}, csrfToken{token: token, fieldName: fieldName})
+}
+
+// CSRFToken returns the CSRF token of the request context and the form field
+// it must be sent in, or empty strings if the CSRF middleware did not run.
+func CSRFToken(ctx context.Context) (token, fieldName string, err error) {
+	t, _ := ctx.Value(csrfCtxKey{}).(csrfToken)
+	if t.token == nil {
+		return "", "", nil
+	}
+
+	token, err = t.token()
+	return token, t.fieldName, err
+}
+
+// csrfTokenHelper returns the CSRF token of the request, for forms built in
+// javascript and the X-CSRF-Token header of ajax requests:
+//
+//	<meta name="csrf-token" content="{{ csrfToken .Request }}">
+func csrfTokenHelper(r *http.Request) (string, error) {
+	if r == nil {
+		return "", errNoRequest
+	}
+
+	token, _, err := CSRFToken(r.Context())
+	return token, err
+}
+
+// csrfFieldHelper returns a hidden form field holding the CSRF token of the
+// request, to be put in every form that is not sent with GET:
+//
+//	<form method="post">{{ csrfField .Request }}</form>
+func csrfFieldHelper(r *http.Request) (template.HTML, error) {
+	if r == nil {
+		return "", errNoRequest
+	}
+
+	token, fieldName, err := CSRFToken(r.Context())
+	if err != nil {
+		return "", err
+	}
+	if len(fieldName) == 0 {
+		fieldName = DefaultCSRFFieldName
+	}
+
+	return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`,
+		template.HTMLEscapeString(fieldName), template.HTMLEscapeString(token))), nil
+}
@@ -0,0 +1,42 @@
+package abcrender
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCSRFHelpers(t *testing.T) {
+	t.Parallel()
+
+	if _, err := csrfFieldHelper(nil); err != errNoRequest {
+		t.Errorf("expected an error without a request, got %v", err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	if got, err := csrfFieldHelper(r); err != nil || got != `<input type="hidden" name="csrf_token" value="">` {
+		t.Errorf("expected an empty field without a token, got %s (%v)", got, err)
+	}
+
+	calls := 0
+	token := func() (string, error) {
+		calls++
+		return `a"b`, nil
+	}
+	r = r.WithContext(WithCSRFToken(r.Context(), token, "token"))
+	if calls != 0 {
+		t.Error("expected the token to be made when it is asked for")
+	}
+	if got, err := csrfTokenHelper(r); err != nil || got != `a"b` {
+		t.Errorf("expected %q, got %q (%v)", `a"b`, got, err)
+	}
+	if got, err := csrfFieldHelper(r); err != nil || got != `<input type="hidden" name="token" value="a&#34;b">` {
+		t.Errorf("expected an escaped field, got %s (%v)", got, err)
+	}
+
+	failed := errors.New("no session")
+	r = r.WithContext(WithCSRFToken(r.Context(), func() (string, error) { return "", failed }, "token"))
+	if _, err := csrfFieldHelper(r); err != failed {
+		t.Errorf("expected the token error, got %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+package abcrender
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+
+	"github.com/volatiletech/abcweb/v5/abcsessions"
+)
+
+// flashAlertClasses maps the flash message levels to their twitter
+// bootstrap alert classes
+var flashAlertClasses = map[abcsessions.FlashLevel]string{
+	abcsessions.FlashError:   "alert-danger",
+	abcsessions.FlashWarning: "alert-warning",
+	abcsessions.FlashSuccess: "alert-success",
+	abcsessions.FlashInfo:    "alert-info",
+}
+
+// flashAlerts renders flash messages returned by abcsessions.DrainFlashes as
+// dismissible twitter bootstrap alerts:
+//
+//	{{ flashAlerts .Flashes }}
+func flashAlerts(flashes []abcsessions.FlashMessage) template.HTML {
+	buf := bytes.Buffer{}
+	for _, f := range flashes {
+		class, ok := flashAlertClasses[f.Level]
+		if !ok {
+			class = "alert-info"
+		}
+
+		buf.WriteString(fmt.Sprintf("<div class=\"alert %s alert-dismissible fade show\" role=\"alert\">\n", class))
+		buf.WriteString(template.HTMLEscapeString(f.Message))
+		buf.WriteString("\n<button type=\"button\" class=\"close\" data-dismiss=\"alert\" aria-label=\"Close\"><span aria-hidden=\"true\">&times;</span></button>\n</div>\n")
+	}
+
+	return template.HTML(buf.String())
+}
@@ -0,0 +1,32 @@
+package abcrender
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/volatiletech/abcweb/v5/abcsessions"
+)
+
+func TestFlashAlerts(t *testing.T) {
+	t.Parallel()
+
+	if got := flashAlerts(nil); len(got) != 0 {
+		t.Errorf("expected nothing for no flashes, got %s", got)
+	}
+
+	got := string(flashAlerts([]abcsessions.FlashMessage{
+		{Level: abcsessions.FlashError, Message: "<b>failed</b>"},
+		{Level: abcsessions.FlashSuccess, Message: "saved"},
+	}))
+
+	if strings.Count(got, `class="close" data-dismiss="alert"`) != 2 {
+		t.Errorf("expected two dismissible alerts, got %s", got)
+	}
+	if !strings.Contains(got, `class="alert alert-danger alert-dismissible fade show"`) ||
+		!strings.Contains(got, `class="alert alert-success alert-dismissible fade show"`) {
+		t.Errorf("expected the level classes, got %s", got)
+	}
+	if !strings.Contains(got, "&lt;b&gt;failed&lt;/b&gt;") {
+		t.Errorf("expected the message to be escaped, got %s", got)
+	}
+}
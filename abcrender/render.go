@@ -111,6 +111,19 @@ func AppHelpers(manifest map[string]string) template.FuncMap {
 
 		"joinPath": func(pieces ...string) string { return strings.Join(pieces, "/") },
 
+		// the CSRF token of the request set by the abcmiddleware CSRF
+		// middleware, on its own or in a hidden form field
+		"csrfToken": csrfTokenHelper,
+		"csrfField": csrfFieldHelper,
+
+		// the Content-Security-Policy nonce of the request set by the
+		// abcmiddleware SecurityHeaders middleware
+		"cspNonce": cspNonceHelper,
+
+		// render the flash messages of abcsessions.DrainFlashes as
+		// dismissible alerts
+		"flashAlerts": flashAlerts,
+
 		// return all javascript include tags for all twitter bootstrap js plugins
 		// for the default bootstrap install.
 		"jsBootstrap": jsBootstrap,
@@ -0,0 +1,804 @@
+package abcsessionstest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/volatiletech/abcweb/v5/abcsessions"
+)
+
+// ExpiryMaxAge is the maxAge the suite passes to the Factory when it needs
+// sessions to expire during a test. All other tests use a maxAge of one hour.
+const ExpiryMaxAge = time.Second
+
+// Factory creates a new empty Storer for a single test. Sessions must expire
+// maxAge after they were last set or had their expiry reset. Use t.Cleanup
+// to release any resources (folders, database connections) the storer needs.
+type Factory func(t *testing.T, maxAge time.Duration) abcsessions.Storer
+
+// cleaner is implemented by storers that delete expired sessions in a
+// separate step, such as the disk, memory and sql storers.
+type cleaner interface {
+	Clean()
+}
+
+// errCleaner is a cleaner that can fail
+type errCleaner interface {
+	Clean() error
+}
+
+// unwrapper is implemented by storers that wrap another storer, such as
+// the EncryptingStorer and CompressingStorer
+type unwrapper interface {
+	Unwrap() abcsessions.Storer
+}
+
+// wrapped returns the storer and every storer it wraps
+func wrapped(s abcsessions.Storer) []abcsessions.Storer {
+	storers := []abcsessions.Storer{s}
+	for {
+		u, ok := s.(unwrapper)
+		if !ok {
+			return storers
+		}
+		s = u.Unwrap()
+		storers = append(storers, s)
+	}
+}
+
+// RunStorerSuite runs the Storer conformance tests against the storers
+// created by factory. Run it with -race to check concurrent access.
+// The CASStorer, UserIndexStorer and TTLStorer tests are skipped for storers
+// that do not implement them.
+func RunStorerSuite(t *testing.T, factory Factory) {
+	t.Run("GetNoSession", func(t *testing.T) { testGetNoSession(t, factory) })
+	t.Run("SetGet", func(t *testing.T) { testSetGet(t, factory) })
+	t.Run("SetOverwrite", func(t *testing.T) { testSetOverwrite(t, factory) })
+	t.Run("Del", func(t *testing.T) { testDel(t, factory) })
+	t.Run("All", func(t *testing.T) { testAll(t, factory) })
+	t.Run("ResetExpiry", func(t *testing.T) { testResetExpiry(t, factory) })
+	t.Run("Expiry", func(t *testing.T) { testExpiry(t, factory) })
+	t.Run("ResetExpiryExtends", func(t *testing.T) { testResetExpiryExtends(t, factory) })
+	t.Run("Concurrent", func(t *testing.T) { testConcurrent(t, factory) })
+	t.Run("SetIfVersion", func(t *testing.T) { testSetIfVersion(t, factory) })
+	t.Run("ConcurrentSetIfVersion", func(t *testing.T) { testConcurrentSetIfVersion(t, factory) })
+	t.Run("SetMeta", func(t *testing.T) { testSetMeta(t, factory) })
+	t.Run("ListByUser", func(t *testing.T) { testListByUser(t, factory) })
+	t.Run("DeleteByUser", func(t *testing.T) { testDeleteByUser(t, factory) })
+	t.Run("TTL", func(t *testing.T) { testTTL(t, factory) })
+	t.Run("Context", func(t *testing.T) { testContext(t, factory) })
+}
+
+// newKey returns a UUIDv4 session key, the format all storers accept
+func newKey() string {
+	return uuid.NewV4().String()
+}
+
+// clean runs the clean step of the storer, and of the storers it wraps,
+// if they have one
+func clean(t *testing.T, s abcsessions.Storer) {
+	t.Helper()
+
+	for _, s := range wrapped(s) {
+		switch c := s.(type) {
+		case errCleaner:
+			if err := c.Clean(); err != nil {
+				t.Fatalf("clean failed: %v", err)
+			}
+		case cleaner:
+			c.Clean()
+		}
+	}
+}
+
+func testGetNoSession(t *testing.T, factory Factory) {
+	s := factory(t, time.Hour)
+
+	_, err := s.Get(newKey())
+	if !abcsessions.IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+}
+
+func testSetGet(t *testing.T, factory Factory) {
+	s := factory(t, time.Hour)
+
+	values := []string{
+		"hello",
+		`{"Value":{"user":"1"},"Flash":null}`,
+		"multi\nline\tvalue with ünïcødé",
+	}
+
+	for _, value := range values {
+		key := newKey()
+		if err := s.Set(key, value); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := s.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != value {
+			t.Errorf("expected %q, got %q", value, got)
+		}
+	}
+}
+
+func testSetOverwrite(t *testing.T, factory Factory) {
+	s := factory(t, time.Hour)
+
+	key1, key2 := newKey(), newKey()
+
+	if err := s.Set(key1, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(key1, "whatsup"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(key2, "friend"); err != nil {
+		t.Fatal(err)
+	}
+
+	if val, err := s.Get(key1); err != nil {
+		t.Error(err)
+	} else if val != "whatsup" {
+		t.Errorf("expected %q, got %q", "whatsup", val)
+	}
+
+	if val, err := s.Get(key2); err != nil {
+		t.Error(err)
+	} else if val != "friend" {
+		t.Errorf("expected %q, got %q", "friend", val)
+	}
+}
+
+func testDel(t *testing.T, factory Factory) {
+	s := factory(t, time.Hour)
+
+	key1, key2 := newKey(), newKey()
+
+	if err := s.Set(key1, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(key2, "friend"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Del(key1); err != nil {
+		t.Error(err)
+	}
+
+	_, err := s.Get(key1)
+	if !abcsessions.IsNoSessionError(err) {
+		t.Errorf("expected no session error after delete, got: %v", err)
+	}
+
+	if val, err := s.Get(key2); err != nil {
+		t.Error(err)
+	} else if val != "friend" {
+		t.Errorf("expected %q, got %q", "friend", val)
+	}
+
+	// Deleting a session that does not exist is not an error
+	if err := s.Del(newKey()); err != nil {
+		t.Errorf("expected no error deleting a missing session, got: %v", err)
+	}
+}
+
+func testAll(t *testing.T, factory Factory) {
+	s := factory(t, time.Hour)
+
+	list, err := s.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 0 {
+		t.Errorf("expected empty store, got %v", list)
+	}
+
+	keys := []string{newKey(), newKey(), newKey()}
+	for _, key := range keys {
+		if err := s.Set(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Del(keys[2]); err != nil {
+		t.Fatal(err)
+	}
+	keys = keys[:2]
+
+	list, err = s.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(keys)
+	sort.Strings(list)
+	if fmt.Sprint(keys) != fmt.Sprint(list) {
+		t.Errorf("expected keys %v, got %v", keys, list)
+	}
+}
+
+func testResetExpiry(t *testing.T, factory Factory) {
+	s := factory(t, time.Hour)
+
+	err := s.ResetExpiry(newKey())
+	if !abcsessions.IsNoSessionError(err) {
+		t.Errorf("expected no session error resetting a missing session, got: %v", err)
+	}
+
+	key := newKey()
+	if err := s.Set(key, "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ResetExpiry(key); err != nil {
+		t.Error(err)
+	}
+
+	if val, err := s.Get(key); err != nil {
+		t.Error(err)
+	} else if val != "value" {
+		t.Errorf("expected value to be unchanged, got %q", val)
+	}
+}
+
+func testExpiry(t *testing.T, factory Factory) {
+	s := factory(t, ExpiryMaxAge)
+
+	key := newKey()
+	if err := s.Set(key, "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(ExpiryMaxAge + ExpiryMaxAge/2)
+	clean(t, s)
+
+	_, err := s.Get(key)
+	if !abcsessions.IsNoSessionError(err) {
+		t.Errorf("expected no session error for expired session, got: %v", err)
+	}
+
+	list, err := s.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range list {
+		if k == key {
+			t.Error("expected expired session to be removed from All")
+		}
+	}
+}
+
+func testResetExpiryExtends(t *testing.T, factory Factory) {
+	s := factory(t, ExpiryMaxAge)
+
+	key := newKey()
+	if err := s.Set(key, "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Together both sleeps are past the maxAge of the original Set,
+	// but the second is within the maxAge of the reset.
+	time.Sleep(ExpiryMaxAge * 6 / 10)
+	if err := s.ResetExpiry(key); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(ExpiryMaxAge * 6 / 10)
+	clean(t, s)
+
+	if val, err := s.Get(key); err != nil {
+		t.Errorf("expected reset session to still exist, got: %v", err)
+	} else if val != "value" {
+		t.Errorf("expected %q, got %q", "value", val)
+	}
+}
+
+func testConcurrent(t *testing.T, factory Factory) {
+	s := factory(t, time.Hour)
+
+	const workers = 8
+	const iterations = 25
+
+	shared := newKey()
+	if err := s.Set(shared, "shared"); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*iterations)
+	keys := make([]string, workers)
+
+	for i := 0; i < workers; i++ {
+		keys[i] = newKey()
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+
+			for j := 0; j < iterations; j++ {
+				value := fmt.Sprintf("%s-%d", key, j)
+				if err := s.Set(key, value); err != nil {
+					errs <- err
+					return
+				}
+				if got, err := s.Get(key); err != nil {
+					errs <- err
+					return
+				} else if got != value {
+					errs <- fmt.Errorf("expected %q, got %q", value, got)
+					return
+				}
+
+				if err := s.Set(shared, value); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := s.Get(shared); err != nil {
+					errs <- err
+					return
+				}
+				if err := s.ResetExpiry(shared); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := s.All(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(keys[i])
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	for i, key := range keys {
+		want := fmt.Sprintf("%s-%d", key, iterations-1)
+		if got, err := s.Get(key); err != nil {
+			t.Error(err)
+		} else if got != want {
+			t.Errorf("worker %d: expected %q, got %q", i, want, got)
+		}
+	}
+}
+
+// casStorer returns the storer as a CASStorer or skips the test
+func casStorer(t *testing.T, s abcsessions.Storer) abcsessions.CASStorer {
+	t.Helper()
+
+	for _, s := range wrapped(s) {
+		if _, ok := s.(abcsessions.CASStorer); !ok {
+			t.Skip("storer does not implement CASStorer")
+		}
+	}
+
+	return s.(abcsessions.CASStorer)
+}
+
+func testSetIfVersion(t *testing.T, factory Factory) {
+	s := casStorer(t, factory(t, time.Hour))
+
+	key := newKey()
+	if _, _, err := s.GetVersion(key); !abcsessions.IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+
+	// An empty version only creates the session if it does not exist
+	if err := s.SetIfVersion(key, "hello", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetIfVersion(key, "whatsup", ""); !abcsessions.IsVersionConflictError(err) {
+		t.Errorf("expected version conflict creating an existing session, got: %v", err)
+	}
+
+	val, version, err := s.GetVersion(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "hello" {
+		t.Errorf("expected %q, got %q", "hello", val)
+	}
+
+	if err := s.SetIfVersion(key, "whatsup", version); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetIfVersion(key, "friend", version); !abcsessions.IsVersionConflictError(err) {
+		t.Errorf("expected version conflict with a stale version, got: %v", err)
+	}
+
+	if val, newVersion, err := s.GetVersion(key); err != nil {
+		t.Error(err)
+	} else if val != "whatsup" {
+		t.Errorf("expected %q, got %q", "whatsup", val)
+	} else if newVersion == version {
+		t.Error("expected the version to change with the value")
+	}
+
+	// A plain Set also changes the version
+	if err := s.Set(key, "friend"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetIfVersion(key, "whatsup", version); !abcsessions.IsVersionConflictError(err) {
+		t.Errorf("expected version conflict after set, got: %v", err)
+	}
+
+	if err := s.SetIfVersion(newKey(), "hello", version); !abcsessions.IsVersionConflictError(err) {
+		t.Errorf("expected version conflict for a missing session, got: %v", err)
+	}
+}
+
+func testConcurrentSetIfVersion(t *testing.T, factory Factory) {
+	s := casStorer(t, factory(t, time.Hour))
+
+	const workers = 8
+	const iterations = 10
+
+	key := newKey()
+	if err := s.Set(key, "0"); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < iterations; j++ {
+				for {
+					val, version, err := s.GetVersion(key)
+					if err != nil {
+						errs <- err
+						return
+					}
+
+					var n int
+					fmt.Sscan(val, &n)
+
+					err = s.SetIfVersion(key, fmt.Sprint(n+1), version)
+					if err == nil {
+						break
+					} else if !abcsessions.IsVersionConflictError(err) {
+						errs <- err
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	want := fmt.Sprint(workers * iterations)
+	if got, err := s.Get(key); err != nil {
+		t.Error(err)
+	} else if got != want {
+		t.Errorf("expected every increment to be kept, want %s got %s", want, got)
+	}
+}
+
+// userIndexStorer returns the storer as a UserIndexStorer or skips the test
+func userIndexStorer(t *testing.T, s abcsessions.Storer) abcsessions.UserIndexStorer {
+	t.Helper()
+
+	for _, s := range wrapped(s) {
+		if _, ok := s.(abcsessions.UserIndexStorer); !ok {
+			t.Skip("storer does not implement UserIndexStorer")
+		}
+	}
+
+	return s.(abcsessions.UserIndexStorer)
+}
+
+func testSetMeta(t *testing.T, factory Factory) {
+	s := userIndexStorer(t, factory(t, time.Hour))
+
+	key := newKey()
+	if _, err := s.GetMeta(key); !abcsessions.IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+	if err := s.SetMeta(key, abcsessions.SessionMeta{UserID: "1"}); !abcsessions.IsNoSessionError(err) {
+		t.Errorf("expected no session error setting meta of a missing session, got: %v", err)
+	}
+
+	if err := s.Set(key, "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sessions without metadata still have an id
+	if meta, err := s.GetMeta(key); err != nil {
+		t.Error(err)
+	} else if meta.ID != key || len(meta.UserID) != 0 {
+		t.Errorf("expected empty metadata, got: %#v", meta)
+	}
+
+	created := time.Now().UTC().Add(-time.Minute).Truncate(time.Second)
+	want := abcsessions.SessionMeta{
+		UserID:    "1",
+		CreatedAt: created,
+		IP:        "127.0.0.1",
+		UserAgent: "test agent",
+	}
+	if err := s.SetMeta(key, want); err != nil {
+		t.Fatal(err)
+	}
+
+	// The metadata survives changes to the value
+	if err := s.Set(key, "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ResetExpiry(key); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := s.GetMeta(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.ID != key {
+		t.Errorf("expected id %q, got %q", key, meta.ID)
+	}
+	if meta.UserID != want.UserID || meta.IP != want.IP || meta.UserAgent != want.UserAgent {
+		t.Errorf("expected %#v, got %#v", want, meta)
+	}
+	if !meta.CreatedAt.Equal(created) {
+		t.Errorf("expected created at %v, got %v", created, meta.CreatedAt)
+	}
+	if since := time.Since(meta.LastSeen); since < -time.Second || since > time.Minute {
+		t.Errorf("expected last seen to be recent, got %v", meta.LastSeen)
+	}
+
+	if err := s.Del(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetMeta(key); !abcsessions.IsNoSessionError(err) {
+		t.Errorf("expected no session error after delete, got: %v", err)
+	}
+}
+
+func testListByUser(t *testing.T, factory Factory) {
+	s := userIndexStorer(t, factory(t, time.Hour))
+
+	metas, err := s.ListByUser("nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != 0 {
+		t.Errorf("expected no sessions, got %v", metas)
+	}
+
+	keys := []string{newKey(), newKey(), newKey(), newKey()}
+	users := []string{"user/1", "user/1", "user/2", "user/1"}
+	for i, key := range keys {
+		if err := s.Set(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SetMeta(key, abcsessions.SessionMeta{UserID: users[i]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Moving a session to another user removes it from the old index
+	if err := s.SetMeta(keys[3], abcsessions.SessionMeta{UserID: "user/2"}); err != nil {
+		t.Fatal(err)
+	}
+	// Deleted sessions are removed from the index
+	if err := s.Del(keys[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	for user, want := range map[string][]string{
+		"user/1": {keys[0]},
+		"user/2": {keys[2], keys[3]},
+	} {
+		metas, err := s.ListByUser(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, meta := range metas {
+			if meta.UserID != user {
+				t.Errorf("expected user %q, got %q", user, meta.UserID)
+			}
+			got = append(got, meta.ID)
+		}
+
+		sort.Strings(got)
+		sort.Strings(want)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: expected sessions %v, got %v", user, want, got)
+		}
+	}
+
+	// Metadata is not a session
+	list, err := s.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		t.Errorf("expected 3 sessions, got %v", list)
+	}
+}
+
+func testDeleteByUser(t *testing.T, factory Factory) {
+	s := userIndexStorer(t, factory(t, time.Hour))
+
+	keys := []string{newKey(), newKey(), newKey()}
+	users := []string{"1", "1", "2"}
+	for i, key := range keys {
+		if err := s.Set(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SetMeta(key, abcsessions.SessionMeta{UserID: users[i]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.DeleteByUser("1"); err != nil {
+		t.Fatal(err)
+	}
+	// Users without sessions are not an error
+	if err := s.DeleteByUser("nobody"); err != nil {
+		t.Errorf("expected no error deleting sessions of an unknown user, got: %v", err)
+	}
+
+	for _, key := range keys[:2] {
+		if _, err := s.Get(key); !abcsessions.IsNoSessionError(err) {
+			t.Errorf("expected no session error after delete by user, got: %v", err)
+		}
+	}
+	if _, err := s.Get(keys[2]); err != nil {
+		t.Errorf("expected the other users session to remain, got: %v", err)
+	}
+
+	metas, err := s.ListByUser("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != 0 {
+		t.Errorf("expected no sessions, got %v", metas)
+	}
+}
+
+// ttlStorer returns the storer as a TTLStorer or skips the test
+func ttlStorer(t *testing.T, s abcsessions.Storer) abcsessions.TTLStorer {
+	t.Helper()
+
+	for _, s := range wrapped(s) {
+		if _, ok := s.(abcsessions.TTLStorer); !ok {
+			t.Skip("storer does not implement TTLStorer")
+		}
+	}
+
+	return s.(abcsessions.TTLStorer)
+}
+
+func testTTL(t *testing.T, factory Factory) {
+	s := ttlStorer(t, factory(t, time.Hour))
+
+	key := newKey()
+	if _, err := s.TTL(key); !abcsessions.IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+
+	if err := s.Set(key, "value"); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := s.TTL(key); err != nil {
+		t.Error(err)
+	} else if ttl > time.Hour || ttl < time.Hour-time.Minute {
+		t.Errorf("expected a ttl of the max age, got %v", ttl)
+	}
+
+	if err := s.SetWithTTL(key, "changed", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := s.Get(key); err != nil {
+		t.Error(err)
+	} else if val != "changed" {
+		t.Errorf("expected %q, got %q", "changed", val)
+	}
+	if ttl, err := s.TTL(key); err != nil {
+		t.Error(err)
+	} else if ttl > time.Minute || ttl < 50*time.Second {
+		t.Errorf("expected a ttl of 1 minute, got %v", ttl)
+	}
+
+	// A ttl of 0 uses the max age
+	if err := s.SetWithTTL(key, "value", 0); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := s.TTL(key); err != nil {
+		t.Error(err)
+	} else if ttl > time.Hour || ttl < time.Hour-time.Minute {
+		t.Errorf("expected a ttl of the max age, got %v", ttl)
+	}
+
+	// The expiry of sessions set with a ttl can be reset
+	if err := s.SetWithTTL(key, "value", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ResetExpiry(key); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := s.TTL(key); err != nil {
+		t.Error(err)
+	} else if ttl < time.Hour-time.Minute {
+		t.Errorf("expected the ttl to be reset to the max age, got %v", ttl)
+	}
+}
+
+func testContext(t *testing.T, factory Factory) {
+	s := abcsessions.AsStorerContext(factory(t, time.Hour))
+
+	key := newKey()
+	ctx := context.Background()
+	if err := s.SetContext(ctx, key, "value"); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := s.GetContext(ctx, key); err != nil {
+		t.Error(err)
+	} else if val != "value" {
+		t.Errorf("expected %q, got %q", "value", val)
+	}
+	if err := s.ResetExpiryContext(ctx, key); err != nil {
+		t.Error(err)
+	}
+	if keys, err := s.AllContext(ctx); err != nil {
+		t.Error(err)
+	} else if len(keys) != 1 || keys[0] != key {
+		t.Errorf("expected only %q, got %v", key, keys)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	if _, err := s.AllContext(canceled); !errors.Is(err, context.Canceled) {
+		t.Errorf("AllContext: expected context canceled, got: %v", err)
+	}
+	if _, err := s.GetContext(canceled, key); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetContext: expected context canceled, got: %v", err)
+	}
+	if err := s.SetContext(canceled, key, "changed"); !errors.Is(err, context.Canceled) {
+		t.Errorf("SetContext: expected context canceled, got: %v", err)
+	}
+	if err := s.ResetExpiryContext(canceled, key); !errors.Is(err, context.Canceled) {
+		t.Errorf("ResetExpiryContext: expected context canceled, got: %v", err)
+	}
+	if err := s.DelContext(canceled, key); !errors.Is(err, context.Canceled) {
+		t.Errorf("DelContext: expected context canceled, got: %v", err)
+	}
+
+	// Nothing is changed by the canceled operations
+	if val, err := s.Get(key); err != nil {
+		t.Error(err)
+	} else if val != "value" {
+		t.Errorf("expected %q, got %q", "value", val)
+	}
+
+	if err := s.DelContext(ctx, key); err != nil {
+		t.Error(err)
+	}
+	if _, err := s.Get(key); !abcsessions.IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+}
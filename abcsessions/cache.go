@@ -0,0 +1,321 @@
+package abcsessions
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/friendsofgo/errors"
+)
+
+// sessionCache holds the sessions used by the helper functions (Set, Get,
+// AddFlash etc.) during a single request. Each session is read from its
+// overseer the first time it is used and written back once, right before
+// the sessionsResponseWriter writes the response headers.
+type sessionCache struct {
+	// r is the request the cached sessions are written back with
+	r        *http.Request
+	sessions map[Overseer]*cachedSession
+	// err is the error of writing the sessions back with the response,
+	// and onError is called with it
+	err     error
+	onError func(r *http.Request, err error)
+}
+
+// cachedSession is a session loaded from an overseer during the request
+type cachedSession struct {
+	sess session
+	// version of the session when it was loaded, if the overseer
+	// supports versions
+	version string
+	// exists is false if the overseer had no session and none has
+	// been created during the request
+	exists bool
+	// dirty is true if the session has changed since it was loaded
+	dirty bool
+	// changes made to the session since it was loaded, they are applied
+	// again if another request changed the session in the meantime
+	changes []func(*session) error
+}
+
+type sessionCacher interface {
+	sessionCache() *sessionCache
+}
+
+// getSessionCache returns the session cache of the response writer or nil
+// if CacheMiddleware is not in use.
+func getSessionCache(w http.ResponseWriter) *sessionCache {
+	c, ok := w.(sessionCacher)
+	if !ok {
+		return nil
+	}
+
+	return c.sessionCache()
+}
+
+// CacheMiddleware caches the sessions used by the helper functions (Set, Get,
+// SetObj, GetObj, AddFlash, GetFlash etc.) for the duration of the request.
+// A session is loaded from the overseer on first use, and is written back to
+// the overseer once if it was modified, just before the response headers are
+// written. Without the cache every helper call reads and writes the session.
+//
+// The cached sessions are only written back when the handler writes the
+// response or returns, so Overseer errors surface late: the response can no
+// longer be changed, and the error is only returned by Save after that.
+// Call Save to write the sessions and handle the error in the handler, and
+// use CacheMiddlewareWithErrorHandler to log the errors that surface late.
+//
+// Calling the Overseer Get and Set methods directly bypasses the cache, use
+// Save first if they must see changes made with the helpers. Overseer Del
+// discards the cached session.
+//
+// The sessions Middleware must come BEFORE this middleware in the chain,
+// or you will get a panic.
+func CacheMiddleware(next http.Handler) http.Handler {
+	return CacheMiddlewareWithErrorHandler(nil)(next)
+}
+
+// CacheMiddlewareWithErrorHandler returns a CacheMiddleware that calls
+// onError with the request and the error when the sessions can not be
+// written back as the response is written, for example to log it.
+func CacheMiddlewareWithErrorHandler(onError func(r *http.Request, err error)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return cacheMiddleware(next, onError)
+	}
+}
+
+func cacheMiddleware(next http.Handler, onError func(r *http.Request, err error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw, ok := w.(*sessionsResponseWriter)
+		if !ok {
+			panic("abcsessions: CacheMiddleware requires the sessions Middleware to come first")
+		}
+
+		sw.cache = &sessionCache{
+			r:        r,
+			sessions: make(map[Overseer]*cachedSession),
+			onError:  onError,
+		}
+
+		next.ServeHTTP(w, r)
+
+		// The handler did not write a response, so net/http will write the
+		// headers after we return and the cookies must be set before then.
+		if !sw.wroteHeader {
+			sw.saveCache()
+			sw.writeCookies()
+		}
+	})
+}
+
+// Save writes the sessions that were modified during the request to their
+// overseers. It is a noop if CacheMiddleware is not in use. Call Save before
+// writing the response to handle errors, once the response is written it
+// returns the error of writing the sessions back with it.
+func Save(w http.ResponseWriter) error {
+	c := getSessionCache(w)
+	if c == nil {
+		return nil
+	}
+	if c.err != nil {
+		return c.err
+	}
+
+	return c.save(w)
+}
+
+// save writes all dirty sessions to their overseers. If another request
+// changed a session since it was loaded, the changes made during this
+// request are applied again on top of the latest session.
+func (c *sessionCache) save(w http.ResponseWriter) error {
+	for overseer, cached := range c.sessions {
+		if !cached.dirty {
+			continue
+		}
+
+		sess, version := &cached.sess, cached.version
+		for attempt := 0; ; attempt++ {
+			err := writeSession(overseer, w, c.r, sess, version)
+			if err == nil {
+				break
+			} else if !IsVersionConflictError(err) || attempt == maxVersionConflictRetries {
+				return errors.Wrap(err, "unable to set session")
+			}
+
+			if sess, version, err = readSession(overseer, w, c.r); IsNoSessionError(err) {
+				sess = newSession(overseer)
+			} else if err != nil {
+				return errors.Wrap(err, "unable to get session")
+			}
+
+			for _, change := range cached.changes {
+				// The other request may have already made the same change,
+				// for example by reading the same flash message
+				if err := change(sess); err != nil && !IsNoMapKeyError(err) {
+					return err
+				}
+			}
+		}
+
+		cached.sess = *sess
+		cached.changes = nil
+		cached.dirty = false
+	}
+
+	return nil
+}
+
+// forget discards the cached session of the overseer, so deleted sessions
+// are not written back at the end of the request.
+func (c *sessionCache) forget(overseer Overseer) {
+	c.sessions[overseer] = &cachedSession{}
+}
+
+// forgetSession discards the overseers cached session if the cache is in use
+func forgetSession(overseer Overseer, w http.ResponseWriter) {
+	if c := getSessionCache(w); c != nil {
+		c.forget(overseer)
+	}
+}
+
+// load returns the cached session of the overseer, reading it from the
+// overseer if it is not cached yet.
+func (c *sessionCache) load(overseer Overseer, w http.ResponseWriter, r *http.Request) (*cachedSession, error) {
+	if cached, ok := c.sessions[overseer]; ok {
+		return cached, nil
+	}
+
+	cached := &cachedSession{}
+
+	sess, version, err := readSession(overseer, w, r)
+	if err == nil {
+		cached.sess, cached.version, cached.exists = *sess, version, true
+	} else if !IsNoSessionError(err) {
+		return nil, err
+	}
+
+	c.sessions[overseer] = cached
+	return cached, nil
+}
+
+// loadSession returns the session stored by the overseer, or the cached
+// session if CacheMiddleware is in use. It returns errNoSession if there
+// is no session. The returned session must not be modified, use
+// updateSession instead.
+func loadSession(overseer Overseer, w http.ResponseWriter, r *http.Request) (*session, error) {
+	c := getSessionCache(w)
+	if c == nil {
+		sess, _, err := readSession(overseer, w, r)
+		return sess, err
+	}
+
+	cached, err := c.load(overseer, w, r)
+	if err != nil {
+		return nil, err
+	}
+	if !cached.exists {
+		return nil, errNoSession{}
+	}
+
+	return &cached.sess, nil
+}
+
+// updateSession applies change to the session stored by the overseer and
+// stores the result. If there is no session it returns errNoSession, unless
+// create is true in which case change is applied to a new session. The
+// change must leave the session untouched when it returns an error.
+//
+// If the overseer supports versions and another request changed the
+// session first, change is applied again on the latest session. When
+// CacheMiddleware is in use the change is made to the cached session and
+// kept to be applied again when the session is written back.
+func updateSession(overseer Overseer, w http.ResponseWriter, r *http.Request, create bool, change func(*session) error) error {
+	if c := getSessionCache(w); c != nil {
+		cached, err := c.load(overseer, w, r)
+		if err != nil {
+			return err
+		}
+		if !cached.exists && !create {
+			return errNoSession{}
+		}
+		if cached.sess.codec == nil {
+			cached.sess.codec = overseerCodec(overseer)
+		}
+
+		if err := change(&cached.sess); err != nil {
+			return err
+		}
+
+		cached.changes = append(cached.changes, change)
+		cached.exists = true
+		cached.dirty = true
+		return nil
+	}
+
+	for attempt := 0; ; attempt++ {
+		sess, version, err := readSession(overseer, w, r)
+		if IsNoSessionError(err) && create {
+			sess = newSession(overseer)
+		} else if err != nil {
+			return err
+		}
+
+		if err := change(sess); err != nil {
+			return err
+		}
+
+		err = writeSession(overseer, w, r, sess, version)
+		if !IsVersionConflictError(err) || attempt == maxVersionConflictRetries {
+			return err
+		}
+	}
+}
+
+// readSession gets and decodes the session from the overseer, along with
+// its version if the overseer supports versions.
+func readSession(overseer Overseer, w http.ResponseWriter, r *http.Request) (*session, string, error) {
+	var val, version string
+	var err error
+
+	if v, ok := asVersioned(overseer); ok {
+		val, version, err = v.getVersion(w, r)
+	} else {
+		val, err = overseer.Get(w, r)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	sess, err := decodeSession(overseerCodec(overseer), val)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "unable to unmarshal session object")
+	}
+
+	return sess, version, nil
+}
+
+// writeSession encodes and sets the session with the overseer, recording
+// the creation time of new sessions. If the
+// overseer supports versions, the session is only set if its version still
+// matches version.
+func writeSession(overseer Overseer, w http.ResponseWriter, r *http.Request, sess *session, version string) error {
+	if sess.Created == nil {
+		now := time.Now().UTC().Truncate(time.Second)
+		sess.Created = &now
+	}
+
+	ret, err := encodeSession(overseerCodec(overseer), sess)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal session object")
+	}
+
+	if v, ok := asVersioned(overseer); ok {
+		return v.setIfVersion(w, r, ret, version)
+	}
+
+	return overseer.Set(w, r, ret)
+}
+
+// newSession returns an empty session encoded with the codec of the overseer
+func newSession(overseer Overseer) *session {
+	return &session{codec: overseerCodec(overseer)}
+}
@@ -0,0 +1,215 @@
+package abcsessions
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// countingOverseer counts the calls made to the overseer it wraps
+type countingOverseer struct {
+	Overseer
+	gets int
+	sets int
+	err  error
+}
+
+func (c *countingOverseer) Get(w http.ResponseWriter, r *http.Request) (string, error) {
+	c.gets++
+	return c.Overseer.Get(w, r)
+}
+
+func (c *countingOverseer) Set(w http.ResponseWriter, r *http.Request, value string) error {
+	c.sets++
+	if c.err != nil {
+		return c.err
+	}
+	return c.Overseer.Set(w, r, value)
+}
+
+func TestCacheMiddleware(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	o := &countingOverseer{Overseer: NewStorageOverseer(NewCookieOptions(), m)}
+
+	handler := Middleware(CacheMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := Get(o, w, r, "a"); !IsNoSessionError(err) {
+			t.Errorf("expected no session error, got: %v", err)
+		}
+
+		for _, key := range []string{"a", "b", "c"} {
+			if err := Set(o, w, r, key, key+"value"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := Del(o, w, r, "c"); err != nil {
+			t.Fatal(err)
+		}
+		if err := AddFlash(o, w, r, "flash", "flashvalue"); err != nil {
+			t.Fatal(err)
+		}
+
+		if val, err := Get(o, w, r, "b"); err != nil {
+			t.Error(err)
+		} else if val != "bvalue" {
+			t.Errorf("expected %q, got %q", "bvalue", val)
+		}
+
+		// Nothing is written until the response is
+		if len(m.sessions) != 0 {
+			t.Error("expected session to be written with the response")
+		}
+
+		w.WriteHeader(http.StatusOK)
+
+		// Sessions modified after the headers are written are lost, but
+		// must not be written twice
+		if err := Set(o, w, r, "late", "value"); err != nil {
+			t.Fatal(err)
+		}
+	})))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	if o.gets != 1 {
+		t.Errorf("expected 1 overseer get, got %d", o.gets)
+	}
+	if o.sets != 1 {
+		t.Errorf("expected 1 overseer set, got %d", o.sets)
+	}
+	if len(rec.Result().Cookies()) != 1 {
+		t.Errorf("expected 1 cookie, got %d", len(rec.Result().Cookies()))
+	}
+
+	if len(m.sessions) != 1 {
+		t.Fatalf("expected 1 session, got %d", len(m.sessions))
+	}
+	for _, v := range m.sessions {
+		want := `{"Value":{"a":"avalue","b":"bvalue"},"Flash":{"flash":"flashvalue"}}`
+		if withoutCreated(t, v.value) != want {
+			t.Errorf("expected %q, got %q", want, v.value)
+		}
+	}
+}
+
+func TestCacheMiddlewareNoResponse(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	o := NewStorageOverseer(NewCookieOptions(), m)
+
+	// The handler writes nothing, so the session is saved when it returns
+	handler := Middleware(CacheMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := Set(o, w, r, "a", "value"); err != nil {
+			t.Fatal(err)
+		}
+	})))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected 1 cookie, got %d", len(cookies))
+	}
+
+	// The next request reads the session from the cookie
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookies[0])
+	handler = Middleware(CacheMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if val, err := Get(o, w, r, "a"); err != nil {
+			t.Error(err)
+		} else if val != "value" {
+			t.Errorf("expected %q, got %q", "value", val)
+		}
+	})))
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+}
+
+func TestCacheMiddlewareOverseerDel(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	o := NewStorageOverseer(NewCookieOptions(), m)
+
+	handler := Middleware(CacheMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := Set(o, w, r, "a", "value"); err != nil {
+			t.Fatal(err)
+		}
+		if err := Save(w); err != nil {
+			t.Fatal(err)
+		}
+		if err := Set(o, w, r, "b", "value"); err != nil {
+			t.Fatal(err)
+		}
+		if err := o.Del(w, r); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Get(o, w, r, "a"); !IsNoSessionError(err) {
+			t.Errorf("expected no session error, got: %v", err)
+		}
+	})))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if len(m.sessions) != 0 {
+		t.Errorf("expected deleted session to not be written, got %d sessions", len(m.sessions))
+	}
+}
+
+func TestCacheMiddlewareSaveError(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	o := &countingOverseer{Overseer: NewStorageOverseer(NewCookieOptions(), m), err: errors.New("failed")}
+
+	var handled error
+	onError := func(r *http.Request, err error) { handled = err }
+
+	handler := Middleware(CacheMiddlewareWithErrorHandler(onError)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := Set(o, w, r, "a", "value"); err != nil {
+			t.Fatal(err)
+		}
+		if err := Save(w); err == nil {
+			t.Error("expected save to fail")
+		}
+
+		// Writing the response does not panic, and saves only once
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write([]byte("body")); err != nil {
+			t.Error(err)
+		}
+		if err := Save(w); err == nil || err != handled {
+			t.Errorf("expected save to return the error of writing the response, got: %v", err)
+		}
+	})))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", rec.Code)
+	}
+	if handled == nil {
+		t.Error("expected the error handler to be called")
+	}
+	if o.sets != 2 {
+		t.Errorf("expected 2 overseer sets, got %d", o.sets)
+	}
+}
+
+func TestCacheMiddlewareRequiresMiddleware(t *testing.T) {
+	t.Parallel()
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic without the sessions middleware")
+		}
+	}()
+
+	handler := CacheMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
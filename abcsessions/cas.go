@@ -0,0 +1,41 @@
+package abcsessions
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+)
+
+// maxVersionConflictRetries is how many times a session change is retried
+// on the latest session after another request changed the session first
+const maxVersionConflictRetries = 5
+
+// valueVersion returns the version of a session value for the storers that
+// implement CASStorer. It is the hex encoded sha1 of the value, which is
+// also available to Redis scripts as redis.sha1hex.
+func valueVersion(value string) string {
+	sum := sha1.Sum([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// versionedOverseer is implemented by overseers that can get and set
+// sessions with a version when their storer is a CASStorer
+type versionedOverseer interface {
+	// versioned returns true if the overseers storer supports versions
+	versioned() bool
+	// getVersion returns the session value and its version
+	getVersion(w http.ResponseWriter, r *http.Request) (value, version string, err error)
+	// setIfVersion sets the session value if its version still matches
+	setIfVersion(w http.ResponseWriter, r *http.Request, value, version string) error
+}
+
+// asVersioned returns the overseer as a versionedOverseer if it supports
+// versions
+func asVersioned(overseer Overseer) (versionedOverseer, bool) {
+	v, ok := overseer.(versionedOverseer)
+	if !ok || !v.versioned() {
+		return nil, false
+	}
+
+	return v, true
+}
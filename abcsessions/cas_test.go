@@ -0,0 +1,174 @@
+package abcsessions
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// conflictStorer runs interfere once before the first SetIfVersionContext,
+// to simulate another request changing the session at the same time
+type conflictStorer struct {
+	*MemoryStorer
+	interfere func()
+}
+
+func (c *conflictStorer) SetIfVersionContext(ctx context.Context, key, value, version string) error {
+	if c.interfere != nil {
+		interfere := c.interfere
+		c.interfere = nil
+		interfere()
+	}
+
+	return c.MemoryStorer.SetIfVersionContext(ctx, key, value, version)
+}
+
+func TestStorageOverseerVersioned(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	if !NewStorageOverseer(NewCookieOptions(), m).versioned() {
+		t.Error("expected memory storer to be versioned")
+	}
+
+	s, _ := NewDefaultSQLStorer(nil)
+	if NewStorageOverseer(NewCookieOptions(), s).versioned() {
+		t.Error("expected sql storer to not be versioned")
+	}
+}
+
+// newConflictTest creates a session with key a and returns a request
+// with its cookie, and a func that sets key b from another request.
+func newConflictTest(t *testing.T) (*conflictStorer, *StorageOverseer, *http.Request, func()) {
+	m, _ := NewDefaultMemoryStorer()
+	c := &conflictStorer{MemoryStorer: m}
+	o := NewStorageOverseer(NewCookieOptions(), c)
+
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+	r := httptest.NewRequest("GET", "/", nil)
+	if err := Set(o, w, r, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddFlash(o, w, r, "flash", "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(w.cookies[o.options.Name])
+
+	other := func() {
+		ow := newSessionsResponseWriter(httptest.NewRecorder())
+		if err := Set(o, ow, r, "b", "2"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return c, o, r, other
+}
+
+func checkMergedSession(t *testing.T, o Overseer, r *http.Request, keys map[string]string) {
+	t.Helper()
+
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+	for key, want := range keys {
+		if got, err := Get(o, w, r, key); err != nil {
+			t.Errorf("key %s: %v", key, err)
+		} else if got != want {
+			t.Errorf("key %s: expected %q, got %q", key, want, got)
+		}
+	}
+}
+
+func TestSetVersionConflict(t *testing.T) {
+	t.Parallel()
+
+	c, o, r, other := newConflictTest(t)
+	c.interfere = other
+
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+	if err := Set(o, w, r, "c", "3"); err != nil {
+		t.Fatal(err)
+	}
+
+	checkMergedSession(t, o, r, map[string]string{"a": "1", "b": "2", "c": "3"})
+}
+
+func TestGetFlashVersionConflict(t *testing.T) {
+	t.Parallel()
+
+	c, o, r, other := newConflictTest(t)
+	c.interfere = other
+
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+	flash, err := GetFlash(o, w, r, "flash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flash != "hello" {
+		t.Errorf("expected %q, got %q", "hello", flash)
+	}
+
+	checkMergedSession(t, o, r, map[string]string{"a": "1", "b": "2"})
+	if _, err := GetFlash(o, w, r, "flash"); !IsNoMapKeyError(err) {
+		t.Errorf("expected flash to be deleted, got: %v", err)
+	}
+}
+
+func TestCacheMiddlewareVersionConflict(t *testing.T) {
+	t.Parallel()
+
+	c, o, r, other := newConflictTest(t)
+
+	handler := Middleware(CacheMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := Set(o, w, r, "c", "3"); err != nil {
+			t.Fatal(err)
+		}
+		if err := Del(o, w, r, "a"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := GetFlash(o, w, r, "flash"); err != nil {
+			t.Fatal(err)
+		}
+
+		// The other request changes the session after it was loaded
+		c.interfere = other
+	})))
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	checkMergedSession(t, o, r, map[string]string{"b": "2", "c": "3"})
+
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+	if _, err := Get(o, w, r, "a"); !IsNoMapKeyError(err) {
+		t.Errorf("expected key a to be deleted, got: %v", err)
+	}
+	if _, err := GetFlash(o, w, r, "flash"); !IsNoMapKeyError(err) {
+		t.Errorf("expected flash to be deleted, got: %v", err)
+	}
+}
+
+func TestVersionConflictRetriesExhausted(t *testing.T) {
+	t.Parallel()
+
+	c, o, r, _ := newConflictTest(t)
+
+	// Interfere with every attempt, changing the value each time so the
+	// version changes too
+	n := 0
+	var interfere func()
+	interfere = func() {
+		n++
+		ow := newSessionsResponseWriter(httptest.NewRecorder())
+		if err := Set(o, ow, r, "b", strconv.Itoa(n)); err != nil {
+			t.Fatal(err)
+		}
+		c.interfere = interfere
+	}
+	c.interfere = interfere
+
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+	if err := Set(o, w, r, "c", "3"); !IsVersionConflictError(err) {
+		t.Errorf("expected version conflict error, got: %v", err)
+	}
+}
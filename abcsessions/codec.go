@@ -0,0 +1,214 @@
+package abcsessions
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/friendsofgo/errors"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes the session envelope and the values stored in it by the
+// helpers (Set, SetObj, AddFlash etc.). Set the Codec of an overseer to
+// change how its sessions are encoded, the default is JSONCodec.
+type Codec interface {
+	// Name identifies the codec in the header of encoded sessions, so
+	// sessions can be decoded after the codec of the overseer changes.
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec encodes sessions with encoding/json. It is the default codec
+// and the only one that writes sessions without a header, in the format
+// used before codecs were pluggable.
+type JSONCodec struct{}
+
+// Name of the codec
+func (JSONCodec) Name() string { return "json" }
+
+// Marshal v with json.Marshal
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+// Unmarshal data with json.Unmarshal
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// GobCodec encodes sessions with encoding/gob. Unlike json it keeps the
+// precision of time.Time and stores []byte as is, but it can only encode
+// exported struct fields and concrete types stored in interfaces must be
+// registered with gob.Register.
+type GobCodec struct{}
+
+// Name of the codec
+func (GobCodec) Name() string { return "gob" }
+
+// Marshal v with a gob.Encoder
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Unmarshal data with a gob.Decoder
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// MessagePackCodec encodes sessions with MessagePack, which is more compact
+// than json and keeps the precision of time.Time. Struct fields can be
+// renamed with `msgpack` tags.
+type MessagePackCodec struct{}
+
+// Name of the codec
+func (MessagePackCodec) Name() string { return "msgpack" }
+
+// Marshal v with msgpack.Marshal
+func (MessagePackCodec) Marshal(v interface{}) ([]byte, error) { return msgpack.Marshal(v) }
+
+// Unmarshal data with msgpack.Unmarshal
+func (MessagePackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+// codecs are the codecs sessions can always be decoded with, whatever the
+// codec of the overseer is
+var codecs = map[string]Codec{
+	JSONCodec{}.Name():        JSONCodec{},
+	GobCodec{}.Name():         GobCodec{},
+	MessagePackCodec{}.Name(): MessagePackCodec{},
+}
+
+// codecHeaderVersion prefixes the header of encoded sessions:
+// "v1:<codec name>:<base64 encoded envelope>". Sessions without the header
+// are json, the format used before codecs were pluggable.
+const codecHeaderVersion = "v1"
+
+// codecOverseer is implemented by overseers with a configurable codec
+type codecOverseer interface {
+	codec() Codec
+}
+
+// overseerCodec returns the codec of the overseer, JSONCodec by default
+func overseerCodec(overseer Overseer) Codec {
+	if c, ok := overseer.(codecOverseer); ok {
+		return c.codec()
+	}
+
+	return JSONCodec{}
+}
+
+// sessionEnvelope is how a session is encoded by codecs other than json
+type sessionEnvelope struct {
+	Value   []byte            `msgpack:",omitempty"`
+	Flash   map[string][]byte `msgpack:",omitempty"`
+	Created *time.Time        `msgpack:",omitempty"`
+}
+
+// jsonSessionEnvelope is how a session is encoded by JSONCodec, with the
+// values embedded as json instead of base64 strings
+type jsonSessionEnvelope struct {
+	Value   *json.RawMessage
+	Flash   map[string]*json.RawMessage
+	Created *time.Time `json:",omitempty"`
+}
+
+// encodeSession encodes the session with the codec its values are encoded
+// with, or the codec of the overseer for sessions without values.
+func encodeSession(codec Codec, sess *session) (string, error) {
+	if sess.codec != nil {
+		codec = sess.codec
+	}
+
+	if _, ok := codec.(JSONCodec); ok {
+		env := jsonSessionEnvelope{Created: sess.Created}
+		if sess.Value != nil {
+			env.Value = (*json.RawMessage)(&sess.Value)
+		}
+		if sess.Flash != nil {
+			env.Flash = make(map[string]*json.RawMessage, len(sess.Flash))
+			for k, v := range sess.Flash {
+				v := v
+				env.Flash[k] = (*json.RawMessage)(&v)
+			}
+		}
+
+		ret, err := json.Marshal(env)
+		return string(ret), err
+	}
+
+	ret, err := codec.Marshal(sessionEnvelope{
+		Value:   sess.Value,
+		Flash:   sess.Flash,
+		Created: sess.Created,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return codecHeaderVersion + ":" + codec.Name() + ":" + base64.StdEncoding.EncodeToString(ret), nil
+}
+
+// decodeSession decodes a session with the codec named in its header, or
+// as json if it has no header. The codec of the overseer is used for
+// sessions that name it, so it does not need to be one of the built in
+// codecs.
+func decodeSession(codec Codec, value string) (*session, error) {
+	header := codecHeaderVersion + ":"
+	if !strings.HasPrefix(value, header) {
+		var env jsonSessionEnvelope
+		if err := json.Unmarshal([]byte(value), &env); err != nil {
+			return nil, err
+		}
+
+		sess := &session{Created: env.Created, codec: JSONCodec{}}
+		if env.Value != nil {
+			sess.Value = []byte(*env.Value)
+		}
+		if env.Flash != nil {
+			sess.Flash = make(map[string][]byte, len(env.Flash))
+			for k, v := range env.Flash {
+				if v != nil {
+					sess.Flash[k] = []byte(*v)
+				}
+			}
+		}
+
+		return sess, nil
+	}
+
+	parts := strings.SplitN(value[len(header):], ":", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("session header is missing the codec name")
+	}
+
+	if codec == nil || codec.Name() != parts[0] {
+		var ok bool
+		if codec, ok = codecs[parts[0]]; !ok {
+			return nil, errors.Errorf("unknown session codec %q", parts[0])
+		}
+	}
+
+	data, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to base64 decode session")
+	}
+
+	var env sessionEnvelope
+	if err := codec.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+
+	return &session{
+		Value:   env.Value,
+		Flash:   env.Flash,
+		Created: env.Created,
+		codec:   codec,
+	}, nil
+}
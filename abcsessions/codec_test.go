@@ -0,0 +1,243 @@
+package abcsessions
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type codecTestObj struct {
+	Time  time.Time
+	Bytes []byte
+	Name  string
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	for _, codec := range []Codec{JSONCodec{}, GobCodec{}, MessagePackCodec{}} {
+		codec := codec
+		t.Run(codec.Name(), func(t *testing.T) {
+			t.Parallel()
+
+			m, _ := NewDefaultMemoryStorer()
+			s := NewStorageOverseer(NewCookieOptions(), m)
+			s.Codec = codec
+
+			r := httptest.NewRequest("GET", "/", nil)
+			w := newSessionsResponseWriter(httptest.NewRecorder())
+
+			want := codecTestObj{
+				Time:  time.Date(2020, 1, 2, 3, 4, 5, 123456789, time.UTC),
+				Bytes: []byte{0, 1, 2, 255},
+				Name:  "hello",
+			}
+			if err := SetObj(s, w, r, want); err != nil {
+				t.Fatal(err)
+			}
+			if err := AddFlash(s, w, r, "flash", "message"); err != nil {
+				t.Fatal(err)
+			}
+			if err := AddFlashObj(s, w, r, "obj", want); err != nil {
+				t.Fatal(err)
+			}
+
+			var got codecTestObj
+			if err := GetObj(s, w, r, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !got.Time.Equal(want.Time) || !bytes.Equal(got.Bytes, want.Bytes) || got.Name != want.Name {
+				t.Errorf("expected %#v, got %#v", want, got)
+			}
+
+			if val, err := GetFlash(s, w, r, "flash"); err != nil {
+				t.Error(err)
+			} else if val != "message" {
+				t.Errorf("expected %q, got %q", "message", val)
+			}
+
+			got = codecTestObj{}
+			if err := GetFlashObj(s, w, r, "obj", &got); err != nil {
+				t.Error(err)
+			} else if got.Name != want.Name || !bytes.Equal(got.Bytes, want.Bytes) {
+				t.Errorf("expected %#v, got %#v", want, got)
+			}
+
+			id, _ := s.SessionID(w, r)
+			value := m.sessions[id].value
+			if _, ok := codec.(JSONCodec); ok {
+				if !strings.HasPrefix(value, "{") {
+					t.Errorf("expected a json session without a header, got %q", value)
+				}
+			} else if prefix := "v1:" + codec.Name() + ":"; !strings.HasPrefix(value, prefix) {
+				t.Errorf("expected header %q, got %q", prefix, value)
+			}
+		})
+	}
+}
+
+func TestCodecsKeyValue(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	s := NewStorageOverseer(NewCookieOptions(), m)
+	s.Codec = MessagePackCodec{}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+
+	if err := Set(s, w, r, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Set(s, w, r, "b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Del(s, w, r, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Get(s, w, r, "a"); !IsNoMapKeyError(err) {
+		t.Errorf("expected no map key error, got: %v", err)
+	}
+	if val, err := Get(s, w, r, "b"); err != nil {
+		t.Error(err)
+	} else if val != "2" {
+		t.Errorf("expected %q, got %q", "2", val)
+	}
+}
+
+func TestCodecsReadLegacyJSON(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	s := NewStorageOverseer(NewCookieOptions(), m)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+
+	// A session written before the codec was changed
+	if err := s.Set(w, r, `{"Value":{"hi":"hello"},"Flash":{"f":"flash"}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Codec = GobCodec{}
+
+	if val, err := Get(s, w, r, "hi"); err != nil {
+		t.Error(err)
+	} else if val != "hello" {
+		t.Errorf("expected %q, got %q", "hello", val)
+	}
+	if val, err := GetFlash(s, w, r, "f"); err != nil {
+		t.Error(err)
+	} else if val != "flash" {
+		t.Errorf("expected %q, got %q", "flash", val)
+	}
+
+	// The session keeps its codec when it is modified
+	if err := Set(s, w, r, "hi", "again"); err != nil {
+		t.Fatal(err)
+	}
+	id, _ := s.SessionID(w, r)
+	if value := m.sessions[id].value; !strings.HasPrefix(value, `{"Value":{"hi":"again"}`) {
+		t.Errorf("expected the session to stay json, got %q", value)
+	}
+
+	// New sessions use the codec of the overseer
+	if err := s.Del(w, r); err != nil {
+		t.Fatal(err)
+	}
+	if err := Set(s, w, r, "hi", "new"); err != nil {
+		t.Fatal(err)
+	}
+	id, _ = s.SessionID(w, r)
+	if value := m.sessions[id].value; !strings.HasPrefix(value, "v1:gob:") {
+		t.Errorf("expected a gob session, got %q", value)
+	}
+
+	// Sessions of any built in codec are read after switching back
+	s.Codec = nil
+	if val, err := Get(s, w, r, "hi"); err != nil {
+		t.Error(err)
+	} else if val != "new" {
+		t.Errorf("expected %q, got %q", "new", val)
+	}
+}
+
+// upperCodec is a custom codec that is not one of the built in codecs
+type upperCodec struct {
+	JSONCodec
+}
+
+func (upperCodec) Name() string { return "upper" }
+
+func TestCodecsDecodeSession(t *testing.T) {
+	t.Parallel()
+
+	created := time.Now().UTC().Truncate(time.Second)
+	sess := &session{
+		Value:   []byte(`"value"`),
+		Flash:   map[string][]byte{"f": []byte(`"flash"`)},
+		Created: &created,
+	}
+
+	value, err := encodeSession(upperCodec{}, sess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(value, "v1:upper:") {
+		t.Errorf("expected the custom codec header, got %q", value)
+	}
+
+	// The overseers codec decodes sessions that name it
+	got, err := decodeSession(upperCodec{}, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Value) != `"value"` || string(got.Flash["f"]) != `"flash"` || !got.Created.Equal(created) {
+		t.Errorf("expected %#v, got %#v", sess, got)
+	}
+	if got.codec.Name() != "upper" {
+		t.Errorf("expected the session codec to be upper, got %q", got.codec.Name())
+	}
+
+	// Other overseers do not know the custom codec
+	if _, err := decodeSession(JSONCodec{}, value); err == nil {
+		t.Error("expected an error for an unknown codec")
+	}
+	if _, err := decodeSession(JSONCodec{}, "v1:gob"); err == nil {
+		t.Error("expected an error for a header without a codec")
+	}
+	if _, err := decodeSession(JSONCodec{}, "v1:gob:!!"); err == nil {
+		t.Error("expected an error for invalid base64")
+	}
+}
+
+func TestCodecsCookieOverseer(t *testing.T) {
+	t.Parallel()
+
+	c := NewCookieOverseer(NewCookieOptions(), make([]byte, 32))
+	c.Codec = MessagePackCodec{}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+
+	if err := Set(c, w, r, "hi", "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	val, err := c.Get(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(val, "v1:msgpack:") {
+		t.Errorf("expected a msgpack session, got %q", val)
+	}
+
+	if val, err := Get(c, w, r, "hi"); err != nil {
+		t.Error(err)
+	} else if val != "hello" {
+		t.Errorf("expected %q, got %q", "hello", val)
+	}
+}
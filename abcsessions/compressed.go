@@ -0,0 +1,216 @@
+package abcsessions
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/friendsofgo/errors"
+)
+
+const (
+	// compressedPrefix marks gzip compressed, base64 encoded values
+	compressedPrefix = "gz:"
+	// rawPrefix marks uncompressed values that would otherwise be
+	// mistaken for compressed values
+	rawPrefix = "raw:"
+	// defaultCompressThreshold is the default size of the smallest value
+	// that is compressed
+	defaultCompressThreshold = 1024
+)
+
+// CompressingStorer is a Storer decorator that gzip compresses large session
+// values before they are written to the Storer it wraps. Smaller values are
+// stored as is, as are values that do not get smaller when compressed.
+//
+// To encrypt the values as well, the CompressingStorer must wrap the
+// EncryptingStorer since encrypted values can not be compressed:
+//
+//	encrypted, _ := NewEncryptingStorer(storer, key)
+//	storer = NewCompressingStorer(encrypted, 0)
+type CompressingStorer struct {
+	storerWrapper
+	threshold int
+}
+
+// NewCompressingStorer wraps the storer so that values of threshold bytes or
+// more are compressed. A threshold of 0 uses the default of 1024 bytes.
+// Values already in the storer are read as uncompressed values.
+func NewCompressingStorer(storer Storer, threshold int) *CompressingStorer {
+	if threshold <= 0 {
+		threshold = defaultCompressThreshold
+	}
+
+	return &CompressingStorer{
+		storerWrapper: storerWrapper{storer: storer},
+		threshold:     threshold,
+	}
+}
+
+// Get returns the decompressed value of the session pointed to by the
+// session id key.
+func (c *CompressingStorer) Get(key string) (string, error) {
+	return c.GetContext(context.Background(), key)
+}
+
+// GetContext returns the decompressed value of the session pointed to by the
+// session id key.
+func (c *CompressingStorer) GetContext(ctx context.Context, key string) (string, error) {
+	value, err := AsStorerContext(c.storer).GetContext(ctx, key)
+	if err != nil {
+		return "", err
+	}
+
+	return decompressValue(value)
+}
+
+// Set compresses the value if it is large enough and stores it in the
+// wrapped storer
+func (c *CompressingStorer) Set(key, value string) error {
+	return c.SetContext(context.Background(), key, value)
+}
+
+// SetContext compresses the value if it is large enough and stores it in the
+// wrapped storer
+func (c *CompressingStorer) SetContext(ctx context.Context, key, value string) error {
+	compressed, err := c.compress(value)
+	if err != nil {
+		return err
+	}
+
+	return AsStorerContext(c.storer).SetContext(ctx, key, compressed)
+}
+
+// SetWithTTL compresses the value if it is large enough and stores it in the
+// wrapped storer, which must be a TTLStorer, expiring it after ttl.
+func (c *CompressingStorer) SetWithTTL(key, value string, ttl time.Duration) error {
+	ttlStorer, err := c.ttlStorer()
+	if err != nil {
+		return err
+	}
+
+	compressed, err := c.compress(value)
+	if err != nil {
+		return err
+	}
+
+	return ttlStorer.SetWithTTL(key, compressed, ttl)
+}
+
+// ResetExpiry resets the expiry of the session in the wrapped storer
+func (c *CompressingStorer) ResetExpiry(key string) error {
+	return c.storer.ResetExpiry(key)
+}
+
+// ResetExpiryContext resets the expiry of the session in the wrapped storer
+func (c *CompressingStorer) ResetExpiryContext(ctx context.Context, key string) error {
+	return AsStorerContext(c.storer).ResetExpiryContext(ctx, key)
+}
+
+// GetVersion returns the decompressed value and the version of the session
+// in the wrapped storer, which must be a CASStorer.
+func (c *CompressingStorer) GetVersion(key string) (value, version string, err error) {
+	return c.GetVersionContext(context.Background(), key)
+}
+
+// GetVersionContext returns the decompressed value and the version of the
+// session in the wrapped storer, which must be a CASStorer.
+func (c *CompressingStorer) GetVersionContext(ctx context.Context, key string) (value, version string, err error) {
+	cas, err := c.casStorer()
+	if err != nil {
+		return "", "", err
+	}
+
+	value, version, err = cas.GetVersionContext(ctx, key)
+	if err != nil {
+		return "", "", err
+	}
+
+	value, err = decompressValue(value)
+	return value, version, err
+}
+
+// SetIfVersion compresses the value if it is large enough and stores it in
+// the wrapped storer if the version still matches. The wrapped storer must
+// be a CASStorer.
+func (c *CompressingStorer) SetIfVersion(key, value, version string) error {
+	return c.SetIfVersionContext(context.Background(), key, value, version)
+}
+
+// SetIfVersionContext compresses the value if it is large enough and stores
+// it in the wrapped storer if the version still matches. The wrapped storer
+// must be a CASStorer.
+func (c *CompressingStorer) SetIfVersionContext(ctx context.Context, key, value, version string) error {
+	cas, err := c.casStorer()
+	if err != nil {
+		return err
+	}
+
+	compressed, err := c.compress(value)
+	if err != nil {
+		return err
+	}
+
+	return cas.SetIfVersionContext(ctx, key, compressed, version)
+}
+
+// compress returns the value gzip compressed and base64 encoded if it is at
+// least threshold bytes long and gets smaller, otherwise the value as is.
+func (c *CompressingStorer) compress(value string) (string, error) {
+	raw := value
+	if strings.HasPrefix(value, compressedPrefix) || strings.HasPrefix(value, rawPrefix) {
+		raw = rawPrefix + value
+	}
+
+	if len(value) < c.threshold {
+		return raw, nil
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte(value)); err != nil {
+		return "", errors.Wrap(err, "unable to compress session value")
+	}
+	if err := gz.Close(); err != nil {
+		return "", errors.Wrap(err, "unable to compress session value")
+	}
+
+	compressed := compressedPrefix + base64.StdEncoding.EncodeToString(buf.Bytes())
+	if len(compressed) >= len(raw) {
+		return raw, nil
+	}
+
+	return compressed, nil
+}
+
+// decompressValue returns the original value of a value stored by compress
+func decompressValue(value string) (string, error) {
+	if strings.HasPrefix(value, rawPrefix) {
+		return value[len(rawPrefix):], nil
+	}
+	if !strings.HasPrefix(value, compressedPrefix) {
+		return value, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(value[len(compressedPrefix):])
+	if err != nil {
+		return "", errors.Wrap(err, "unable to base64 decode session value")
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", errors.Wrap(err, "unable to decompress session value")
+	}
+	defer gz.Close()
+
+	pt, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to decompress session value")
+	}
+
+	return string(pt), nil
+}
@@ -0,0 +1,96 @@
+package abcsessions
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestCompressingStorer(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	c := NewCompressingStorer(m, 100)
+
+	large := strings.Repeat("compressible ", 100)
+
+	random := make([]byte, 300)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	incompressible := base64.StdEncoding.EncodeToString(random)
+
+	tests := []struct {
+		Value  string
+		Stored string
+	}{
+		{"small", "small"},
+		{"gz:small", "raw:gz:small"},
+		{"raw:small", "raw:raw:small"},
+		{large, "gz:"},
+		{"gz:" + large, "gz:"},
+		{incompressible, incompressible},
+	}
+
+	for i, test := range tests {
+		if err := c.Set("key", test.Value); err != nil {
+			t.Fatal(err)
+		}
+
+		stored := m.sessions["key"].value
+		if test.Stored == "gz:" {
+			if !strings.HasPrefix(stored, "gz:") || len(stored) >= len(test.Value) {
+				t.Errorf("%d) expected the value to be compressed, got %q", i, stored)
+			}
+		} else if stored != test.Stored {
+			t.Errorf("%d) expected %q to be stored, got %q", i, test.Stored, stored)
+		}
+
+		if val, err := c.Get("key"); err != nil {
+			t.Errorf("%d) %v", i, err)
+		} else if val != test.Value {
+			t.Errorf("%d) expected %q, got %q", i, test.Value, val)
+		}
+	}
+
+	// Values stored before the storer was wrapped are read as is
+	m.put("plain", memorySession{value: `{"Value":null}`})
+	if val, err := c.Get("plain"); err != nil {
+		t.Error(err)
+	} else if val != `{"Value":null}` {
+		t.Errorf("expected %q, got %q", `{"Value":null}`, val)
+	}
+
+	m.put("broken", memorySession{value: "gz:!!"})
+	if _, err := c.Get("broken"); err == nil {
+		t.Error("expected an error for an invalid compressed value")
+	}
+}
+
+func TestCompressingStorerVersion(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	c := NewCompressingStorer(m, 0)
+
+	large := strings.Repeat("a", 2000)
+	if err := c.SetIfVersion("key", large, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	val, version, err := c.GetVersion("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != large {
+		t.Errorf("expected the decompressed value, got %d bytes", len(val))
+	}
+
+	if err := c.SetIfVersion("key", "small", version); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetIfVersion("key", "again", version); !IsVersionConflictError(err) {
+		t.Errorf("expected a version conflict, got: %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package abcsessions
+
+import (
+	"context"
+)
+
+// StorerContext is a Storer whose operations take a context, so a slow
+// storer does not hold a request past its deadline or after the client went
+// away. The StorageOverseer and TokenOverseer pass the context of the
+// request to it when their Storer implements it. All of the built-in
+// storers implement it.
+//
+// The operations return the error of the context, which can be checked with
+// errors.Is, if it is done before they finish. An operation that writes
+// must not return it once the write could have been made, so storers that
+// can not cancel a write check the context before they start it.
+type StorerContext interface {
+	Storer
+	// AllContext returns all keys in the store
+	AllContext(ctx context.Context) (keys []string, err error)
+	// GetContext returns the value string saved in the session pointed to
+	// by the session id key.
+	GetContext(ctx context.Context, key string) (value string, err error)
+	// SetContext saves the value string to the session pointed to by the
+	// session id key.
+	SetContext(ctx context.Context, key, value string) error
+	// DelContext deletes the session pointed to by the session id key.
+	DelContext(ctx context.Context, key string) error
+	// ResetExpiryContext resets the expiry of the session pointed to by
+	// the session id key.
+	ResetExpiryContext(ctx context.Context, key string) error
+}
+
+// AsStorerContext returns the storer as a StorerContext. Storers that do not
+// implement it are adapted so that each operation first checks if the
+// context is done, but an operation can not be stopped once it started.
+func AsStorerContext(storer Storer) StorerContext {
+	if s, ok := storer.(StorerContext); ok {
+		return s
+	}
+
+	return storerContextAdapter{Storer: storer}
+}
+
+// storerContextAdapter adapts a Storer to a StorerContext
+type storerContextAdapter struct {
+	Storer
+}
+
+// AllContext returns all keys in the store if ctx is not done
+func (s storerContextAdapter) AllContext(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return s.All()
+}
+
+// GetContext returns the value of the session if ctx is not done
+func (s storerContextAdapter) GetContext(ctx context.Context, key string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	return s.Get(key)
+}
+
+// SetContext saves the value of the session if ctx is not done
+func (s storerContextAdapter) SetContext(ctx context.Context, key, value string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.Set(key, value)
+}
+
+// DelContext deletes the session if ctx is not done
+func (s storerContextAdapter) DelContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.Del(key)
+}
+
+// ResetExpiryContext resets the expiry of the session if ctx is not done
+func (s storerContextAdapter) ResetExpiryContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.ResetExpiry(key)
+}
+
+// CASStorerContext is a CASStorer whose version operations take a context,
+// like StorerContext. The StorageOverseer and TokenOverseer pass the context
+// of the request to it. All of the built-in CASStorers implement it.
+type CASStorerContext interface {
+	CASStorer
+	// GetVersionContext returns the value string and the version of the
+	// session pointed to by the session id key.
+	GetVersionContext(ctx context.Context, key string) (value, version string, err error)
+	// SetIfVersionContext saves the value string to the session pointed to
+	// by the session id key if the session is still at version.
+	SetIfVersionContext(ctx context.Context, key, value, version string) error
+}
+
+// AsCASStorerContext returns the storer as a CASStorerContext. Storers that
+// do not implement it are adapted like in AsStorerContext.
+func AsCASStorerContext(storer CASStorer) CASStorerContext {
+	if s, ok := storer.(CASStorerContext); ok {
+		return s
+	}
+
+	return casStorerContextAdapter{CASStorer: storer}
+}
+
+// casStorerContextAdapter adapts a CASStorer to a CASStorerContext
+type casStorerContextAdapter struct {
+	CASStorer
+}
+
+// GetVersionContext returns the value and version of the session if ctx is
+// not done
+func (c casStorerContextAdapter) GetVersionContext(ctx context.Context, key string) (string, string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", "", err
+	}
+
+	return c.GetVersion(key)
+}
+
+// SetIfVersionContext saves the value of the session if it is still at
+// version and ctx is not done
+func (c casStorerContextAdapter) SetIfVersionContext(ctx context.Context, key, value, version string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return c.SetIfVersion(key, value, version)
+}
+
+// readContext runs op and returns its error, or the error of ctx if it is
+// done first. An op that is still running when ctx is done is left to
+// finish in the background, so it must only read, and must not touch
+// anything the caller uses after readContext returns. Writes must not be
+// abandoned, or a write reported as failed could still be made.
+func readContext(ctx context.Context, op func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// Contexts that are never done do not need a go routine
+	if ctx.Done() == nil {
+		return op()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- op()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
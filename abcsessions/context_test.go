@@ -0,0 +1,192 @@
+package abcsessions
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/friendsofgo/errors"
+	redis "gopkg.in/redis.v5"
+)
+
+// plainStorer hides the StorerContext methods of the storer it holds
+type plainStorer struct {
+	Storer
+}
+
+func TestStorerContextImplements(t *testing.T) {
+	t.Parallel()
+
+	var _ StorerContext = &MemoryStorer{}
+	var _ StorerContext = &DiskStorer{}
+	var _ StorerContext = &RedisStorer{}
+	var _ StorerContext = &SQLStorer{}
+	var _ StorerContext = &EncryptingStorer{}
+	var _ StorerContext = &CompressingStorer{}
+
+	var _ CASStorerContext = &MemoryStorer{}
+	var _ CASStorerContext = &DiskStorer{}
+	var _ CASStorerContext = &RedisStorer{}
+	var _ CASStorerContext = &EncryptingStorer{}
+	var _ CASStorerContext = &CompressingStorer{}
+}
+
+func TestAsStorerContext(t *testing.T) {
+	t.Parallel()
+
+	mem, _ := NewDefaultMemoryStorer()
+	if s := AsStorerContext(mem); s != StorerContext(mem) {
+		t.Errorf("expected the storer itself, got %T", s)
+	}
+
+	s := AsStorerContext(plainStorer{mem})
+	if _, ok := s.(storerContextAdapter); !ok {
+		t.Fatalf("expected an adapter, got %T", s)
+	}
+
+	ctx := context.Background()
+	if err := s.SetContext(ctx, "a", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := s.GetContext(ctx, "a"); err != nil || val != "value" {
+		t.Errorf("expected %q, got %q: %v", "value", val, err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	if _, err := s.GetContext(canceled, "a"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled, got: %v", err)
+	}
+	if err := s.DelContext(canceled, "a"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled, got: %v", err)
+	}
+	if val, err := mem.Get("a"); err != nil || val != "value" {
+		t.Errorf("expected the session to be kept, got %q: %v", val, err)
+	}
+}
+
+func TestStorageOverseerRequestContext(t *testing.T) {
+	t.Parallel()
+
+	mem, _ := NewDefaultMemoryStorer()
+	s := NewStorageOverseer(NewCookieOptions(), mem)
+	mem.put("sessionid", memorySession{value: "value"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r := httptest.NewRequest("GET", "http://localhost", nil).WithContext(ctx)
+	r.AddCookie(&http.Cookie{Name: s.options.Name, Value: "sessionid"})
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+
+	if _, err := s.Get(w, r); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled, got: %v", err)
+	}
+	if err := s.Set(w, r, "changed"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled, got: %v", err)
+	}
+	if val, _ := mem.Get("sessionid"); val != "value" {
+		t.Errorf("expected the session to be kept, got %q", val)
+	}
+}
+
+// cancelingStorer cancels the request once the version of the session was
+// read, so the update that follows is made with a done context
+type cancelingStorer struct {
+	*MemoryStorer
+	cancel context.CancelFunc
+}
+
+func (c cancelingStorer) GetVersionContext(ctx context.Context, key string) (string, string, error) {
+	defer c.cancel()
+	return c.MemoryStorer.GetVersionContext(ctx, key)
+}
+
+func TestStorageOverseerCASRequestContext(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mem, _ := NewDefaultMemoryStorer()
+	s := NewStorageOverseer(NewCookieOptions(), cancelingStorer{MemoryStorer: mem, cancel: cancel})
+
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	if err := Set(s, w, r, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	cookie := w.cookies[s.options.Name]
+
+	r = httptest.NewRequest("GET", "http://localhost", nil).WithContext(ctx)
+	r.AddCookie(cookie)
+	w = newSessionsResponseWriter(httptest.NewRecorder())
+	if err := Set(s, w, r, "a", "2"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled, got: %v", err)
+	}
+
+	r = httptest.NewRequest("GET", "http://localhost", nil)
+	r.AddCookie(cookie)
+	if val, err := Get(s, w, r, "a"); err != nil || val != "1" {
+		t.Errorf("expected the session to be kept, got %q: %v", val, err)
+	}
+}
+
+func TestRedisStorerContextDeadline(t *testing.T) {
+	t.Parallel()
+
+	// A redis server that accepts connections but never replies
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(ioutil.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	r, err := NewRedisStorer(redis.Options{Addr: ln.Addr().String(), ReadTimeout: time.Second}, time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.client.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := r.GetContext(ctx, "a"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got: %v", err)
+	}
+	if took := time.Since(start); took > 500*time.Millisecond {
+		t.Errorf("expected GetContext to return at the deadline, took %v", took)
+	}
+
+	// Writes wait for the command, so they never report the deadline while
+	// the write could still be made
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := r.SetContext(ctx, "a", "value"); err == nil || errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the read timeout of the client, got: %v", err)
+	}
+	if err := r.SetContext(ctx, "a", "value"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded once the context is done, got: %v", err)
+	}
+}
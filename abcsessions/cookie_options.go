@@ -2,7 +2,19 @@ package abcsessions
 
 import (
 	"net/http"
+	"strconv"
 	"time"
+
+	"github.com/friendsofgo/errors"
+)
+
+const (
+	// defaultCookieChunkSize leaves room for the cookie name and attributes
+	// below the 4096 byte limit browsers put on a single cookie
+	defaultCookieChunkSize = 3800
+	// defaultCookieMaxSize allows four full chunks, which keeps the Cookie
+	// request header below the 16KB limit many proxies and servers enforce
+	defaultCookieMaxSize = 4 * defaultCookieChunkSize
 )
 
 // CookieOptions for the session cookies themselves.
@@ -21,6 +33,23 @@ type CookieOptions struct {
 	Secure bool
 	// HTTPOnly means the browser will never allow JS to touch this cookie
 	HTTPOnly bool
+	// SameSite controls whether the browser sends the cookie with cross-site
+	// requests. http.SameSiteNoneMode requires Secure to be set.
+	// A value of 0 leaves the attribute out and the browser picks the default.
+	SameSite http.SameSite
+	// Partitioned stores the cookie in partitioned storage keyed by the top
+	// level site (CHIPS), for apps embedded in other sites with
+	// SameSite=None. Partitioned requires Secure to be set.
+	Partitioned bool
+
+	// ChunkSize is the largest value the CookieOverseer puts in a single
+	// cookie. Larger values are split across the Name, Name.1, Name.2...
+	// cookies. A value of 0 uses the default of 3800 bytes.
+	ChunkSize int
+	// MaxSize is the largest value the CookieOverseer writes across all
+	// chunks. Setting a larger value returns an error that can be checked
+	// with IsCookieTooLargeError. A value of 0 uses the default of 15200 bytes.
+	MaxSize int
 }
 
 // NewCookieOptions gives healthy defaults for session cookies
@@ -31,9 +60,26 @@ func NewCookieOptions() CookieOptions {
 		MaxAge:   0,
 		Secure:   true,
 		HTTPOnly: true,
+		SameSite: http.SameSiteLaxMode,
 	}
 }
 
+// Validate returns an error if the options would create cookies that
+// browsers reject.
+func (c CookieOptions) Validate() error {
+	if len(c.Name) == 0 {
+		return errors.New("cookie name must be provided")
+	}
+	if c.SameSite == http.SameSiteNoneMode && !c.Secure {
+		return errors.New("cookie with SameSite=None must be secure")
+	}
+	if c.Partitioned && !c.Secure {
+		return errors.New("partitioned cookie must be secure")
+	}
+
+	return nil
+}
+
 func (c CookieOptions) makeCookie(value string) *http.Cookie {
 	cookie := &http.Cookie{
 		Domain:   c.Domain,
@@ -43,7 +89,9 @@ func (c CookieOptions) makeCookie(value string) *http.Cookie {
 		MaxAge:   int(c.MaxAge.Seconds()),
 		HttpOnly: c.HTTPOnly,
 		Secure:   c.Secure,
+		SameSite: c.SameSite,
 	}
+	c.setPartitioned(cookie)
 
 	if c.MaxAge != 0 {
 		cookie.Expires = time.Now().UTC().Add(c.MaxAge)
@@ -52,22 +100,51 @@ func (c CookieOptions) makeCookie(value string) *http.Cookie {
 	return cookie
 }
 
+// WriteCookie sets a cookie made with the options on the response, for
+// cookies kept next to the session cookie. Its attributes match the session
+// cookie, including Partitioned which http.SetCookie leaves out, and it is
+// written with the session cookie. It must be called after the abcsessions
+// middleware.
+func WriteCookie(w http.ResponseWriter, opts CookieOptions, value string) {
+	w.(cookieWriter).SetCookie(opts.makeCookie(value))
+}
+
 // deleteCookie sets the cookie to a deleted value to force the client to delete
 func (c CookieOptions) deleteCookie(w http.ResponseWriter) {
+	w.(cookieWriter).SetCookie(c.makeDeleteCookie(c.Name))
+}
+
+func (c CookieOptions) makeDeleteCookie(name string) *http.Cookie {
 	cookie := &http.Cookie{
 		// If the browser refuses to delete it, set value to "" so subsequent
 		// requests replace it when it does not point to a valid session id.
 		Path:     c.Path,
 		Domain:   c.Domain,
 		Value:    "",
-		Name:     c.Name,
+		Name:     name,
 		MaxAge:   -1,
 		Expires:  time.Now().UTC().AddDate(-1, 0, 0),
 		HttpOnly: c.HTTPOnly,
 		Secure:   c.Secure,
+		SameSite: c.SameSite,
 	}
+	// The attributes must match the cookie being deleted or the browser
+	// treats it as a different cookie and keeps the original.
+	c.setPartitioned(cookie)
 
-	w.(cookieWriter).SetCookie(cookie)
+	return cookie
+}
+
+// partitionedAttr is the Set-Cookie attribute for partitioned cookies
+const partitionedAttr = "Partitioned"
+
+// setPartitioned adds the Partitioned attribute to the cookie. net/http
+// has no field for it, so it is carried in Unparsed and appended to the
+// Set-Cookie header by the sessionsResponseWriter.
+func (c CookieOptions) setPartitioned(cookie *http.Cookie) {
+	if c.Partitioned {
+		cookie.Unparsed = append(cookie.Unparsed, partitionedAttr)
+	}
 }
 
 // getCookieValue returns the cookie value (usually the ID of the session)
@@ -87,3 +164,112 @@ func (c CookieOptions) getCookieValue(w http.ResponseWriter, r *http.Request) (s
 
 	return reqCookie.Value, nil
 }
+
+// chunkName returns the cookie name of the nth chunk of a chunked value.
+// The first chunk uses the plain cookie name so values that fit in a
+// single cookie are stored the same way as unchunked values.
+func (c CookieOptions) chunkName(n int) string {
+	if n == 0 {
+		return c.Name
+	}
+
+	return c.Name + "." + strconv.Itoa(n)
+}
+
+// setChunkedCookies splits the value across as many cookies as required
+// and deletes any chunks left over from a previously larger value.
+// It returns an error if the value is larger than MaxSize.
+func (c CookieOptions) setChunkedCookies(w http.ResponseWriter, r *http.Request, value string) error {
+	maxSize := c.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultCookieMaxSize
+	}
+	if len(value) > maxSize {
+		return errCookieTooLarge{size: len(value), max: maxSize}
+	}
+
+	chunkSize := c.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultCookieChunkSize
+	}
+
+	cw := w.(cookieWriter)
+	existing := c.countChunks(w, r)
+
+	n := 0
+	for ; n == 0 || len(value) > 0; n++ {
+		size := chunkSize
+		if size > len(value) {
+			size = len(value)
+		}
+
+		cookie := c.makeCookie(value[:size])
+		cookie.Name = c.chunkName(n)
+		cw.SetCookie(cookie)
+		value = value[size:]
+	}
+
+	for ; n < existing; n++ {
+		cw.SetCookie(c.makeDeleteCookie(c.chunkName(n)))
+	}
+
+	return nil
+}
+
+// deleteChunkedCookies deletes every chunk of a chunked value
+func (c CookieOptions) deleteChunkedCookies(w http.ResponseWriter, r *http.Request) {
+	existing := c.countChunks(w, r)
+	if existing == 0 {
+		existing = 1
+	}
+
+	for n := 0; n < existing; n++ {
+		w.(cookieWriter).SetCookie(c.makeDeleteCookie(c.chunkName(n)))
+	}
+}
+
+// getChunkedCookieValue joins the chunks of a value set with
+// setChunkedCookies. Like getCookieValue, chunks in the cookies cache take
+// precedence over the chunks in the request headers.
+func (c CookieOptions) getChunkedCookieValue(w http.ResponseWriter, r *http.Request) (string, error) {
+	n := c.countChunks(w, r)
+	if n == 0 {
+		return "", errNoSession{}
+	}
+
+	var value []byte
+	for i := 0; i < n; i++ {
+		chunk, _ := c.getChunk(w, r, i)
+		value = append(value, chunk.Value...)
+	}
+
+	return string(value), nil
+}
+
+// countChunks returns the number of consecutive chunks that exist, ignoring
+// chunks that have been deleted in the cookies cache.
+func (c CookieOptions) countChunks(w http.ResponseWriter, r *http.Request) int {
+	n := 0
+	for {
+		if _, ok := c.getChunk(w, r, n); !ok {
+			return n
+		}
+		n++
+	}
+}
+
+// getChunk returns the nth chunk from the cookies cache or the request
+func (c CookieOptions) getChunk(w http.ResponseWriter, r *http.Request, n int) (*http.Cookie, bool) {
+	name := c.chunkName(n)
+
+	if cookie := w.(cookieWriter).GetCookie(name); cookie != nil {
+		return cookie, cookie.MaxAge >= 0
+	}
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return nil, false
+	}
+
+	return cookie, true
+}
@@ -3,6 +3,7 @@ package abcsessions
 import (
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -23,6 +24,47 @@ func TestNewCookieOptions(t *testing.T) {
 	if o.HTTPOnly != true {
 		t.Error("expected httponly to be true")
 	}
+	if o.SameSite != http.SameSiteLaxMode {
+		t.Error("expected samesite to be lax")
+	}
+	if o.Partitioned {
+		t.Error("expected partitioned to be false")
+	}
+	if err := o.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCookieOptionsValidate(t *testing.T) {
+	t.Parallel()
+
+	o := NewCookieOptions()
+	o.Name = ""
+	if err := o.Validate(); err == nil {
+		t.Error("expected error for empty name")
+	}
+
+	o = NewCookieOptions()
+	o.SameSite = http.SameSiteNoneMode
+	if err := o.Validate(); err != nil {
+		t.Error(err)
+	}
+	o.Secure = false
+	if err := o.Validate(); err == nil {
+		t.Error("expected error for samesite none without secure")
+	}
+
+	o = NewCookieOptions()
+	o.SameSite = http.SameSiteNoneMode
+	o.Partitioned = true
+	if err := o.Validate(); err != nil {
+		t.Error(err)
+	}
+	o.SameSite = http.SameSiteStrictMode
+	o.Secure = false
+	if err := o.Validate(); err == nil {
+		t.Error("expected error for partitioned without secure")
+	}
 }
 
 func TestMakeCookie(t *testing.T) {
@@ -46,6 +88,12 @@ func TestMakeCookie(t *testing.T) {
 	if c.Secure != o.Secure {
 		t.Errorf("expected secure %t to match %t", c.Secure, o.Secure)
 	}
+	if c.SameSite != o.SameSite {
+		t.Errorf("expected samesite %v to match %v", c.SameSite, o.SameSite)
+	}
+	if len(c.Unparsed) != 0 {
+		t.Errorf("expected no unparsed attributes, got %v", c.Unparsed)
+	}
 	if c.MaxAge != 0 {
 		if c.Expires.Equal(time.Time{}) {
 			t.Errorf("when maxage is 0 expected expires to be non-zero")
@@ -96,3 +144,116 @@ func TestGetCookieValue(t *testing.T) {
 		t.Errorf("Expected %q, got %q", "idvalue", val)
 	}
 }
+
+func TestChunkedCookies(t *testing.T) {
+	t.Parallel()
+
+	o := NewCookieOptions()
+	o.ChunkSize = 10
+	o.MaxSize = 45
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+
+	if _, err := o.getChunkedCookieValue(w, r); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+
+	value := strings.Repeat("abcdefghij", 3) + "xyz"
+	if err := o.setChunkedCookies(w, r, value); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"id", "id.1", "id.2", "id.3"} {
+		if c := w.GetCookie(name); c == nil || c.MaxAge < 0 {
+			t.Errorf("expected chunk %s to be set", name)
+		}
+	}
+	if w.GetCookie("id.3").Value != "xyz" {
+		t.Errorf("expected last chunk to be %q, got %q", "xyz", w.GetCookie("id.3").Value)
+	}
+
+	val, err := o.getChunkedCookieValue(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != value {
+		t.Errorf("expected %q, got %q", value, val)
+	}
+
+	// Move the chunks into a new request to check they are read from it
+	r = httptest.NewRequest("GET", "http://localhost", nil)
+	for _, c := range w.cookies {
+		r.AddCookie(c)
+	}
+	w = newSessionsResponseWriter(httptest.NewRecorder())
+
+	val, err = o.getChunkedCookieValue(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != value {
+		t.Errorf("expected %q, got %q", value, val)
+	}
+
+	// Shrinking the value deletes the stale chunks
+	if err := o.setChunkedCookies(w, r, "short"); err != nil {
+		t.Fatal(err)
+	}
+	if w.GetCookie("id").Value != "short" {
+		t.Errorf("expected %q, got %q", "short", w.GetCookie("id").Value)
+	}
+	for _, name := range []string{"id.1", "id.2", "id.3"} {
+		if c := w.GetCookie(name); c == nil || c.MaxAge >= 0 {
+			t.Errorf("expected stale chunk %s to be deleted", name)
+		}
+	}
+
+	val, err = o.getChunkedCookieValue(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "short" {
+		t.Errorf("expected %q, got %q", "short", val)
+	}
+
+	err = o.setChunkedCookies(w, r, strings.Repeat("a", 46))
+	if !IsCookieTooLargeError(err) {
+		t.Errorf("expected cookie too large error, got: %v", err)
+	}
+
+	o.deleteChunkedCookies(w, r)
+	for _, name := range []string{"id", "id.1", "id.2", "id.3"} {
+		if c := w.GetCookie(name); c == nil || c.MaxAge >= 0 {
+			t.Errorf("expected chunk %s to be deleted", name)
+		}
+	}
+	if _, err := o.getChunkedCookieValue(w, r); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+}
+
+func TestMakeCookiePartitioned(t *testing.T) {
+	t.Parallel()
+
+	o := NewCookieOptions()
+	o.SameSite = http.SameSiteNoneMode
+	o.Partitioned = true
+
+	w := httptest.NewRecorder()
+	setCookie(w, o.makeCookie("test"))
+	setCookie(w, o.makeDeleteCookie(o.Name))
+
+	headers := w.Result().Header["Set-Cookie"]
+	if len(headers) != 2 {
+		t.Fatalf("expected 2 cookies, got %d", len(headers))
+	}
+	for _, h := range headers {
+		if !strings.Contains(h, "; SameSite=None") {
+			t.Errorf("expected SameSite=None in %q", h)
+		}
+		if !strings.HasSuffix(h, "; Partitioned") {
+			t.Errorf("expected Partitioned in %q", h)
+		}
+	}
+}
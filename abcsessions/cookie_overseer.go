@@ -1,23 +1,53 @@
 package abcsessions
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
-	"encoding/base64"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/friendsofgo/errors"
+	uuid "github.com/satori/go.uuid"
 )
 
+// cookieIDPrefix starts the payload of cookies that hold a session id. It is
+// followed by the session id, a colon and the session value. Cookies set
+// before session ids were added have no prefix and get a session id the
+// next time they are set.
+const cookieIDPrefix = "sid1:"
+
+// CookieRevoker is a server-side deny-list of cookie session ids. Cookie
+// sessions are stored by the client, so without one a copy of a session
+// cookie stays valid until it expires, even after the session was deleted
+// or regenerated.
+type CookieRevoker interface {
+	// Revoke adds the session id to the deny-list. It is called by Del
+	// and Regenerate with the session id they replace. Entries can be
+	// dropped once the cookie MaxAge or AbsoluteMaxAge has passed.
+	Revoke(id string) error
+	// Revoked returns true if the session id is on the deny-list
+	Revoked(id string) (bool, error)
+}
+
 // CookieOverseer oversees cookie operations that are encrypted and verified
 // but does store all data client side which means it is a possible attack
 // vector. Uses GCM to verify and encrypt data.
 type CookieOverseer struct {
+	// AbsoluteMaxAge is how long a session may live after it was created,
+	// however often its expiry is reset. Sessions past it are deleted when
+	// they are read. A value of 0 means sessions only expire with the
+	// cookie MaxAge.
+	AbsoluteMaxAge time.Duration
+	// Codec encodes the sessions set with the helpers, defaults to
+	// JSONCodec. Sessions encoded with another codec are still read, and
+	// keep their codec until they are deleted.
+	Codec Codec
+	// Revoker, if set, is told the session ids Del and Regenerate replace,
+	// and sessions whose id it revoked are treated as missing.
+	Revoker CookieRevoker
+
 	options CookieOptions
 
-	secretKey    []byte
-	gcmBlockMode cipher.AEAD
+	keys *keyring
 
 	resetExpiryMiddleware
 }
@@ -25,23 +55,31 @@ type CookieOverseer struct {
 // NewCookieOverseer creates an overseer from cookie options and a secret key
 // for use in encryption. Panic's on any errors that deal with cryptography.
 func NewCookieOverseer(opts CookieOptions, secretKey []byte) *CookieOverseer {
-	if len(opts.Name) == 0 {
-		panic("cookie name must be provided")
-	}
+	return NewCookieOverseerWithKeys(opts, EncryptionKey{Key: secretKey})
+}
 
-	block, err := aes.NewCipher(secretKey)
-	if err != nil {
+// NewCookieOverseerWithKeys creates an overseer from cookie options and a
+// keyring for use in encryption. New cookies are encrypted with the current
+// key, cookies encrypted with one of the old keys can still be decrypted and
+// are re-encrypted with the current key on the next Set or ResetExpiry.
+// Cookies encrypted with a key that is not in the keyring are treated as
+// if there is no session.
+//
+// To rotate the key used with NewCookieOverseer, pass it as an old key with
+// an empty ID. Panic's on any errors that deal with cryptography.
+func NewCookieOverseerWithKeys(opts CookieOptions, current EncryptionKey, old ...EncryptionKey) *CookieOverseer {
+	if err := opts.Validate(); err != nil {
 		panic(err)
 	}
-	gcm, err := cipher.NewGCM(block)
+
+	keys, err := newKeyring(current, old...)
 	if err != nil {
 		panic(err)
 	}
 
 	o := &CookieOverseer{
-		options:      opts,
-		secretKey:    secretKey,
-		gcmBlockMode: gcm,
+		options: opts,
+		keys:    keys,
 	}
 
 	o.resetExpiryMiddleware.resetter = o
@@ -51,93 +89,245 @@ func NewCookieOverseer(opts CookieOptions, secretKey []byte) *CookieOverseer {
 
 // Get a value from the cookie overseer
 func (c *CookieOverseer) Get(w http.ResponseWriter, r *http.Request) (string, error) {
-	val, err := c.options.getCookieValue(w, r)
+	_, val, err := c.read(w, r)
 	if err != nil {
-		return "", errors.Wrap(err, "unable to get session value from cookie")
+		return "", err
 	}
 
-	return c.decode(val)
+	return val, nil
 }
 
-// Set a value into the cookie overseer
+// Set a value into the cookie overseer. Values that do not fit in a single
+// cookie are split across multiple cookies, see CookieOptions.ChunkSize.
+// The session keeps its session id, new sessions get a random one.
 func (c *CookieOverseer) Set(w http.ResponseWriter, r *http.Request, value string) error {
-	ev, err := c.encode(value)
+	id, err := c.currentID(w, r)
 	if err != nil {
-		return errors.Wrap(err, "unable to encode session value into cookie")
+		return err
+	}
+	if len(id) == 0 {
+		id = uuid.NewV4().String()
 	}
 
-	w.(cookieWriter).SetCookie(c.options.makeCookie(ev))
-
-	return nil
+	return c.write(w, r, id, value)
 }
 
-// Del a value from the cookie overseer
+// Del a value from the cookie overseer. The session id is revoked if the
+// overseer has a Revoker.
 func (c *CookieOverseer) Del(w http.ResponseWriter, r *http.Request) error {
-	c.options.deleteCookie(w)
+	id, err := c.currentID(w, r)
+	if err != nil {
+		return err
+	}
+
+	if len(id) != 0 && c.Revoker != nil {
+		if err := c.Revoker.Revoke(id); err != nil {
+			return errors.Wrap(err, "unable to revoke session id")
+		}
+	}
+
+	c.deleteCookies(w, r)
 	return nil
 }
 
-// Regenerate for the cookie overseer will panic because cookie sessions
-// do not have session IDs, only values.
+// Regenerate a new session ID for your current session. The session value
+// is sealed again with the new session ID and starts a new AbsoluteMaxAge
+// lifetime, and the old session ID is revoked if the overseer has a Revoker.
 func (c *CookieOverseer) Regenerate(w http.ResponseWriter, r *http.Request) error {
-	panic("cookie sessions do not use session ids")
+	id, val, err := c.read(w, r)
+	if err != nil {
+		return errors.Wrap(err, "unable to get session value from cookie")
+	}
+
+	val, err = renewCreated(c.codec(), val)
+	if err != nil {
+		return err
+	}
+
+	if len(id) != 0 && c.Revoker != nil {
+		if err := c.Revoker.Revoke(id); err != nil {
+			return errors.Wrap(err, "unable to revoke session id")
+		}
+	}
+
+	return c.write(w, r, uuid.NewV4().String(), val)
 }
 
-// SessionID for the cookie overseer will panic because cookie sessions
-// do not have session IDs, only values.
+// SessionID returns the random session ID sealed in the session cookie.
+// It will return a errNoSession error if no session exists.
 func (c *CookieOverseer) SessionID(w http.ResponseWriter, r *http.Request) (string, error) {
-	panic("cookie sessions do not use session ids")
+	id, val, err := c.read(w, r)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to get session id from cookie")
+	}
+	if len(id) != 0 {
+		return id, nil
+	}
+
+	// Sessions set before session ids were added get one now
+	id = uuid.NewV4().String()
+	if err := c.write(w, r, id, val); err != nil {
+		return "", err
+	}
+
+	return id, nil
 }
 
 // ResetExpiry resets the age of the session to time.Now(), so that
-// MaxAge calculations are renewed
+// MaxAge calculations are renewed. Sessions that are past the
+// AbsoluteMaxAge or whose session id has been revoked are deleted instead.
 func (c *CookieOverseer) ResetExpiry(w http.ResponseWriter, r *http.Request) error {
-	if c.options.MaxAge == 0 {
+	val, err := c.options.getChunkedCookieValue(w, r)
+	// Browser session cookies have no expiry to reset, so they only
+	// need to be rewritten if they were encrypted with an old key
+	if c.options.MaxAge == 0 && (err != nil || c.keys.isCurrent(val)) {
 		return nil
 	}
-
-	val, err := c.options.getCookieValue(w, r)
 	if err != nil {
 		return errors.Wrap(err, "unable to get session value from cookie")
 	}
 
-	w.(cookieWriter).SetCookie(c.options.makeCookie(val))
+	pt, err := c.decode(val)
+	if err != nil {
+		return errors.Wrap(err, "unable to decode session value from cookie")
+	}
+	id, value := splitCookieID(pt)
+	if err := c.check(w, r, id, value); err != nil {
+		return err
+	}
+
+	// Re-encrypt cookies that were encrypted with an old key
+	if !c.keys.isCurrent(val) {
+		if val, err = c.encode(pt); err != nil {
+			return errors.Wrap(err, "unable to encode session value into cookie")
+		}
+	}
 
-	return nil
+	return errors.Wrap(c.options.setChunkedCookies(w, r, val), "unable to set session cookies")
 }
 
-// encode into base64'd aes-gcm
-func (c *CookieOverseer) encode(plaintext string) (string, error) {
-	nonce := make([]byte, c.gcmBlockMode.NonceSize())
-	if _, err := rand.Read(nonce); err != nil {
-		return "", errors.Wrap(err, "failed to encode session cookie value")
+// read returns the session id and value of the session cookie. Sessions
+// that are past the AbsoluteMaxAge or whose session id has been revoked are
+// deleted and returned as errNoSession.
+func (c *CookieOverseer) read(w http.ResponseWriter, r *http.Request) (id, value string, err error) {
+	ct, err := c.options.getChunkedCookieValue(w, r)
+	if err != nil {
+		return "", "", errors.Wrap(err, "unable to get session value from cookie")
 	}
 
-	// Append ciphertext to the end of nonce so we have the nonce for decrypt
-	ciphertext := c.gcmBlockMode.Seal(nonce, nonce, []byte(plaintext), nil)
-	return base64.StdEncoding.EncodeToString(ciphertext), nil
+	pt, err := c.decode(ct)
+	if err != nil {
+		return "", "", err
+	}
+	id, value = splitCookieID(pt)
+
+	if err := c.check(w, r, id, value); err != nil {
+		return "", "", err
+	}
+
+	return id, value, nil
 }
 
-// decode base64'd aes-gcm
-func (c *CookieOverseer) decode(ciphertext string) (string, error) {
-	ct, err := base64.StdEncoding.DecodeString(ciphertext)
+// check deletes the session cookies and returns errNoSession if the session
+// id has been revoked or the session is past the AbsoluteMaxAge
+func (c *CookieOverseer) check(w http.ResponseWriter, r *http.Request, id, value string) error {
+	if len(id) != 0 && c.Revoker != nil {
+		revoked, err := c.Revoker.Revoked(id)
+		if err != nil {
+			return errors.Wrap(err, "unable to check if session id is revoked")
+		}
+		if revoked {
+			c.deleteCookies(w, r)
+			return errNoSession{}
+		}
+	}
+
+	if pastAbsoluteMaxAge(c.codec(), value, c.AbsoluteMaxAge) {
+		c.deleteCookies(w, r)
+		return errNoSession{}
+	}
+
+	return nil
+}
+
+// currentID returns the session id of the session cookie, or an empty
+// string if there is no valid session cookie or it has no session id.
+// Sessions that are past the AbsoluteMaxAge or whose session id has been
+// revoked are deleted and have no session id, so it is not issued again.
+func (c *CookieOverseer) currentID(w http.ResponseWriter, r *http.Request) (string, error) {
+	ct, err := c.options.getChunkedCookieValue(w, r)
+	if err != nil {
+		return "", nil
+	}
+
+	pt, err := c.decode(ct)
 	if err != nil {
 		return "", nil
 	}
 
-	if len(ct) <= c.gcmBlockMode.NonceSize() {
-		return "", errors.New("failed to decode session cookie value")
+	id, value := splitCookieID(pt)
+	if err := c.check(w, r, id, value); IsNoSessionError(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
 	}
 
-	// Nonce comes from the first n bytes (n = NonceSize)
-	plaintext, err := c.gcmBlockMode.Open(nil,
-		ct[:c.gcmBlockMode.NonceSize()],
-		ct[c.gcmBlockMode.NonceSize():],
-		nil)
+	return id, nil
+}
 
+// write seals the session id and value into the session cookies
+func (c *CookieOverseer) write(w http.ResponseWriter, r *http.Request, id, value string) error {
+	ev, err := c.encode(cookieIDPrefix + id + ":" + value)
 	if err != nil {
-		return "", errors.Wrap(err, "unable to open gcm block mode")
+		return errors.Wrap(err, "unable to encode session value into cookie")
+	}
+
+	return errors.Wrap(c.options.setChunkedCookies(w, r, ev), "unable to set session cookies")
+}
+
+// deleteCookies deletes the session cookies without revoking the session id
+func (c *CookieOverseer) deleteCookies(w http.ResponseWriter, r *http.Request) {
+	forgetSession(c, w)
+	c.options.deleteChunkedCookies(w, r)
+}
+
+// splitCookieID splits the payload of a session cookie into its session id
+// and value. Payloads without a session id return an empty id.
+func splitCookieID(payload string) (id, value string) {
+	if !strings.HasPrefix(payload, cookieIDPrefix) {
+		return "", payload
+	}
+
+	rest := payload[len(cookieIDPrefix):]
+	i := strings.IndexByte(rest, ':')
+	if i < 0 {
+		return "", payload
+	}
+
+	return rest[:i], rest[i+1:]
+}
+
+// encode into base64'd aes-gcm prefixed with the current key id
+func (c *CookieOverseer) encode(plaintext string) (string, error) {
+	ct, err := c.keys.seal([]byte(plaintext))
+	return ct, errors.Wrap(err, "failed to encode session cookie value")
+}
+
+// decode key id prefixed base64'd aes-gcm
+func (c *CookieOverseer) decode(ciphertext string) (string, error) {
+	pt, err := c.keys.open(ciphertext)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to decode session cookie value")
+	}
+
+	return string(pt), nil
+}
+
+// codec returns the Codec of the overseer, JSONCodec by default
+func (c *CookieOverseer) codec() Codec {
+	if c.Codec == nil {
+		return JSONCodec{}
 	}
 
-	return string(plaintext), nil
+	return c.Codec
 }
@@ -1,10 +1,10 @@
 package abcsessions
 
 import (
-	"bytes"
 	"net/http"
 	"net/http/httptest"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 )
@@ -28,12 +28,12 @@ func TestCookieOverseerNew(t *testing.T) {
 		t.Error("c should not be nil")
 	}
 
-	if c.gcmBlockMode == nil {
+	if c.keys == nil || c.keys.current == nil {
 		t.Error("block mode should be instantiated")
 	}
 
-	if bytes.Compare(c.secretKey, testCookieKey) != 0 {
-		t.Error("key was not copied")
+	if c.keys.currentID != "" {
+		t.Errorf("expected no key id, got %q", c.keys.currentID)
 	}
 }
 
@@ -231,3 +231,423 @@ func TestCookieOverseerResetExpiry(t *testing.T) {
 		t.Errorf("expected paths to match, got %v and %v", newCookie.Path, oldCookie.Path)
 	}
 }
+
+func TestCookieOverseerKeyRotation(t *testing.T) {
+	t.Parallel()
+
+	opts := NewCookieOptions()
+	opts.MaxAge = time.Hour
+
+	oldOverseer := NewCookieOverseer(opts, testCookieKey)
+	ct, err := oldOverseer.encode("hello world")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newKey := EncryptionKey{ID: "2", Key: []byte("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")}
+	c := NewCookieOverseerWithKeys(opts, newKey, EncryptionKey{Key: testCookieKey})
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: opts.Name, Value: ct})
+
+	value, err := c.Get(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "hello world" {
+		t.Error("value was wrong:", value)
+	}
+
+	// ResetExpiry re-seals the cookie with the current key
+	if err := c.ResetExpiry(w, r); err != nil {
+		t.Fatal(err)
+	}
+	resealed := w.cookies[opts.Name].Value
+	if !strings.HasPrefix(resealed, "2.") {
+		t.Errorf("expected cookie to be re-sealed with key 2, got %q", resealed)
+	}
+
+	onlyNew := NewCookieOverseerWithKeys(opts, newKey)
+	if value, err := onlyNew.decode(resealed); err != nil {
+		t.Error(err)
+	} else if value != "hello world" {
+		t.Error("value was wrong:", value)
+	}
+
+	// Once the old key is removed its cookies no longer have a session
+	_, err = onlyNew.decode(ct)
+	if !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+
+	// Set always uses the current key
+	if err := c.Set(w, r, "new value"); err != nil {
+		t.Fatal(err)
+	}
+	if v := w.cookies[opts.Name].Value; !strings.HasPrefix(v, "2.") {
+		t.Errorf("expected cookie to be sealed with key 2, got %q", v)
+	}
+}
+
+func TestCookieOverseerKeyRotationSessionCookie(t *testing.T) {
+	t.Parallel()
+
+	// MaxAge 0 cookies are only rewritten by ResetExpiry when the key rotated
+	opts := NewCookieOptions()
+
+	newKey := EncryptionKey{ID: "2", Key: []byte("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")}
+	c := NewCookieOverseerWithKeys(opts, newKey, EncryptionKey{Key: testCookieKey})
+
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+	r := httptest.NewRequest("GET", "/", nil)
+	if err := c.ResetExpiry(w, r); err != nil {
+		t.Errorf("expected no error without a session, got: %v", err)
+	}
+
+	current, err := c.encode("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.AddCookie(&http.Cookie{Name: opts.Name, Value: current})
+	if err := c.ResetExpiry(w, r); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.cookies) != 0 {
+		t.Error("expected current key cookie to not be rewritten")
+	}
+
+	old, err := NewCookieOverseer(opts, testCookieKey).encode("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: opts.Name, Value: old})
+	if err := c.ResetExpiry(w, r); err != nil {
+		t.Fatal(err)
+	}
+	if v := w.cookies[opts.Name].Value; !strings.HasPrefix(v, "2.") {
+		t.Errorf("expected cookie to be re-sealed with key 2, got %q", v)
+	}
+}
+
+func TestCookieOverseerChunked(t *testing.T) {
+	t.Parallel()
+
+	c := NewCookieOverseer(NewCookieOptions(), testCookieKey)
+
+	// A value that is well past the size browsers allow in one cookie
+	value := strings.Repeat("a", 9000)
+
+	rec := httptest.NewRecorder()
+	w := newSessionsResponseWriter(rec)
+	r := httptest.NewRequest("GET", "/", nil)
+	if err := c.Set(w, r, value); err != nil {
+		t.Fatal(err)
+	}
+	w.WriteHeader(http.StatusOK)
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 4 {
+		t.Fatalf("expected 4 chunks, got %d", len(cookies))
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range cookies {
+		if len(cookie.String()) > 4096 {
+			t.Errorf("cookie %s is larger than 4096 bytes", cookie.Name)
+		}
+		r.AddCookie(cookie)
+	}
+
+	w = newSessionsResponseWriter(httptest.NewRecorder())
+	got, err := c.Get(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != value {
+		t.Error("chunked value was wrong")
+	}
+
+	if err := c.Set(w, r, strings.Repeat("b", 20000)); !IsCookieTooLargeError(err) {
+		t.Errorf("expected cookie too large error, got: %v", err)
+	}
+
+	if err := c.Del(w, r); err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range cookies {
+		if w.cookies[cookie.Name].MaxAge >= 0 {
+			t.Errorf("expected chunk %s to be deleted", cookie.Name)
+		}
+	}
+	if _, err := c.Get(w, r); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+}
+
+func TestCookieOverseerAbsoluteMaxAge(t *testing.T) {
+	t.Parallel()
+
+	c := NewCookieOverseer(NewCookieOptions(), testCookieKey)
+	c.AbsoluteMaxAge = time.Hour
+
+	r := httptest.NewRequest("GET", "/", nil)
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+
+	created := time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	if err := c.Set(w, r, `{"Value":{"hi":"hello"},"Flash":null,"Created":"`+created+`"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Get(c, w, r, "hi"); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+	if w.cookies[c.options.Name].MaxAge >= 0 {
+		t.Error("expected session cookie to be deleted")
+	}
+
+	// Without an absolute max age the session is still valid
+	c.AbsoluteMaxAge = 0
+	if err := c.Set(w, r, `{"Value":{"hi":"hello"},"Flash":null,"Created":"`+created+`"}`); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := Get(c, w, r, "hi"); err != nil {
+		t.Error(err)
+	} else if val != "hello" {
+		t.Errorf("expected %q, got %q", "hello", val)
+	}
+}
+
+// denyList is a CookieRevoker that keeps revoked session ids in a map
+type denyList map[string]bool
+
+func (d denyList) Revoke(id string) error          { d[id] = true; return nil }
+func (d denyList) Revoked(id string) (bool, error) { return d[id], nil }
+
+func TestCookieOverseerSessionID(t *testing.T) {
+	t.Parallel()
+
+	c := NewCookieOverseer(NewCookieOptions(), testCookieKey)
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+	r := httptest.NewRequest("GET", "/", nil)
+
+	if _, err := c.SessionID(w, r); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+
+	if err := c.Set(w, r, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	id, err := c.SessionID(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(id) != 36 {
+		t.Errorf("expected a uuid session id, got %q", id)
+	}
+
+	// The session id is kept across sets
+	if err := c.Set(w, r, "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := c.SessionID(w, r); again != id {
+		t.Errorf("expected session id %q, got %q", id, again)
+	}
+	if val, err := c.Get(w, r); err != nil || val != "changed" {
+		t.Errorf("expected %q, got %q: %v", "changed", val, err)
+	}
+}
+
+func TestCookieOverseerSessionIDLegacy(t *testing.T) {
+	t.Parallel()
+
+	c := NewCookieOverseer(NewCookieOptions(), testCookieKey)
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+	r := httptest.NewRequest("GET", "/", nil)
+
+	// Cookies set before session ids were added get one when asked for it
+	ct, err := c.encode("hello world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.AddCookie(&http.Cookie{Name: c.options.Name, Value: ct})
+
+	id, err := c.SessionID(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(id) == 0 {
+		t.Error("expected a session id to be assigned")
+	}
+	if again, _ := c.SessionID(w, r); again != id {
+		t.Errorf("expected session id %q, got %q", id, again)
+	}
+	if val, err := c.Get(w, r); err != nil || val != "hello world" {
+		t.Errorf("expected %q, got %q: %v", "hello world", val, err)
+	}
+}
+
+func TestCookieOverseerRegenerate(t *testing.T) {
+	t.Parallel()
+
+	c := NewCookieOverseer(NewCookieOptions(), testCookieKey)
+	revoked := denyList{}
+	c.Revoker = revoked
+
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+	r := httptest.NewRequest("GET", "/", nil)
+
+	if err := c.Regenerate(w, r); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+
+	if err := c.Set(w, r, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	oldID, _ := c.SessionID(w, r)
+	oldCookie := *w.cookies[c.options.Name]
+
+	if err := c.Regenerate(w, r); err != nil {
+		t.Fatal(err)
+	}
+	newID, err := c.SessionID(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newID == oldID {
+		t.Error("expected a new session id")
+	}
+	if w.cookies[c.options.Name].Value == oldCookie.Value {
+		t.Error("expected the cookie to be sealed again")
+	}
+	if val, err := c.Get(w, r); err != nil || val != "hello" {
+		t.Errorf("expected %q, got %q: %v", "hello", val, err)
+	}
+	if !revoked[oldID] || revoked[newID] {
+		t.Errorf("expected only the old session id to be revoked, got %v", revoked)
+	}
+
+	// A copy of the old cookie is no longer a session
+	w = newSessionsResponseWriter(httptest.NewRecorder())
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&oldCookie)
+	if _, err := c.Get(w, r); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+	if w.cookies[c.options.Name].MaxAge >= 0 {
+		t.Error("expected the revoked session cookie to be deleted")
+	}
+}
+
+func TestCookieOverseerDelRevokes(t *testing.T) {
+	t.Parallel()
+
+	c := NewCookieOverseer(NewCookieOptions(), testCookieKey)
+	revoked := denyList{}
+	c.Revoker = revoked
+
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+	r := httptest.NewRequest("GET", "/", nil)
+
+	if err := c.Set(w, r, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	id, _ := c.SessionID(w, r)
+
+	if err := c.Del(w, r); err != nil {
+		t.Fatal(err)
+	}
+	if !revoked[id] {
+		t.Error("expected the session id to be revoked")
+	}
+}
+
+func TestCookieOverseerSetRevoked(t *testing.T) {
+	t.Parallel()
+
+	c := NewCookieOverseer(NewCookieOptions(), testCookieKey)
+	revoked := denyList{}
+	c.Revoker = revoked
+
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+	r := httptest.NewRequest("GET", "/", nil)
+	if err := c.Set(w, r, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	oldID, _ := c.SessionID(w, r)
+	oldCookie := *w.cookies[c.options.Name]
+
+	if err := c.Regenerate(w, r); err != nil {
+		t.Fatal(err)
+	}
+
+	// Setting a session with a copy of the old cookie does not issue the
+	// revoked session id again
+	w = newSessionsResponseWriter(httptest.NewRecorder())
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&oldCookie)
+	if err := c.Set(w, r, "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := c.SessionID(w, r); err != nil {
+		t.Fatal(err)
+	} else if id == oldID {
+		t.Error("expected a new session id")
+	}
+}
+
+func TestCookieOverseerResetExpiryRevoked(t *testing.T) {
+	t.Parallel()
+
+	opts := NewCookieOptions()
+	opts.MaxAge = time.Hour
+	c := NewCookieOverseer(opts, testCookieKey)
+	revoked := denyList{}
+	c.Revoker = revoked
+
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+	r := httptest.NewRequest("GET", "/", nil)
+	if err := c.Set(w, r, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	oldCookie := *w.cookies[c.options.Name]
+
+	if err := c.Regenerate(w, r); err != nil {
+		t.Fatal(err)
+	}
+
+	// The expiry of a copy of the old cookie is not reset
+	w = newSessionsResponseWriter(httptest.NewRecorder())
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&oldCookie)
+	if err := c.ResetExpiry(w, r); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+	if w.cookies[c.options.Name].MaxAge >= 0 {
+		t.Error("expected the revoked session cookie to be deleted")
+	}
+}
+
+func TestCookieOverseerResetExpiryAbsoluteMaxAge(t *testing.T) {
+	t.Parallel()
+
+	opts := NewCookieOptions()
+	opts.MaxAge = time.Hour
+	c := NewCookieOverseer(opts, testCookieKey)
+	c.AbsoluteMaxAge = time.Hour
+
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+	r := httptest.NewRequest("GET", "/", nil)
+
+	created := time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	if err := c.Set(w, r, `{"Value":{"hi":"hello"},"Flash":null,"Created":"`+created+`"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.ResetExpiry(w, r); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+	if w.cookies[c.options.Name].MaxAge >= 0 {
+		t.Error("expected the session cookie to be deleted")
+	}
+}
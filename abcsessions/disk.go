@@ -1,9 +1,17 @@
 package abcsessions
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,8 +19,31 @@ import (
 	"github.com/friendsofgo/errors"
 )
 
+const (
+	// diskShards is the number of shard folders, one for each value of the
+	// first byte of the session id
+	diskShards = 256
+	// diskHeaderVersion starts the first line of each session file, followed
+	// by the expiry of the session in unix nanoseconds
+	diskHeaderVersion = "v1"
+	// diskMetaFolder holds a json file of metadata for each session in
+	// the shard
+	diskMetaFolder = ".meta"
+	// diskUsersFolder holds a folder for each user, with an empty file
+	// named after each of the users session ids
+	diskUsersFolder = ".users"
+	// diskTempPrefix starts the names of files that are still being written
+	diskTempPrefix = ".tmp-"
+)
+
 // DiskStorer is a session storer implementation for saving sessions
 // to disk.
+//
+// Session files are kept in 256 shard folders named after the first two
+// characters of the session id, each with its own lock. The first line of
+// each session file holds when the session expires, so expiry does not
+// depend on file access times, and files are written to a temporary file
+// that is renamed over the session file so a session is never half written.
 type DiskStorer struct {
 	// Path to the session files folder
 	folderPath string
@@ -21,8 +52,11 @@ type DiskStorer struct {
 	maxAge time.Duration
 	// How often the disk should be polled for maxAge expired sessions
 	cleanInterval time.Duration
-	// Disk storage mutex
-	mut sync.RWMutex
+	// shards are the locks of the shard folders
+	shards [diskShards]sync.RWMutex
+	// users is the lock of the user index folder. It is always taken
+	// after the lock of a shard.
+	users sync.Mutex
 	// wg is used to manage the cleaner loop
 	wg sync.WaitGroup
 	// quit channel for exiting the cleaner loop
@@ -45,6 +79,9 @@ func NewDefaultDiskStorer(tmpSubFolder string) (*DiskStorer, error) {
 // task should check for maxAge expired sessions to be removed from disk.
 // Persistent storage can be attained by setting maxAge and cleanInterval
 // to zero.
+//
+// Sessions stored in the folder by an older DiskStorer, which kept every
+// session file in the folder itself, are moved into the shard folders.
 func NewDiskStorer(folderPath string, maxAge, cleanInterval time.Duration) (*DiskStorer, error) {
 	if (maxAge != 0 && cleanInterval == 0) || (cleanInterval != 0 && maxAge == 0) {
 		panic("if max age or clean interval is set, the other must also be set")
@@ -65,20 +102,67 @@ func NewDiskStorer(folderPath string, maxAge, cleanInterval time.Duration) (*Dis
 		}
 	}
 
+	if err := d.migrateFlat(); err != nil {
+		return nil, err
+	}
+
 	return d, nil
 }
 
-// All keys in the disk store
-func (d *DiskStorer) All() ([]string, error) {
-	files, err := ioutil.ReadDir(d.folderPath)
+// OpenDiskStorer returns a DiskStorer for an existing session folder without
+// changing it, for tools that read the sessions of another app such as the
+// abcweb sessions migrate command. Unlike NewDiskStorer it does not create
+// the folder or move sessions of the flat layout of older DiskStorers into
+// shard folders, it returns an error for those folders instead, since the
+// app using the folder may still expect the flat layout.
+func OpenDiskStorer(folderPath string, maxAge time.Duration) (*DiskStorer, error) {
+	info, err := os.Stat(folderPath)
 	if err != nil {
-		return []string{}, errors.Wrapf(err, "unable to read directory: %s", d.folderPath)
+		return nil, errors.Wrapf(err, "unable to open session folder: %s", folderPath)
+	}
+	if !info.IsDir() {
+		return nil, errors.Errorf("session folder is not a folder: %s", folderPath)
 	}
 
-	sessions := make([]string, len(files))
+	flat, err := hasFlatSessions(folderPath)
+	if err != nil {
+		return nil, err
+	}
+	if flat {
+		return nil, errors.Errorf("session folder has sessions in the flat layout of older versions, open it with NewDiskStorer to move them into shard folders: %s", folderPath)
+	}
+
+	return &DiskStorer{
+		folderPath:    folderPath,
+		maxAge:        maxAge,
+		cleanInterval: maxAge,
+	}, nil
+}
+
+// All keys in the disk store
+func (d *DiskStorer) All() ([]string, error) {
+	var sessions []string
+
+	for i := 0; i < diskShards; i++ {
+		shardPath := path.Join(d.folderPath, diskShardName(i))
+		files, err := ioutil.ReadDir(shardPath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return []string{}, errors.Wrapf(err, "unable to read directory: %s", shardPath)
+		}
 
-	for i := 0; i < len(files); i++ {
-		sessions[i] = files[i].Name()
+		for _, file := range files {
+			// Skip the metadata folder and temporary files
+			if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+				continue
+			}
+			sessions = append(sessions, file.Name())
+		}
+	}
+
+	if sessions == nil {
+		return []string{}, nil
 	}
 
 	return sessions, nil
@@ -91,57 +175,181 @@ func (d *DiskStorer) Get(key string) (value string, err error) {
 		return "", errNoSession{}
 	}
 
-	filePath := path.Join(d.folderPath, key)
+	mut := d.lock(key)
+	mut.RLock()
+	defer mut.RUnlock()
 
-	d.mut.RLock()
-	defer d.mut.RUnlock()
+	value, _, err = d.readSession(key)
+	return value, err
+}
 
-	_, err = os.Stat(filePath)
-	if err != nil {
-		return "", errors.Wrapf(err, "unable to stat session file: %s", filePath)
+// Set saves the value string to the session pointed to by the session id key.
+func (d *DiskStorer) Set(key, value string) error {
+	if !validKey(key) {
+		return errNoSession{}
 	}
 
-	contents, err := ioutil.ReadFile(filePath)
+	mut := d.lock(key)
+	mut.Lock()
+	defer mut.Unlock()
+
+	return d.writeSession(key, value, time.Now().UTC().Add(d.maxAge))
+}
+
+// AllContext returns all keys in the disk store if ctx is not done
+func (d *DiskStorer) AllContext(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return d.All()
+}
+
+// GetContext returns the value string saved in the session pointed to by the
+// session id key if ctx is not done.
+func (d *DiskStorer) GetContext(ctx context.Context, key string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	return d.Get(key)
+}
+
+// SetContext saves the value string to the session pointed to by the session
+// id key if ctx is not done.
+func (d *DiskStorer) SetContext(ctx context.Context, key, value string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return d.Set(key, value)
+}
+
+// DelContext deletes the session pointed to by the session id key if ctx is
+// not done.
+func (d *DiskStorer) DelContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return d.Del(key)
+}
+
+// ResetExpiryContext resets the expiry of the key if ctx is not done
+func (d *DiskStorer) ResetExpiryContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return d.ResetExpiry(key)
+}
+
+// TTL returns how long the session pointed to by the session id key has
+// left before it expires, or 0 if it never expires.
+func (d *DiskStorer) TTL(key string) (time.Duration, error) {
+	if !validKey(key) {
+		return 0, errNoSession{}
+	}
+
+	mut := d.lock(key)
+	mut.RLock()
+	defer mut.RUnlock()
+
+	_, expires, err := d.readSession(key)
 	if err != nil {
-		return "", errors.Wrapf(err, "unable to read file: %s", filePath)
+		return 0, err
+	}
+	if d.maxAge == 0 {
+		return 0, nil
 	}
 
-	return string(contents), nil
+	return time.Until(expires), nil
 }
 
-// Set saves the value string to the session pointed to by the session id key.
-func (d *DiskStorer) Set(key, value string) error {
+// SetWithTTL saves the value string to the session pointed to by the
+// session id key, expiring it after ttl instead of maxAge.
+func (d *DiskStorer) SetWithTTL(key, value string, ttl time.Duration) error {
 	if !validKey(key) {
 		return errNoSession{}
 	}
 
-	filePath := path.Join(d.folderPath, key)
+	mut := d.lock(key)
+	mut.Lock()
+	defer mut.Unlock()
 
-	d.mut.Lock()
-	defer d.mut.Unlock()
+	return d.writeSession(key, value, time.Now().UTC().Add(ttlOrMaxAge(ttl, d.maxAge)))
+}
+
+// GetVersion returns the value string and version saved in the session
+// pointed to by the session id key.
+func (d *DiskStorer) GetVersion(key string) (value, version string, err error) {
+	value, err = d.Get(key)
+	if err != nil {
+		return "", "", err
+	}
 
-	return ioutil.WriteFile(filePath, []byte(value), 0600)
+	return value, valueVersion(value), nil
 }
 
-// Del the session pointed to by the session id key and remove it.
-func (d *DiskStorer) Del(key string) error {
+// SetIfVersion saves the value string to the session pointed to by the
+// session id key if the session is still at version. An empty version
+// means the session must not exist. The version is only checked against
+// writes made through this DiskStorer, so multiple processes sharing a
+// folder can still overwrite each other.
+func (d *DiskStorer) SetIfVersion(key, value, version string) error {
 	if !validKey(key) {
 		return errNoSession{}
 	}
 
-	filePath := path.Join(d.folderPath, key)
-
-	d.mut.Lock()
-	defer d.mut.Unlock()
+	mut := d.lock(key)
+	mut.Lock()
+	defer mut.Unlock()
 
-	_, err := os.Stat(filePath)
-	if os.IsNotExist(err) {
-		return nil
+	current, _, err := d.readSession(key)
+	if IsNoSessionError(err) {
+		if len(version) != 0 {
+			return errVersionConflict{}
+		}
 	} else if err != nil {
-		return errors.Wrapf(err, "unable to stat session file: %s", filePath)
+		return err
+	} else if valueVersion(current) != version {
+		return errVersionConflict{}
 	}
 
-	return os.Remove(filePath)
+	return d.writeSession(key, value, time.Now().UTC().Add(d.maxAge))
+}
+
+// GetVersionContext returns the value string and version saved in the
+// session pointed to by the session id key if ctx is not done.
+func (d *DiskStorer) GetVersionContext(ctx context.Context, key string) (value, version string, err error) {
+	if err := ctx.Err(); err != nil {
+		return "", "", err
+	}
+
+	return d.GetVersion(key)
+}
+
+// SetIfVersionContext saves the value string to the session pointed to by
+// the session id key if the session is still at version and ctx is not done.
+func (d *DiskStorer) SetIfVersionContext(ctx context.Context, key, value, version string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return d.SetIfVersion(key, value, version)
+}
+
+// Del the session pointed to by the session id key and remove it.
+func (d *DiskStorer) Del(key string) error {
+	if !validKey(key) {
+		return errNoSession{}
+	}
+
+	mut := d.lock(key)
+	mut.Lock()
+	defer mut.Unlock()
+
+	return d.delete(key)
 }
 
 // StopCleaner stops the cleaner go routine
@@ -156,10 +364,16 @@ func (d *DiskStorer) ResetExpiry(key string) error {
 		return errNoSession{}
 	}
 
-	filePath := path.Join(d.folderPath, key)
-	nowTime := time.Now().UTC()
+	mut := d.lock(key)
+	mut.Lock()
+	defer mut.Unlock()
 
-	return os.Chtimes(filePath, nowTime, nowTime)
+	value, _, err := d.readSession(key)
+	if err != nil {
+		return err
+	}
+
+	return d.writeSession(key, value, time.Now().UTC().Add(d.maxAge))
 }
 
 // StartCleaner starts the disk session cleaner go routine. This go routine
@@ -186,54 +400,512 @@ func (d *DiskStorer) cleanerLoop() {
 
 	t, c := timerTestHarness(d.cleanInterval)
 
-	select {
-	case <-c:
-		d.Clean()
-		t.Reset(d.cleanInterval)
-	case <-d.quit:
-		t.Stop()
-		return
+	for {
+		select {
+		case <-c:
+			// A failed clean is retried on the next interval, the expiry
+			// check in Get ensures stale sessions are never returned.
+			_ = d.Clean()
+			t.Reset(d.cleanInterval)
+		case <-d.quit:
+			t.Stop()
+			return
+		}
 	}
 }
 
-// Clean checks all session files on disk to see if they are older than
-// maxAge by checking their access time. If it finds an expired session file
-// it will remove it from disk.
-func (d *DiskStorer) Clean() {
-	t := time.Now().UTC()
+// Clean checks all session files on disk to see if they are past the expiry
+// in their header. If it finds an expired session file it will remove it from
+// disk. Each shard is only locked while an expired file is removed from it.
+// Temporary files left behind by a crash are removed once they are older
+// than maxAge, and files without a valid header are left alone.
+//
+// Files that can not be read or removed do not stop the clean, the first
+// error is returned once every shard has been checked.
+func (d *DiskStorer) Clean() error {
+	if d.maxAge == 0 {
+		return nil
+	}
 
-	files, err := ioutil.ReadDir(d.folderPath)
+	t := time.Now().UTC()
 
-	if err != nil {
-		panic(err)
+	var cleanErr error
+	record := func(err error) {
+		if cleanErr == nil {
+			cleanErr = err
+		}
 	}
 
-	for _, file := range files {
-		tspec := times.Get(file)
+	for i := 0; i < diskShards; i++ {
+		shardPath := path.Join(d.folderPath, diskShardName(i))
+		files, err := ioutil.ReadDir(shardPath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			record(errors.Wrapf(err, "unable to read directory: %s", shardPath))
+			continue
+		}
+
+		for _, file := range files {
+			if file.IsDir() {
+				continue
+			}
 
-		// File is expired
-		if tspec.AccessTime().UTC().UTC().Add(d.maxAge).Before(t) {
-			filePath := path.Join(d.folderPath, file.Name())
+			if strings.HasPrefix(file.Name(), diskTempPrefix) {
+				if file.ModTime().Add(d.maxAge).Before(t) {
+					_ = os.Remove(path.Join(shardPath, file.Name()))
+				}
+				continue
+			}
 
-			d.mut.Lock()
-			_, err := os.Stat(filePath)
+			expires, err := readExpiry(path.Join(shardPath, file.Name()))
 			// If the file has been deleted manually from the server
 			// in between the time we read the directory and now, it will
 			// fail here with a ErrNotExist. If so, continue gracefully.
-			// It would be innefficient to hold a lock for the duration of
-			// the loop, so we only lock when we find an expired file.
-			if os.IsNotExist(err) {
-				d.mut.Unlock()
+			if os.IsNotExist(err) || isDiskHeaderError(err) {
 				continue
 			} else if err != nil {
-				panic(err)
+				record(err)
+				continue
+			}
+
+			if !t.After(expires) {
+				continue
 			}
 
-			err = os.Remove(filePath)
-			d.mut.Unlock()
+			// It would be innefficient to hold a lock for the duration of
+			// the loop, so we only lock when we find an expired file, and
+			// check it again in case it was set in the meantime.
+			d.shards[i].Lock()
+			expires, err = readExpiry(path.Join(shardPath, file.Name()))
+			if err == nil && t.After(expires) {
+				err = d.delete(file.Name())
+			} else if os.IsNotExist(err) || isDiskHeaderError(err) {
+				err = nil
+			}
+			d.shards[i].Unlock()
 			if err != nil {
-				panic(err)
+				record(err)
 			}
 		}
 	}
+
+	return cleanErr
+}
+
+// GetMeta returns the metadata of the session pointed to by the session id key.
+func (d *DiskStorer) GetMeta(key string) (SessionMeta, error) {
+	if !validKey(key) {
+		return SessionMeta{}, errNoSession{}
+	}
+
+	mut := d.lock(key)
+	mut.RLock()
+	defer mut.RUnlock()
+
+	return d.getMeta(key)
+}
+
+// SetMeta sets the metadata of the session pointed to by the session id key
+// and adds it to the index of the user.
+func (d *DiskStorer) SetMeta(key string, meta SessionMeta) error {
+	if !validKey(key) {
+		return errNoSession{}
+	}
+
+	mut := d.lock(key)
+	mut.Lock()
+	defer mut.Unlock()
+
+	if _, _, err := d.readSession(key); err != nil {
+		return err
+	}
+
+	// Remove the session from the index of its previous user
+	if err := d.deleteMeta(key); err != nil {
+		return err
+	}
+
+	meta.ID = key
+	if meta.CreatedAt.IsZero() {
+		meta.CreatedAt = time.Now().UTC()
+	}
+
+	contents, err := json.Marshal(meta)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal session metadata")
+	}
+
+	metaFolder := path.Join(d.folderPath, key[:2], diskMetaFolder)
+	if err := os.MkdirAll(metaFolder, 0700); err != nil {
+		return errors.Wrapf(err, "unable to make directory: %s", metaFolder)
+	}
+	if err := writeFileAtomic(path.Join(metaFolder, key), contents); err != nil {
+		return errors.Wrap(err, "unable to write session metadata")
+	}
+
+	if len(meta.UserID) == 0 {
+		return nil
+	}
+
+	d.users.Lock()
+	defer d.users.Unlock()
+
+	userFolder := d.userFolder(meta.UserID)
+	if err := os.MkdirAll(userFolder, 0700); err != nil {
+		return errors.Wrapf(err, "unable to make directory: %s", userFolder)
+	}
+
+	return errors.Wrap(ioutil.WriteFile(path.Join(userFolder, key), nil, 0600), "unable to write user index")
+}
+
+// ListByUser returns the metadata of all sessions of the user, the most
+// recently seen session first.
+func (d *DiskStorer) ListByUser(userID string) ([]SessionMeta, error) {
+	keys, err := d.userKeys(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	metas := make([]SessionMeta, 0, len(keys))
+	for _, key := range keys {
+		if !validKey(key) {
+			continue
+		}
+
+		mut := d.lock(key)
+		mut.RLock()
+		meta, err := d.getMeta(key)
+		mut.RUnlock()
+		if IsNoSessionError(err) {
+			// The session file was removed without its index entry
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		metas = append(metas, meta)
+	}
+
+	sortSessionMeta(metas)
+
+	return metas, nil
+}
+
+// DeleteByUser deletes all sessions of the user.
+func (d *DiskStorer) DeleteByUser(userID string) error {
+	keys, err := d.userKeys(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if !validKey(key) {
+			continue
+		}
+
+		mut := d.lock(key)
+		mut.Lock()
+		err := d.delete(key)
+		mut.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lock returns the lock of the shard of the session id key
+func (d *DiskStorer) lock(key string) *sync.RWMutex {
+	shard, _ := strconv.ParseUint(key[:2], 16, 8)
+	return &d.shards[shard]
+}
+
+// diskShardName returns the folder name of the shard
+func diskShardName(shard int) string {
+	return fmt.Sprintf("%02x", shard)
+}
+
+// sessionPath returns the path of the session file in its shard folder
+func (d *DiskStorer) sessionPath(key string) string {
+	return path.Join(d.folderPath, key[:2], key)
+}
+
+// readSession reads the value and expiry of a session, expired sessions
+// return errNoSession. The caller must hold the shard lock.
+func (d *DiskStorer) readSession(key string) (value string, expires time.Time, err error) {
+	filePath := d.sessionPath(key)
+
+	contents, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return "", time.Time{}, errNoSession{}
+	} else if err != nil {
+		return "", time.Time{}, errors.Wrapf(err, "unable to read file: %s", filePath)
+	}
+
+	i := bytes.IndexByte(contents, '\n')
+	if i < 0 {
+		return "", time.Time{}, errors.Errorf("missing header in session file: %s", filePath)
+	}
+	expires, err = parseDiskHeader(string(contents[:i]))
+	if err != nil {
+		return "", time.Time{}, errors.Wrapf(err, "invalid header in session file: %s", filePath)
+	}
+
+	if d.maxAge != 0 && time.Now().UTC().After(expires) {
+		return "", time.Time{}, errNoSession{}
+	}
+
+	return string(contents[i+1:]), expires, nil
+}
+
+// writeSession writes the session file with the expiry in its header. The
+// caller must hold the shard write lock.
+func (d *DiskStorer) writeSession(key, value string, expires time.Time) error {
+	shardPath := path.Join(d.folderPath, key[:2])
+	if err := os.MkdirAll(shardPath, 0700); err != nil {
+		return errors.Wrapf(err, "unable to make directory: %s", shardPath)
+	}
+
+	header := fmt.Sprintf("%s %d\n", diskHeaderVersion, expires.UnixNano())
+	return writeFileAtomic(d.sessionPath(key), []byte(header+value))
+}
+
+// delete removes the session file and its metadata. The caller must hold
+// the shard write lock.
+func (d *DiskStorer) delete(key string) error {
+	filePath := d.sessionPath(key)
+
+	err := os.Remove(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "unable to remove session file: %s", filePath)
+	}
+
+	return d.deleteMeta(key)
+}
+
+// errDiskHeader is returned by readExpiry for files whose first line is not
+// a session file header, such as truncated or foreign files
+type errDiskHeader struct {
+	error
+}
+
+// isDiskHeaderError checks an error to see if it means a file has no valid
+// session file header
+func isDiskHeaderError(err error) bool {
+	_, ok := errors.Cause(err).(errDiskHeader)
+	return ok
+}
+
+// readExpiry reads the expiry from the header of a session file without
+// reading the rest of the file
+func readExpiry(filePath string) (time.Time, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err == io.EOF {
+		return time.Time{}, errors.Wrapf(errDiskHeader{err}, "truncated header in session file: %s", filePath)
+	} else if err != nil {
+		return time.Time{}, errors.Wrapf(err, "unable to read header of session file: %s", filePath)
+	}
+
+	expires, err := parseDiskHeader(strings.TrimSuffix(line, "\n"))
+	if err != nil {
+		return time.Time{}, errors.Wrapf(errDiskHeader{err}, "invalid header in session file: %s", filePath)
+	}
+
+	return expires, nil
+}
+
+// parseDiskHeader returns the expiry in the header line of a session file
+func parseDiskHeader(line string) (time.Time, error) {
+	if !strings.HasPrefix(line, diskHeaderVersion+" ") {
+		return time.Time{}, errors.New("unknown header version")
+	}
+
+	nanos, err := strconv.ParseInt(line[len(diskHeaderVersion)+1:], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(0, nanos).UTC(), nil
+}
+
+// writeFileAtomic writes the contents to a temporary file in the same folder
+// and renames it over the file, so readers see either the old or the new
+// contents
+func writeFileAtomic(filePath string, contents []byte) error {
+	f, err := ioutil.TempFile(path.Dir(filePath), diskTempPrefix+"*")
+	if err != nil {
+		return errors.Wrap(err, "unable to create temporary file")
+	}
+
+	_, err = f.Write(contents)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filePath)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return errors.Wrapf(err, "unable to write file: %s", filePath)
+	}
+
+	return nil
+}
+
+// hasFlatSessions returns true if the folder has session files of the flat
+// layout, where every session file was in the folder itself
+func hasFlatSessions(folderPath string) (bool, error) {
+	files, err := ioutil.ReadDir(folderPath)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to read directory: %s", folderPath)
+	}
+
+	for _, file := range files {
+		if !file.IsDir() && validKey(file.Name()) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// migrateFlat moves the session files and metadata of the flat layout, where
+// every session file was in the folder itself, into the shard folders. The
+// expiry of the sessions is taken from the later of the access and modify
+// times of their files.
+func (d *DiskStorer) migrateFlat() error {
+	files, err := ioutil.ReadDir(d.folderPath)
+	if err != nil {
+		return errors.Wrapf(err, "unable to read directory: %s", d.folderPath)
+	}
+
+	oldMetaFolder := path.Join(d.folderPath, diskMetaFolder)
+	for _, file := range files {
+		if file.IsDir() || !validKey(file.Name()) {
+			continue
+		}
+
+		key := file.Name()
+		oldPath := path.Join(d.folderPath, key)
+		contents, err := ioutil.ReadFile(oldPath)
+		if err != nil {
+			return errors.Wrapf(err, "unable to read file: %s", oldPath)
+		}
+
+		// Access times are not updated on noatime mounts, so a session
+		// written since it was last read is seen by its modify time
+		lastSeen := times.Get(file).AccessTime()
+		if file.ModTime().After(lastSeen) {
+			lastSeen = file.ModTime()
+		}
+		expires := lastSeen.UTC().Add(d.maxAge)
+		if err := d.writeSession(key, string(contents), expires); err != nil {
+			return err
+		}
+
+		metaFolder := path.Join(d.folderPath, key[:2], diskMetaFolder)
+		if err := os.MkdirAll(metaFolder, 0700); err != nil {
+			return errors.Wrapf(err, "unable to make directory: %s", metaFolder)
+		}
+		err = os.Rename(path.Join(oldMetaFolder, key), path.Join(metaFolder, key))
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "unable to move session metadata")
+		}
+
+		if err := os.Remove(oldPath); err != nil {
+			return errors.Wrapf(err, "unable to remove session file: %s", oldPath)
+		}
+	}
+
+	// Only succeeds once the metadata of every session was moved
+	_ = os.Remove(oldMetaFolder)
+
+	return nil
+}
+
+// getMeta reads the metadata of a session, with LastSeen taken from the
+// expiry of the session. The caller must hold the shard lock.
+func (d *DiskStorer) getMeta(key string) (SessionMeta, error) {
+	var meta SessionMeta
+
+	_, expires, err := d.readSession(key)
+	if err != nil {
+		return meta, err
+	}
+
+	contents, err := ioutil.ReadFile(path.Join(d.folderPath, key[:2], diskMetaFolder, key))
+	if err == nil {
+		if err := json.Unmarshal(contents, &meta); err != nil {
+			return meta, errors.Wrap(err, "unable to unmarshal session metadata")
+		}
+	} else if !os.IsNotExist(err) {
+		return meta, errors.Wrap(err, "unable to read session metadata")
+	}
+
+	meta.ID = key
+	meta.LastSeen = expires.Add(-d.maxAge)
+
+	return meta, nil
+}
+
+// deleteMeta removes the metadata of a session and its user index entry.
+// The caller must hold the shard write lock.
+func (d *DiskStorer) deleteMeta(key string) error {
+	metaPath := path.Join(d.folderPath, key[:2], diskMetaFolder, key)
+
+	contents, err := ioutil.ReadFile(metaPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "unable to read session metadata")
+	}
+
+	var meta SessionMeta
+	if err := json.Unmarshal(contents, &meta); err == nil && len(meta.UserID) != 0 {
+		d.users.Lock()
+		userFolder := d.userFolder(meta.UserID)
+		err := os.Remove(path.Join(userFolder, key))
+		// Only succeeds once the user has no sessions left
+		_ = os.Remove(userFolder)
+		d.users.Unlock()
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "unable to remove user index entry")
+		}
+	}
+
+	return errors.Wrap(os.Remove(metaPath), "unable to remove session metadata")
+}
+
+// userKeys returns the session ids in the index of the user
+func (d *DiskStorer) userKeys(userID string) ([]string, error) {
+	d.users.Lock()
+	defer d.users.Unlock()
+
+	files, err := ioutil.ReadDir(d.userFolder(userID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "unable to read user index")
+	}
+
+	keys := make([]string, len(files))
+	for i, file := range files {
+		keys[i] = file.Name()
+	}
+
+	return keys, nil
+}
+
+// userFolder is the folder of the user index
+func (d *DiskStorer) userFolder(userID string) string {
+	return path.Join(d.folderPath, diskUsersFolder, userIndexName(userID))
 }
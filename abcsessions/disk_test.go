@@ -7,7 +7,6 @@ import (
 	"testing"
 	"time"
 
-	"github.com/djherbis/times"
 	uuid "github.com/satori/go.uuid"
 )
 
@@ -48,43 +47,6 @@ func TestDiskStorerNew(t *testing.T) {
 	d.wg.Wait()
 }
 
-func TestDiskStorerAll(t *testing.T) {
-	t.Parallel()
-
-	d, err := NewDiskStorer(filepath.Join(testpath, "b"), 0, 0)
-	if err != nil {
-		t.Error(err)
-	}
-
-	list, err := d.All()
-	if err != nil {
-		t.Error("expected no error on empty list")
-	}
-	if len(list) > 0 {
-		t.Error("Expected len 0")
-	}
-
-	testid1 := uuid.NewV4().String()
-	testid2 := uuid.NewV4().String()
-
-	d.Set(testid1, "hello")
-	d.Set(testid2, "friend")
-
-	list, err = d.All()
-	if err != nil {
-		t.Error(err)
-	}
-	if len(list) != 2 {
-		t.Errorf("Expected len 2, got %d", len(list))
-	}
-	if (list[0] != testid1 && list[0] != testid2) || list[0] == list[1] {
-		t.Errorf("Expected list[0] to be %q or %q, got %q", "yo", "hi", list[0])
-	}
-	if (list[1] != testid2 && list[1] != testid1) || list[1] == list[0] {
-		t.Errorf("Expected list[1] to be %q or %q, got %q", "hi", "yo", list[1])
-	}
-}
-
 func TestDiskStorerGet(t *testing.T) {
 	t.Parallel()
 
@@ -111,30 +73,47 @@ func TestDiskStorerGet(t *testing.T) {
 	}
 }
 
-func TestDiskStorerSet(t *testing.T) {
-	t.Parallel()
+// diskTestTimer is used in the timerTestHarness override so we can
+// control sending signals to the sleep channel and trigger cleans manually
+type diskTestTimer struct{}
 
-	d, err := NewDiskStorer(filepath.Join(testpath, "d"), 0, 0)
-	if err != nil {
-		t.Error(err)
-	}
+func (diskTestTimer) Reset(time.Duration) bool {
+	return true
+}
 
-	files, err := ioutil.ReadDir(d.folderPath)
+func (diskTestTimer) Stop() bool {
+	return true
+}
+
+func TestDiskStorerCleaner(t *testing.T) {
+	d, err := NewDiskStorer(filepath.Join(testpath, "f"), time.Hour, time.Hour)
 	if err != nil {
 		t.Error(err)
 	}
-	if len(files) != 0 {
-		t.Errorf("Expected len 0, got %d", len(files))
+
+	tm := diskTestTimer{}
+	ch := make(chan time.Time)
+	timerTestHarness = func(d time.Duration) (timer, <-chan time.Time) {
+		return tm, ch
 	}
 
 	testid1 := uuid.NewV4().String()
 	testid2 := uuid.NewV4().String()
+	testid3 := uuid.NewV4().String()
 
-	d.Set(testid1, "hello")
-	d.Set(testid1, "whatsup")
-	d.Set(testid2, "friend")
+	//test1
+	err = d.Set(testid1, testid1)
+	if err != nil {
+		t.Error(err)
+	}
+	//test2, which expired yesterday so we can test it gets deleted
+	err = d.writeSession(testid2, testid2, time.Now().AddDate(0, 0, -1))
+	if err != nil {
+		t.Error(err)
+	}
 
-	files, err = ioutil.ReadDir(d.folderPath)
+	// Ensure there are currently 2 files, as expected
+	files, err := d.All()
 	if err != nil {
 		t.Error(err)
 	}
@@ -142,32 +121,42 @@ func TestDiskStorerSet(t *testing.T) {
 		t.Errorf("Expected len 2, got %d", len(files))
 	}
 
-	val, err := d.Get(testid1)
+	// Start the cleaner go routine
+	d.StartCleaner()
+
+	// Signal the timer channel to execute the clean
+	ch <- time.Time{}
+
+	// The cleaner keeps running after the first clean
+	err = d.writeSession(testid3, testid3, time.Now().AddDate(0, 0, -1))
 	if err != nil {
 		t.Error(err)
 	}
-	if val != "whatsup" {
-		t.Errorf("Expected %q, got %s", "whatsup", val)
-	}
+	ch <- time.Time{}
 
-	val, err = d.Get(testid2)
+	// Stop the cleaner, this will block until the cleaner has finished its operations
+	d.StopCleaner()
+
+	files, err = d.All()
 	if err != nil {
 		t.Error(err)
 	}
-	if val != "friend" {
-		t.Errorf("Expected %q, got %s", "friend", val)
+	if len(files) != 1 {
+		t.Errorf("Expected len 1, got %d: %#v", len(files), files)
+	} else if files[0] != testid1 {
+		t.Errorf("expected only test1 to be kept, got %s", files[0])
 	}
 }
 
-func TestDiskStorerDel(t *testing.T) {
+func TestDiskStorerResetExpiry(t *testing.T) {
 	t.Parallel()
 
-	d, err := NewDiskStorer(filepath.Join(testpath, "e"), 0, 0)
+	d, err := NewDiskStorer(filepath.Join(testpath, "g"), time.Hour, time.Hour)
 	if err != nil {
 		t.Error(err)
 	}
 
-	files, err := ioutil.ReadDir(d.folderPath)
+	files, err := d.All()
 	if err != nil {
 		t.Error(err)
 	}
@@ -176,176 +165,223 @@ func TestDiskStorerDel(t *testing.T) {
 	}
 
 	testid1 := uuid.NewV4().String()
-	testid2 := uuid.NewV4().String()
-
-	d.Set(testid1, "hello")
-	d.Set(testid1, "whatsup")
-	d.Set(testid2, "friend")
 
-	files, err = ioutil.ReadDir(d.folderPath)
+	err = d.Set(testid1, "val")
 	if err != nil {
 		t.Error(err)
 	}
-	if len(files) != 2 {
-		t.Errorf("Expected len 2, got %d", len(files))
-	}
 
-	err = d.Del(testid1)
+	// The session file is in the shard folder of its id
+	sessionPath := filepath.Join(d.folderPath, testid1[:2], testid1)
+	oldExpires, err := readExpiry(sessionPath)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
-	_, err = d.Get(testid1)
-	if err == nil {
-		t.Errorf("Expected get hi to fail")
+	time.Sleep(time.Millisecond * 1)
+
+	err = d.ResetExpiry(testid1)
+	if err != nil {
+		t.Error(err)
 	}
 
-	files, err = ioutil.ReadDir(d.folderPath)
+	files, err = d.All()
 	if err != nil {
 		t.Error(err)
 	}
 	if len(files) != 1 {
 		t.Errorf("Expected len 1, got %d", len(files))
 	}
-}
-
-// diskTestTimer is used in the timerTestHarness override so we can
-// control sending signals to the sleep channel and trigger cleans manually
-type diskTestTimer struct{}
 
-func (diskTestTimer) Reset(time.Duration) bool {
-	return true
-}
-
-func (diskTestTimer) Stop() bool {
-	return true
-}
-
-func TestDiskStorerCleaner(t *testing.T) {
-	d, err := NewDiskStorer(filepath.Join(testpath, "f"), time.Hour, time.Hour)
+	newExpires, err := readExpiry(sessionPath)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
-	tm := diskTestTimer{}
-	ch := make(chan time.Time)
-	timerTestHarness = func(d time.Duration) (timer, <-chan time.Time) {
-		return tm, ch
+	if !newExpires.After(oldExpires) {
+		t.Errorf("Expected newexpires to be newer than old expires, got: %#v, %#v", oldExpires, newExpires)
 	}
 
-	testid1 := uuid.NewV4().String()
-	testid2 := uuid.NewV4().String()
+	if val, err := d.Get(testid1); err != nil || val != "val" {
+		t.Errorf("Expected %q, got %q: %v", "val", val, err)
+	}
 
-	//test1
-	err = d.Set(testid1, testid1)
+	// No temporary files are left behind
+	shardFiles, err := ioutil.ReadDir(filepath.Dir(sessionPath))
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	//test2
-	err = d.Set(testid2, testid2)
-	if err != nil {
-		t.Error(err)
+	if len(shardFiles) != 1 {
+		t.Errorf("Expected only the session file in the shard, got %d files", len(shardFiles))
 	}
+}
 
-	// Change the mod time of test2 file to yesterday so we can test it gets deleted
-	os.Chtimes(filepath.Join(d.folderPath, testid2),
-		time.Now().AddDate(0, 0, -1),
-		time.Now().AddDate(0, 0, -1),
-	)
+func TestDiskStorerExpiredGet(t *testing.T) {
+	t.Parallel()
 
-	// Ensure there are currently 2 files, as expected
-	files, err := ioutil.ReadDir(d.folderPath)
+	d, err := NewDiskStorer(filepath.Join(testpath, "h"), time.Hour, time.Hour)
 	if err != nil {
-		t.Error(err)
-	}
-	if len(files) != 2 {
-		t.Errorf("Expected len 2, got %d", len(files))
+		t.Fatal(err)
 	}
 
-	// Start the cleaner go routine
-	d.StartCleaner()
+	testid1 := uuid.NewV4().String()
+	if err := d.writeSession(testid1, "val", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
 
-	// Signal the timer channel to execute the clean
-	ch <- time.Time{}
+	if _, err := d.Get(testid1); !IsNoSessionError(err) {
+		t.Errorf("Expected ErrNoSession, got: %v", err)
+	}
+	if err := d.ResetExpiry(testid1); !IsNoSessionError(err) {
+		t.Errorf("Expected ErrNoSession, got: %v", err)
+	}
+}
 
-	// Stop the cleaner, this will block until the cleaner has finished its operations
-	d.StopCleaner()
+func TestDiskStorerCleanInvalidHeader(t *testing.T) {
+	t.Parallel()
 
-	files, err = ioutil.ReadDir(d.folderPath)
+	d, err := NewDiskStorer(filepath.Join(testpath, "j"), time.Hour, time.Hour)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	if len(files) != 1 {
-		for _, f := range files {
-			t.Log(f.Name())
+
+	expired := uuid.NewV4().String()
+	if err := d.writeSession(expired, "val", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files with a foreign header, a bad version and a truncated header
+	// in the shard of the expired session
+	garbage := map[string]string{
+		expired[:2] + "garbage":   "not a session\nvalue",
+		expired[:2] + "version":   "v9 123\nvalue",
+		expired[:2] + "truncated": "v1 12",
+	}
+	for name, contents := range garbage {
+		if err := ioutil.WriteFile(filepath.Join(d.folderPath, expired[:2], name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
 		}
-		t.Errorf("Expected len 1, got %d: %#v", len(files), files)
+	}
+
+	if err := d.Clean(); err != nil {
+		t.Fatal(err)
+	}
 
+	if _, err := os.Stat(d.sessionPath(expired)); !os.IsNotExist(err) {
+		t.Errorf("Expected the expired session to be removed, got: %v", err)
 	}
-	if files[0].Name() == testid2 {
-		t.Errorf("expected test2 file to be deleted, but is present")
+	for name := range garbage {
+		if _, err := os.Stat(filepath.Join(d.folderPath, expired[:2], name)); err != nil {
+			t.Errorf("Expected %s to be left alone, got: %v", name, err)
+		}
 	}
 }
 
-func TestDiskStorerResetExpiry(t *testing.T) {
+func TestDiskStorerMigrateFlat(t *testing.T) {
 	t.Parallel()
 
-	d, err := NewDiskStorer(filepath.Join(testpath, "g"), 0, 0)
-	if err != nil {
-		t.Error(err)
+	folder := filepath.Join(testpath, "i")
+	if err := os.MkdirAll(filepath.Join(folder, diskMetaFolder), 0700); err != nil {
+		t.Fatal(err)
 	}
 
-	files, err := ioutil.ReadDir(d.folderPath)
-	if err != nil {
-		t.Error(err)
+	// Sessions in the flat layout, one of them with metadata
+	testid1 := uuid.NewV4().String()
+	testid2 := uuid.NewV4().String()
+	if err := ioutil.WriteFile(filepath.Join(folder, testid1), []byte("one"), 0600); err != nil {
+		t.Fatal(err)
 	}
-	if len(files) != 0 {
-		t.Errorf("Expected len 0, got %d", len(files))
+	if err := ioutil.WriteFile(filepath.Join(folder, testid2), []byte("two"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	meta := []byte(`{"ID":"` + testid1 + `","UserID":"bob"}`)
+	if err := ioutil.WriteFile(filepath.Join(folder, diskMetaFolder, testid1), meta, 0600); err != nil {
+		t.Fatal(err)
 	}
 
-	testid1 := uuid.NewV4().String()
+	// The access time is older than the modify time, as on noatime mounts
+	lastSeen := time.Now().Add(-time.Minute).Truncate(time.Second)
+	if err := os.Chtimes(filepath.Join(folder, testid2), lastSeen.Add(-time.Hour), lastSeen); err != nil {
+		t.Fatal(err)
+	}
 
-	err = d.Set(testid1, "val")
+	d, err := NewDiskStorer(folder, time.Hour, time.Hour)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
-	files, err = ioutil.ReadDir(d.folderPath)
+	for key, want := range map[string]string{testid1: "one", testid2: "two"} {
+		if val, err := d.Get(key); err != nil || val != want {
+			t.Errorf("Expected %q, got %q: %v", want, val, err)
+		}
+		if _, err := os.Stat(filepath.Join(folder, key)); !os.IsNotExist(err) {
+			t.Errorf("Expected the flat session file to be removed, got: %v", err)
+		}
+	}
+
+	got, err := d.GetMeta(testid1)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	if len(files) != 1 {
-		t.Errorf("Expected len 1, got %d", len(files))
+	if got.UserID != "bob" {
+		t.Errorf("Expected the metadata to be moved, got %#v", got)
+	}
+	if _, err := os.Stat(filepath.Join(folder, diskMetaFolder)); !os.IsNotExist(err) {
+		t.Errorf("Expected the flat metadata folder to be removed, got: %v", err)
 	}
 
-	ts, err := times.Stat(filepath.Join(d.folderPath, testid1))
+	// The expiry is taken from the later of the access and modify times of
+	// the flat file
+	got, err = d.GetMeta(testid2)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	if !got.LastSeen.Equal(lastSeen) {
+		t.Errorf("Expected last seen %v, got %v", lastSeen, got.LastSeen)
 	}
-	oldExpires := ts.AccessTime()
+}
 
-	time.Sleep(time.Nanosecond * 1)
+func TestOpenDiskStorer(t *testing.T) {
+	t.Parallel()
 
-	err = d.ResetExpiry(testid1)
-	if err != nil {
-		t.Error(err)
+	missing := filepath.Join(testpath, "k", "missing")
+	if _, err := OpenDiskStorer(missing, time.Hour); err == nil {
+		t.Error("Expected an error for a missing folder")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("Expected the missing folder not to be created, got: %v", err)
 	}
 
-	files, err = ioutil.ReadDir(d.folderPath)
-	if err != nil {
-		t.Error(err)
+	// Folders in the flat layout are not migrated
+	flat := filepath.Join(testpath, "k", "flat")
+	if err := os.MkdirAll(flat, 0700); err != nil {
+		t.Fatal(err)
 	}
-	if len(files) != 1 {
-		t.Errorf("Expected len 1, got %d", len(files))
+	testid1 := uuid.NewV4().String()
+	if err := ioutil.WriteFile(filepath.Join(flat, testid1), []byte("one"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenDiskStorer(flat, time.Hour); err == nil {
+		t.Error("Expected an error for a folder in the flat layout")
+	}
+	if _, err := os.Stat(filepath.Join(flat, testid1)); err != nil {
+		t.Errorf("Expected the flat session file to be kept, got: %v", err)
 	}
 
-	ts, err = times.Stat(filepath.Join(d.folderPath, testid1))
+	sharded := filepath.Join(testpath, "k", "sharded")
+	d, err := NewDiskStorer(sharded, time.Hour, time.Hour)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	if err := d.Set(testid1, "one"); err != nil {
+		t.Fatal(err)
 	}
-	newExpires := ts.AccessTime()
 
-	if !newExpires.After(oldExpires) || newExpires == oldExpires {
-		t.Errorf("Expected newexpires to be newer than old expires, got: %#v, %#v", oldExpires, newExpires)
+	d, err = OpenDiskStorer(sharded, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := d.Get(testid1); err != nil || val != "one" {
+		t.Errorf("Expected %q, got %q: %v", "one", val, err)
 	}
 }
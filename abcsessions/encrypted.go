@@ -0,0 +1,200 @@
+package abcsessions
+
+import (
+	"context"
+	"time"
+
+	"github.com/friendsofgo/errors"
+)
+
+// EncryptingStorer is a Storer decorator that encrypts session values with
+// AES-GCM before they are written to the Storer it wraps, so they are not
+// stored in plaintext on disk or in Redis. It uses the same keys and format
+// as the CookieOverseer, including key rotation.
+//
+// Values that can not be decrypted, such as values written before the
+// Storer was wrapped or with a key that has been removed, are treated as
+// missing sessions. Session ids and the metadata of a UserIndexStorer are
+// not encrypted.
+type EncryptingStorer struct {
+	storerWrapper
+	keys *keyring
+}
+
+// NewEncryptingStorer wraps the storer so that values are encrypted with the
+// current key. Values encrypted with one of the old keys can still be
+// decrypted and are re-encrypted with the current key on the next Set or
+// ResetExpiry.
+func NewEncryptingStorer(storer Storer, current EncryptionKey, old ...EncryptionKey) (*EncryptingStorer, error) {
+	if storer == nil {
+		return nil, errors.New("storer must not be nil")
+	}
+
+	keys, err := newKeyring(current, old...)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create keyring")
+	}
+
+	return &EncryptingStorer{
+		storerWrapper: storerWrapper{storer: storer},
+		keys:          keys,
+	}, nil
+}
+
+// Get returns the decrypted value of the session pointed to by the session
+// id key.
+func (e *EncryptingStorer) Get(key string) (string, error) {
+	return e.GetContext(context.Background(), key)
+}
+
+// GetContext returns the decrypted value of the session pointed to by the
+// session id key.
+func (e *EncryptingStorer) GetContext(ctx context.Context, key string) (string, error) {
+	value, err := AsStorerContext(e.storer).GetContext(ctx, key)
+	if err != nil {
+		return "", err
+	}
+
+	return e.open(value)
+}
+
+// Set encrypts the value and stores it in the wrapped storer
+func (e *EncryptingStorer) Set(key, value string) error {
+	return e.SetContext(context.Background(), key, value)
+}
+
+// SetContext encrypts the value and stores it in the wrapped storer
+func (e *EncryptingStorer) SetContext(ctx context.Context, key, value string) error {
+	sealed, err := e.keys.seal([]byte(value))
+	if err != nil {
+		return errors.Wrap(err, "unable to encrypt session value")
+	}
+
+	return AsStorerContext(e.storer).SetContext(ctx, key, sealed)
+}
+
+// SetWithTTL encrypts the value and stores it in the wrapped storer, which
+// must be a TTLStorer, expiring it after ttl.
+func (e *EncryptingStorer) SetWithTTL(key, value string, ttl time.Duration) error {
+	ttlStorer, err := e.ttlStorer()
+	if err != nil {
+		return err
+	}
+
+	sealed, err := e.keys.seal([]byte(value))
+	if err != nil {
+		return errors.Wrap(err, "unable to encrypt session value")
+	}
+
+	return ttlStorer.SetWithTTL(key, sealed, ttl)
+}
+
+// ResetExpiry resets the expiry of the session in the wrapped storer. When
+// old keys are in use, values encrypted with an old key are re-encrypted
+// with the current key instead.
+func (e *EncryptingStorer) ResetExpiry(key string) error {
+	return e.ResetExpiryContext(context.Background(), key)
+}
+
+// ResetExpiryContext resets the expiry of the session in the wrapped storer,
+// re-encrypting values encrypted with an old key like ResetExpiry.
+func (e *EncryptingStorer) ResetExpiryContext(ctx context.Context, key string) error {
+	storer := AsStorerContext(e.storer)
+	if len(e.keys.keys) == 1 {
+		return storer.ResetExpiryContext(ctx, key)
+	}
+
+	cas, casErr := e.casStorer()
+
+	var value, version string
+	var err error
+	if casErr == nil {
+		value, version, err = cas.GetVersionContext(ctx, key)
+	} else {
+		value, err = storer.GetContext(ctx, key)
+	}
+	if err != nil {
+		return err
+	}
+
+	if e.keys.isCurrent(value) {
+		return storer.ResetExpiryContext(ctx, key)
+	}
+
+	pt, err := e.open(value)
+	if err != nil {
+		return err
+	}
+	sealed, err := e.keys.seal([]byte(pt))
+	if err != nil {
+		return errors.Wrap(err, "unable to encrypt session value")
+	}
+
+	if casErr != nil {
+		return storer.SetContext(ctx, key, sealed)
+	}
+
+	// A request that changed the session first also re-encrypted it
+	err = cas.SetIfVersionContext(ctx, key, sealed, version)
+	if IsVersionConflictError(err) {
+		return storer.ResetExpiryContext(ctx, key)
+	}
+
+	return err
+}
+
+// GetVersion returns the decrypted value and the version of the session in
+// the wrapped storer, which must be a CASStorer.
+func (e *EncryptingStorer) GetVersion(key string) (value, version string, err error) {
+	return e.GetVersionContext(context.Background(), key)
+}
+
+// GetVersionContext returns the decrypted value and the version of the
+// session in the wrapped storer, which must be a CASStorer.
+func (e *EncryptingStorer) GetVersionContext(ctx context.Context, key string) (value, version string, err error) {
+	cas, err := e.casStorer()
+	if err != nil {
+		return "", "", err
+	}
+
+	value, version, err = cas.GetVersionContext(ctx, key)
+	if err != nil {
+		return "", "", err
+	}
+
+	value, err = e.open(value)
+	return value, version, err
+}
+
+// SetIfVersion encrypts the value and stores it in the wrapped storer if the
+// version still matches. The wrapped storer must be a CASStorer.
+func (e *EncryptingStorer) SetIfVersion(key, value, version string) error {
+	return e.SetIfVersionContext(context.Background(), key, value, version)
+}
+
+// SetIfVersionContext encrypts the value and stores it in the wrapped storer
+// if the version still matches. The wrapped storer must be a CASStorer.
+func (e *EncryptingStorer) SetIfVersionContext(ctx context.Context, key, value, version string) error {
+	cas, err := e.casStorer()
+	if err != nil {
+		return err
+	}
+
+	sealed, err := e.keys.seal([]byte(value))
+	if err != nil {
+		return errors.Wrap(err, "unable to encrypt session value")
+	}
+
+	return cas.SetIfVersionContext(ctx, key, sealed, version)
+}
+
+// open decrypts a value, values that can not be decrypted are returned
+// as errNoSession
+func (e *EncryptingStorer) open(value string) (string, error) {
+	pt, err := e.keys.open(value)
+	if err != nil {
+		return "", errNoSession{}
+	}
+
+	return string(pt), nil
+}
@@ -0,0 +1,175 @@
+package abcsessions
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEncryptingStorerNew(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+
+	if _, err := NewEncryptingStorer(nil, EncryptionKey{Key: make([]byte, 32)}); err == nil {
+		t.Error("expected an error for a nil storer")
+	}
+	if _, err := NewEncryptingStorer(m, EncryptionKey{Key: make([]byte, 5)}); err == nil {
+		t.Error("expected an error for an invalid key")
+	}
+	if _, err := NewEncryptingStorer(m, EncryptionKey{ID: "1", Key: make([]byte, 32)}, EncryptionKey{ID: "1", Key: make([]byte, 32)}); err == nil {
+		t.Error("expected an error for a duplicate key id")
+	}
+}
+
+func TestEncryptingStorerEncrypts(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	e, err := NewEncryptingStorer(m, EncryptionKey{ID: "1", Key: make([]byte, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Set("key", "secret value"); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := m.sessions["key"].value
+	if strings.Contains(stored, "secret") {
+		t.Errorf("expected the stored value to be encrypted, got %q", stored)
+	}
+	if !strings.HasPrefix(stored, "1.") {
+		t.Errorf("expected the stored value to start with the key id, got %q", stored)
+	}
+
+	if val, err := e.Get("key"); err != nil {
+		t.Error(err)
+	} else if val != "secret value" {
+		t.Errorf("expected %q, got %q", "secret value", val)
+	}
+
+	// Values that can not be decrypted are missing sessions
+	m.put("plain", memorySession{value: `{"Value":null}`})
+	if _, err := e.Get("plain"); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+}
+
+func TestEncryptingStorerRotation(t *testing.T) {
+	t.Parallel()
+
+	oldKey := EncryptionKey{ID: "1", Key: []byte("0123456789abcdef")}
+	newKey := EncryptionKey{ID: "2", Key: []byte("fedcba9876543210")}
+
+	m, _ := NewDefaultMemoryStorer()
+	old, err := NewEncryptingStorer(m, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Set("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewEncryptingStorer(m, newKey, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if val, err := e.Get("key"); err != nil {
+		t.Error(err)
+	} else if val != "value" {
+		t.Errorf("expected %q, got %q", "value", val)
+	}
+
+	// ResetExpiry re-encrypts values with the current key
+	if err := e.ResetExpiry("key"); err != nil {
+		t.Fatal(err)
+	}
+	if stored := m.sessions["key"].value; !strings.HasPrefix(stored, "2.") {
+		t.Errorf("expected the value to be re-encrypted with key 2, got %q", stored)
+	}
+	if val, err := e.Get("key"); err != nil {
+		t.Error(err)
+	} else if val != "value" {
+		t.Errorf("expected %q, got %q", "value", val)
+	}
+
+	if err := e.ResetExpiry("missing"); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+
+	// Once the old key is removed its values are missing sessions
+	if err := old.Set("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	current, err := NewEncryptingStorer(m, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := current.Get("key"); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+}
+
+func TestEncryptingStorerOverseer(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	e, err := NewEncryptingStorer(m, EncryptionKey{Key: make([]byte, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewStorageOverseer(NewCookieOptions(), e)
+
+	if !s.versioned() {
+		t.Error("expected the overseer to use versions of the wrapped memory storer")
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+
+	if err := Set(s, w, r, "hi", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetUser(w, r, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := Get(s, w, r, "hi"); err != nil {
+		t.Error(err)
+	} else if val != "hello" {
+		t.Errorf("expected %q, got %q", "hello", val)
+	}
+
+	metas, err := e.ListByUser("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != 1 {
+		t.Errorf("expected 1 session, got %d", len(metas))
+	}
+
+	// Wrapping a storer without versions or a user index
+	sqlStorer := newTestSQLStorer(t, "encrypting", 0, 0)
+	e, err = NewEncryptingStorer(sqlStorer, EncryptionKey{Key: make([]byte, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = NewStorageOverseer(NewCookieOptions(), e)
+
+	if s.versioned() {
+		t.Error("expected the overseer not to use versions of the wrapped sql storer")
+	}
+	if _, _, err := e.GetVersion("key"); err == nil {
+		t.Error("expected an error getting the version from a sql storer")
+	}
+	if _, err := e.ListByUser("1"); err == nil {
+		t.Error("expected an error listing sessions of a sql storer")
+	}
+	if err := Set(s, w, r, "hi", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetUser(w, r, "1"); err == nil {
+		t.Error("expected an error setting the user with a sql storer")
+	}
+}
@@ -0,0 +1,14 @@
+package abcsessions
+
+// SQLiteSessionsTable creates a sqlite sessions table matching the
+// db/migrations/00001_create_sessions.sql migration.
+const SQLiteSessionsTable = `create table sessions (
+	id text primary key,
+	value text not null,
+	expires timestamp
+)`
+
+// FlushRedisStorer deletes every key in the redis storers database
+func FlushRedisStorer(r *RedisStorer) error {
+	return r.client.FlushDb().Err()
+}
@@ -0,0 +1,140 @@
+package abcsessions
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/friendsofgo/errors"
+)
+
+// FlashLevel is the level of a flash message added with AddFlashMessage
+type FlashLevel string
+
+// The flash message levels, DrainFlashes returns messages in this order
+const (
+	FlashError   FlashLevel = "error"
+	FlashWarning FlashLevel = "warning"
+	FlashSuccess FlashLevel = "success"
+	FlashInfo    FlashLevel = "info"
+)
+
+// flashLevels are the flash message levels in the order they are drained
+var flashLevels = []FlashLevel{FlashError, FlashWarning, FlashSuccess, FlashInfo}
+
+// flashLevelPrefix is put in front of the level to make the flash key the
+// messages of a level are stored under, so they do not clash with the keys
+// used with AddFlash
+const flashLevelPrefix = "_level:"
+
+// FlashMessage is a flash message and its level
+type FlashMessage struct {
+	Level   FlashLevel
+	Message string
+}
+
+// AddFlashMessage adds a flash message of the level to the session. A level
+// holds any number of messages, they are all deleted when they are retrieved
+// with DrainFlashes.
+func AddFlashMessage(overseer Overseer, w http.ResponseWriter, r *http.Request, level FlashLevel, message string) error {
+	if !validFlashLevel(level) {
+		return errors.Errorf("unknown flash level %q", level)
+	}
+
+	key := flashLevelPrefix + string(level)
+	err := updateSession(overseer, w, r, true, func(sess *session) error {
+		var messages []string
+		if fv, ok := sess.Flash[key]; ok {
+			if err := sess.unmarshal(fv, &messages); err != nil {
+				return errors.Wrap(err, "unable to unmarshal flash messages")
+			}
+		}
+
+		mv, err := sess.marshal(append(messages, message))
+		if err != nil {
+			return errors.Wrap(err, "unable to marshal flash messages")
+		}
+
+		if sess.Flash == nil {
+			sess.Flash = make(map[string][]byte)
+		}
+
+		sess.Flash[key] = mv
+		return nil
+	})
+
+	return errors.Wrap(err, "unable to add flash message")
+}
+
+// DrainFlashes retrieves the flash messages of every level from the session
+// then deletes them. Messages are ordered by level, from FlashError to
+// FlashInfo, then in the order they were added. It returns no messages and
+// no error if there is no session, and leaves the session untouched if it
+// has no messages.
+func DrainFlashes(overseer Overseer, w http.ResponseWriter, r *http.Request) ([]FlashMessage, error) {
+	sess, err := loadSession(overseer, w, r)
+	if IsNoSessionError(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "unable to get session")
+	}
+	if !hasFlashMessages(sess) {
+		return nil, nil
+	}
+
+	var flashes []FlashMessage
+	err = updateSession(overseer, w, r, false, func(sess *session) error {
+		// The change is applied again when another request changed the
+		// session first, so start over each time
+		var drained []FlashMessage
+		for _, level := range flashLevels {
+			fv, ok := sess.Flash[flashLevelPrefix+string(level)]
+			if !ok {
+				continue
+			}
+
+			var messages []string
+			if err := sess.unmarshal(fv, &messages); err != nil {
+				return errors.Wrap(err, "unable to unmarshal flash messages")
+			}
+			for _, m := range messages {
+				drained = append(drained, FlashMessage{Level: level, Message: m})
+			}
+		}
+
+		for _, level := range flashLevels {
+			delete(sess.Flash, flashLevelPrefix+string(level))
+		}
+
+		flashes = drained
+		return nil
+	})
+	if IsNoSessionError(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "unable to drain flash messages")
+	}
+
+	return flashes, nil
+}
+
+// hasFlashMessages returns true if the session holds leveled flash messages
+func hasFlashMessages(sess *session) bool {
+	for key := range sess.Flash {
+		if strings.HasPrefix(key, flashLevelPrefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validFlashLevel returns true if level is one of the flash levels
+func validFlashLevel(level FlashLevel) bool {
+	for _, l := range flashLevels {
+		if l == level {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,67 @@
+package abcsessions
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestDrainFlashes(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+
+	m, _ := NewDefaultMemoryStorer()
+	s := NewStorageOverseer(NewCookieOptions(), m)
+
+	// No session is not an error, and does not create one
+	flashes, err := DrainFlashes(s, w, r)
+	if err != nil || len(flashes) != 0 {
+		t.Errorf("expected no flashes, got %#v: %v", flashes, err)
+	}
+	if len(m.sessions) != 0 {
+		t.Error("expected no session to be created, got:", len(m.sessions))
+	}
+
+	if err := AddFlashMessage(s, w, r, "fatal", "nope"); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+
+	adds := []FlashMessage{
+		{Level: FlashInfo, Message: "first info"},
+		{Level: FlashError, Message: "an error"},
+		{Level: FlashInfo, Message: "second info"},
+		{Level: FlashSuccess, Message: "saved"},
+	}
+	for _, f := range adds {
+		if err := AddFlashMessage(s, w, r, f.Level, f.Message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := AddFlash(s, w, r, "other", "kept"); err != nil {
+		t.Fatal(err)
+	}
+
+	flashes, err = DrainFlashes(s, w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []FlashMessage{
+		{Level: FlashError, Message: "an error"},
+		{Level: FlashSuccess, Message: "saved"},
+		{Level: FlashInfo, Message: "first info"},
+		{Level: FlashInfo, Message: "second info"},
+	}
+	if !reflect.DeepEqual(flashes, expected) {
+		t.Errorf("expected:\n%#v\ngot:\n%#v", expected, flashes)
+	}
+
+	// The messages are gone, other flashes are not
+	if flashes, err = DrainFlashes(s, w, r); err != nil || len(flashes) != 0 {
+		t.Errorf("expected the flashes to be drained, got %#v: %v", flashes, err)
+	}
+	if val, err := GetFlash(s, w, r, "other"); err != nil || val != "kept" {
+		t.Errorf("expected %q, got %q: %v", "kept", val, err)
+	}
+}
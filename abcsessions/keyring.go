@@ -0,0 +1,132 @@
+package abcsessions
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+
+	"github.com/friendsofgo/errors"
+)
+
+// keyIDSeparator separates the key id from the base64 encoded ciphertext.
+// It is not part of the base64 alphabet so it can never appear in ciphertext.
+const keyIDSeparator = "."
+
+// EncryptionKey is an AES-GCM secret key (16, 24 or 32 bytes long) with an
+// ID. The ID is stored in front of every value sealed with the key so that
+// the right key can be chosen to open it again without trying each one.
+//
+// An empty ID seals values without a prefix, which is the format used by
+// NewCookieOverseer. Use an empty ID for a key that was used before keys
+// were rotated so the values it sealed can still be opened.
+type EncryptionKey struct {
+	ID  string
+	Key []byte
+}
+
+// keyring seals values with the current key and opens values that were
+// sealed with the current key or any of the old keys.
+type keyring struct {
+	currentID string
+	current   cipher.AEAD
+	keys      map[string]cipher.AEAD
+}
+
+// newKeyring creates a keyring from the current key and the old keys that
+// are still accepted for decryption.
+func newKeyring(current EncryptionKey, old ...EncryptionKey) (*keyring, error) {
+	k := &keyring{
+		currentID: current.ID,
+		keys:      make(map[string]cipher.AEAD, len(old)+1),
+	}
+
+	for _, key := range append([]EncryptionKey{current}, old...) {
+		if strings.Contains(key.ID, keyIDSeparator) {
+			return nil, errors.Errorf("key id %q must not contain %q", key.ID, keyIDSeparator)
+		}
+		if _, ok := k.keys[key.ID]; ok {
+			return nil, errors.Errorf("duplicate key id %q", key.ID)
+		}
+
+		block, err := aes.NewCipher(key.Key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to create cipher for key id %q", key.ID)
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to create gcm for key id %q", key.ID)
+		}
+
+		k.keys[key.ID] = gcm
+	}
+
+	k.current = k.keys[current.ID]
+
+	return k, nil
+}
+
+// seal encrypts the plaintext with the current key and returns it base64
+// encoded and prefixed with the current key id.
+func (k *keyring) seal(plaintext []byte) (string, error) {
+	nonce := make([]byte, k.current.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", errors.Wrap(err, "unable to generate nonce")
+	}
+
+	// Append ciphertext to the end of nonce so we have the nonce for decrypt
+	ciphertext := k.current.Seal(nonce, nonce, plaintext, nil)
+	encoded := base64.StdEncoding.EncodeToString(ciphertext)
+
+	if len(k.currentID) == 0 {
+		return encoded, nil
+	}
+
+	return k.currentID + keyIDSeparator + encoded, nil
+}
+
+// open decrypts a value created by seal. It returns errNoSession if the
+// value was sealed with a key that is no longer in the keyring.
+func (k *keyring) open(value string) ([]byte, error) {
+	id, encoded := splitKeyID(value)
+
+	gcm, ok := k.keys[id]
+	if !ok {
+		return nil, errNoSession{}
+	}
+
+	ct, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to base64 decode value")
+	}
+
+	if len(ct) <= gcm.NonceSize() {
+		return nil, errors.New("sealed value is too short")
+	}
+
+	// Nonce comes from the first n bytes (n = NonceSize)
+	plaintext, err := gcm.Open(nil, ct[:gcm.NonceSize()], ct[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open gcm block mode")
+	}
+
+	return plaintext, nil
+}
+
+// isCurrent returns true if the value was sealed with the current key
+func (k *keyring) isCurrent(value string) bool {
+	id, _ := splitKeyID(value)
+	return id == k.currentID
+}
+
+// splitKeyID splits a sealed value into its key id and base64 ciphertext.
+// Values without a key id prefix have an empty id.
+func splitKeyID(value string) (id, encoded string) {
+	i := strings.Index(value, keyIDSeparator)
+	if i < 0 {
+		return "", value
+	}
+
+	return value[:i], value[i+1:]
+}
@@ -0,0 +1,92 @@
+package abcsessions
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKeyringSealOpen(t *testing.T) {
+	t.Parallel()
+
+	k, err := newKeyring(EncryptionKey{ID: "b", Key: testCookieKey}, EncryptionKey{ID: "a", Key: []byte("bbbbbbbbbbbbbbbb")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ct, err := k.seal([]byte("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(ct, "b.") {
+		t.Errorf("expected key id prefix, got %q", ct)
+	}
+	if !k.isCurrent(ct) {
+		t.Error("expected value to be sealed with the current key")
+	}
+
+	pt, err := k.open(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pt) != "hello world" {
+		t.Error("plaintext was wrong:", string(pt))
+	}
+
+	if _, err := k.open("c." + strings.TrimPrefix(ct, "b.")); !IsNoSessionError(err) {
+		t.Errorf("expected no session error for unknown key id, got: %v", err)
+	}
+	if _, err := k.open("a." + strings.TrimPrefix(ct, "b.")); err == nil || IsNoSessionError(err) {
+		t.Errorf("expected decryption error for wrong key, got: %v", err)
+	}
+	if _, err := k.open("b.!!!"); err == nil {
+		t.Error("expected error for invalid base64")
+	}
+}
+
+func TestKeyringOldKey(t *testing.T) {
+	t.Parallel()
+
+	old, err := newKeyring(EncryptionKey{Key: testCookieKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ct, err := old.seal([]byte("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(ct, keyIDSeparator) {
+		t.Errorf("expected no key id prefix for empty id, got %q", ct)
+	}
+
+	k, err := newKeyring(EncryptionKey{ID: "1", Key: []byte("bbbbbbbbbbbbbbbb")}, EncryptionKey{Key: testCookieKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if k.isCurrent(ct) {
+		t.Error("expected value to be sealed with an old key")
+	}
+
+	pt, err := k.open(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pt) != "hello world" {
+		t.Error("plaintext was wrong:", string(pt))
+	}
+}
+
+func TestKeyringInvalid(t *testing.T) {
+	t.Parallel()
+
+	if _, err := newKeyring(EncryptionKey{ID: "a.b", Key: testCookieKey}); err == nil {
+		t.Error("expected error for key id containing separator")
+	}
+	if _, err := newKeyring(EncryptionKey{ID: "a", Key: testCookieKey}, EncryptionKey{ID: "a", Key: testCookieKey}); err == nil {
+		t.Error("expected error for duplicate key id")
+	}
+	if _, err := newKeyring(EncryptionKey{ID: "a", Key: []byte("short")}); err == nil {
+		t.Error("expected error for invalid key length")
+	}
+}
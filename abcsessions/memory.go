@@ -1,15 +1,35 @@
 package abcsessions
 
 import (
+	"container/heap"
+	"context"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/friendsofgo/errors"
 )
 
 // MemoryStorer is a session storer implementation for saving sessions
 // to memory.
 type MemoryStorer struct {
+	// clock and stats are updated atomically, they are first in the struct
+	// so they are 64-bit aligned on 32-bit platforms. clock is ticked on
+	// every use of a session to order the sessions by last use.
+	clock uint64
+	stats MemoryStorerStats
+
 	// sessions is the memory storage for the sessions. The map key is the id.
 	sessions map[string]memorySession
+	// users is the index of session ids by the user id in their metadata
+	users map[string]map[string]struct{}
+	// expiry is a min-heap of the sessions by expiry, soonest first
+	expiry memoryExpiryHeap
+	// bytes is the size of all sessions in memory
+	bytes int64
+	// maxEntries and maxBytes bound the storer, 0 means unbounded
+	maxEntries int
+	maxBytes   int64
 	// How long sessions take to expire on disk
 	maxAge time.Duration
 	// How often the memory map should be polled for maxAge expired sessions
@@ -22,11 +42,85 @@ type MemoryStorer struct {
 	quit chan struct{}
 }
 
+// MemoryStorerStats are counters of the operations of a MemoryStorer, for
+// exporting to metrics
+type MemoryStorerStats struct {
+	// Hits is the number of Gets that found a session
+	Hits uint64
+	// Misses is the number of Gets that found no session
+	Misses uint64
+	// Evictions is the number of sessions deleted to stay within the bounds
+	Evictions uint64
+	// Expirations is the number of expired sessions deleted by Clean
+	Expirations uint64
+	// Entries is the number of sessions in memory
+	Entries int
+	// Bytes is the size of the session ids and values in memory
+	Bytes int64
+}
+
 type memorySession struct {
 	expires time.Time
-	value   string
+	// lastSeen is when the session was last set or had its expiry reset
+	lastSeen time.Time
+	value    string
+	meta     *SessionMeta
+	// expiry is the entry of the session in the expiry heap
+	expiry *memoryExpiry
+	// used is the clock tick of the last use of the session. It is shared
+	// by the copies of the session and updated atomically, so Get can
+	// record it with only the read lock.
+	used *uint64
+}
+
+// memoryExpiry is when a session expires, kept in the expiry heap
+type memoryExpiry struct {
+	key     string
+	expires time.Time
+	// index of the entry in the heap, kept up to date by the heap
+	index int
+}
+
+// memoryExpiryHeap is a container/heap of session expiries, soonest first
+type memoryExpiryHeap []*memoryExpiry
+
+func (h memoryExpiryHeap) Len() int           { return len(h) }
+func (h memoryExpiryHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+
+func (h memoryExpiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
 }
 
+func (h *memoryExpiryHeap) Push(x interface{}) {
+	e := x.(*memoryExpiry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *memoryExpiryHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+// size is how many bytes of memory the session counts for
+func (m memorySession) size(key string) int64 {
+	return int64(len(key) + len(m.value))
+}
+
+// memoryCleanBatch is how many expired sessions Clean deletes each time it
+// takes the write lock, so Get and Set are not blocked for long
+const memoryCleanBatch = 1000
+
+// memoryEvictSamples is how many sessions a bounded storer looks at to
+// find the least recently used one to evict, as keeping the sessions in
+// order of use would take the write lock on every Get
+const memoryEvictSamples = 16
+
 // NewDefaultMemoryStorer returns a MemoryStorer object with default values.
 // The default values are:
 // maxAge: 2 days (clear session stored on server after 2 days)
@@ -42,12 +136,28 @@ func NewDefaultMemoryStorer() (*MemoryStorer, error) {
 // Persistent storage can be attained by setting maxAge and cleanInterval
 // to zero, however the memory will be wiped when the server is restarted.
 func NewMemoryStorer(maxAge, cleanInterval time.Duration) (*MemoryStorer, error) {
+	return NewBoundedMemoryStorer(maxAge, cleanInterval, 0, 0)
+}
+
+// NewBoundedMemoryStorer initializes and returns a new MemoryStorer object
+// that holds at most maxEntries sessions taking up at most maxBytes (counting
+// the session ids and values). When a Set goes over either bound the least
+// recently used (read or written) of memoryEvictSamples sessions is evicted
+// until the storer is within them, so clients without cookies can not grow
+// the memory without limit. A bound of 0 means no limit.
+func NewBoundedMemoryStorer(maxAge, cleanInterval time.Duration, maxEntries int, maxBytes int64) (*MemoryStorer, error) {
 	if (maxAge != 0 && cleanInterval == 0) || (cleanInterval != 0 && maxAge == 0) {
 		panic("if max age or clean interval is set, the other must also be set")
 	}
+	if maxEntries < 0 || maxBytes < 0 {
+		return nil, errors.New("max entries and max bytes must not be negative")
+	}
 
 	m := &MemoryStorer{
 		sessions:      make(map[string]memorySession),
+		users:         make(map[string]map[string]struct{}),
+		maxEntries:    maxEntries,
+		maxBytes:      maxBytes,
 		maxAge:        maxAge,
 		cleanInterval: cleanInterval,
 	}
@@ -76,30 +186,172 @@ func (m *MemoryStorer) All() ([]string, error) {
 func (m *MemoryStorer) Get(key string) (value string, err error) {
 	m.mut.RLock()
 	session, ok := m.sessions[key]
+	if ok {
+		m.use(session)
+	}
 	m.mut.RUnlock()
+
 	if !ok {
+		atomic.AddUint64(&m.stats.Misses, 1)
 		return "", errNoSession{}
 	}
 
+	atomic.AddUint64(&m.stats.Hits, 1)
 	return session.value, nil
 }
 
 // Set saves the value string to the session pointed to by the session id key.
 func (m *MemoryStorer) Set(key, value string) error {
 	m.mut.Lock()
-	m.sessions[key] = memorySession{
-		expires: time.Now().UTC().Add(m.maxAge),
-		value:   value,
+	session := m.sessions[key]
+	session.lastSeen = time.Now().UTC()
+	session.expires = session.lastSeen.Add(m.maxAge)
+	session.value = value
+	m.put(key, session)
+	m.mut.Unlock()
+
+	return nil
+}
+
+// AllContext returns all keys in the memory store if ctx is not done
+func (m *MemoryStorer) AllContext(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return m.All()
+}
+
+// GetContext returns the value string saved in the session pointed to by the
+// session id key if ctx is not done.
+func (m *MemoryStorer) GetContext(ctx context.Context, key string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	return m.Get(key)
+}
+
+// SetContext saves the value string to the session pointed to by the session
+// id key if ctx is not done.
+func (m *MemoryStorer) SetContext(ctx context.Context, key, value string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return m.Set(key, value)
+}
+
+// DelContext deletes the session pointed to by the session id key if ctx is
+// not done.
+func (m *MemoryStorer) DelContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return m.Del(key)
+}
+
+// ResetExpiryContext resets the expiry of the key if ctx is not done
+func (m *MemoryStorer) ResetExpiryContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return m.ResetExpiry(key)
+}
+
+// TTL returns how long the session pointed to by the session id key has
+// left before it expires, or 0 if it never expires.
+func (m *MemoryStorer) TTL(key string) (time.Duration, error) {
+	m.mut.RLock()
+	session, ok := m.sessions[key]
+	m.mut.RUnlock()
+
+	if !ok {
+		return 0, errNoSession{}
+	}
+	if m.maxAge == 0 {
+		return 0, nil
 	}
+
+	ttl := time.Until(session.expires)
+	if ttl <= 0 {
+		return 0, errNoSession{}
+	}
+
+	return ttl, nil
+}
+
+// SetWithTTL saves the value string to the session pointed to by the
+// session id key, expiring it after ttl instead of maxAge.
+func (m *MemoryStorer) SetWithTTL(key, value string, ttl time.Duration) error {
+	m.mut.Lock()
+	session := m.sessions[key]
+	session.lastSeen = time.Now().UTC()
+	session.expires = session.lastSeen.Add(ttlOrMaxAge(ttl, m.maxAge))
+	session.value = value
+	m.put(key, session)
 	m.mut.Unlock()
 
 	return nil
 }
 
+// GetVersion returns the value string and version saved in the session
+// pointed to by the session id key.
+func (m *MemoryStorer) GetVersion(key string) (value, version string, err error) {
+	value, err = m.Get(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	return value, valueVersion(value), nil
+}
+
+// SetIfVersion saves the value string to the session pointed to by the
+// session id key if the session is still at version. An empty version
+// means the session must not exist.
+func (m *MemoryStorer) SetIfVersion(key, value, version string) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	session, ok := m.sessions[key]
+	if (ok && valueVersion(session.value) != version) || (!ok && len(version) != 0) {
+		return errVersionConflict{}
+	}
+
+	session.lastSeen = time.Now().UTC()
+	session.expires = session.lastSeen.Add(m.maxAge)
+	session.value = value
+	m.put(key, session)
+
+	return nil
+}
+
+// GetVersionContext returns the value string and version saved in the
+// session pointed to by the session id key if ctx is not done.
+func (m *MemoryStorer) GetVersionContext(ctx context.Context, key string) (value, version string, err error) {
+	if err := ctx.Err(); err != nil {
+		return "", "", err
+	}
+
+	return m.GetVersion(key)
+}
+
+// SetIfVersionContext saves the value string to the session pointed to by
+// the session id key if the session is still at version and ctx is not done.
+func (m *MemoryStorer) SetIfVersionContext(ctx context.Context, key, value, version string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return m.SetIfVersion(key, value, version)
+}
+
 // Del the session pointed to by the session id key and remove it.
 func (m *MemoryStorer) Del(key string) error {
 	m.mut.Lock()
-	delete(m.sessions, key)
+	m.delete(key)
 	m.mut.Unlock()
 
 	return nil
@@ -107,30 +359,250 @@ func (m *MemoryStorer) Del(key string) error {
 
 // ResetExpiry resets the expiry of the key
 func (m *MemoryStorer) ResetExpiry(key string) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	session, ok := m.sessions[key]
+	if !ok {
+		return errNoSession{}
+	}
+
+	session.lastSeen = time.Now().UTC()
+	session.expires = session.lastSeen.Add(m.maxAge)
+	m.put(key, session)
+	return nil
+}
+
+// GetMeta returns the metadata of the session pointed to by the session id key.
+func (m *MemoryStorer) GetMeta(key string) (SessionMeta, error) {
 	m.mut.RLock()
+	defer m.mut.RUnlock()
+
+	session, ok := m.sessions[key]
+	if !ok {
+		return SessionMeta{}, errNoSession{}
+	}
+
+	return m.meta(key, session), nil
+}
+
+// SetMeta sets the metadata of the session pointed to by the session id key
+// and adds it to the index of the user.
+func (m *MemoryStorer) SetMeta(key string, meta SessionMeta) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
 	session, ok := m.sessions[key]
-	m.mut.RUnlock()
 	if !ok {
 		return errNoSession{}
 	}
 
-	session.expires = time.Now().UTC().Add(m.maxAge)
+	if session.meta != nil {
+		m.unindex(key, session.meta.UserID)
+	}
+
+	meta.ID = key
+	if meta.CreatedAt.IsZero() {
+		meta.CreatedAt = time.Now().UTC()
+	}
+	session.meta = &meta
 	m.sessions[key] = session
+
+	if len(meta.UserID) != 0 {
+		if m.users[meta.UserID] == nil {
+			m.users[meta.UserID] = make(map[string]struct{})
+		}
+		m.users[meta.UserID][key] = struct{}{}
+	}
+
+	return nil
+}
+
+// ListByUser returns the metadata of all sessions of the user, the most
+// recently seen session first.
+func (m *MemoryStorer) ListByUser(userID string) ([]SessionMeta, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+
+	metas := make([]SessionMeta, 0, len(m.users[userID]))
+	for key := range m.users[userID] {
+		metas = append(metas, m.meta(key, m.sessions[key]))
+	}
+
+	sortSessionMeta(metas)
+
+	return metas, nil
+}
+
+// DeleteByUser deletes all sessions of the user.
+func (m *MemoryStorer) DeleteByUser(userID string) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	for key := range m.users[userID] {
+		m.delete(key)
+	}
+
 	return nil
 }
 
-// Clean checks all sessions in memory to see if they are older than
-// maxAge by checking their expiry. If it finds an expired session
-// it will remove it from memory.
+// meta returns the metadata of a session, with LastSeen taken from when
+// it was last set or had its expiry reset
+func (m *MemoryStorer) meta(key string, session memorySession) SessionMeta {
+	var meta SessionMeta
+	if session.meta != nil {
+		meta = *session.meta
+	}
+
+	meta.ID = key
+	meta.LastSeen = session.lastSeen
+
+	return meta
+}
+
+// put stores the session, keeping the expiry heap in order and evicting the
+// least recently used sessions if the storer is over its bounds. The caller
+// must hold the write lock.
+func (m *MemoryStorer) put(key string, session memorySession) {
+	old, exists := m.sessions[key]
+	if exists {
+		m.bytes -= old.size(key)
+	}
+	m.bytes += session.size(key)
+
+	if session.expiry == nil {
+		session.expiry = &memoryExpiry{key: key, expires: session.expires}
+		heap.Push(&m.expiry, session.expiry)
+	} else {
+		session.expiry.expires = session.expires
+		heap.Fix(&m.expiry, session.expiry.index)
+	}
+
+	if session.used == nil {
+		session.used = new(uint64)
+	}
+	m.use(session)
+
+	m.sessions[key] = session
+
+	m.evict(key)
+}
+
+// use records the use of the session. The caller must hold the read or
+// write lock.
+func (m *MemoryStorer) use(session memorySession) {
+	atomic.StoreUint64(session.used, atomic.AddUint64(&m.clock, 1))
+}
+
+// evict deletes sessions until the storer is within its bounds, each time
+// the least recently used of memoryEvictSamples sessions. The session that
+// was just set is never evicted. The caller must hold the write lock.
+func (m *MemoryStorer) evict(keep string) {
+	if !m.bounded() {
+		return
+	}
+
+	for (m.maxEntries != 0 && len(m.sessions) > m.maxEntries) || (m.maxBytes != 0 && m.bytes > m.maxBytes) {
+		// Map iteration starts at a random session, so the sessions
+		// looked at are different each time
+		var oldest string
+		var oldestUsed uint64
+		n := 0
+		for key, session := range m.sessions {
+			if key == keep {
+				continue
+			}
+			if used := atomic.LoadUint64(session.used); len(oldest) == 0 || used < oldestUsed {
+				oldest, oldestUsed = key, used
+			}
+			if n++; n == memoryEvictSamples {
+				break
+			}
+		}
+		if len(oldest) == 0 {
+			return
+		}
+
+		m.delete(oldest)
+		atomic.AddUint64(&m.stats.Evictions, 1)
+	}
+}
+
+// bounded returns true if the storer has a bound on its size
+func (m *MemoryStorer) bounded() bool {
+	return m.maxEntries != 0 || m.maxBytes != 0
+}
+
+// delete removes the session and its user index entry. The caller must
+// hold the write lock.
+func (m *MemoryStorer) delete(key string) {
+	session, ok := m.sessions[key]
+	if !ok {
+		return
+	}
+
+	if session.meta != nil {
+		m.unindex(key, session.meta.UserID)
+	}
+	if session.expiry != nil {
+		heap.Remove(&m.expiry, session.expiry.index)
+	}
+	m.bytes -= session.size(key)
+
+	delete(m.sessions, key)
+}
+
+// unindex removes the session from the index of the user. The caller must
+// hold the write lock.
+func (m *MemoryStorer) unindex(key, userID string) {
+	delete(m.users[userID], key)
+	if len(m.users[userID]) == 0 {
+		delete(m.users, userID)
+	}
+}
+
+// Clean deletes the sessions in memory that are older than maxAge. The
+// sessions are kept in a heap by expiry, so it only looks at the expired
+// sessions, and deletes them in batches so the lock is not held for long.
 func (m *MemoryStorer) Clean() {
+	if m.maxAge == 0 {
+		return
+	}
+
 	t := time.Now().UTC()
-	m.mut.Lock()
-	for id, session := range m.sessions {
-		if t.After(session.expires) {
-			delete(m.sessions, id)
+	for {
+		m.mut.Lock()
+		n := 0
+		for ; n < memoryCleanBatch; n++ {
+			if len(m.expiry) == 0 || !t.After(m.expiry[0].expires) {
+				break
+			}
+
+			m.delete(m.expiry[0].key)
+		}
+		m.mut.Unlock()
+
+		atomic.AddUint64(&m.stats.Expirations, uint64(n))
+		if n < memoryCleanBatch {
+			return
 		}
 	}
-	m.mut.Unlock()
+}
+
+// Stats returns the counters of the storer and its current size
+func (m *MemoryStorer) Stats() MemoryStorerStats {
+	m.mut.RLock()
+	entries, bytes := len(m.sessions), m.bytes
+	m.mut.RUnlock()
+
+	return MemoryStorerStats{
+		Hits:        atomic.LoadUint64(&m.stats.Hits),
+		Misses:      atomic.LoadUint64(&m.stats.Misses),
+		Evictions:   atomic.LoadUint64(&m.stats.Evictions),
+		Expirations: atomic.LoadUint64(&m.stats.Expirations),
+		Entries:     entries,
+		Bytes:       bytes,
+	}
 }
 
 // StartCleaner starts the memory session cleaner go routine. This go routine
@@ -163,12 +635,14 @@ func (m *MemoryStorer) cleanerLoop() {
 
 	t, c := timerTestHarness(m.cleanInterval)
 
-	select {
-	case <-c:
-		m.Clean()
-		t.Reset(m.cleanInterval)
-	case <-m.quit:
-		t.Stop()
-		return
+	for {
+		select {
+		case <-c:
+			m.Clean()
+			t.Reset(m.cleanInterval)
+		case <-m.quit:
+			t.Stop()
+			return
+		}
 	}
 }
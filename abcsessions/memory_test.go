@@ -1,6 +1,8 @@
 package abcsessions
 
 import (
+	"math/rand"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -33,207 +35,314 @@ func TestMemoryStorerNewDefault(t *testing.T) {
 	m.wg.Wait()
 }
 
-func TestMemoryStorerAll(t *testing.T) {
-	t.Parallel()
-
-	m, _ := NewDefaultMemoryStorer()
+// memoryTestTimer is used in the timerTestHarness override so we can
+// control sending signals to the sleep channel and trigger cleans manually
+type memoryTestTimer struct{}
 
-	list, err := m.All()
-	if err != nil {
-		t.Error("expected no error on empty list")
-	}
-	if len(list) > 0 {
-		t.Error("Expected len 0")
-	}
+func (memoryTestTimer) Reset(time.Duration) bool {
+	return true
+}
 
-	m.Set("hi", "hello")
-	m.Set("yo", "friend")
+func (memoryTestTimer) Stop() bool {
+	return true
+}
 
-	list, err = m.All()
+func TestMemoryStorerCleaner(t *testing.T) {
+	m, err := NewMemoryStorer(time.Hour, time.Hour)
 	if err != nil {
 		t.Error(err)
 	}
-	if len(list) != 2 {
-		t.Errorf("Expected len 2, got %d", len(list))
-	}
-	if (list[0] != "hi" && list[0] != "yo") || list[0] == list[1] {
-		t.Errorf("Expected list[0] to be %q or %q, got %q", "yo", "hi", list[0])
+
+	tm := memoryTestTimer{}
+	ch := make(chan time.Time)
+	timerTestHarness = func(d time.Duration) (timer, <-chan time.Time) {
+		return tm, ch
 	}
-	if (list[1] != "yo" && list[1] != "hi") || list[1] == list[0] {
-		t.Errorf("Expected list[1] to be %q or %q, got %q", "hi", "yo", list[1])
+
+	m.put("testid1", memorySession{
+		value:   "test1",
+		expires: time.Now().Add(time.Hour),
+	})
+	m.put("testid2", memorySession{
+		value:   "test2",
+		expires: time.Now().AddDate(0, 0, -1),
+	})
+
+	if len(m.sessions) != 2 {
+		t.Error("expected len 2")
 	}
-}
 
-func TestMemoryStorerGet(t *testing.T) {
-	t.Parallel()
+	// Start the cleaner go routine
+	m.StartCleaner()
 
-	m, _ := NewDefaultMemoryStorer()
+	// Signal the timer channel to execute the clean
+	ch <- time.Time{}
 
-	val, err := m.Get("lol")
-	if !IsNoSessionError(err) {
-		t.Errorf("Expected ErrNoSession, got: %v", err)
-	}
+	// The cleaner keeps running after the first clean
+	m.mut.Lock()
+	m.put("testid3", memorySession{
+		value:   "test3",
+		expires: time.Now().AddDate(0, 0, -1),
+	})
+	m.mut.Unlock()
+	ch <- time.Time{}
 
-	m.Set("hi", "hello")
+	// Stop the cleaner, this will block until the cleaner has finished its operations
+	m.StopCleaner()
 
-	val, err = m.Get("hi")
-	if err != nil {
-		t.Error(err)
+	if len(m.sessions) != 1 {
+		t.Errorf("expected len 1, got %d", len(m.sessions))
 	}
-	if val != "hello" {
-		t.Errorf("Expected %q, got %s", "hello", val)
+
+	_, ok := m.sessions["testid2"]
+	if ok {
+		t.Error("expected testid2 to be deleted, but was not")
+	}
+	_, ok = m.sessions["testid3"]
+	if ok {
+		t.Error("expected testid3 to be deleted, but was not")
 	}
 }
 
-func TestMemoryStorerSet(t *testing.T) {
+func TestMemoryStorerCleanOrder(t *testing.T) {
 	t.Parallel()
 
-	m, _ := NewDefaultMemoryStorer()
-
-	if len(m.sessions) != 0 {
-		t.Errorf("Expected len 0, got %d", len(m.sessions))
+	m, err := NewMemoryStorer(time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	m.Set("hi", "hello")
-	m.Set("hi", "whatsup")
-	m.Set("yo", "friend")
+	now := time.Now().UTC()
+	m.put("late", memorySession{expires: now.Add(time.Minute)})
+	m.put("early", memorySession{expires: now.Add(-2 * time.Minute)})
+	m.put("middle", memorySession{expires: now.Add(-time.Minute)})
 
-	if len(m.sessions) != 2 {
-		t.Errorf("Expected len 2, got %d", len(m.sessions))
+	if first := m.expiry[0].key; first != "early" {
+		t.Errorf("expected early to expire first, got %s", first)
 	}
 
-	val, err := m.Get("hi")
-	if err != nil {
-		t.Error(err)
+	m.Clean()
+
+	if len(m.sessions) != 1 || m.expiry.Len() != 1 {
+		t.Errorf("expected 1 session left, got %d", len(m.sessions))
+	}
+	if _, ok := m.sessions["late"]; !ok {
+		t.Error("expected the unexpired session to be kept")
 	}
-	if val != "whatsup" {
-		t.Errorf("Expected %q, got %s", "whatsup", val)
+	if stats := m.Stats(); stats.Expirations != 2 {
+		t.Errorf("expected 2 expirations, got %d", stats.Expirations)
 	}
 
-	val, err = m.Get("yo")
-	if err != nil {
-		t.Error(err)
+	// Resetting the expiry moves the session back in the heap
+	m.put("other", memorySession{expires: now.Add(time.Hour)})
+	if first := m.expiry[0].key; first != "late" {
+		t.Errorf("expected late to expire first, got %s", first)
 	}
-	if val != "friend" {
-		t.Errorf("Expected %q, got %s", "friend", val)
+	if err := m.ResetExpiry("late"); err != nil {
+		t.Fatal(err)
+	}
+	if first := m.expiry[0].key; first != "other" {
+		t.Errorf("expected other to expire first, got %s", first)
 	}
 }
 
-func TestMemoryStorerDel(t *testing.T) {
+func TestMemoryStorerExpiryHeap(t *testing.T) {
 	t.Parallel()
 
-	m, _ := NewDefaultMemoryStorer()
+	m, err := NewMemoryStorer(time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	if len(m.sessions) != 0 {
-		t.Errorf("Expected len 0, got %d", len(m.sessions))
+	// Sessions expired i minutes ago for even i, and in i minutes for odd i,
+	// set out of order
+	now := time.Now().UTC()
+	for _, i := range rand.Perm(100) {
+		expires := now.Add(time.Duration(i) * time.Minute)
+		if i%2 == 0 {
+			expires = now.Add(-time.Duration(i+1) * time.Minute)
+		}
+		m.put(strconv.Itoa(i), memorySession{expires: expires})
 	}
 
-	m.Set("hi", "hello")
-	m.Set("hi", "whatsup")
-	m.Set("yo", "friend")
+	// Deleting and resetting sessions keeps the heap in order
+	_ = m.Del("1")
+	_ = m.Del("2")
+	if err := m.ResetExpiry("4"); err != nil {
+		t.Fatal(err)
+	}
 
-	if len(m.sessions) != 2 {
-		t.Errorf("Expected len 2, got %d", len(m.sessions))
+	m.Clean()
+
+	if len(m.sessions) != 50 || m.expiry.Len() != 50 {
+		t.Fatalf("expected 50 sessions left, got %d and %d in the heap", len(m.sessions), m.expiry.Len())
+	}
+	for key, session := range m.sessions {
+		if !session.expires.After(now) {
+			t.Errorf("expected %s to be cleaned", key)
+		}
+		if m.expiry[session.expiry.index] != session.expiry {
+			t.Errorf("expected the heap index of %s to be kept up to date", key)
+		}
 	}
+}
+
+func TestMemoryStorerMaxEntries(t *testing.T) {
+	t.Parallel()
 
-	err := m.Del("hi")
+	m, err := NewBoundedMemoryStorer(0, 0, 2, 0)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
-	_, err = m.Get("hi")
-	if err == nil {
-		t.Errorf("Expected get hi to fail")
-	}
+	_ = m.Set("a", "1")
+	_ = m.Set("b", "2")
 
-	if len(m.sessions) != 1 {
-		t.Errorf("Expected len 1, got %d", len(m.sessions))
+	// Reading a makes b the least recently used session
+	if _, err := m.Get("a"); err != nil {
+		t.Fatal(err)
 	}
-}
 
-// memoryTestTimer is used in the timerTestHarness override so we can
-// control sending signals to the sleep channel and trigger cleans manually
-type memoryTestTimer struct{}
+	_ = m.Set("c", "3")
 
-func (memoryTestTimer) Reset(time.Duration) bool {
-	return true
-}
+	if _, err := m.Get("b"); !IsNoSessionError(err) {
+		t.Errorf("expected b to be evicted, got: %v", err)
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, err := m.Get(key); err != nil {
+			t.Errorf("expected %s to be kept, got: %v", key, err)
+		}
+	}
 
-func (memoryTestTimer) Stop() bool {
-	return true
+	stats := m.Stats()
+	if stats.Evictions != 1 || stats.Entries != 2 {
+		t.Errorf("expected 1 eviction and 2 entries, got %#v", stats)
+	}
+	if m.expiry.Len() != 2 {
+		t.Errorf("expected the heap to hold 2 sessions, got %d", m.expiry.Len())
+	}
 }
 
-func TestMemoryStorerCleaner(t *testing.T) {
-	m, err := NewMemoryStorer(time.Hour, time.Hour)
+func TestMemoryStorerEvictReadSessions(t *testing.T) {
+	t.Parallel()
+
+	m, err := NewBoundedMemoryStorer(0, 0, 8, 0)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
-	tm := memoryTestTimer{}
-	ch := make(chan time.Time)
-	timerTestHarness = func(d time.Duration) (timer, <-chan time.Time) {
-		return tm, ch
+	users := []string{"u0", "u1", "u2", "u3"}
+	for _, key := range users {
+		_ = m.Set(key, "user")
+	}
+	for i := 0; i < 4; i++ {
+		_ = m.Set("old-bot"+strconv.Itoa(i), "bot")
 	}
 
-	m.sessions["testid1"] = memorySession{
-		value:   "test1",
-		expires: time.Now().Add(time.Hour),
+	// Users that read their session once are kept over a burst of new
+	// sessions, instead of being evicted in the order they were set
+	for _, key := range users {
+		if _, err := m.Get(key); err != nil {
+			t.Fatal(err)
+		}
 	}
-	m.sessions["testid2"] = memorySession{
-		value:   "test2",
-		expires: time.Now().AddDate(0, 0, -1),
+	for i := 0; i < 4; i++ {
+		_ = m.Set("new-bot"+strconv.Itoa(i), "bot")
 	}
 
-	if len(m.sessions) != 2 {
-		t.Error("expected len 2")
+	for _, key := range users {
+		if _, err := m.Get(key); err != nil {
+			t.Errorf("expected %s to be kept, got: %v", key, err)
+		}
 	}
+	for i := 0; i < 4; i++ {
+		if _, err := m.Get("old-bot" + strconv.Itoa(i)); !IsNoSessionError(err) {
+			t.Errorf("expected old-bot%d to be evicted, got: %v", i, err)
+		}
+	}
+}
 
-	// Start the cleaner go routine
-	m.StartCleaner()
-
-	// Signal the timer channel to execute the clean
-	ch <- time.Time{}
+func TestMemoryStorerLastSeen(t *testing.T) {
+	t.Parallel()
 
-	// Stop the cleaner, this will block until the cleaner has finished its operations
-	m.StopCleaner()
+	m, err := NewMemoryStorer(time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	if len(m.sessions) != 1 {
-		t.Errorf("expected len 1, got %d", len(m.sessions))
+	// Sessions copied with a ttl shorter than maxAge were still seen now
+	if err := m.SetWithTTL("a", "val", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetMeta("a", SessionMeta{UserID: "bob"}); err != nil {
+		t.Fatal(err)
 	}
 
-	_, ok := m.sessions["testid2"]
-	if ok {
-		t.Error("expected testid2 to be deleted, but was not")
+	meta, err := m.GetMeta("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if since := time.Since(meta.LastSeen); since < 0 || since > time.Minute/2 {
+		t.Errorf("expected last seen to be now, got %s", meta.LastSeen)
 	}
 }
 
-func TestMemoryStorerResetExpiry(t *testing.T) {
+func TestMemoryStorerMaxBytes(t *testing.T) {
 	t.Parallel()
 
-	m, err := NewDefaultMemoryStorer()
+	m, err := NewBoundedMemoryStorer(0, 0, 0, 10)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
-	err = m.Set("test", "val")
-	if err != nil {
-		t.Error(err)
+	_ = m.Set("a", "1234")
+	_ = m.Set("b", "1234")
+	if stats := m.Stats(); stats.Bytes != 10 || stats.Evictions != 0 {
+		t.Errorf("expected 10 bytes and no evictions, got %#v", stats)
 	}
 
-	sess := m.sessions["test"]
-	oldExpires := sess.expires
+	// Growing a session evicts the others
+	_ = m.Set("b", "12345")
+	if _, err := m.Get("a"); !IsNoSessionError(err) {
+		t.Errorf("expected a to be evicted, got: %v", err)
+	}
 
-	time.Sleep(time.Nanosecond * 1)
+	// A session larger than the bound is still stored
+	_ = m.Set("c", "12345678901234567890")
+	if val, err := m.Get("c"); err != nil || val != "12345678901234567890" {
+		t.Errorf("expected the large session to be stored, got %q: %v", val, err)
+	}
+
+	stats := m.Stats()
+	if stats.Entries != 1 || stats.Bytes != 21 || stats.Evictions != 2 {
+		t.Errorf("expected only the large session, got %#v", stats)
+	}
 
-	err = m.ResetExpiry("test")
+	_ = m.Del("c")
+	if stats := m.Stats(); stats.Entries != 0 || stats.Bytes != 0 {
+		t.Errorf("expected an empty storer, got %#v", stats)
+	}
+
+	if _, err := NewBoundedMemoryStorer(0, 0, -1, 0); err == nil {
+		t.Error("expected an error for a negative bound")
+	}
+}
+
+func TestMemoryStorerStats(t *testing.T) {
+	t.Parallel()
+
+	m, err := NewDefaultMemoryStorer()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
-	sess = m.sessions["test"]
-	newExpires := sess.expires
+	_ = m.Set("a", "1")
+	_, _ = m.Get("a")
+	_, _ = m.Get("a")
+	_, _ = m.Get("b")
 
-	if !newExpires.After(oldExpires) || newExpires == oldExpires {
-		t.Errorf("Expected newexpires to be newer than old expires, got: %#v, %#v", oldExpires, newExpires)
+	stats := m.Stats()
+	if stats.Hits != 2 || stats.Misses != 1 || stats.Entries != 1 || stats.Bytes != 2 {
+		t.Errorf("expected 2 hits, 1 miss and 1 entry, got %#v", stats)
 	}
 }
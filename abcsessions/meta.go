@@ -0,0 +1,84 @@
+package abcsessions
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// SessionMeta is metadata about a session that is stored alongside its
+// value by a UserIndexStorer, for example to show users a list of the
+// devices they are logged in on.
+type SessionMeta struct {
+	// ID is the session id
+	ID string
+	// UserID is the id of the user the session belongs to
+	UserID string
+	// CreatedAt is when the metadata was first set, usually at login
+	CreatedAt time.Time
+	// LastSeen is the last time the session was set or had its expiry reset
+	LastSeen time.Time
+	// IP is the remote address of the request that set the metadata
+	IP string
+	// UserAgent is the user agent of the request that set the metadata
+	UserAgent string
+}
+
+// UserIndexStorer is a Storer that can store metadata about sessions and
+// keeps an index from user ids to their sessions, so that all sessions of
+// a user can be listed and deleted ("log out everywhere").
+type UserIndexStorer interface {
+	Storer
+	// GetMeta returns the metadata of the session pointed to by the session
+	// id key. Sessions without metadata return a SessionMeta with only the
+	// ID and LastSeen set.
+	GetMeta(key string) (SessionMeta, error)
+	// SetMeta sets the metadata of the session pointed to by the session id
+	// key and adds it to the index of meta.UserID. The session must exist.
+	SetMeta(key string, meta SessionMeta) error
+	// ListByUser returns the metadata of all sessions of the user, the most
+	// recently seen session first.
+	ListByUser(userID string) ([]SessionMeta, error)
+	// DeleteByUser deletes all sessions of the user.
+	DeleteByUser(userID string) error
+}
+
+// newSessionMeta creates the metadata of a session for the user from the
+// request. The IP is the host of r.RemoteAddr, use a middleware such as
+// chi's RealIP to set it from proxy headers.
+func newSessionMeta(r *http.Request, userID string) SessionMeta {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	now := time.Now().UTC()
+
+	return SessionMeta{
+		UserID:    userID,
+		CreatedAt: now,
+		LastSeen:  now,
+		IP:        ip,
+		UserAgent: r.UserAgent(),
+	}
+}
+
+// userIndexName returns a name for the user id that is safe to use as a
+// file name or key, whatever characters the user id contains.
+func userIndexName(userID string) string {
+	sum := sha1.Sum([]byte(userID))
+	return hex.EncodeToString(sum[:])
+}
+
+// sortSessionMeta sorts sessions by the most recently seen first
+func sortSessionMeta(metas []SessionMeta) {
+	sort.Slice(metas, func(i, j int) bool {
+		if metas[i].LastSeen.Equal(metas[j].LastSeen) {
+			return metas[i].ID < metas[j].ID
+		}
+		return metas[i].LastSeen.After(metas[j].LastSeen)
+	})
+}
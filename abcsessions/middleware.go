@@ -1,6 +1,9 @@
 package abcsessions
 
-import "net/http"
+import (
+	"net/http"
+	"sort"
+)
 
 type cookieWriter interface {
 	SetCookie(cookie *http.Cookie)
@@ -15,6 +18,9 @@ type sessionsResponseWriter struct {
 	wroteHeader  bool
 	wroteCookies bool
 	cookies      map[string]*http.Cookie
+	// cache is the session cache used by CacheMiddleware
+	cache      *sessionCache
+	savedCache bool
 }
 
 // newSessionsResponseWriter returns a new sessionsResponseWriter object with a pointer to
@@ -31,20 +37,69 @@ func (s *sessionsResponseWriter) Write(buf []byte) (int, error) {
 	return s.ResponseWriter.Write(buf)
 }
 
-// WriteHeader sets all cookies in the buffer on the underlying ResponseWriter's
-// headers and calls the underlying ResponseWriter WriteHeader func
+// WriteHeader saves the sessions in the session cache, sets all cookies in
+// the buffer on the underlying ResponseWriter's headers and calls the
+// underlying ResponseWriter WriteHeader func
 func (s *sessionsResponseWriter) WriteHeader(code int) {
 	s.wroteHeader = true
 
-	// Set all the cookies in the cookie buffer
-	if !s.wroteCookies {
-		s.wroteCookies = true
-		for _, c := range s.cookies {
-			http.SetCookie(s.ResponseWriter, c)
+	s.saveCache()
+	s.writeCookies()
+
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// saveCache saves the sessions in the session cache once. The response is
+// already being written, so errors can not change it: they are passed to
+// the error handler of the cache and returned by Save.
+func (s *sessionsResponseWriter) saveCache() {
+	if s.cache == nil || s.savedCache {
+		return
+	}
+	s.savedCache = true
+
+	if err := s.cache.save(s); err != nil {
+		s.cache.err = err
+		if s.cache.onError != nil {
+			s.cache.onError(s.cache.r, err)
 		}
 	}
+}
 
-	s.ResponseWriter.WriteHeader(code)
+// writeCookies sets all the cookies in the cookie buffer on the underlying
+// ResponseWriter's headers, unless they have already been written. They are
+// sorted by name so the chunks of a chunked cookie are written in a
+// consistent order.
+func (s *sessionsResponseWriter) writeCookies() {
+	if s.wroteCookies {
+		return
+	}
+	s.wroteCookies = true
+
+	names := make([]string, 0, len(s.cookies))
+	for name := range s.cookies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		setCookie(s.ResponseWriter, s.cookies[name])
+	}
+}
+
+// setCookie works like http.SetCookie but also writes the attributes in
+// cookie.Unparsed, such as Partitioned, which http.Cookie has no field for.
+func setCookie(w http.ResponseWriter, cookie *http.Cookie) {
+	v := cookie.String()
+	if len(v) == 0 {
+		return
+	}
+
+	for _, attr := range cookie.Unparsed {
+		v += "; " + attr
+	}
+
+	w.Header().Add("Set-Cookie", v)
 }
 
 func (s *sessionsResponseWriter) SetCookie(cookie *http.Cookie) {
@@ -63,6 +118,10 @@ func (s *sessionsResponseWriter) GetCookie(name string) *http.Cookie {
 	return s.cookies[name]
 }
 
+func (s *sessionsResponseWriter) sessionCache() *sessionCache {
+	return s.cache
+}
+
 // Middleware converts the ResponseWriter object to a sessionsResponseWriter
 // for buffering cookies across session API requests.
 // The sessionsResponseWriter implements cookieWriter.
@@ -0,0 +1,169 @@
+package abcsessions
+
+import (
+	"time"
+
+	"github.com/friendsofgo/errors"
+)
+
+// TTLStorer is a Storer that can tell how long a session has left before it
+// expires, and store a session with a different expiry than its maxAge.
+// MigrateStorer uses it to keep the remaining lifetime of the sessions it
+// copies.
+type TTLStorer interface {
+	Storer
+	// TTL returns how long the session pointed to by the session id key has
+	// left before it expires, or 0 if it never expires.
+	TTL(key string) (time.Duration, error)
+	// SetWithTTL saves the value string to the session pointed to by the
+	// session id key, expiring it after ttl instead of the maxAge of the
+	// storer. A ttl of 0 uses the maxAge, and storers without a maxAge
+	// keep the session forever.
+	SetWithTTL(key, value string, ttl time.Duration) error
+}
+
+// ttlOrMaxAge returns how long a session set with ttl lives in a storer
+// with maxAge
+func ttlOrMaxAge(ttl, maxAge time.Duration) time.Duration {
+	if ttl <= 0 || maxAge == 0 {
+		return maxAge
+	}
+
+	return ttl
+}
+
+// MigrateOptions for MigrateStorer
+type MigrateOptions struct {
+	// DryRun reads every session from the source storer without writing
+	// them to the destination storer
+	DryRun bool
+	// Progress is called after each session with the progress so far
+	Progress func(MigrateProgress)
+}
+
+// MigrateProgress counts the sessions seen by MigrateStorer
+type MigrateProgress struct {
+	// Total is the number of sessions in the source storer
+	Total int
+	// Copied is the number of sessions copied to the destination storer,
+	// or that would have been copied in a dry run
+	Copied int
+	// Skipped is the number of sessions that expired or were deleted
+	// before they were copied
+	Skipped int
+}
+
+// MigrateStorer copies every session from one Storer to another, for example
+// when moving from the DiskStorer to the RedisStorer, so users are not logged
+// out. Sessions that already exist in the destination are overwritten.
+//
+// When both storers are TTLStorers the sessions keep the time they have left
+// before they expire, otherwise they get the maxAge of the destination. When
+// both are UserIndexStorers the session metadata is copied too.
+func MigrateStorer(from, to Storer, opts MigrateOptions) (MigrateProgress, error) {
+	var progress MigrateProgress
+
+	keys, err := from.All()
+	if err != nil {
+		return progress, errors.Wrap(err, "unable to list sessions")
+	}
+	progress.Total = len(keys)
+
+	fromTTL, toTTL := ttlStorers(from, to)
+	fromIndex, toIndex := userIndexStorers(from, to)
+
+	for _, key := range keys {
+		copied, err := migrateSession(key, from, to, fromTTL, toTTL, fromIndex, toIndex, opts.DryRun)
+		if err != nil {
+			return progress, errors.Wrapf(err, "unable to migrate session %s", key)
+		}
+
+		if copied {
+			progress.Copied++
+		} else {
+			progress.Skipped++
+		}
+
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+	}
+
+	return progress, nil
+}
+
+// ttlStorers returns both storers as TTLStorers, or nils if either is not
+func ttlStorers(from, to Storer) (TTLStorer, TTLStorer) {
+	fromTTL, fromOK := asTTLStorer(from)
+	toTTL, toOK := asTTLStorer(to)
+	if !fromOK || !toOK {
+		return nil, nil
+	}
+
+	return fromTTL, toTTL
+}
+
+// userIndexStorers returns both storers as UserIndexStorers, or nils if
+// either is not
+func userIndexStorers(from, to Storer) (UserIndexStorer, UserIndexStorer) {
+	fromIndex, fromOK := asUserIndexStorer(from)
+	toIndex, toOK := asUserIndexStorer(to)
+	if !fromOK || !toOK {
+		return nil, nil
+	}
+
+	return fromIndex, toIndex
+}
+
+// migrateSession copies a single session and its metadata. It returns false
+// if the session no longer exists in the source storer.
+func migrateSession(key string, from, to Storer, fromTTL, toTTL TTLStorer, fromIndex, toIndex UserIndexStorer, dryRun bool) (bool, error) {
+	value, err := from.Get(key)
+	if IsNoSessionError(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	var ttl time.Duration
+	if fromTTL != nil {
+		ttl, err = fromTTL.TTL(key)
+		if IsNoSessionError(err) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+
+	var meta SessionMeta
+	if fromIndex != nil {
+		meta, err = fromIndex.GetMeta(key)
+		if IsNoSessionError(err) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+
+	if dryRun {
+		return true, nil
+	}
+
+	if toTTL != nil {
+		err = toTTL.SetWithTTL(key, value, ttl)
+	} else {
+		err = to.Set(key, value)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// Sessions without metadata only have an id
+	if toIndex != nil && (len(meta.UserID) != 0 || !meta.CreatedAt.IsZero() || len(meta.IP) != 0 || len(meta.UserAgent) != 0) {
+		if err := toIndex.SetMeta(key, meta); err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
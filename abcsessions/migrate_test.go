@@ -0,0 +1,118 @@
+package abcsessions
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestMigrateStorer(t *testing.T) {
+	t.Parallel()
+
+	from, err := NewMemoryStorer(time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "migratetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	to, err := NewDiskStorer(dir, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id1, id2, expired := uuid.NewV4().String(), uuid.NewV4().String(), uuid.NewV4().String()
+	if err := from.Set(id1, "one"); err != nil {
+		t.Fatal(err)
+	}
+	if err := from.SetMeta(id1, SessionMeta{UserID: "bob", IP: "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := from.SetWithTTL(id2, "two", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	from.put(expired, memorySession{value: "old", expires: time.Now().Add(-time.Minute)})
+
+	var calls []MigrateProgress
+	progress, err := MigrateStorer(from, to, MigrateOptions{
+		Progress: func(p MigrateProgress) { calls = append(calls, p) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if progress != (MigrateProgress{Total: 3, Copied: 2, Skipped: 1}) {
+		t.Errorf("expected 2 copied and 1 skipped, got %#v", progress)
+	}
+	if len(calls) != 3 || calls[2] != progress {
+		t.Errorf("expected progress after each session, got %#v", calls)
+	}
+
+	if val, err := to.Get(id1); err != nil || val != "one" {
+		t.Errorf("expected %q, got %q: %v", "one", val, err)
+	}
+	if val, err := to.Get(id2); err != nil || val != "two" {
+		t.Errorf("expected %q, got %q: %v", "two", val, err)
+	}
+	if _, err := to.Get(expired); !IsNoSessionError(err) {
+		t.Errorf("expected the expired session to be skipped, got: %v", err)
+	}
+
+	// The remaining ttl is kept
+	if ttl, err := to.TTL(id2); err != nil {
+		t.Error(err)
+	} else if ttl > time.Minute || ttl < 50*time.Second {
+		t.Errorf("expected a ttl of 1 minute, got %v", ttl)
+	}
+	if ttl, err := to.TTL(id1); err != nil {
+		t.Error(err)
+	} else if ttl < time.Hour-time.Minute {
+		t.Errorf("expected a ttl of 1 hour, got %v", ttl)
+	}
+
+	// The metadata and user index are copied
+	metas, err := to.ListByUser("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != 1 || metas[0].ID != id1 || metas[0].IP != "127.0.0.1" {
+		t.Errorf("expected the session of bob, got %#v", metas)
+	}
+	if meta, err := to.GetMeta(id2); err != nil {
+		t.Error(err)
+	} else if !meta.CreatedAt.IsZero() {
+		t.Errorf("expected no metadata to be set, got %#v", meta)
+	}
+}
+
+func TestMigrateStorerDryRun(t *testing.T) {
+	t.Parallel()
+
+	from, _ := NewDefaultMemoryStorer()
+	to, _ := NewDefaultMemoryStorer()
+
+	for i := 0; i < 3; i++ {
+		if err := from.Set(uuid.NewV4().String(), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	progress, err := MigrateStorer(from, to, MigrateOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if progress != (MigrateProgress{Total: 3, Copied: 3}) {
+		t.Errorf("expected 3 sessions to be counted, got %#v", progress)
+	}
+	if keys, _ := to.All(); len(keys) != 0 {
+		t.Errorf("expected nothing to be written, got %v", keys)
+	}
+}
@@ -1,6 +1,9 @@
 package abcsessions
 
 import (
+	"context"
+	"encoding/json"
+	"strings"
 	"time"
 
 	"github.com/friendsofgo/errors"
@@ -12,6 +15,8 @@ import (
 type RedisStorer struct {
 	// How long sessions take to expire in Redis
 	maxAge time.Duration
+	// prefix is put in front of every key written to Redis
+	prefix string
 	client *redis.Client
 }
 
@@ -22,6 +27,7 @@ type RedisStorer struct {
 // Password: no password
 // DB: First database (0) to be selected after connecting to Redis
 // maxAge: 2 days (clear session stored in Redis after 2 days)
+// prefix: no prefix, sessions are stored at the top level of the database
 func NewDefaultRedisStorer(addr, password string, db int) (*RedisStorer, error) {
 	if addr == "" {
 		addr = "localhost:6379"
@@ -31,29 +37,38 @@ func NewDefaultRedisStorer(addr, password string, db int) (*RedisStorer, error)
 		Password: password,
 		DB:       db,
 	}
-	return NewRedisStorer(opts, time.Hour*24*2)
+	return NewRedisStorer(opts, time.Hour*24*2, "")
 }
 
 // NewRedisStorer initializes and returns a new RedisStorer object.
-// It takes a bind address of the Redis server host:port and the maxAge of how
-// long each session should live in the Redis server.
+// It takes a bind address of the Redis server host:port, the maxAge of how
+// long each session should live in the Redis server and a prefix that is put
+// in front of every key the storer writes, such as "session:", so sessions
+// can share a database with other data.
 // Persistent storage can be attained by setting maxAge to zero.
-func NewRedisStorer(opts redis.Options, maxAge time.Duration) (*RedisStorer, error) {
+func NewRedisStorer(opts redis.Options, maxAge time.Duration, prefix string) (*RedisStorer, error) {
 	r := &RedisStorer{
 		maxAge: maxAge,
+		prefix: prefix,
 		client: redis.NewClient(&opts),
 	}
 
 	return r, nil
 }
 
-// All keys in the redis store
+// All keys in the redis store. Only the keys that start with the prefix
+// are scanned, and they are returned without it.
 func (r *RedisStorer) All() ([]string, error) {
 	var sessions []string
 
-	iter := r.client.Scan(0, "", 0).Iterator()
+	iter := r.client.Scan(0, redisEscapeGlob(r.prefix)+"*", 0).Iterator()
 	for iter.Next() {
-		sessions = append(sessions, iter.Val())
+		key := strings.TrimPrefix(iter.Val(), r.prefix)
+		// Skip the metadata and user index keys
+		if strings.HasPrefix(key, redisIndexPrefix) {
+			continue
+		}
+		sessions = append(sessions, key)
 	}
 	err := iter.Err()
 	return sessions, errors.Wrap(err, "unable to iterate redis store")
@@ -62,7 +77,11 @@ func (r *RedisStorer) All() ([]string, error) {
 // Get returns the value string saved in the session pointed to by the
 // session id key.
 func (r *RedisStorer) Get(key string) (value string, err error) {
-	val, err := r.client.Get(key).Result()
+	if !redisSessionKey(key) {
+		return "", errNoSession{}
+	}
+
+	val, err := r.client.Get(r.key(key)).Result()
 	if err == redis.Nil {
 		return "", errNoSession{}
 	} else if err != nil {
@@ -74,15 +93,448 @@ func (r *RedisStorer) Get(key string) (value string, err error) {
 
 // Set saves the value string to the session pointed to by the session id key.
 func (r *RedisStorer) Set(key, value string) error {
-	return r.client.Set(key, value, r.maxAge).Err()
+	return r.SetWithTTL(key, value, 0)
+}
+
+// SetWithTTL saves the value string to the session pointed to by the
+// session id key, expiring it after ttl instead of maxAge.
+func (r *RedisStorer) SetWithTTL(key, value string, ttl time.Duration) error {
+	if !redisSessionKey(key) {
+		return errNoSession{}
+	}
+
+	ttl = ttlOrMaxAge(ttl, r.maxAge)
+	if ttl == 0 {
+		return r.client.Set(r.key(key), value, 0).Err()
+	}
+
+	// Keep the metadata alive as long as the session
+	pipe := r.client.Pipeline()
+	pipe.Set(r.key(key), value, ttl)
+	pipe.Expire(r.metaKey(key), ttl)
+	_, err := pipe.Exec()
+
+	return err
+}
+
+// The redis client does not take a context. The Context methods that read
+// run the command in a go routine and stop waiting for it when the context
+// is done, leaving it to finish or time out by the ReadTimeout of the client
+// in the background. The Context methods that write only check the context
+// before they start, and then wait for the command, so a write is never
+// reported as failed while it could still be made.
+
+// AllContext returns all keys in the redis store, or the error of ctx if it
+// is done first.
+func (r *RedisStorer) AllContext(ctx context.Context) ([]string, error) {
+	var keys []string
+	err := readContext(ctx, func() (err error) {
+		keys, err = r.All()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// GetContext returns the value string saved in the session pointed to by the
+// session id key, or the error of ctx if it is done first.
+func (r *RedisStorer) GetContext(ctx context.Context, key string) (string, error) {
+	var value string
+	err := readContext(ctx, func() (err error) {
+		value, err = r.Get(key)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return value, nil
+}
+
+// SetContext saves the value string to the session pointed to by the session
+// id key if ctx is not done.
+func (r *RedisStorer) SetContext(ctx context.Context, key, value string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return r.Set(key, value)
+}
+
+// DelContext deletes the session pointed to by the session id key if ctx is
+// not done.
+func (r *RedisStorer) DelContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return r.Del(key)
+}
+
+// ResetExpiryContext resets the expiry of the key if ctx is not done
+func (r *RedisStorer) ResetExpiryContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return r.ResetExpiry(key)
+}
+
+// TTL returns how long the session pointed to by the session id key has
+// left before it expires, or 0 if it never expires.
+func (r *RedisStorer) TTL(key string) (time.Duration, error) {
+	if !redisSessionKey(key) {
+		return 0, errNoSession{}
+	}
+
+	pipe := r.client.Pipeline()
+	keyType := pipe.Type(r.key(key))
+	ttl := pipe.PTTL(r.key(key))
+	if _, err := pipe.Exec(); err != nil {
+		return 0, errors.Wrap(err, "unable to get session ttl")
+	}
+
+	if keyType.Val() == "none" {
+		return 0, errNoSession{}
+	}
+	// Keys without an expiry have a negative ttl
+	if ttl.Val() < 0 {
+		return 0, nil
+	}
+
+	return ttl.Val(), nil
+}
+
+// GetVersion returns the value string and version saved in the session
+// pointed to by the session id key.
+func (r *RedisStorer) GetVersion(key string) (value, version string, err error) {
+	value, err = r.Get(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	return value, valueVersion(value), nil
+}
+
+// redisSetIfVersion sets KEYS[1] to ARGV[2] with an expiry of ARGV[3]
+// milliseconds if the sha1 of its current value is ARGV[1], or if it does
+// not exist and ARGV[1] is empty. The expiry of the metadata key KEYS[2]
+// is reset with it. It returns 1 if the key was set.
+const redisSetIfVersion = `
+local current = redis.call("GET", KEYS[1])
+if current then
+	if redis.sha1hex(current) ~= ARGV[1] then
+		return 0
+	end
+elseif ARGV[1] ~= "" then
+	return 0
+end
+if tonumber(ARGV[3]) > 0 then
+	redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+	redis.call("PEXPIRE", KEYS[2], ARGV[3])
+else
+	redis.call("SET", KEYS[1], ARGV[2])
+end
+return 1
+`
+
+// SetIfVersion saves the value string to the session pointed to by the
+// session id key if the session is still at version. An empty version
+// means the session must not exist. The check and set are made
+// atomically in a Lua script.
+func (r *RedisStorer) SetIfVersion(key, value, version string) error {
+	if !redisSessionKey(key) {
+		return errNoSession{}
+	}
+
+	ms := int64(r.maxAge / time.Millisecond)
+
+	res, err := r.client.Eval(redisSetIfVersion, []string{r.key(key), r.metaKey(key)}, version, value, ms).Result()
+	if err != nil {
+		return errors.Wrap(err, "unable to set session")
+	}
+	if set, _ := res.(int64); set != 1 {
+		return errVersionConflict{}
+	}
+
+	return nil
+}
+
+// GetVersionContext returns the value string and version saved in the
+// session pointed to by the session id key, or the error of ctx if it is
+// done first.
+func (r *RedisStorer) GetVersionContext(ctx context.Context, key string) (value, version string, err error) {
+	err = readContext(ctx, func() (err error) {
+		value, version, err = r.GetVersion(key)
+		return err
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return value, version, nil
+}
+
+// SetIfVersionContext saves the value string to the session pointed to by
+// the session id key if the session is still at version and ctx is not done.
+func (r *RedisStorer) SetIfVersionContext(ctx context.Context, key, value, version string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return r.SetIfVersion(key, value, version)
 }
 
 // Del the session pointed to by the session id key and remove it.
 func (r *RedisStorer) Del(key string) error {
-	return r.client.Del(key).Err()
+	if !redisSessionKey(key) {
+		return errNoSession{}
+	}
+
+	meta, err := r.client.Get(r.metaKey(key)).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrap(err, "unable to get session metadata")
+	}
+
+	if err == nil {
+		if userID := redisMetaUserID(meta); len(userID) != 0 {
+			if err := r.client.SRem(r.userKey(userID), key).Err(); err != nil {
+				return errors.Wrap(err, "unable to remove session from user index")
+			}
+		}
+	}
+
+	return r.client.Del(r.key(key), r.metaKey(key)).Err()
 }
 
 // ResetExpiry resets the expiry of the key
 func (r *RedisStorer) ResetExpiry(key string) error {
-	return r.client.Expire(key, r.maxAge).Err()
+	if !redisSessionKey(key) {
+		return errNoSession{}
+	}
+
+	// Sessions without a maxAge never expire, and EXPIRE with a ttl of 0
+	// would delete them, so only check that the session exists
+	if r.maxAge == 0 {
+		keyType, err := r.client.Type(r.key(key)).Result()
+		if err != nil {
+			return errors.Wrap(err, "unable to reset session expiry")
+		}
+		if keyType == "none" {
+			return errNoSession{}
+		}
+
+		return nil
+	}
+
+	pipe := r.client.Pipeline()
+	expire := pipe.Expire(r.key(key), r.maxAge)
+	pipe.Expire(r.metaKey(key), r.maxAge)
+	if _, err := pipe.Exec(); err != nil {
+		return errors.Wrap(err, "unable to reset session expiry")
+	}
+
+	ok, err := expire.Result()
+	if err != nil {
+		return errors.Wrap(err, "unable to reset session expiry")
+	}
+	if !ok {
+		return errNoSession{}
+	}
+
+	return nil
+}
+
+const (
+	// redisIndexPrefix is the prefix of the keys that hold session
+	// metadata and user indexes, they are not sessions
+	redisIndexPrefix = "abcsessions:"
+	// redisMetaPrefix is the prefix of the key that holds the json
+	// metadata of a session
+	redisMetaPrefix = redisIndexPrefix + "meta:"
+	// redisUserPrefix is the prefix of the set of session ids of a user
+	redisUserPrefix = redisIndexPrefix + "user:"
+)
+
+// redisSessionKey returns false for session ids that start with
+// redisIndexPrefix, so they can not read or overwrite the metadata and user
+// index keys
+func redisSessionKey(key string) bool {
+	return !strings.HasPrefix(key, redisIndexPrefix)
+}
+
+// key returns the redis key of the session
+func (r *RedisStorer) key(key string) string {
+	return r.prefix + key
+}
+
+// metaKey returns the redis key of the metadata of the session
+func (r *RedisStorer) metaKey(key string) string {
+	return r.prefix + redisMetaPrefix + key
+}
+
+// userKey returns the redis key of the user index
+func (r *RedisStorer) userKey(userID string) string {
+	return r.prefix + redisUserPrefix + userIndexName(userID)
+}
+
+// redisEscapeGlob escapes the characters that have a meaning in a SCAN
+// MATCH pattern
+func redisEscapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
+
+// redisMetaUserID returns the user id of json metadata, or an empty
+// string if it can not be read
+func redisMetaUserID(meta string) string {
+	var m SessionMeta
+	if err := json.Unmarshal([]byte(meta), &m); err != nil {
+		return ""
+	}
+
+	return m.UserID
+}
+
+// GetMeta returns the metadata of the session pointed to by the session id key.
+func (r *RedisStorer) GetMeta(key string) (SessionMeta, error) {
+	meta, _, err := r.getMeta(key)
+	return meta, err
+}
+
+// SetMeta sets the metadata of the session pointed to by the session id key
+// and adds it to the index of the user.
+func (r *RedisStorer) SetMeta(key string, meta SessionMeta) error {
+	old, ttl, err := r.getMeta(key)
+	if err != nil {
+		return err
+	}
+
+	if len(old.UserID) != 0 && old.UserID != meta.UserID {
+		if err := r.client.SRem(r.userKey(old.UserID), key).Err(); err != nil {
+			return errors.Wrap(err, "unable to remove session from user index")
+		}
+	}
+
+	meta.ID = key
+	if meta.CreatedAt.IsZero() {
+		meta.CreatedAt = time.Now().UTC()
+	}
+
+	contents, err := json.Marshal(meta)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal session metadata")
+	}
+
+	// Expire the metadata with the session, sessions without an expiry
+	// have a negative ttl
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	if err := r.client.Set(r.metaKey(key), contents, ttl).Err(); err != nil {
+		return errors.Wrap(err, "unable to set session metadata")
+	}
+
+	if len(meta.UserID) != 0 {
+		if err := r.client.SAdd(r.userKey(meta.UserID), key).Err(); err != nil {
+			return errors.Wrap(err, "unable to add session to user index")
+		}
+	}
+
+	return nil
+}
+
+// ListByUser returns the metadata of all sessions of the user, the most
+// recently seen session first.
+func (r *RedisStorer) ListByUser(userID string) ([]SessionMeta, error) {
+	keys, err := r.client.SMembers(r.userKey(userID)).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get user index")
+	}
+
+	metas := make([]SessionMeta, 0, len(keys))
+	for _, key := range keys {
+		meta, _, err := r.getMeta(key)
+		if IsNoSessionError(err) || (err == nil && meta.UserID != userID) {
+			// The session expired, remove it from the index
+			if err := r.client.SRem(r.userKey(userID), key).Err(); err != nil {
+				return nil, errors.Wrap(err, "unable to remove session from user index")
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		metas = append(metas, meta)
+	}
+
+	sortSessionMeta(metas)
+
+	return metas, nil
+}
+
+// DeleteByUser deletes all sessions of the user.
+func (r *RedisStorer) DeleteByUser(userID string) error {
+	userKey := r.userKey(userID)
+
+	keys, err := r.client.SMembers(userKey).Result()
+	if err != nil {
+		return errors.Wrap(err, "unable to get user index")
+	}
+
+	toDelete := []string{userKey}
+	for _, key := range keys {
+		toDelete = append(toDelete, r.key(key), r.metaKey(key))
+	}
+
+	return errors.Wrap(r.client.Del(toDelete...).Err(), "unable to delete user sessions")
+}
+
+// getMeta returns the metadata of a session and its remaining ttl. LastSeen
+// is worked out from the ttl, since it is reset to maxAge on every Set and
+// ResetExpiry.
+func (r *RedisStorer) getMeta(key string) (SessionMeta, time.Duration, error) {
+	if !redisSessionKey(key) {
+		return SessionMeta{}, 0, errNoSession{}
+	}
+
+	var meta SessionMeta
+
+	pipe := r.client.Pipeline()
+	keyType := pipe.Type(r.key(key))
+	ttlCmd := pipe.PTTL(r.key(key))
+	metaCmd := pipe.Get(r.metaKey(key))
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return meta, 0, errors.Wrap(err, "unable to get session metadata")
+	}
+
+	if keyType.Val() == "none" {
+		return meta, 0, errNoSession{}
+	}
+
+	if contents, err := metaCmd.Result(); err == nil {
+		if err := json.Unmarshal([]byte(contents), &meta); err != nil {
+			return meta, 0, errors.Wrap(err, "unable to unmarshal session metadata")
+		}
+	}
+
+	ttl := ttlCmd.Val()
+	meta.ID = key
+	if r.maxAge != 0 && ttl > 0 {
+		meta.LastSeen = time.Now().UTC().Add(ttl - r.maxAge)
+	}
+
+	return meta, ttl, nil
 }
@@ -4,8 +4,7 @@ import (
 	"testing"
 	"time"
 
-	uuid "github.com/satori/go.uuid"
-
+	"github.com/alicebob/miniredis/v2"
 	redis "gopkg.in/redis.v5"
 )
 
@@ -19,7 +18,7 @@ func TestRedisStorerNew(t *testing.T) {
 	r := redis.Options{
 		Password: "test",
 	}
-	storer, err := NewRedisStorer(r, 2)
+	storer, err := NewRedisStorer(r, 2, "")
 	if err != nil {
 		t.Error(err)
 	}
@@ -54,187 +53,222 @@ func TestRedisStorerNewDefault(t *testing.T) {
 	}
 }
 
-func TestRedisStorerAll(t *testing.T) {
-	t.Parallel()
+func TestRedisStorerResetExpiry(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping long test")
+	}
 
-	s, err := NewDefaultRedisStorer("", "", 13)
+	storer, err := NewDefaultRedisStorer("", "", 13)
 	if err != nil {
 		t.Error(err)
 	}
+	// Set maxage duration to 1 hour
+	storer.maxAge = time.Hour * 1
 
-	list, err := s.All()
+	err = storer.Set("test", "test1")
 	if err != nil {
-		t.Error("expected no error on empty list")
-	}
-	if len(list) > 0 {
-		t.Error("Expected len 0")
+		t.Error(err)
 	}
 
-	s.Set("hi", "hello")
-	s.Set("yo", "friend")
-
-	list, err = s.All()
+	oldDur, err := storer.client.TTL("test").Result()
 	if err != nil {
 		t.Error(err)
 	}
-	if len(list) != 2 {
-		t.Errorf("Expected len 2, got %d", len(list))
-	}
-	if (list[0] != "hi" && list[0] != "yo") || list[0] == list[1] {
-		t.Errorf("Expected list[0] to be %q or %q, got %q", "yo", "hi", list[0])
-	}
-	if (list[1] != "yo" && list[1] != "hi") || list[1] == list[0] {
-		t.Errorf("Expected list[1] to be %q or %q, got %q", "hi", "yo", list[1])
-	}
-
-	// Cleanup
-	s.Del("hi")
-	s.Del("yo")
-}
 
-func TestRedisStorerGet(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skipping long test")
+	// Make sure the duration is roughly 1 hour and no greater
+	if oldDur > time.Hour*1 || oldDur < time.Minute*59 {
+		t.Errorf("expected TTL in Redis to be set to 1 hour, but got: %v", oldDur.String())
 	}
 
-	storer, err := NewDefaultRedisStorer("", "", 13)
+	// Adjust the duration to something else so we can ensure it was reset
+	storer.maxAge = time.Hour * 24
+
+	err = storer.ResetExpiry("test")
 	if err != nil {
 		t.Error(err)
 	}
 
-	testid1 := uuid.NewV4().String()
-
-	val, err := storer.Get(testid1)
-	if !IsNoSessionError(err) {
-		t.Errorf("Expected ErrNoSession, got: %v", err)
-	}
-
-	storer.Set(testid1, "banana")
-
-	val, err = storer.Get(testid1)
+	newDur, err := storer.client.TTL("test").Result()
 	if err != nil {
 		t.Error(err)
 	}
-	if val != "banana" {
-		t.Errorf("Expected %q, got %q", "banana", val)
+
+	// Make sure the new reset duration is roughly 1 day and no less
+	if newDur > time.Hour*24 || newDur < time.Hour*23 {
+		t.Errorf("expected TTL in Redis to be set to 24 hours, but got: %v", newDur.String())
 	}
 
 	// Cleanup
-	storer.Del(testid1)
+	storer.Del("test")
 }
 
-func TestRedisStorerSet(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skipping long test")
-	}
+func TestRedisStorerPrefix(t *testing.T) {
+	t.Parallel()
 
-	storer, err := NewDefaultRedisStorer("", "", 13)
+	mr, err := miniredis.Run()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
+	defer mr.Close()
 
-	testid1 := uuid.NewV4().String()
-	testid2 := uuid.NewV4().String()
-
-	storer.Set(testid1, "hello")
-	storer.Set(testid1, "whatsup")
-	storer.Set(testid2, "friend")
+	// Keys of other applications, one of them matches the prefix when its
+	// glob characters are not escaped
+	for _, key := range []string{"cache:1", "sessXon:1", "abcsessions:meta:other"} {
+		if err := mr.Set(key, "other"); err != nil {
+			t.Fatal(err)
+		}
+	}
 
-	val, err := storer.Get(testid1)
+	storer, err := NewRedisStorer(redis.Options{Addr: mr.Addr()}, time.Hour, "sess?on:")
 	if err != nil {
 		t.Fatal(err)
 	}
-	if val != "whatsup" {
-		t.Errorf("Expected %q, got %q", "whatsup", val)
-	}
 
-	val, err = storer.Get(testid2)
-	if err != nil {
-		t.Error(err)
+	if err := storer.Set("id1", "val"); err != nil {
+		t.Fatal(err)
 	}
-	if val != "friend" {
-		t.Errorf("Expected %q, got %q", "friend", val)
+	if err := storer.SetMeta("id1", SessionMeta{UserID: "bob"}); err != nil {
+		t.Fatal(err)
 	}
 
-	// Cleanup
-	storer.Del(testid1)
-	storer.Del(testid2)
-}
-
-func TestRedisStorerDel(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skipping long test")
+	if val, err := mr.Get("sess?on:id1"); err != nil || val != "val" {
+		t.Errorf("expected the session to be stored under the prefix, got %q: %v", val, err)
+	}
+	if !mr.Exists("sess?on:abcsessions:meta:id1") {
+		t.Error("expected the metadata to be stored under the prefix")
+	}
+	if mr.Exists("id1") {
+		t.Error("expected no session at the top level")
+	}
+	if ttl := mr.TTL("sess?on:id1"); ttl != time.Hour {
+		t.Errorf("expected a ttl of 1 hour, got %v", ttl)
 	}
 
-	storer, err := NewDefaultRedisStorer("", "", 13)
+	keys, err := storer.All()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "id1" {
+		t.Errorf("expected only the session id without the prefix, got %v", keys)
 	}
 
-	storer.Set("hi", "hello")
-	storer.Set("hi", "whatsup")
-	storer.Set("yo", "friend")
-
-	err = storer.Del("hi")
-	if err != nil {
-		t.Error(err)
+	if val, err := storer.Get("id1"); err != nil || val != "val" {
+		t.Errorf("expected %q, got %q: %v", "val", val, err)
 	}
 
-	_, err = storer.Get("hi")
-	if err == nil {
-		t.Errorf("Expected get hi to fail")
+	mr.FastForward(time.Minute)
+	if err := storer.ResetExpiry("id1"); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := mr.TTL("sess?on:id1"); ttl != time.Hour {
+		t.Errorf("expected the ttl to be reset to 1 hour, got %v", ttl)
 	}
 
-	// Cleanup
-	storer.Del("hi")
-	storer.Del("yo")
+	if err := storer.Del("id1"); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists("sess?on:id1") || mr.Exists("sess?on:abcsessions:meta:id1") {
+		t.Error("expected the session and its metadata to be deleted")
+	}
+	for _, key := range []string{"cache:1", "sessXon:1", "abcsessions:meta:other"} {
+		if !mr.Exists(key) {
+			t.Errorf("expected %s to be left alone", key)
+		}
+	}
 }
 
-func TestRedisStorerResetExpiry(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skipping long test")
-	}
+func TestRedisStorerIndexKeys(t *testing.T) {
+	t.Parallel()
 
-	storer, err := NewDefaultRedisStorer("", "", 13)
+	mr, err := miniredis.Run()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	// Set maxage duration to 1 hour
-	storer.maxAge = time.Hour * 1
+	defer mr.Close()
 
-	err = storer.Set("test", "test1")
+	storer, err := NewRedisStorer(redis.Options{Addr: mr.Addr()}, time.Hour, "")
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
-	oldDur, err := storer.client.TTL("test").Result()
-	if err != nil {
-		t.Error(err)
+	if err := storer.Set("id1", "val"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storer.SetMeta("id1", SessionMeta{UserID: "bob"}); err != nil {
+		t.Fatal(err)
 	}
 
-	// Make sure the duration is roughly 1 hour and no greater
-	if oldDur > time.Hour*1 || oldDur < time.Minute*59 {
-		t.Errorf("expected TTL in Redis to be set to 1 hour, but got: %v", oldDur.String())
+	// Session ids that would point at the metadata and user index keys
+	meta := redisMetaPrefix + "id1"
+	user := redisUserPrefix + userIndexName("bob")
+
+	for _, key := range []string{meta, user} {
+		if _, err := storer.Get(key); !IsNoSessionError(err) {
+			t.Errorf("%s: expected no session error from Get, got: %v", key, err)
+		}
+		if _, _, err := storer.GetVersion(key); !IsNoSessionError(err) {
+			t.Errorf("%s: expected no session error from GetVersion, got: %v", key, err)
+		}
+		if err := storer.Set(key, "overwritten"); !IsNoSessionError(err) {
+			t.Errorf("%s: expected no session error from Set, got: %v", key, err)
+		}
+		if err := storer.SetIfVersion(key, "overwritten", ""); !IsNoSessionError(err) {
+			t.Errorf("%s: expected no session error from SetIfVersion, got: %v", key, err)
+		}
+		if err := storer.ResetExpiry(key); !IsNoSessionError(err) {
+			t.Errorf("%s: expected no session error from ResetExpiry, got: %v", key, err)
+		}
+		if _, err := storer.TTL(key); !IsNoSessionError(err) {
+			t.Errorf("%s: expected no session error from TTL, got: %v", key, err)
+		}
+		if _, err := storer.GetMeta(key); !IsNoSessionError(err) {
+			t.Errorf("%s: expected no session error from GetMeta, got: %v", key, err)
+		}
+		if err := storer.SetMeta(key, SessionMeta{UserID: "eve"}); !IsNoSessionError(err) {
+			t.Errorf("%s: expected no session error from SetMeta, got: %v", key, err)
+		}
+		if err := storer.Del(key); !IsNoSessionError(err) {
+			t.Errorf("%s: expected no session error from Del, got: %v", key, err)
+		}
+	}
+
+	if !mr.Exists(user) {
+		t.Error("expected the user index to be kept")
+	}
+	if got, err := storer.GetMeta("id1"); err != nil || got.UserID != "bob" {
+		t.Errorf("expected the metadata to be kept, got %+v: %v", got, err)
 	}
+}
 
-	// Adjust the duration to something else so we can ensure it was reset
-	storer.maxAge = time.Hour * 24
+func TestRedisStorerResetExpiryPersistent(t *testing.T) {
+	t.Parallel()
 
-	err = storer.ResetExpiry("test")
+	mr, err := miniredis.Run()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
+	defer mr.Close()
 
-	newDur, err := storer.client.TTL("test").Result()
+	storer, err := NewRedisStorer(redis.Options{Addr: mr.Addr()}, 0, "")
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
-	// Make sure the new reset duration is roughly 1 day and no less
-	if newDur > time.Hour*24 || newDur < time.Hour*23 {
-		t.Errorf("expected TTL in Redis to be set to 24 hours, but got: %v", newDur.String())
+	if err := storer.ResetExpiry("id1"); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
 	}
 
-	// Cleanup
-	storer.Del("test")
+	if err := storer.Set("id1", "val"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storer.ResetExpiry("id1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if val, err := storer.Get("id1"); err != nil || val != "val" {
+		t.Errorf("expected the session to be kept, got %q: %v", val, err)
+	}
+	if ttl := mr.TTL("id1"); ttl != 0 {
+		t.Errorf("expected the session not to expire, got a ttl of %s", ttl)
+	}
 }
@@ -1,7 +1,7 @@
 package abcsessions
 
 import (
-	"encoding/json"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -10,12 +10,28 @@ import (
 
 // session holds the session value and the flash messages key/value mapping
 type session struct {
-	// value is the session value stored as a json encoded string
-	Value *json.RawMessage
-	// flash is the key/value storage for flash messages. Depending on whether
-	// you're calling Get/SetFlash or Get/SetFlashObj it will either store
-	// a json string or a json object.
-	Flash map[string]*json.RawMessage
+	// value is the session value encoded with the session codec
+	Value []byte
+	// flash is the key/value storage for flash messages. Each value is
+	// a string encoded with the session codec.
+	Flash map[string][]byte
+	// Created is when the session was created, it is used to enforce the
+	// AbsoluteMaxAge of the overseers. Sessions created before it was
+	// recorded get the time they are next modified.
+	Created *time.Time
+	// codec the values are encoded with. It is the codec the session was
+	// decoded with, or the codec of the overseer for new sessions.
+	codec Codec
+}
+
+// marshal encodes v with the session codec
+func (s *session) marshal(v interface{}) ([]byte, error) {
+	return s.codec.Marshal(v)
+}
+
+// unmarshal decodes data with the session codec
+func (s *session) unmarshal(data []byte, v interface{}) error {
+	return s.codec.Unmarshal(data, v)
 }
 
 // Storer provides methods to retrieve, add and delete sessions.
@@ -28,6 +44,27 @@ type Storer interface {
 	ResetExpiry(key string) error
 }
 
+// CASStorer is a Storer that supports optimistic concurrency, so that two
+// requests modifying the same session at once do not lose each others
+// changes. The session helpers (Set, Del, AddFlash, GetFlash etc.) use it
+// when the StorageOverseer's Storer implements it, and retry their change
+// on the latest session when another request changed it first.
+//
+// The version of a session is an opaque string that changes whenever the
+// value of the session changes.
+type CASStorer interface {
+	Storer
+	// GetVersion returns the value string and the version of the session
+	// pointed to by the session id key.
+	GetVersion(key string) (value, version string, err error)
+	// SetIfVersion saves the value string to the session pointed to by the
+	// session id key only if the version of the session is still version.
+	// An empty version means the session must not exist. It returns an
+	// error that can be checked with IsVersionConflictError if it does not
+	// match.
+	SetIfVersion(key, value, version string) error
+}
+
 // Overseer of session cookies
 type Overseer interface {
 	Resetter
@@ -67,6 +104,12 @@ type noSessionInterface interface {
 type noMapKeyInterface interface {
 	NoMapKey()
 }
+type cookieTooLargeInterface interface {
+	CookieTooLarge()
+}
+type versionConflictInterface interface {
+	VersionConflict()
+}
 
 type errNoSession struct{}
 type errNoMapKey struct{}
@@ -81,6 +124,29 @@ func (errNoMapKey) Error() string {
 	return "session map key does not exist"
 }
 
+// errVersionConflict is returned by CASStorer.SetIfVersion when the
+// session was changed since it was read
+type errVersionConflict struct{}
+
+func (errVersionConflict) VersionConflict() {}
+
+func (errVersionConflict) Error() string {
+	return "session was modified concurrently"
+}
+
+// errCookieTooLarge is returned when a cookie session value is larger than
+// the MaxSize of the cookie options
+type errCookieTooLarge struct {
+	size int
+	max  int
+}
+
+func (errCookieTooLarge) CookieTooLarge() {}
+
+func (e errCookieTooLarge) Error() string {
+	return fmt.Sprintf("session cookie value of %d bytes exceeds the max size of %d bytes", e.size, e.max)
+}
+
 // IsNoSessionError checks an error to see if it means that there was no session
 func IsNoSessionError(err error) bool {
 	_, ok := err.(noSessionInterface)
@@ -104,6 +170,66 @@ func IsNoMapKeyError(err error) bool {
 	return ok
 }
 
+// IsVersionConflictError checks an error to see if it means that the
+// session was changed by another request since it was read
+func IsVersionConflictError(err error) bool {
+	_, ok := err.(versionConflictInterface)
+	if ok {
+		return ok
+	}
+
+	_, ok = errors.Cause(err).(versionConflictInterface)
+	return ok
+}
+
+// IsCookieTooLargeError checks an error to see if it means that the session
+// value was too large to be stored in the session cookies
+func IsCookieTooLargeError(err error) bool {
+	_, ok := err.(cookieTooLargeInterface)
+	if ok {
+		return ok
+	}
+
+	_, ok = errors.Cause(err).(cookieTooLargeInterface)
+	return ok
+}
+
+// pastAbsoluteMaxAge returns true if the session value was created more than
+// absoluteMaxAge ago. Values without a creation time, such as values that
+// were not set with the helpers, are never past it.
+func pastAbsoluteMaxAge(codec Codec, value string, absoluteMaxAge time.Duration) bool {
+	if absoluteMaxAge <= 0 {
+		return false
+	}
+
+	sess, err := decodeSession(codec, value)
+	if err != nil || sess.Created == nil {
+		return false
+	}
+
+	return time.Since(*sess.Created) > absoluteMaxAge
+}
+
+// renewCreated returns the session value with its creation time reset to
+// now, so a regenerated session starts a new AbsoluteMaxAge lifetime. Values
+// without a creation time are returned unchanged.
+func renewCreated(codec Codec, value string) (string, error) {
+	sess, err := decodeSession(codec, value)
+	if err != nil || sess.Created == nil {
+		return value, nil
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	sess.Created = &now
+
+	renewed, err := encodeSession(codec, sess)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to marshal session object")
+	}
+
+	return renewed, nil
+}
+
 // timerTestHarness allows us to control the timer channels manually in the
 // disk and memory storer tests so that we can trigger cleans at will
 var timerTestHarness = func(d time.Duration) (timer, <-chan time.Time) {
@@ -149,63 +275,46 @@ func validKey(key string) bool {
 	return true
 }
 
-// Set is a JSON helper used for storing key-value session values.
+// Set is a helper used for storing key-value session values.
 // Set modifies the marshalled map stored in the session to include the key value pair passed in.
 func Set(overseer Overseer, w http.ResponseWriter, r *http.Request, key string, value string) error {
-	var sess session
-	sessMap := make(map[string]string)
-
-	val, err := overseer.Get(w, r)
-	if err != nil && !IsNoSessionError(err) {
-		return errors.Wrap(err, "unable to get session")
-	}
-
-	if !IsNoSessionError(err) {
-		err = json.Unmarshal([]byte(val), &sess)
-		if err != nil {
-			return errors.Wrap(err, "unable to unmarshal session object")
-		}
-
+	err := updateSession(overseer, w, r, true, func(sess *session) error {
+		sessMap := make(map[string]string)
 		if sess.Value != nil {
-			err = json.Unmarshal(*sess.Value, &sessMap)
+			err := sess.unmarshal(sess.Value, &sessMap)
 			if err != nil {
 				return errors.Wrap(err, "unable to unmarshal session map value")
 			}
 		}
-	}
 
-	sessMap[key] = value
+		sessMap[key] = value
 
-	mv, err := json.Marshal(sessMap)
-	if err != nil {
-		return errors.Wrap(err, "unable to marshal session map value")
-	}
-	sess.Value = (*json.RawMessage)(&mv)
+		mv, err := sess.marshal(sessMap)
+		if err != nil {
+			return errors.Wrap(err, "unable to marshal session map value")
+		}
+		sess.Value = mv
 
-	ret, err := json.Marshal(sess)
-	if err != nil {
-		return errors.Wrap(err, "unable to marshal session object")
-	}
+		return nil
+	})
 
-	return overseer.Set(w, r, string(ret))
+	return errors.Wrap(err, "unable to set session map value")
 }
 
-// Get is a JSON helper used for retrieving key-value session values.
+// Get is a helper used for retrieving key-value session values.
 // Get returns the value pointed to by the key of the marshalled map stored in the session.
 func Get(overseer Overseer, w http.ResponseWriter, r *http.Request, key string) (string, error) {
-	val, err := overseer.Get(w, r)
+	sess, err := loadSession(overseer, w, r)
 	if err != nil {
 		return "", errors.Wrap(err, "unable to get session")
 	}
 
-	var sess session
-	err = json.Unmarshal([]byte(val), &sess)
-	if err != nil {
-		return "", errors.Wrap(err, "unable to unmarshal session object")
+	if sess.Value == nil {
+		return "", errNoMapKey{}
 	}
 
 	var sessMap map[string]string
-	err = json.Unmarshal(*sess.Value, &sessMap)
+	err = sess.unmarshal(sess.Value, &sessMap)
 	if err != nil {
 		return "", errors.Wrap(err, "unable to unmarshal session map value")
 	}
@@ -218,184 +327,154 @@ func Get(overseer Overseer, w http.ResponseWriter, r *http.Request, key string)
 	return mapVal, nil
 }
 
-// Del is a JSON helper used for deleting keys from a key-value session values store.
+// Del is a helper used for deleting keys from a key-value session values store.
 // Del is a noop on nonexistent keys, but will error if the session does not exist.
 func Del(overseer Overseer, w http.ResponseWriter, r *http.Request, key string) error {
-	val, err := overseer.Get(w, r)
-	if err != nil {
-		return errors.Wrap(err, "unable to get session")
-	}
+	err := updateSession(overseer, w, r, false, func(sess *session) error {
+		sessMap := make(map[string]string)
+		if sess.Value != nil {
+			err := sess.unmarshal(sess.Value, &sessMap)
+			if err != nil {
+				return errors.Wrap(err, "unable to unmarshal session map value")
+			}
+		}
 
-	var sess session
-	err = json.Unmarshal([]byte(val), &sess)
-	if err != nil {
-		return errors.Wrap(err, "unable to unmarshal session object")
-	}
+		delete(sessMap, key)
 
-	var sessMap map[string]string
-	err = json.Unmarshal(*sess.Value, &sessMap)
-	if err != nil {
-		return errors.Wrap(err, "unable to unmarshal session map value")
-	}
-
-	delete(sessMap, key)
+		mv, err := sess.marshal(sessMap)
+		if err != nil {
+			return errors.Wrap(err, "unable to marshal session map value")
+		}
+		sess.Value = mv
 
-	mv, err := json.Marshal(sessMap)
-	if err != nil {
-		return errors.Wrap(err, "unable to marshal session map value")
-	}
-	sess.Value = (*json.RawMessage)(&mv)
+		return nil
+	})
 
-	ret, err := json.Marshal(sess)
-	if err != nil {
-		return errors.Wrap(err, "unable to marshal session object")
-	}
-
-	return overseer.Set(w, r, string(ret))
+	return errors.Wrap(err, "unable to delete session map value")
 }
 
-// SetObj is a JSON helper used for storing object or variable session values.
+// SetObj is a helper used for storing object or variable session values.
 // Set stores in the session a marshaled version of the passed in value pointed to by value.
 func SetObj(overseer Overseer, w http.ResponseWriter, r *http.Request, value interface{}) error {
-	val, err := overseer.Get(w, r)
-	// If it's a no session error because a session hasn't been created yet
-	// then we can skip this return statement and create a fresh map
-	if err != nil && !IsNoSessionError(err) {
-		return errors.Wrap(err, "unable to get session")
-	}
-
-	var sess session
-
-	// If there's an existing session then unmarshal it so we can copy over
-	// the flash messages to the new marshalled session
-	if !IsNoSessionError(err) {
-		// json unmarshal the outter session struct
-		err = json.Unmarshal([]byte(val), &sess)
+	// A new session is created if one does not exist yet, otherwise the
+	// value is replaced and the flash messages are kept
+	err := updateSession(overseer, w, r, true, func(sess *session) error {
+		mv, err := sess.marshal(value)
 		if err != nil {
-			return errors.Wrap(err, "unable to unmarshal session object")
+			return errors.Wrap(err, "unable to marshal value")
 		}
 
-	}
-
-	mv, err := json.Marshal(value)
-	if err != nil {
-		return errors.Wrap(err, "unable to marshal value")
-	}
-	sess.Value = (*json.RawMessage)(&mv)
-
-	ret, err := json.Marshal(sess)
-	if err != nil {
-		return errors.Wrap(err, "unable to marshal session object")
-	}
+		sess.Value = mv
+		return nil
+	})
 
-	return overseer.Set(w, r, string(ret))
+	return errors.Wrap(err, "unable to set session value")
 }
 
-// GetObj is a JSON helper used for retrieving object or variable session values.
+// GetObj is a helper used for retrieving object or variable session values.
 // GetObj unmarshals the session value into the pointer pointed to by pointer.
 func GetObj(overseer Overseer, w http.ResponseWriter, r *http.Request, pointer interface{}) error {
-	val, err := overseer.Get(w, r)
+	sess, err := loadSession(overseer, w, r)
 	if err != nil {
 		return errors.Wrap(err, "unable to get session")
 	}
 
-	var sess session
-	// json unmarshal the outter session struct
-	err = json.Unmarshal([]byte(val), &sess)
-	if err != nil {
-		return errors.Wrap(err, "unable to unmarshal session object")
+	// A session that only holds flash messages has no value
+	if sess.Value == nil {
+		return errNoSession{}
 	}
 
-	// json unmarshal the RawMessage value into the users pointer
-	err = json.Unmarshal(*sess.Value, pointer)
+	// unmarshal the value into the users pointer
+	err = sess.unmarshal(sess.Value, pointer)
 	return errors.Wrap(err, "unable to unmarshal session value into pointer")
 }
 
 // AddFlash adds a flash message to the session that will be deleted when it is retrieved with GetFlash
 func AddFlash(overseer Overseer, w http.ResponseWriter, r *http.Request, key string, value string) error {
-	var sess session
-
-	val, err := overseer.Get(w, r)
-	if err != nil && !IsNoSessionError(err) {
-		return errors.Wrap(err, "unable to get session")
-	} else if !IsNoSessionError(err) {
-		err = json.Unmarshal([]byte(val), &sess)
+	err := updateSession(overseer, w, r, true, func(sess *session) error {
+		mv, err := sess.marshal(value)
 		if err != nil {
-			return errors.Wrap(err, "unable to unmarshal session object")
+			return errors.Wrap(err, "unable to marshal session value")
 		}
-	}
 
-	if sess.Flash == nil {
-		sess.Flash = make(map[string]*json.RawMessage)
-	}
+		if sess.Flash == nil {
+			sess.Flash = make(map[string][]byte)
+		}
 
-	mv, err := json.Marshal(value)
-	if err != nil {
-		return errors.Wrap(err, "unable to marshal session value")
-	}
-	sess.Flash[key] = (*json.RawMessage)(&mv)
+		sess.Flash[key] = mv
+		return nil
+	})
 
-	ret, err := json.Marshal(sess)
-	if err != nil {
-		return errors.Wrap(err, "unable to marshal session object")
-	}
-
-	return overseer.Set(w, r, string(ret))
+	return errors.Wrap(err, "unable to add flash message")
 }
 
 // GetFlash retrieves a flash message from the session then deletes it
 func GetFlash(overseer Overseer, w http.ResponseWriter, r *http.Request, key string) (string, error) {
-	var sess session
-
-	val, err := overseer.Get(w, r)
-	if err != nil {
-		return "", errors.Wrap(err, "unable to get session")
-	}
+	val, _, err := getFlash(overseer, w, r, key)
+	return val, err
+}
 
-	err = json.Unmarshal([]byte(val), &sess)
-	if err != nil {
-		return "", errors.Wrap(err, "unable to unmarshal session object")
-	}
+// getFlash retrieves a flash message from the session then deletes it. It
+// also returns the codec of the session.
+func getFlash(overseer Overseer, w http.ResponseWriter, r *http.Request, key string) (string, Codec, error) {
+	var ret string
+	var codec Codec
 
-	fv, ok := sess.Flash[key]
-	if !ok {
-		return "", errNoMapKey{}
-	}
+	err := updateSession(overseer, w, r, false, func(sess *session) error {
+		fv, ok := sess.Flash[key]
+		if !ok {
+			return errNoMapKey{}
+		}
 
-	var ret string
-	err = json.Unmarshal(*fv, &ret)
-	if err != nil {
-		return ret, errors.Wrap(err, "unable to unmarshal flash value")
-	}
+		var val string
+		err := sess.unmarshal(fv, &val)
+		if err != nil {
+			return errors.Wrap(err, "unable to unmarshal flash value")
+		}
 
-	delete(sess.Flash, key)
+		delete(sess.Flash, key)
+		ret, codec = val, sess.codec
 
-	mv, err := json.Marshal(sess)
+		return nil
+	})
 	if err != nil {
-		return ret, errors.Wrap(err, "unable to marshal session object")
+		return "", nil, errors.Wrap(err, "unable to get flash message")
 	}
 
-	err = overseer.Set(w, r, string(mv))
-	return ret, errors.Wrap(err, "unable to set flash session object")
+	return ret, codec, nil
 }
 
 // AddFlashObj adds a flash message to the session that will be deleted when it is retrieved with GetFlash
 func AddFlashObj(overseer Overseer, w http.ResponseWriter, r *http.Request, key string, value interface{}) error {
-	mv, err := json.Marshal(value)
-	if err != nil {
-		return errors.Wrap(err, "unable to marshal flash value")
-	}
+	err := updateSession(overseer, w, r, true, func(sess *session) error {
+		// The object is stored as an encoded string like AddFlash values
+		obj, err := sess.marshal(value)
+		if err != nil {
+			return errors.Wrap(err, "unable to marshal flash value")
+		}
+		mv, err := sess.marshal(string(obj))
+		if err != nil {
+			return errors.Wrap(err, "unable to marshal flash value")
+		}
+
+		if sess.Flash == nil {
+			sess.Flash = make(map[string][]byte)
+		}
+
+		sess.Flash[key] = mv
+		return nil
+	})
 
-	return AddFlash(overseer, w, r, key, string(mv))
+	return errors.Wrap(err, "unable to add flash message")
 }
 
 // GetFlashObj unmarshals a flash message from the session into the users pointer
 // then deletes it from the session.
 func GetFlashObj(overseer Overseer, w http.ResponseWriter, r *http.Request, key string, pointer interface{}) error {
-	val, err := GetFlash(overseer, w, r, key)
+	val, codec, err := getFlash(overseer, w, r, key)
 	if err != nil {
 		return errors.Wrap(err, "unable to get flash object")
 	}
 
-	return json.Unmarshal([]byte(val), pointer)
+	return codec.Unmarshal([]byte(val), pointer)
 }
@@ -3,9 +3,25 @@ package abcsessions
 import (
 	"net/http/httptest"
 	"reflect"
+	"regexp"
 	"testing"
+	"time"
 )
 
+var rgxCreated = regexp.MustCompile(`,"Created":"([^"]+)"`)
+
+// withoutCreated removes the creation time from a session value so it can
+// be compared, failing the test if the value does not have one
+func withoutCreated(t *testing.T, value string) string {
+	t.Helper()
+
+	if !rgxCreated.MatchString(value) {
+		t.Errorf("expected session value to have a creation time: %s", value)
+	}
+
+	return rgxCreated.ReplaceAllString(value, "")
+}
+
 func TestSetAndGet(t *testing.T) {
 	t.Parallel()
 
@@ -94,7 +110,7 @@ func TestDel(t *testing.T) {
 	}
 
 	for _, v := range m.sessions {
-		if v.value != `{"Value":{},"Flash":null}` {
+		if withoutCreated(t, v.value) != `{"Value":{},"Flash":null}` {
 			t.Errorf("Expected value to be empty json map, but was: %#v", v.value)
 		}
 	}
@@ -180,7 +196,7 @@ func TestAddFlash(t *testing.T) {
 	for _, v := range m.sessions {
 		sess = v
 	}
-	if sess.value != `{"Value":null,"Flash":{"test":"flashvalue"}}` {
+	if withoutCreated(t, sess.value) != `{"Value":null,"Flash":{"test":"flashvalue"}}` {
 		t.Errorf("expected session value to be %q, but got %q", `{"test":"flashvalue"}`, sess.value)
 	}
 	if len(w.cookies) != 1 {
@@ -224,7 +240,7 @@ func TestGetFlash(t *testing.T) {
 	for _, v := range m.sessions {
 		sess = v
 	}
-	if sess.value != `{"Value":null,"Flash":{}}` {
+	if withoutCreated(t, sess.value) != `{"Value":null,"Flash":{}}` {
 		t.Errorf("expected session value to be %q, but got %q", `{"Value":{},"Flash":null}`, sess.value)
 	}
 
@@ -396,7 +412,7 @@ func TestAddFlashAndSetCombined(t *testing.T) {
 		t.Error(err)
 	}
 
-	if res != `{"Value":{"testone":"stuffone","testtwo":"stufftwo"},"Flash":{"flashone":"fmone","flashtwo":"fmtwo"}}` {
+	if withoutCreated(t, res) != `{"Value":{"testone":"stuffone","testtwo":"stufftwo"},"Flash":{"flashone":"fmone","flashtwo":"fmtwo"}}` {
 		t.Errorf("json serialized value is not as expected in session: %s", res)
 	}
 
@@ -437,7 +453,7 @@ func TestAddFlashAndSetCombined(t *testing.T) {
 		t.Error(err)
 	}
 
-	if res != `{"Value":{"testone":"stuffone","testtwo":"stufftwo"},"Flash":{}}` {
+	if withoutCreated(t, res) != `{"Value":{"testone":"stuffone","testtwo":"stufftwo"},"Flash":{}}` {
 		t.Errorf("json serialized value is not as expected in session: %s", res)
 	}
 }
@@ -474,3 +490,122 @@ func TestValidKey(t *testing.T) {
 		}
 	}
 }
+
+func TestSessionCreated(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+
+	m, _ := NewDefaultMemoryStorer()
+	s := NewStorageOverseer(NewCookieOptions(), m)
+
+	// Sessions created before the creation time was recorded get one
+	// the next time they are modified
+	if err := s.Set(w, r, `{"Value":{"a":"b"},"Flash":null}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := Set(s, w, r, "hi", "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	val, err := s.Get(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := rgxCreated.FindStringSubmatch(val)
+	if created == nil {
+		t.Fatalf("expected session to have a creation time: %s", val)
+	}
+	if c, err := time.Parse(time.RFC3339, created[1]); err != nil {
+		t.Error(err)
+	} else if time.Since(c) > time.Minute {
+		t.Errorf("expected creation time to be now, got %s", c)
+	}
+
+	// Modifying the session keeps the creation time
+	old := `{"Value":{},"Flash":null,"Created":"2006-01-02T15:04:05Z"}`
+	if err := s.Set(w, r, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddFlash(s, w, r, "flash", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := s.Get(w, r); err != nil {
+		t.Error(err)
+	} else if created := rgxCreated.FindStringSubmatch(val); created == nil || created[1] != "2006-01-02T15:04:05Z" {
+		t.Errorf("expected creation time to be kept: %s", val)
+	}
+}
+
+func TestPastAbsoluteMaxAge(t *testing.T) {
+	t.Parallel()
+
+	old := `{"Value":null,"Flash":null,"Created":"` + time.Now().Add(-2*time.Hour).Format(time.RFC3339) + `"}`
+	recent := `{"Value":null,"Flash":null,"Created":"` + time.Now().Format(time.RFC3339) + `"}`
+
+	tests := []struct {
+		value  string
+		maxAge time.Duration
+		want   bool
+	}{
+		{old, time.Hour, true},
+		{old, 3 * time.Hour, false},
+		{old, 0, false},
+		{recent, time.Hour, false},
+		{`{"Value":null,"Flash":null}`, time.Hour, false},
+		{"not json", time.Hour, false},
+	}
+
+	for i, test := range tests {
+		if got := pastAbsoluteMaxAge(JSONCodec{}, test.value, test.maxAge); got != test.want {
+			t.Errorf("%d) expected %t, got %t", i, test.want, got)
+		}
+	}
+}
+
+func TestRegenerateRenewsCreated(t *testing.T) {
+	t.Parallel()
+
+	old := `{"Value":{"a":"b"},"Flash":null,"Created":"` + time.Now().Add(-30*time.Minute).UTC().Format(time.RFC3339) + `"}`
+
+	m, _ := NewDefaultMemoryStorer()
+	storage := NewStorageOverseer(NewCookieOptions(), m)
+	storage.AbsoluteMaxAge = time.Hour
+	cookie := NewCookieOverseer(NewCookieOptions(), testCookieKey)
+	cookie.AbsoluteMaxAge = time.Hour
+
+	for _, s := range []Overseer{storage, cookie} {
+		r := httptest.NewRequest("GET", "http://localhost", nil)
+		w := newSessionsResponseWriter(httptest.NewRecorder())
+
+		if err := s.Set(w, r, old); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Regenerate(w, r); err != nil {
+			t.Fatal(err)
+		}
+
+		val, err := s.Get(w, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		created := rgxCreated.FindStringSubmatch(val)
+		if created == nil {
+			t.Fatalf("%T: expected session to have a creation time: %s", s, val)
+		}
+		if c, err := time.Parse(time.RFC3339, created[1]); err != nil {
+			t.Error(err)
+		} else if time.Since(c) > time.Minute {
+			t.Errorf("%T: expected creation time to be renewed, got %s", s, c)
+		}
+		if got := withoutCreated(t, val); got != `{"Value":{"a":"b"},"Flash":null}` {
+			t.Errorf("%T: expected the value to be kept, got %s", s, got)
+		}
+	}
+
+	// Values that are not sessions are moved as they are
+	if val, err := renewCreated(JSONCodec{}, "not json"); err != nil || val != "not json" {
+		t.Errorf("expected the value to be kept, got %q: %v", val, err)
+	}
+}
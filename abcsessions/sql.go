@@ -0,0 +1,270 @@
+package abcsessions
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/friendsofgo/errors"
+)
+
+// SQLStorer is a session storer implementation for saving sessions
+// to a SQL database table using the database/sql package.
+//
+// The queries use $N style placeholders, which are supported by both
+// PostgreSQL and SQLite. The table must contain an id, value and expires
+// column. See the db/migrations/00001_create_sessions.sql file generated
+// by "abcweb new" for the default table definition.
+type SQLStorer struct {
+	// db is the database handle the sessions table lives in
+	db *sql.DB
+	// Name of the table the sessions are stored in
+	tableName string
+	// How long sessions take to expire in the database
+	maxAge time.Duration
+	// How often the table should be polled for maxAge expired sessions
+	cleanInterval time.Duration
+	// wg is used to manage the cleaner loop
+	wg sync.WaitGroup
+	// quit channel for exiting the cleaner loop
+	quit chan struct{}
+
+	// queries are built once with the table name on creation
+	allQuery   string
+	getQuery   string
+	setQuery   string
+	delQuery   string
+	resetQuery string
+	cleanQuery string
+	ttlQuery   string
+}
+
+// NewDefaultSQLStorer returns a SQLStorer object with default values.
+// The default values are:
+// tableName: sessions
+// maxAge: 2 days (clear session stored in the database after 2 days)
+// cleanInterval: 1 hour (delete sessions older than maxAge every 1 hour)
+func NewDefaultSQLStorer(db *sql.DB) (*SQLStorer, error) {
+	return NewSQLStorer(db, "sessions", time.Hour*24*2, time.Hour)
+}
+
+// NewSQLStorer initializes and returns a new SQLStorer object.
+// It takes a database handle, the name of the sessions table,
+// the maxAge of how long each session should live in the database,
+// and a cleanInterval duration which defines how often the clean
+// task should check for maxAge expired sessions to be removed.
+// Persistent storage can be attained by setting maxAge and cleanInterval
+// to zero.
+func NewSQLStorer(db *sql.DB, tableName string, maxAge, cleanInterval time.Duration) (*SQLStorer, error) {
+	if (maxAge != 0 && cleanInterval == 0) || (cleanInterval != 0 && maxAge == 0) {
+		panic("if max age or clean interval is set, the other must also be set")
+	}
+
+	if db == nil {
+		return nil, errors.New("database handle must be provided")
+	}
+	if len(tableName) == 0 {
+		return nil, errors.New("table name must be provided")
+	}
+
+	s := &SQLStorer{
+		db:            db,
+		tableName:     tableName,
+		maxAge:        maxAge,
+		cleanInterval: cleanInterval,
+
+		allQuery: fmt.Sprintf(`select id from %s where expires is null or expires > $1`, tableName),
+		getQuery: fmt.Sprintf(`select value from %s where id = $1 and (expires is null or expires > $2)`, tableName),
+		setQuery: fmt.Sprintf(`insert into %s (id, value, expires) values ($1, $2, $3)
+			on conflict (id) do update set value = excluded.value, expires = excluded.expires`, tableName),
+		delQuery:   fmt.Sprintf(`delete from %s where id = $1`, tableName),
+		resetQuery: fmt.Sprintf(`update %s set expires = $1 where id = $2`, tableName),
+		cleanQuery: fmt.Sprintf(`delete from %s where expires <= $1`, tableName),
+		ttlQuery:   fmt.Sprintf(`select expires from %s where id = $1 and (expires is null or expires > $2)`, tableName),
+	}
+
+	return s, nil
+}
+
+// All keys in the sql store
+func (s *SQLStorer) All() ([]string, error) {
+	return s.AllContext(context.Background())
+}
+
+// AllContext returns all keys in the sql store
+func (s *SQLStorer) AllContext(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, s.allQuery, time.Now().UTC())
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to query sessions table")
+	}
+	defer rows.Close()
+
+	var sessions []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, errors.Wrap(err, "unable to scan session id")
+		}
+		sessions = append(sessions, id)
+	}
+
+	return sessions, errors.Wrap(rows.Err(), "unable to iterate sessions table")
+}
+
+// Get returns the value string saved in the session pointed to by the
+// session id key.
+func (s *SQLStorer) Get(key string) (value string, err error) {
+	return s.GetContext(context.Background(), key)
+}
+
+// GetContext returns the value string saved in the session pointed to by
+// the session id key.
+func (s *SQLStorer) GetContext(ctx context.Context, key string) (value string, err error) {
+	err = s.db.QueryRowContext(ctx, s.getQuery, key, time.Now().UTC()).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", errNoSession{}
+	} else if err != nil {
+		return "", errors.Wrap(err, "unable to get session")
+	}
+
+	return value, nil
+}
+
+// Set saves the value string to the session pointed to by the session id key.
+func (s *SQLStorer) Set(key, value string) error {
+	return s.SetContext(context.Background(), key, value)
+}
+
+// SetContext saves the value string to the session pointed to by the
+// session id key.
+func (s *SQLStorer) SetContext(ctx context.Context, key, value string) error {
+	_, err := s.db.ExecContext(ctx, s.setQuery, key, value, s.expiry())
+	return errors.Wrap(err, "unable to set session")
+}
+
+// TTL returns how long the session pointed to by the session id key has
+// left before it expires, or 0 if it never expires.
+func (s *SQLStorer) TTL(key string) (time.Duration, error) {
+	var expires sql.NullTime
+	err := s.db.QueryRow(s.ttlQuery, key, time.Now().UTC()).Scan(&expires)
+	if err == sql.ErrNoRows {
+		return 0, errNoSession{}
+	} else if err != nil {
+		return 0, errors.Wrap(err, "unable to get session expiry")
+	}
+
+	if !expires.Valid {
+		return 0, nil
+	}
+
+	return time.Until(expires.Time), nil
+}
+
+// SetWithTTL saves the value string to the session pointed to by the
+// session id key, expiring it after ttl instead of maxAge.
+func (s *SQLStorer) SetWithTTL(key, value string, ttl time.Duration) error {
+	var expires interface{}
+	if s.maxAge != 0 {
+		expires = time.Now().UTC().Add(ttlOrMaxAge(ttl, s.maxAge))
+	}
+
+	_, err := s.db.Exec(s.setQuery, key, value, expires)
+	return errors.Wrap(err, "unable to set session")
+}
+
+// Del the session pointed to by the session id key and remove it.
+func (s *SQLStorer) Del(key string) error {
+	return s.DelContext(context.Background(), key)
+}
+
+// DelContext deletes the session pointed to by the session id key.
+func (s *SQLStorer) DelContext(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, s.delQuery, key)
+	return errors.Wrap(err, "unable to delete session")
+}
+
+// ResetExpiry resets the expiry of the key
+func (s *SQLStorer) ResetExpiry(key string) error {
+	return s.ResetExpiryContext(context.Background(), key)
+}
+
+// ResetExpiryContext resets the expiry of the key
+func (s *SQLStorer) ResetExpiryContext(ctx context.Context, key string) error {
+	res, err := s.db.ExecContext(ctx, s.resetQuery, s.expiry(), key)
+	if err != nil {
+		return errors.Wrap(err, "unable to reset session expiry")
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "unable to get affected rows")
+	}
+	if affected == 0 {
+		return errNoSession{}
+	}
+
+	return nil
+}
+
+// Clean deletes all sessions in the table that are older than maxAge
+// by checking their expires column.
+func (s *SQLStorer) Clean() error {
+	_, err := s.db.Exec(s.cleanQuery, time.Now().UTC())
+	return errors.Wrap(err, "unable to clean sessions table")
+}
+
+// StartCleaner starts the sql session cleaner go routine. This go routine
+// will delete expired sessions from the table on the cleanInterval interval.
+func (s *SQLStorer) StartCleaner() {
+	if s.maxAge == 0 || s.cleanInterval == 0 {
+		panic("both max age and clean interval must be set to non-zero")
+	}
+
+	// init quit chan
+	s.quit = make(chan struct{})
+
+	s.wg.Add(1)
+
+	// Start the cleaner infinite loop go routine.
+	// StopCleaner() can be used to kill this go routine.
+	go s.cleanerLoop()
+}
+
+// StopCleaner stops the cleaner go routine
+func (s *SQLStorer) StopCleaner() {
+	close(s.quit)
+	s.wg.Wait()
+}
+
+// cleanerLoop executes the Clean() method every time cleanInterval elapses.
+// StopCleaner() can be used to kill this go routine loop.
+func (s *SQLStorer) cleanerLoop() {
+	defer s.wg.Done()
+
+	t, c := timerTestHarness(s.cleanInterval)
+
+	for {
+		select {
+		case <-c:
+			// A failed clean is retried on the next interval, the expires
+			// check in Get ensures stale sessions are never returned.
+			_ = s.Clean()
+			t.Reset(s.cleanInterval)
+		case <-s.quit:
+			t.Stop()
+			return
+		}
+	}
+}
+
+// expiry returns the expires column value for a session that is
+// created or reset now. A nil value means the session never expires.
+func (s *SQLStorer) expiry() interface{} {
+	if s.maxAge == 0 {
+		return nil
+	}
+
+	return time.Now().UTC().Add(s.maxAge)
+}
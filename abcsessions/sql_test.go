@@ -0,0 +1,125 @@
+package abcsessions
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newTestSQLStorer creates a sqlite database in the disk test folder
+// with a sessions table matching the generated migration.
+func newTestSQLStorer(t *testing.T, name string, maxAge, cleanInterval time.Duration) *SQLStorer {
+	db, err := sql.Open("sqlite3", filepath.Join(testpath, name+".db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec(SQLiteSessionsTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSQLStorer(db, "sessions", maxAge, cleanInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestSQLStorerNew(t *testing.T) {
+	t.Parallel()
+
+	s := newTestSQLStorer(t, "new", time.Hour, time.Minute)
+	if s.maxAge != time.Hour {
+		t.Error("expected max age to be 1 hour")
+	}
+	if s.cleanInterval != time.Minute {
+		t.Error("expected clean interval to be 1 minute")
+	}
+
+	if _, err := NewSQLStorer(nil, "sessions", 0, 0); err == nil {
+		t.Error("expected error for nil db")
+	}
+	if _, err := NewSQLStorer(s.db, "", 0, 0); err == nil {
+		t.Error("expected error for empty table name")
+	}
+}
+
+func TestSQLStorerNewDefault(t *testing.T) {
+	t.Parallel()
+
+	s := newTestSQLStorer(t, "newdefault", 0, 0)
+
+	d, err := NewDefaultSQLStorer(s.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.tableName != "sessions" {
+		t.Errorf("expected table name to be sessions, got %q", d.tableName)
+	}
+	if d.maxAge != time.Hour*24*2 {
+		t.Error("expected max age to be 2 days")
+	}
+}
+
+func TestSQLStorerGetExpired(t *testing.T) {
+	t.Parallel()
+
+	s := newTestSQLStorer(t, "getexpired", time.Hour, time.Hour)
+
+	_, err := s.db.Exec(`insert into sessions (id, value, expires) values ($1, $2, $3)`,
+		"old", "value", time.Now().UTC().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.Get("old")
+	if !IsNoSessionError(err) {
+		t.Errorf("Expected ErrNoSession, got: %v", err)
+	}
+}
+
+func TestSQLStorerCleaner(t *testing.T) {
+	s := newTestSQLStorer(t, "cleaner", time.Hour, time.Hour)
+
+	tm := memoryTestTimer{}
+	ch := make(chan time.Time)
+	timerTestHarness = func(d time.Duration) (timer, <-chan time.Time) {
+		return tm, ch
+	}
+
+	_, err := s.db.Exec(`insert into sessions (id, value, expires) values ($1, $2, $3), ($4, $5, $6)`,
+		"testid1", "test1", time.Now().UTC().Add(time.Hour),
+		"testid2", "test2", time.Now().UTC().AddDate(0, 0, -1),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Start the cleaner go routine
+	s.StartCleaner()
+
+	// Signal the timer channel to execute the clean
+	ch <- time.Time{}
+
+	// Stop the cleaner, this will block until the cleaner has finished its operations
+	s.StopCleaner()
+
+	var count int
+	if err := s.db.QueryRow(`select count(*) from sessions`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected len 1, got %d", count)
+	}
+
+	_, err = s.Get("testid1")
+	if err != nil {
+		t.Errorf("expected testid1 to remain, got: %v", err)
+	}
+}
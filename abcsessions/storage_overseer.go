@@ -1,7 +1,9 @@
 package abcsessions
 
 import (
+	"context"
 	"net/http"
+	"time"
 
 	"github.com/friendsofgo/errors"
 	uuid "github.com/satori/go.uuid"
@@ -9,15 +11,25 @@ import (
 
 // StorageOverseer holds cookie related variables and a session storer
 type StorageOverseer struct {
-	Storer  Storer
+	Storer Storer
+	// AbsoluteMaxAge is how long a session may live after it was created,
+	// however often its expiry is reset. Sessions past it are deleted when
+	// they are read. A value of 0 means sessions only expire after being
+	// idle for the maxAge of the Storer.
+	AbsoluteMaxAge time.Duration
+	// Codec encodes the sessions set with the helpers, defaults to
+	// JSONCodec. Sessions encoded with another codec are still read, and
+	// keep their codec until they are deleted.
+	Codec Codec
+
 	options CookieOptions
 	resetExpiryMiddleware
 }
 
 // NewStorageOverseer returns a new storage overseer
 func NewStorageOverseer(opts CookieOptions, storer Storer) *StorageOverseer {
-	if len(opts.Name) == 0 {
-		panic("cookie name must be provided")
+	if err := opts.Validate(); err != nil {
+		panic(err)
 	}
 
 	o := &StorageOverseer{
@@ -37,11 +49,15 @@ func (s *StorageOverseer) Get(w http.ResponseWriter, r *http.Request) (value str
 		return "", errors.Wrap(err, "unable to get session id from cookie")
 	}
 
-	val, err := s.Storer.Get(sessID)
+	val, err := AsStorerContext(s.Storer).GetContext(r.Context(), sessID)
 	if err != nil {
 		return "", errors.Wrap(err, "unable to get session value")
 	}
 
+	if err := s.checkAbsoluteMaxAge(w, r, val); err != nil {
+		return "", err
+	}
+
 	return val, nil
 }
 
@@ -55,7 +71,7 @@ func (s *StorageOverseer) Set(w http.ResponseWriter, r *http.Request, value stri
 		sessID = uuid.NewV4().String()
 	}
 
-	err := s.Storer.Set(sessID, value)
+	err := AsStorerContext(s.Storer).SetContext(r.Context(), sessID, value)
 	if err != nil {
 		return errors.Wrap(err, "unable to set session value")
 	}
@@ -67,6 +83,8 @@ func (s *StorageOverseer) Set(w http.ResponseWriter, r *http.Request, value stri
 
 // Del deletes the session if it exists and sets the session cookie to expire instantly.
 func (s *StorageOverseer) Del(w http.ResponseWriter, r *http.Request) error {
+	forgetSession(s, w)
+
 	sessID, err := s.options.getCookieValue(w, r)
 	if err != nil {
 		return nil
@@ -74,7 +92,7 @@ func (s *StorageOverseer) Del(w http.ResponseWriter, r *http.Request) error {
 
 	s.options.deleteCookie(w)
 
-	err = s.Storer.Del(sessID)
+	err = AsStorerContext(s.Storer).DelContext(r.Context(), sessID)
 	if IsNoSessionError(err) {
 		return nil
 	} else if err != nil {
@@ -84,27 +102,26 @@ func (s *StorageOverseer) Del(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
-// Regenerate a new session ID for your current session
+// Regenerate a new session ID for your current session. The session starts
+// a new AbsoluteMaxAge lifetime.
 func (s *StorageOverseer) Regenerate(w http.ResponseWriter, r *http.Request) error {
 	id, err := s.options.getCookieValue(w, r)
 	if err != nil {
 		return errors.Wrap(err, "unable to get session id from cookie")
 	}
 
-	val, err := s.Storer.Get(id)
+	val, err := AsStorerContext(s.Storer).GetContext(r.Context(), id)
 	if err != nil {
 		return errors.Wrap(err, "unable to get session value")
 	}
 
-	// Delete the old session
-	_ = s.Storer.Del(id)
-
-	// Generate a new ID
-	id = uuid.NewV4().String()
+	if err := s.checkAbsoluteMaxAge(w, r, val); err != nil {
+		return err
+	}
 
-	// Create a new session with the old value
-	if err = s.Storer.Set(id, val); err != nil {
-		return errors.Wrap(err, "unable to set session value")
+	id, err = moveSession(r.Context(), s.Storer, s.codec(), id, val)
+	if err != nil {
+		return err
 	}
 
 	// Override the old cookie with the new cookie
@@ -113,6 +130,26 @@ func (s *StorageOverseer) Regenerate(w http.ResponseWriter, r *http.Request) err
 	return nil
 }
 
+// SetUser records that the current session belongs to the user, along with
+// the IP and user agent of the request, so it can be found with ListByUser
+// and deleted with DeleteByUser on the Storer. Call it after logging a user
+// in. The session must exist and the Storer must be a UserIndexStorer.
+//
+// Sessions modified with the helpers are saved first if CacheMiddleware is
+// in use.
+func (s *StorageOverseer) SetUser(w http.ResponseWriter, r *http.Request, userID string) error {
+	if err := Save(w); err != nil {
+		return errors.Wrap(err, "unable to save cached sessions")
+	}
+
+	sessID, err := s.options.getCookieValue(w, r)
+	if err != nil {
+		return errors.Wrap(err, "unable to get session id from cookie")
+	}
+
+	return setSessionUser(s.Storer, sessID, r, userID)
+}
+
 // SessionID returns the session ID stored in the cookie's value field.
 // It will return a errNoSession error if no session exists.
 func (s *StorageOverseer) SessionID(w http.ResponseWriter, r *http.Request) (string, error) {
@@ -128,7 +165,7 @@ func (s *StorageOverseer) ResetExpiry(w http.ResponseWriter, r *http.Request) er
 	}
 
 	// Reset the expiry of the server-side session
-	err = s.Storer.ResetExpiry(sessID)
+	err = AsStorerContext(s.Storer).ResetExpiryContext(r.Context(), sessID)
 	if err != nil {
 		return errors.Wrap(err, "unable to reset expiry of server side session")
 	}
@@ -140,3 +177,126 @@ func (s *StorageOverseer) ResetExpiry(w http.ResponseWriter, r *http.Request) er
 
 	return nil
 }
+
+// versioned returns true if the Storer is a CASStorer
+func (s *StorageOverseer) versioned() bool {
+	_, ok := asCASStorer(s.Storer)
+	return ok
+}
+
+// getVersion looks in the cookie for the session ID and retrieves the value
+// string and version stored in the session. The Storer must be a CASStorer.
+func (s *StorageOverseer) getVersion(w http.ResponseWriter, r *http.Request) (value, version string, err error) {
+	sessID, err := s.options.getCookieValue(w, r)
+	if err != nil {
+		return "", "", errors.Wrap(err, "unable to get session id from cookie")
+	}
+
+	value, version, err = AsCASStorerContext(s.Storer.(CASStorer)).GetVersionContext(r.Context(), sessID)
+	if err != nil {
+		return "", "", errors.Wrap(err, "unable to get session value")
+	}
+
+	if err := s.checkAbsoluteMaxAge(w, r, value); err != nil {
+		return "", "", err
+	}
+
+	return value, version, nil
+}
+
+// setIfVersion looks in the cookie for the session ID and modifies the
+// session with the new value if its version still matches. If there is
+// no session ID a new session is created. The Storer must be a CASStorer.
+func (s *StorageOverseer) setIfVersion(w http.ResponseWriter, r *http.Request, value, version string) error {
+	// Reuse the existing cookie ID if it exists
+	sessID, _ := s.options.getCookieValue(w, r)
+
+	if len(sessID) == 0 {
+		sessID = uuid.NewV4().String()
+	}
+
+	err := AsCASStorerContext(s.Storer.(CASStorer)).SetIfVersionContext(r.Context(), sessID, value, version)
+	if err != nil {
+		return errors.Wrap(err, "unable to set session value")
+	}
+
+	w.(cookieWriter).SetCookie(s.options.makeCookie(sessID))
+
+	return nil
+}
+
+// checkAbsoluteMaxAge deletes the session and returns errNoSession if the
+// session value is past the AbsoluteMaxAge.
+func (s *StorageOverseer) checkAbsoluteMaxAge(w http.ResponseWriter, r *http.Request, value string) error {
+	if !pastAbsoluteMaxAge(s.codec(), value, s.AbsoluteMaxAge) {
+		return nil
+	}
+
+	if err := s.Del(w, r); err != nil {
+		return errors.Wrap(err, "unable to delete expired session")
+	}
+
+	return errNoSession{}
+}
+
+// moveSession stores the value of the session under a new random session id
+// and deletes the old session. The metadata of the session is moved with it
+// so the session stays in its users index, and its creation time is renewed.
+// It returns the new session id.
+func moveSession(ctx context.Context, storer Storer, codec Codec, id, value string) (string, error) {
+	value, err := renewCreated(codec, value)
+	if err != nil {
+		return "", err
+	}
+
+	indexer, hasMeta := asUserIndexStorer(storer)
+	var meta SessionMeta
+	if hasMeta {
+		if meta, err = indexer.GetMeta(id); err != nil {
+			return "", errors.Wrap(err, "unable to get session metadata")
+		}
+	}
+
+	// Delete the old session
+	_ = AsStorerContext(storer).DelContext(ctx, id)
+
+	// Generate a new ID
+	id = uuid.NewV4().String()
+
+	// Create a new session with the old value
+	if err := AsStorerContext(storer).SetContext(ctx, id, value); err != nil {
+		return "", errors.Wrap(err, "unable to set session value")
+	}
+
+	if hasMeta && len(meta.UserID) != 0 {
+		if err := indexer.SetMeta(id, meta); err != nil {
+			return "", errors.Wrap(err, "unable to set session metadata")
+		}
+	}
+
+	return id, nil
+}
+
+// setSessionUser sets the metadata of the session for the user from the
+// request. The storer must be a UserIndexStorer.
+func setSessionUser(storer Storer, id string, r *http.Request, userID string) error {
+	indexer, ok := asUserIndexStorer(storer)
+	if !ok {
+		return errors.New("storer does not implement UserIndexStorer")
+	}
+
+	if err := indexer.SetMeta(id, newSessionMeta(r, userID)); err != nil {
+		return errors.Wrap(err, "unable to set session metadata")
+	}
+
+	return nil
+}
+
+// codec returns the Codec of the overseer, JSONCodec by default
+func (s *StorageOverseer) codec() Codec {
+	if s.Codec == nil {
+		return JSONCodec{}
+	}
+
+	return s.Codec
+}
@@ -80,9 +80,9 @@ func TestStorageOverseerGet(t *testing.T) {
 	if !IsNoSessionError(err) {
 		t.Errorf("Expected ErrNoSession, got: %v", err)
 	}
-	m.sessions["sessionid"] = memorySession{
+	m.put("sessionid", memorySession{
 		value: "whatever",
-	}
+	})
 	val, err = s.Get(w, r)
 	if err != nil {
 		t.Fatal(err)
@@ -176,9 +176,9 @@ func TestStorageOverseerDel(t *testing.T) {
 		Value: "sessionid",
 	}
 	r.AddCookie(cookieOne)
-	m.sessions["sessionid"] = memorySession{
+	m.put("sessionid", memorySession{
 		value: "whatever",
-	}
+	})
 
 	err := s.Del(w, r)
 	if err != nil {
@@ -393,3 +393,137 @@ func TestStorageOverseerResetExpiry(t *testing.T) {
 		t.Errorf("expected paths to match, got %v and %v", newCookie.Path, oldCookie.Path)
 	}
 }
+
+func TestStorageOverseerNewInvalidOptions(t *testing.T) {
+	t.Parallel()
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic for invalid cookie options")
+		}
+	}()
+
+	opts := NewCookieOptions()
+	opts.SameSite = http.SameSiteNoneMode
+	opts.Secure = false
+	NewStorageOverseer(opts, nil)
+}
+
+func TestStorageOverseerAbsoluteMaxAge(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	s := NewStorageOverseer(NewCookieOptions(), m)
+	s.AbsoluteMaxAge = time.Hour
+
+	r := httptest.NewRequest("GET", "/", nil)
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+
+	if err := Set(s, w, r, "hi", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := Get(s, w, r, "hi"); err != nil {
+		t.Error(err)
+	} else if val != "hello" {
+		t.Errorf("expected %q, got %q", "hello", val)
+	}
+
+	// A session created before the absolute max age is deleted on read,
+	// even though its expiry is reset
+	created := time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	if err := s.Set(w, r, `{"Value":{"hi":"hello"},"Flash":null,"Created":"`+created+`"}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ResetExpiry(w, r); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Get(s, w, r, "hi"); !IsNoSessionError(err) {
+		t.Errorf("expected no session error, got: %v", err)
+	}
+	if len(m.sessions) != 0 {
+		t.Errorf("expected session to be deleted, got %d sessions", len(m.sessions))
+	}
+	if w.cookies[s.options.Name].MaxAge >= 0 {
+		t.Error("expected session cookie to be deleted")
+	}
+
+	// A new session starts a new lifetime
+	if err := Set(s, w, r, "hi", "again"); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := Get(s, w, r, "hi"); err != nil {
+		t.Error(err)
+	} else if val != "again" {
+		t.Errorf("expected %q, got %q", "again", val)
+	}
+}
+
+func TestStorageOverseerSetUser(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("User-Agent", "test agent")
+	w := newSessionsResponseWriter(httptest.NewRecorder())
+
+	m, _ := NewDefaultMemoryStorer()
+	s := NewStorageOverseer(NewCookieOptions(), m)
+
+	if err := s.SetUser(w, r, "1"); !IsNoSessionError(err) {
+		t.Errorf("Expected no session error, got: %v", err)
+	}
+
+	if err := s.Set(w, r, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetUser(w, r, "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := s.SessionID(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metas, err := m.ListByUser("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != 1 {
+		t.Fatalf("Expected 1 session, got %d", len(metas))
+	}
+	if metas[0].ID != id {
+		t.Errorf("Expected id %q, got %q", id, metas[0].ID)
+	}
+	if metas[0].IP != "10.0.0.1" {
+		t.Errorf("Expected ip %q, got %q", "10.0.0.1", metas[0].IP)
+	}
+	if metas[0].UserAgent != "test agent" {
+		t.Errorf("Expected user agent %q, got %q", "test agent", metas[0].UserAgent)
+	}
+
+	// Regenerating the session id keeps it in the user index
+	if err := s.Regenerate(w, r); err != nil {
+		t.Fatal(err)
+	}
+
+	newID, err := s.SessionID(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metas, err = m.ListByUser("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != 1 || metas[0].ID != newID {
+		t.Errorf("Expected only the regenerated session %q, got %#v", newID, metas)
+	}
+
+	// Hide the UserIndexStorer methods of the memory storer
+	plain := NewStorageOverseer(NewCookieOptions(), struct{ Storer }{m})
+	if err := plain.SetUser(w, r, "1"); err == nil {
+		t.Error("Expected an error for a storer without a user index")
+	}
+}
@@ -0,0 +1,215 @@
+package abcsessions_test
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/volatiletech/abcweb/v5/abcsessions"
+	"github.com/volatiletech/abcweb/v5/abcsessions/abcsessionstest"
+	redis "gopkg.in/redis.v5"
+)
+
+// tempDir creates a temporary folder that is removed when the test ends
+func tempDir(t *testing.T, prefix string) string {
+	dir, err := ioutil.TempDir("", prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return dir
+}
+
+func TestMemoryStorerSuite(t *testing.T) {
+	t.Parallel()
+
+	abcsessionstest.RunStorerSuite(t, func(t *testing.T, maxAge time.Duration) abcsessions.Storer {
+		m, err := abcsessions.NewMemoryStorer(maxAge, maxAge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	})
+}
+
+func TestDiskStorerSuite(t *testing.T) {
+	t.Parallel()
+
+	abcsessionstest.RunStorerSuite(t, func(t *testing.T, maxAge time.Duration) abcsessions.Storer {
+		d, err := abcsessions.NewDiskStorer(tempDir(t, "disksuitetest"), maxAge, maxAge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	})
+}
+
+func TestEncryptingStorerSuite(t *testing.T) {
+	t.Parallel()
+
+	abcsessionstest.RunStorerSuite(t, func(t *testing.T, maxAge time.Duration) abcsessions.Storer {
+		m, err := abcsessions.NewMemoryStorer(maxAge, maxAge)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e, err := abcsessions.NewEncryptingStorer(m,
+			abcsessions.EncryptionKey{ID: "2", Key: make([]byte, 32)},
+			abcsessions.EncryptionKey{ID: "1", Key: make([]byte, 16)},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	})
+}
+
+func TestCompressingDiskStorerSuite(t *testing.T) {
+	t.Parallel()
+
+	abcsessionstest.RunStorerSuite(t, func(t *testing.T, maxAge time.Duration) abcsessions.Storer {
+		d, err := abcsessions.NewDiskStorer(tempDir(t, "diskcompresssuitetest"), maxAge, maxAge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return abcsessions.NewCompressingStorer(d, 16)
+	})
+}
+
+func TestCompressingEncryptingDiskStorerSuite(t *testing.T) {
+	t.Parallel()
+
+	abcsessionstest.RunStorerSuite(t, func(t *testing.T, maxAge time.Duration) abcsessions.Storer {
+		d, err := abcsessions.NewDiskStorer(tempDir(t, "compresssuitetest"), maxAge, maxAge)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e, err := abcsessions.NewEncryptingStorer(d, abcsessions.EncryptionKey{Key: make([]byte, 32)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return abcsessions.NewCompressingStorer(e, 16)
+	})
+}
+
+func TestCompressingSQLStorerSuite(t *testing.T) {
+	t.Parallel()
+
+	abcsessionstest.RunStorerSuite(t, func(t *testing.T, maxAge time.Duration) abcsessions.Storer {
+		db, err := sql.Open("sqlite3", filepath.Join(tempDir(t, "sqlcompresssuitetest"), "sessions.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+
+		if _, err := db.Exec(abcsessions.SQLiteSessionsTable); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := abcsessions.NewSQLStorer(db, "sessions", maxAge, maxAge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return abcsessions.NewCompressingStorer(s, 16)
+	})
+}
+
+func TestSQLStorerSuite(t *testing.T) {
+	t.Parallel()
+
+	abcsessionstest.RunStorerSuite(t, func(t *testing.T, maxAge time.Duration) abcsessions.Storer {
+		db, err := sql.Open("sqlite3", filepath.Join(tempDir(t, "sqlsuitetest"), "sessions.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+
+		if _, err := db.Exec(abcsessions.SQLiteSessionsTable); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := abcsessions.NewSQLStorer(db, "sessions", maxAge, maxAge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+func TestRedisStorerSuite(t *testing.T) {
+	t.Parallel()
+
+	if testing.Short() {
+		t.Skip("skipping long test")
+	}
+
+	abcsessionstest.RunStorerSuite(t, func(t *testing.T, maxAge time.Duration) abcsessions.Storer {
+		r, err := abcsessions.NewRedisStorer(redis.Options{Addr: "localhost:6379", DB: 13}, maxAge, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := abcsessions.FlushRedisStorer(r); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	})
+}
+
+// runMiniredis starts an in-process redis server that is closed when the
+// test ends. Its clock is moved forward in real time so keys expire.
+func runMiniredis(t *testing.T) *miniredis.Miniredis {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				mr.FastForward(10 * time.Millisecond)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	t.Cleanup(func() {
+		close(stop)
+		mr.Close()
+	})
+
+	return mr
+}
+
+func TestRedisStorerPrefixSuite(t *testing.T) {
+	t.Parallel()
+
+	abcsessionstest.RunStorerSuite(t, func(t *testing.T, maxAge time.Duration) abcsessions.Storer {
+		mr := runMiniredis(t)
+
+		// Keys of other applications sharing the database
+		if err := mr.Set("cache:1", "cached"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mr.Lpush("jobs", "job"); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := abcsessions.NewRedisStorer(redis.Options{Addr: mr.Addr()}, maxAge, "session:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	})
+}
@@ -0,0 +1,356 @@
+package abcsessions
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/friendsofgo/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+// TokenOptions for reading and writing session tokens in headers
+type TokenOptions struct {
+	// Header is the request header the session token is read from,
+	// defaults to "Authorization"
+	Header string
+	// Scheme is the authentication scheme in front of the token in Header,
+	// defaults to "Bearer". An empty Scheme means the whole header value
+	// is the token.
+	Scheme string
+	// ResponseHeader is the response header the session token is written
+	// to when a session is created or its id changes, defaults to
+	// "X-Session-Token". An empty value in it means the session was
+	// deleted and the client should forget its token.
+	ResponseHeader string
+}
+
+// NewTokenOptions gives healthy defaults for session tokens
+func NewTokenOptions() TokenOptions {
+	return TokenOptions{
+		Header:         "Authorization",
+		Scheme:         "Bearer",
+		ResponseHeader: "X-Session-Token",
+	}
+}
+
+// Validate returns an error if the options are missing a header name
+func (t TokenOptions) Validate() error {
+	if len(t.Header) == 0 {
+		return errors.New("token header must be provided")
+	}
+	if len(t.ResponseHeader) == 0 {
+		return errors.New("token response header must be provided")
+	}
+
+	return nil
+}
+
+// getToken returns the session token written to the response headers
+// during this request. If there is none it will attempt to fetch it from
+// the request headers. It returns errNoSession if there is no token or
+// the session was deleted during this request.
+func (t TokenOptions) getToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	if vals, ok := w.Header()[textproto.CanonicalMIMEHeaderKey(t.ResponseHeader)]; ok {
+		if len(vals) == 0 || len(vals[0]) == 0 {
+			return "", errNoSession{}
+		}
+		return vals[0], nil
+	}
+
+	token := r.Header.Get(t.Header)
+	if len(t.Scheme) != 0 {
+		// The scheme is case-insensitive and separated from the token by a space
+		if len(token) <= len(t.Scheme) || token[len(t.Scheme)] != ' ' ||
+			!strings.EqualFold(token[:len(t.Scheme)], t.Scheme) {
+			return "", errNoSession{}
+		}
+		token = token[len(t.Scheme)+1:]
+	}
+
+	token = strings.TrimSpace(token)
+	if len(token) == 0 {
+		return "", errNoSession{}
+	}
+
+	return token, nil
+}
+
+// wroteToken returns true if a session token was written to the response
+// headers during this request
+func (t TokenOptions) wroteToken(w http.ResponseWriter) bool {
+	vals := w.Header()[textproto.CanonicalMIMEHeaderKey(t.ResponseHeader)]
+	return len(vals) != 0 && len(vals[0]) != 0
+}
+
+// setToken writes the session token to the response headers
+func (t TokenOptions) setToken(w http.ResponseWriter, token string) {
+	w.Header().Set(t.ResponseHeader, token)
+}
+
+// deleteToken writes an empty session token to the response headers
+// to tell the client to forget its token
+func (t TokenOptions) deleteToken(w http.ResponseWriter) {
+	w.Header()[textproto.CanonicalMIMEHeaderKey(t.ResponseHeader)] = []string{""}
+}
+
+// TokenOverseer holds token related variables and a session storer.
+// It works like the StorageOverseer but reads the session id from a request
+// header (an "Authorization: Bearer" header by default) instead of a cookie,
+// for API clients such as mobile apps and command line tools. New session
+// ids are returned in a response header instead of a cookie.
+type TokenOverseer struct {
+	Storer Storer
+	// AbsoluteMaxAge is how long a session may live after it was created,
+	// however often its expiry is reset. Sessions past it are deleted when
+	// they are read. A value of 0 means sessions only expire after being
+	// idle for the maxAge of the Storer.
+	AbsoluteMaxAge time.Duration
+	// Codec encodes the sessions set with the helpers, defaults to
+	// JSONCodec. Sessions encoded with another codec are still read, and
+	// keep their codec until they are deleted.
+	Codec Codec
+
+	options TokenOptions
+	resetExpiryMiddleware
+}
+
+// NewTokenOverseer returns a new token overseer
+func NewTokenOverseer(opts TokenOptions, storer Storer) *TokenOverseer {
+	if err := opts.Validate(); err != nil {
+		panic(err)
+	}
+
+	o := &TokenOverseer{
+		Storer:  storer,
+		options: opts,
+	}
+
+	o.resetExpiryMiddleware.resetter = o
+
+	return o
+}
+
+// Get looks in the request headers for the session token and retrieves the
+// value string stored in the session.
+func (t *TokenOverseer) Get(w http.ResponseWriter, r *http.Request) (value string, err error) {
+	sessID, err := t.options.getToken(w, r)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to get session id from headers")
+	}
+
+	val, err := AsStorerContext(t.Storer).GetContext(r.Context(), sessID)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to get session value")
+	}
+
+	if err := t.checkAbsoluteMaxAge(w, r, val); err != nil {
+		return "", err
+	}
+
+	return val, nil
+}
+
+// Set looks in the request headers for the session token and modifies the
+// session with the new value. If the session does not exist it creates a new
+// one with a new token, a token the client sent for a session the Storer
+// does not hold is never used. The session token is written to the response
+// headers.
+func (t *TokenOverseer) Set(w http.ResponseWriter, r *http.Request, value string) error {
+	sessID, err := t.currentID(w, r)
+	if err != nil {
+		return err
+	}
+
+	err = AsStorerContext(t.Storer).SetContext(r.Context(), sessID, value)
+	if err != nil {
+		return errors.Wrap(err, "unable to set session value")
+	}
+
+	t.options.setToken(w, sessID)
+
+	return nil
+}
+
+// Del deletes the session if it exists and writes an empty session token to
+// the response headers.
+func (t *TokenOverseer) Del(w http.ResponseWriter, r *http.Request) error {
+	forgetSession(t, w)
+
+	sessID, err := t.options.getToken(w, r)
+	if err != nil {
+		return nil
+	}
+
+	t.options.deleteToken(w)
+
+	err = AsStorerContext(t.Storer).DelContext(r.Context(), sessID)
+	if IsNoSessionError(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "unable to delete server-side session")
+	}
+
+	return nil
+}
+
+// Regenerate a new session ID for your current session. The new session
+// token is written to the response headers and the old token stops working.
+// The session starts a new AbsoluteMaxAge lifetime.
+func (t *TokenOverseer) Regenerate(w http.ResponseWriter, r *http.Request) error {
+	id, err := t.options.getToken(w, r)
+	if err != nil {
+		return errors.Wrap(err, "unable to get session id from headers")
+	}
+
+	val, err := AsStorerContext(t.Storer).GetContext(r.Context(), id)
+	if err != nil {
+		return errors.Wrap(err, "unable to get session value")
+	}
+
+	if err := t.checkAbsoluteMaxAge(w, r, val); err != nil {
+		return err
+	}
+
+	id, err = moveSession(r.Context(), t.Storer, t.codec(), id, val)
+	if err != nil {
+		return err
+	}
+
+	t.options.setToken(w, id)
+
+	return nil
+}
+
+// SetUser records that the current session belongs to the user, see
+// StorageOverseer.SetUser. The Storer must be a UserIndexStorer.
+func (t *TokenOverseer) SetUser(w http.ResponseWriter, r *http.Request, userID string) error {
+	if err := Save(w); err != nil {
+		return errors.Wrap(err, "unable to save cached sessions")
+	}
+
+	sessID, err := t.options.getToken(w, r)
+	if err != nil {
+		return errors.Wrap(err, "unable to get session id from headers")
+	}
+
+	return setSessionUser(t.Storer, sessID, r, userID)
+}
+
+// currentID returns the session token to save the session to: the token
+// written during this request, or the token from the request headers if the
+// Storer holds its session. Otherwise a new token is made, so a client can
+// not choose the id of a new session.
+func (t *TokenOverseer) currentID(w http.ResponseWriter, r *http.Request) (string, error) {
+	sessID, err := t.options.getToken(w, r)
+	if err != nil {
+		return uuid.NewV4().String(), nil
+	}
+	if t.options.wroteToken(w) {
+		return sessID, nil
+	}
+
+	_, err = AsStorerContext(t.Storer).GetContext(r.Context(), sessID)
+	if IsNoSessionError(err) {
+		return uuid.NewV4().String(), nil
+	} else if err != nil {
+		return "", errors.Wrap(err, "unable to get session value")
+	}
+
+	return sessID, nil
+}
+
+// SessionID returns the session token from the request headers.
+// It will return a errNoSession error if no session exists.
+func (t *TokenOverseer) SessionID(w http.ResponseWriter, r *http.Request) (string, error) {
+	return t.options.getToken(w, r)
+}
+
+// ResetExpiry resets the age of the session to time.Now(), so that
+// MaxAge calculations are renewed
+func (t *TokenOverseer) ResetExpiry(w http.ResponseWriter, r *http.Request) error {
+	sessID, err := t.options.getToken(w, r)
+	if err != nil {
+		return errors.Wrap(err, "unable to get session id from headers")
+	}
+
+	err = AsStorerContext(t.Storer).ResetExpiryContext(r.Context(), sessID)
+	if err != nil {
+		return errors.Wrap(err, "unable to reset expiry of server side session")
+	}
+
+	return nil
+}
+
+// versioned returns true if the Storer is a CASStorer
+func (t *TokenOverseer) versioned() bool {
+	_, ok := asCASStorer(t.Storer)
+	return ok
+}
+
+// getVersion looks in the request headers for the session token and
+// retrieves the value string and version stored in the session. The Storer
+// must be a CASStorer.
+func (t *TokenOverseer) getVersion(w http.ResponseWriter, r *http.Request) (value, version string, err error) {
+	sessID, err := t.options.getToken(w, r)
+	if err != nil {
+		return "", "", errors.Wrap(err, "unable to get session id from headers")
+	}
+
+	value, version, err = AsCASStorerContext(t.Storer.(CASStorer)).GetVersionContext(r.Context(), sessID)
+	if err != nil {
+		return "", "", errors.Wrap(err, "unable to get session value")
+	}
+
+	if err := t.checkAbsoluteMaxAge(w, r, value); err != nil {
+		return "", "", err
+	}
+
+	return value, version, nil
+}
+
+// setIfVersion looks in the request headers for the session token and
+// modifies the session with the new value if its version still matches.
+// If there is no session a new session is created with a new token. The
+// Storer must be a CASStorer.
+func (t *TokenOverseer) setIfVersion(w http.ResponseWriter, r *http.Request, value, version string) error {
+	sessID, err := t.options.getToken(w, r)
+	// An empty version means the session did not exist when it was read, so
+	// a token the client sent for it is not reused
+	if err != nil || (len(version) == 0 && !t.options.wroteToken(w)) {
+		sessID = uuid.NewV4().String()
+	}
+
+	err = AsCASStorerContext(t.Storer.(CASStorer)).SetIfVersionContext(r.Context(), sessID, value, version)
+	if err != nil {
+		return errors.Wrap(err, "unable to set session value")
+	}
+
+	t.options.setToken(w, sessID)
+
+	return nil
+}
+
+// checkAbsoluteMaxAge deletes the session and returns errNoSession if the
+// session value is past the AbsoluteMaxAge.
+func (t *TokenOverseer) checkAbsoluteMaxAge(w http.ResponseWriter, r *http.Request, value string) error {
+	if !pastAbsoluteMaxAge(t.codec(), value, t.AbsoluteMaxAge) {
+		return nil
+	}
+
+	if err := t.Del(w, r); err != nil {
+		return errors.Wrap(err, "unable to delete expired session")
+	}
+
+	return errNoSession{}
+}
+
+// codec returns the Codec of the overseer, JSONCodec by default
+func (t *TokenOverseer) codec() Codec {
+	if t.Codec == nil {
+		return JSONCodec{}
+	}
+
+	return t.Codec
+}
@@ -0,0 +1,323 @@
+package abcsessions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTokenImplements(t *testing.T) {
+	t.Parallel()
+
+	// Do assign to nothing to check if implementation of TokenOverseer is complete
+	var _ Overseer = &TokenOverseer{}
+}
+
+func TestTokenOverseerNewInvalidOptions(t *testing.T) {
+	t.Parallel()
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for a missing response header")
+		}
+	}()
+
+	opts := NewTokenOptions()
+	opts.ResponseHeader = ""
+	m, _ := NewDefaultMemoryStorer()
+	NewTokenOverseer(opts, m)
+}
+
+func TestTokenOptionsGetToken(t *testing.T) {
+	t.Parallel()
+
+	bearer := NewTokenOptions()
+	plain := TokenOptions{Header: "X-Session", ResponseHeader: "X-Session"}
+
+	tests := []struct {
+		Options TokenOptions
+		Header  string
+		Value   string
+		Token   string
+	}{
+		{bearer, "Authorization", "", ""},
+		{bearer, "Authorization", "Bearer abc", "abc"},
+		{bearer, "Authorization", "bearer  abc ", "abc"},
+		{bearer, "Authorization", "Basic abc", ""},
+		{bearer, "Authorization", "Bearerabc", ""},
+		{bearer, "Authorization", "Bearer ", ""},
+		{bearer, "X-Session-Token", "Bearer abc", ""},
+		{plain, "X-Session", "abc", "abc"},
+		{plain, "X-Session", "", ""},
+	}
+
+	for i, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(test.Header, test.Value)
+		w := httptest.NewRecorder()
+
+		token, err := test.Options.getToken(w, r)
+		if len(test.Token) == 0 {
+			if !IsNoSessionError(err) {
+				t.Errorf("%d) expected no session error, got: %v", i, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%d) %v", i, err)
+		} else if token != test.Token {
+			t.Errorf("%d) expected token %q, got %q", i, test.Token, token)
+		}
+	}
+}
+
+func TestTokenOverseerGet(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	w := httptest.NewRecorder()
+
+	m, _ := NewDefaultMemoryStorer()
+	s := NewTokenOverseer(NewTokenOptions(), m)
+
+	_, err := s.Get(w, r)
+	if !IsNoSessionError(err) {
+		t.Errorf("Expected ErrNoSession, got: %v", err)
+	}
+
+	r.Header.Set("Authorization", "Bearer sessionid")
+
+	_, err = s.Get(w, r)
+	if !IsNoSessionError(err) {
+		t.Errorf("Expected ErrNoSession, got: %v", err)
+	}
+
+	m.put("sessionid", memorySession{
+		value: "whatever",
+	})
+	val, err := s.Get(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "whatever" {
+		t.Errorf("Expected %q, got %q", "whatever", val)
+	}
+}
+
+func TestTokenOverseerSetDel(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	w := httptest.NewRecorder()
+
+	m, _ := NewDefaultMemoryStorer()
+	s := NewTokenOverseer(NewTokenOptions(), m)
+
+	if err := s.Set(w, r, "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	token := w.Header().Get("X-Session-Token")
+	if len(token) == 0 {
+		t.Fatal("Expected the new token in the response header")
+	}
+	if m.sessions[token].value != "hello" {
+		t.Errorf("Expected %q, got %q", "hello", m.sessions[token].value)
+	}
+
+	// The token written during the request is used by later calls
+	if val, err := s.Get(w, r); err != nil {
+		t.Error(err)
+	} else if val != "hello" {
+		t.Errorf("Expected %q, got %q", "hello", val)
+	}
+
+	// A following request sends the token back and keeps it
+	r = httptest.NewRequest("GET", "http://localhost", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+
+	if err := s.Set(w, r, "whatsup"); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Header().Get("X-Session-Token"); got != token {
+		t.Errorf("Expected token %q to be kept, got %q", token, got)
+	}
+	if len(m.sessions) != 1 {
+		t.Errorf("Expected 1 session, got %d", len(m.sessions))
+	}
+
+	if err := s.Del(w, r); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.sessions) != 0 {
+		t.Errorf("Expected session to be deleted, got %d sessions", len(m.sessions))
+	}
+	if vals := w.Header()["X-Session-Token"]; len(vals) != 1 || vals[0] != "" {
+		t.Errorf("Expected an empty token in the response header, got %q", vals)
+	}
+
+	// The deleted token is not reused
+	if _, err := s.SessionID(w, r); !IsNoSessionError(err) {
+		t.Errorf("Expected ErrNoSession, got: %v", err)
+	}
+	if err := s.Set(w, r, "again"); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Header().Get("X-Session-Token"); len(got) == 0 || got == token {
+		t.Errorf("Expected a new token, got %q", got)
+	}
+}
+
+func TestTokenOverseerClientToken(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	s := NewTokenOverseer(NewTokenOptions(), m)
+
+	// A token the storer does not hold is not used for the new session
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	r.Header.Set("Authorization", "Bearer chosen-by-client")
+	w := httptest.NewRecorder()
+
+	if err := s.Set(w, r, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	token := w.Header().Get("X-Session-Token")
+	if len(token) == 0 || token == "chosen-by-client" {
+		t.Errorf("Expected a new token, got %q", token)
+	}
+	if _, ok := m.sessions["chosen-by-client"]; ok {
+		t.Error("Expected no session with the token of the client")
+	}
+
+	// Nor by the helpers, which set the session with its version
+	w = httptest.NewRecorder()
+	if err := Set(s, w, r, "hi", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	token = w.Header().Get("X-Session-Token")
+	if len(token) == 0 || token == "chosen-by-client" {
+		t.Errorf("Expected a new token, got %q", token)
+	}
+	if _, ok := m.sessions["chosen-by-client"]; ok {
+		t.Error("Expected no session with the token of the client")
+	}
+
+	// The token of a session the storer holds is kept
+	r.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	if err := Set(s, w, r, "hi", "again"); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Header().Get("X-Session-Token"); got != token {
+		t.Errorf("Expected token %q to be kept, got %q", token, got)
+	}
+}
+
+func TestTokenOverseerRegenerate(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	s := NewTokenOverseer(NewTokenOptions(), m)
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	r.Header.Set("Authorization", "Bearer sessionid")
+	w := httptest.NewRecorder()
+
+	if err := s.Regenerate(w, r); !IsNoSessionError(err) {
+		t.Errorf("Expected ErrNoSession, got: %v", err)
+	}
+
+	m.put("sessionid", memorySession{value: "test"})
+
+	if err := s.Regenerate(w, r); err != nil {
+		t.Fatal(err)
+	}
+
+	token := w.Header().Get("X-Session-Token")
+	if len(token) == 0 || token == "sessionid" {
+		t.Fatalf("Expected a new token in the response header, got %q", token)
+	}
+	if id, err := s.SessionID(w, r); err != nil {
+		t.Error(err)
+	} else if id != token {
+		t.Errorf("Expected session id %q, got %q", token, id)
+	}
+
+	if len(m.sessions) != 1 {
+		t.Errorf("Expected sessions len 1, got %d", len(m.sessions))
+	}
+	if m.sessions[token].value != "test" {
+		t.Errorf("Expected val %q to be %q", m.sessions[token].value, "test")
+	}
+}
+
+func TestTokenOverseerResetExpiry(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	s := NewTokenOverseer(NewTokenOptions(), m)
+
+	r := httptest.NewRequest("GET", "http://localhost", nil)
+	w := httptest.NewRecorder()
+
+	if err := s.ResetExpiry(w, r); !IsNoSessionError(err) {
+		t.Errorf("Expected ErrNoSession, got: %v", err)
+	}
+
+	r.Header.Set("Authorization", "Bearer sessionid")
+	m.put("sessionid", memorySession{value: "test"})
+
+	if err := s.ResetExpiry(w, r); err != nil {
+		t.Fatal(err)
+	}
+	if m.sessions["sessionid"].expires.IsZero() {
+		t.Error("Expected the expiry to be reset")
+	}
+	if len(w.Header()) != 0 {
+		t.Errorf("Expected no response headers, got %v", w.Header())
+	}
+}
+
+func TestTokenOverseerHelpers(t *testing.T) {
+	t.Parallel()
+
+	m, _ := NewDefaultMemoryStorer()
+	s := NewTokenOverseer(NewTokenOptions(), m)
+
+	var token string
+	handler := CacheMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := Set(s, w, r, "hi", "hello"); err != nil {
+			t.Error(err)
+		}
+		if err := AddFlash(s, w, r, "flash", "message"); err != nil {
+			t.Error(err)
+		}
+	}))
+	handler = s.MiddlewareWithReset(handler)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	token = w.Header().Get("X-Session-Token")
+	if len(token) == 0 {
+		t.Fatal("Expected the new token in the response header")
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+
+	if val, err := Get(s, w, r, "hi"); err != nil {
+		t.Error(err)
+	} else if val != "hello" {
+		t.Errorf("Expected %q, got %q", "hello", val)
+	}
+	if val, err := GetFlash(s, w, r, "flash"); err != nil {
+		t.Error(err)
+	} else if val != "message" {
+		t.Errorf("Expected %q, got %q", "message", val)
+	}
+}
@@ -0,0 +1,185 @@
+package abcsessions
+
+import (
+	"context"
+	"time"
+
+	"github.com/friendsofgo/errors"
+)
+
+// storerUnwrapper is implemented by Storers that wrap another Storer, such
+// as the EncryptingStorer and CompressingStorer
+type storerUnwrapper interface {
+	Unwrap() Storer
+}
+
+// asCASStorer returns the storer as a CASStorer if it and every storer it
+// wraps support versions. Wrappers always implement CASStorer, but can
+// only use it when the storer they wrap does.
+func asCASStorer(storer Storer) (CASStorer, bool) {
+	cas, ok := storer.(CASStorer)
+	if !ok || !allWrapped(storer, func(s Storer) bool { _, ok := s.(CASStorer); return ok }) {
+		return nil, false
+	}
+
+	return cas, true
+}
+
+// asUserIndexStorer returns the storer as a UserIndexStorer if it and every
+// storer it wraps keep a user index.
+func asUserIndexStorer(storer Storer) (UserIndexStorer, bool) {
+	indexer, ok := storer.(UserIndexStorer)
+	if !ok || !allWrapped(storer, func(s Storer) bool { _, ok := s.(UserIndexStorer); return ok }) {
+		return nil, false
+	}
+
+	return indexer, true
+}
+
+// asTTLStorer returns the storer as a TTLStorer if it and every storer it
+// wraps can get and set the expiry of sessions.
+func asTTLStorer(storer Storer) (TTLStorer, bool) {
+	ttl, ok := storer.(TTLStorer)
+	if !ok || !allWrapped(storer, func(s Storer) bool { _, ok := s.(TTLStorer); return ok }) {
+		return nil, false
+	}
+
+	return ttl, true
+}
+
+// allWrapped returns true if ok is true for every storer wrapped by storer
+func allWrapped(storer Storer, ok func(Storer) bool) bool {
+	for {
+		u, isWrapper := storer.(storerUnwrapper)
+		if !isWrapper {
+			return true
+		}
+
+		storer = u.Unwrap()
+		if !ok(storer) {
+			return false
+		}
+	}
+}
+
+// storerWrapper holds the Storer wrapped by a Storer decorator. It passes
+// All, Del, TTL and the UserIndexStorer methods through to the wrapped Storer.
+// The wrapped Storer is used as a StorerContext so a context given to a
+// decorator reaches it.
+type storerWrapper struct {
+	storer Storer
+}
+
+// Unwrap returns the wrapped Storer
+func (s storerWrapper) Unwrap() Storer {
+	return s.storer
+}
+
+// All keys in the wrapped storer
+func (s storerWrapper) All() ([]string, error) {
+	return s.storer.All()
+}
+
+// AllContext returns all keys in the wrapped storer
+func (s storerWrapper) AllContext(ctx context.Context) ([]string, error) {
+	return AsStorerContext(s.storer).AllContext(ctx)
+}
+
+// Del the session pointed to by the session id key from the wrapped storer
+func (s storerWrapper) Del(key string) error {
+	return s.storer.Del(key)
+}
+
+// DelContext deletes the session pointed to by the session id key from the
+// wrapped storer
+func (s storerWrapper) DelContext(ctx context.Context, key string) error {
+	return AsStorerContext(s.storer).DelContext(ctx, key)
+}
+
+// TTL returns how long the session has left in the wrapped storer, which
+// must be a TTLStorer.
+func (s storerWrapper) TTL(key string) (time.Duration, error) {
+	ttl, err := s.ttlStorer()
+	if err != nil {
+		return 0, err
+	}
+
+	return ttl.TTL(key)
+}
+
+// GetMeta returns the metadata of the session from the wrapped storer,
+// which must be a UserIndexStorer.
+func (s storerWrapper) GetMeta(key string) (SessionMeta, error) {
+	indexer, err := s.userIndexStorer()
+	if err != nil {
+		return SessionMeta{}, err
+	}
+
+	return indexer.GetMeta(key)
+}
+
+// SetMeta sets the metadata of the session in the wrapped storer, which must
+// be a UserIndexStorer.
+func (s storerWrapper) SetMeta(key string, meta SessionMeta) error {
+	indexer, err := s.userIndexStorer()
+	if err != nil {
+		return err
+	}
+
+	return indexer.SetMeta(key, meta)
+}
+
+// ListByUser returns the metadata of all sessions of the user from the
+// wrapped storer, which must be a UserIndexStorer.
+func (s storerWrapper) ListByUser(userID string) ([]SessionMeta, error) {
+	indexer, err := s.userIndexStorer()
+	if err != nil {
+		return nil, err
+	}
+
+	return indexer.ListByUser(userID)
+}
+
+// DeleteByUser deletes all sessions of the user from the wrapped storer,
+// which must be a UserIndexStorer.
+func (s storerWrapper) DeleteByUser(userID string) error {
+	indexer, err := s.userIndexStorer()
+	if err != nil {
+		return err
+	}
+
+	return indexer.DeleteByUser(userID)
+}
+
+// casStorer returns the wrapped storer as a CASStorerContext or an error if
+// it does not support versions
+func (s storerWrapper) casStorer() (CASStorerContext, error) {
+	cas, ok := asCASStorer(s.storer)
+	if !ok {
+		return nil, errors.New("wrapped storer does not implement CASStorer")
+	}
+
+	return AsCASStorerContext(cas), nil
+}
+
+// ttlStorer returns the wrapped storer as a TTLStorer or an error if it
+// can not get and set the expiry of sessions
+func (s storerWrapper) ttlStorer() (TTLStorer, error) {
+	ttl, ok := asTTLStorer(s.storer)
+	if !ok {
+		return nil, errors.New("wrapped storer does not implement TTLStorer")
+	}
+
+	return ttl, nil
+}
+
+// userIndexStorer returns the wrapped storer as a UserIndexStorer or an
+// error if it does not keep a user index
+func (s storerWrapper) userIndexStorer() (UserIndexStorer, error) {
+	indexer, ok := asUserIndexStorer(s.storer)
+	if !ok {
+		return nil, errors.New("wrapped storer does not implement UserIndexStorer")
+	}
+
+	return indexer, nil
+}
@@ -39,8 +39,8 @@ abcweb new gopkg.in/yaml                         -> generates app inside a ./yam
 }
 
 func init() {
-	newCmd.Flags().StringP("sessions-prod-storer", "p", "disk", "Session storer to use in production mode (cookie|memory|disk|redis)")
-	newCmd.Flags().StringP("sessions-dev-storer", "d", "cookie", "Session storer to use in development mode (cookie|memory|disk|redis)")
+	newCmd.Flags().StringP("sessions-prod-storer", "p", "disk", "Session storer to use in production mode (cookie|memory|disk|redis|sql)")
+	newCmd.Flags().StringP("sessions-dev-storer", "d", "cookie", "Session storer to use in development mode (cookie|memory|disk|redis|sql)")
 	newCmd.Flags().StringP("tls-common-name", "", "localhost", "Common Name for generated TLS certificate")
 	newCmd.Flags().StringP("default-env", "", "prod", "Default $APP_ENV to use when starting server")
 	newCmd.Flags().StringP("bootstrap", "b", "regular", "Include Twitter Bootstrap 4 (none|regular|gridonly|rebootonly|gridandrebootonly)")
@@ -415,6 +415,13 @@ func processSkips(cfg newConfig, basePath string, path string, info os.FileInfo)
 		return true, nil
 	}
 
+	// Skip the sessions table migration unless the sql storer is used
+	if strings.HasSuffix(path, "/templates/db/migrations/00001_create_sessions.sql") {
+		if cfg.NoSessions || (cfg.DevStorer != "sql" && cfg.ProdStorer != "sql") {
+			return true, nil
+		}
+	}
+
 	// Skip readme files if requested
 	if cfg.NoReadme {
 		if info.Name() == "README.md" || info.Name() == "README.md.tmpl" {
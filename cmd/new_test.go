@@ -1,8 +1,10 @@
 package cmd
 
 import (
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/spf13/afero"
@@ -202,6 +204,25 @@ func TestProcessSkips(t *testing.T) {
 		t.Error("expected to skip skip sessions.go.tmpl")
 	}
 
+	// check skip db/migrations/00001_create_sessions.sql
+	f, err = appFS.Create("/templates/db/migrations/00001_create_sessions.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	skip, _ = processSkips(cfg, "/templates", "/templates/db/migrations/00001_create_sessions.sql", info)
+	if skip != true {
+		t.Error("expected to skip 00001_create_sessions.sql")
+	}
+	sqlCfg := newConfig{ProdStorer: "sql", DevStorer: "cookie"}
+	skip, _ = processSkips(sqlCfg, "/templates", "/templates/db/migrations/00001_create_sessions.sql", info)
+	if skip == true {
+		t.Error("did not expect skip of 00001_create_sessions.sql with sql storer")
+	}
+
 	// check skip config.toml
 	f, err = appFS.Create("/templates/config.toml")
 	if err != nil {
@@ -327,6 +348,50 @@ func TestNewCmdWalk(t *testing.T) {
 	appFS = afero.NewMemMapFs()
 }
 
+func TestNewCmdWalkSQLDriver(t *testing.T) {
+	contents, err := ioutil.ReadFile("../templates/db/db.go.tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(appFS, "/templates/db/db.go.tmpl", contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := appFS.Stat("/templates/db/db.go.tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		cfg    newConfig
+		driver bool
+	}{
+		{newConfig{ProdStorer: "sql", DevStorer: "cookie"}, true},
+		{newConfig{ProdStorer: "disk", DevStorer: "sql"}, true},
+		{newConfig{ProdStorer: "disk", DevStorer: "cookie"}, false},
+		{newConfig{ProdStorer: "sql", DevStorer: "sql", NoSessions: true}, false},
+	}
+
+	for i, test := range tests {
+		test.cfg.AppPath = "/my/app"
+		test.cfg.Silent = true
+		test.cfg.ForceOverwrite = true
+		if err := newCmdWalk(test.cfg, "/templates", "/templates/db/db.go.tmpl", info, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := afero.ReadFile(appFS, "/my/app/db/db.go")
+		if err != nil {
+			t.Fatal(err)
+		}
+		imported := strings.Contains(string(b), "\n\t_ \"github.com/lib/pq\"\n")
+		if imported != test.driver {
+			t.Errorf("%d) expected the postgres driver import to be %t, got:\n%s", i, test.driver, b)
+		}
+	}
+
+	appFS = afero.NewMemMapFs()
+}
+
 func TestGenerateTLSCerts(t *testing.T) {
 	cfg := newConfig{
 		AppPath:       "/out/spiders",
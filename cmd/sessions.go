@@ -0,0 +1,201 @@
+package cmd
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/friendsofgo/errors"
+	"github.com/spf13/cobra"
+	"github.com/volatiletech/abcweb/v5/abcsessions"
+	redis "gopkg.in/redis.v5"
+
+	// Register the postgres driver of the sql session store
+	_ "github.com/lib/pq"
+)
+
+// sessionsCmd represents the "sessions" command
+var sessionsCmd = &cobra.Command{
+	Use:   "sessions",
+	Short: "Run session store tasks (migrate)",
+	Long:  `Run tasks on the session stores of your app.`,
+	// Session stores are given on the command line, so the app config
+	// is not needed and the commands can run outside the app root.
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return nil
+	},
+}
+
+// sessionsMigrateCmd represents the "sessions migrate" command
+var sessionsMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Copy all sessions from one session store to another",
+	Long: `Copy all sessions from one session store to another, so users are not
+logged out when your app changes session stores. Sessions keep the time they
+have left before they expire.
+
+Session stores are given as:
+
+  disk:<folder>                                         a disk session folder
+  redis://[:password@]host:port[/db][?prefix=p]         a redis database
+  postgres://[user:password@]host:port/db[?table=t]     a sql sessions table
+
+The sql sessions table defaults to "sessions", other query parameters are
+passed on to the postgres driver (e.g. sslmode=disable).`,
+	Example: "abcweb sessions migrate --from disk:/tmp/sessions --to redis://localhost:6379/0\nabcweb sessions migrate --from disk:/tmp/sessions --to postgres://localhost:5432/app?sslmode=disable\nabcweb sessions migrate --from disk:/tmp/sessions --to redis://localhost:6379/0 --dry-run",
+	RunE:    sessionsMigrateCmdRun,
+}
+
+func init() {
+	sessionsMigrateCmd.Flags().StringP("from", "f", "", "The session store to copy sessions from")
+	sessionsMigrateCmd.Flags().StringP("to", "t", "", "The session store to copy sessions to")
+	sessionsMigrateCmd.Flags().BoolP("dry-run", "", false, "Count the sessions that would be copied without copying them")
+	sessionsMigrateCmd.Flags().DurationP("max-age", "", time.Hour*24*2, "How long sessions live in the session stores")
+
+	RootCmd.AddCommand(sessionsCmd)
+	sessionsCmd.AddCommand(sessionsMigrateCmd)
+}
+
+func sessionsMigrateCmdRun(cmd *cobra.Command, args []string) error {
+	fromSpec, _ := cmd.Flags().GetString("from")
+	toSpec, _ := cmd.Flags().GetString("to")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	maxAge, _ := cmd.Flags().GetDuration("max-age")
+
+	if len(fromSpec) == 0 || len(toSpec) == 0 {
+		return errors.New("both --from and --to session stores must be provided")
+	}
+
+	from, err := newSessionStorer(fromSpec, maxAge)
+	if err != nil {
+		return errors.Wrap(err, "invalid --from session store")
+	}
+	to, err := newSessionStorer(toSpec, maxAge)
+	if err != nil {
+		return errors.Wrap(err, "invalid --to session store")
+	}
+
+	if dryRun {
+		fmt.Println("Dry run, no sessions will be copied.")
+	}
+
+	progress, err := abcsessions.MigrateStorer(from, to, abcsessions.MigrateOptions{
+		DryRun: dryRun,
+		Progress: func(p abcsessions.MigrateProgress) {
+			if done := p.Copied + p.Skipped; done%1000 == 0 || done == p.Total {
+				fmt.Printf("\r%d/%d sessions", done, p.Total)
+			}
+		},
+	})
+	if progress.Total != 0 {
+		fmt.Println()
+	}
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		fmt.Printf("%d sessions would be copied, %d expired sessions skipped.\n", progress.Copied, progress.Skipped)
+	} else {
+		fmt.Printf("%d sessions copied, %d expired sessions skipped.\n", progress.Copied, progress.Skipped)
+	}
+
+	return nil
+}
+
+// newSessionStorer returns the session storer for a session store given on
+// the command line. Cleaners are not started, so expired sessions are
+// skipped rather than deleted.
+func newSessionStorer(spec string, maxAge time.Duration) (abcsessions.Storer, error) {
+	switch {
+	case strings.HasPrefix(spec, "disk:"):
+		folder := strings.TrimPrefix(spec, "disk:")
+		if len(folder) == 0 {
+			return nil, errors.New("disk session store must have a folder")
+		}
+		// The folder is opened without creating it or moving the sessions
+		// of older versions into shard folders, so a mistyped folder is an
+		// error and the folder of a running app is left as it is
+		return abcsessions.OpenDiskStorer(folder, maxAge)
+	case strings.HasPrefix(spec, "redis://"):
+		opts, prefix, err := redisStorerOptions(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		return abcsessions.NewRedisStorer(opts, maxAge, prefix)
+	case strings.HasPrefix(spec, "postgres://"), strings.HasPrefix(spec, "postgresql://"):
+		connStr, table, err := sqlStorerOptions(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		db, err := sql.Open("postgres", connStr)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to open sql session store")
+		}
+
+		return abcsessions.NewSQLStorer(db, table, maxAge, maxAge)
+	}
+
+	return nil, errors.Errorf("unknown session store %q, expected disk:<folder>, redis://<host:port> or postgres://<host:port>/<db>", spec)
+}
+
+// sqlStorerOptions parses a postgres://host:port/db[?table=t] session store
+// into the connection string and sessions table of a SQLStorer
+func sqlStorerOptions(spec string) (string, string, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return "", "", errors.Wrap(err, "unable to parse postgres url")
+	}
+
+	if len(strings.Trim(u.Path, "/")) == 0 {
+		return "", "", errors.New("postgres session store must have a database")
+	}
+
+	query := u.Query()
+	table := query.Get("table")
+	if len(table) == 0 {
+		table = "sessions"
+	}
+	query.Del("table")
+	u.RawQuery = query.Encode()
+
+	return u.String(), table, nil
+}
+
+// redisStorerOptions parses a redis://[:password@]host:port[/db][?prefix=p]
+// session store into the options of a RedisStorer
+func redisStorerOptions(spec string) (redis.Options, string, error) {
+	var opts redis.Options
+
+	u, err := url.Parse(spec)
+	if err != nil {
+		return opts, "", errors.Wrap(err, "unable to parse redis url")
+	}
+
+	opts.Addr = u.Host
+	if len(opts.Addr) == 0 {
+		opts.Addr = "localhost:6379"
+	}
+
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			opts.Password = password
+		} else {
+			opts.Password = u.User.Username()
+		}
+	}
+
+	if db := strings.Trim(u.Path, "/"); len(db) != 0 {
+		opts.DB, err = strconv.Atoi(db)
+		if err != nil {
+			return opts, "", errors.Errorf("invalid redis database %q", db)
+		}
+	}
+
+	return opts, u.Query().Get("prefix"), nil
+}
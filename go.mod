@@ -4,12 +4,14 @@ go 1.14
 
 require (
 	github.com/BurntSushi/toml v0.3.1
+	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/djherbis/times v1.2.0
 	github.com/friendsofgo/errors v0.9.2
 	github.com/go-chi/chi v4.1.1+incompatible
 	github.com/go-sql-driver/mysql v1.5.0 // indirect
 	github.com/kat-co/vala v0.0.0-20170210184112-42e1d8b61f12
-	github.com/lib/pq v1.5.1 // indirect
+	github.com/lib/pq v1.5.1
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/onsi/ginkgo v1.12.0 // indirect
 	github.com/onsi/gomega v1.9.0 // indirect
 	github.com/pierrre/archivefile v0.0.0-20170218184037-e2d100bc74f5
@@ -20,6 +22,7 @@ require (
 	github.com/spf13/viper v1.8.1
 	github.com/stretchr/testify v1.7.0
 	github.com/unrolled/render v1.0.3
+	github.com/vmihailenco/msgpack/v5 v5.3.5
 	github.com/volatiletech/mig v1.2.0
 	github.com/volatiletech/refresh/v3 v3.0.4
 	go.uber.org/zap v1.17.0
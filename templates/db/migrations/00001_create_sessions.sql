@@ -0,0 +1,12 @@
+-- +mig Up
+-- sessions is used by the abcsessions SQLStorer to hold server-side sessions.
+CREATE TABLE sessions (
+	id text PRIMARY KEY,
+	value text NOT NULL,
+	expires timestamp with time zone
+);
+
+CREATE INDEX sessions_expires_idx ON sessions (expires);
+
+-- +mig Down
+DROP TABLE sessions;